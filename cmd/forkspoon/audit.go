@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/yourusername/forkspoon/pkg/forkspoon"
+)
+
+const (
+	// How far from the end of an existing audit log its last record is
+	// looked for when appending to it
+	AUDIT_TAIL_SIZE = 64 << 10
+)
+
+// auditLog is the append-only record of the changes made through the
+// mounts (see forkspoon.Config.AuditLog). Unlike the transaction log it is
+// written synchronously, never sampled, filtered, rotated or dropped from:
+// a request is answered once its record is written. Records are JSON lines.
+//
+// With chaining, every record carries the hash of the one before it and its
+// own, so removing or editing records is evident: see verifyAuditLog. A log
+// that already exists is continued, chain included.
+type auditLog struct {
+	mu    sync.Mutex
+	file  *os.File
+	path  string
+	chain bool
+
+	// Sequence number and hash of the last record written
+	seq  uint64
+	hash string
+
+	errors uint64
+}
+
+// auditRecord is a line of the audit log
+type auditRecord struct {
+	Seq     uint64 `json:"seq"`
+	Time    string `json:"time"`
+	Mount   string `json:"mount"`
+	Op      string `json:"op"`
+	Path    string `json:"path"`
+	Flags   uint32 `json:"flags,omitempty"`
+	Errno   int    `json:"errno"`
+	Error   string `json:"error,omitempty"`
+	Uid     uint32 `json:"uid"`
+	Gid     uint32 `json:"gid"`
+	Pid     uint32 `json:"pid"`
+	Process string `json:"process,omitempty"`
+
+	// Hash chain: the hash of the previous record ("" for the first) and
+	// the SHA-256 of this record written with Hash empty
+	Prev string `json:"prev,omitempty"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// openAuditLog opens path for appending, creating it if needed
+func openAuditLog(path string, chain bool) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	a := &auditLog{file: f, path: path, chain: chain}
+	last, err := lastAuditRecord(path)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if last != nil {
+		a.seq, a.hash = last.Seq, last.Hash
+	}
+	return a, nil
+}
+
+// lastAuditRecord returns the last record of the audit log at path, nil if
+// it is empty
+func lastAuditRecord(path string) (*auditRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	off := st.Size() - AUDIT_TAIL_SIZE
+	if off < 0 {
+		off = 0
+	}
+	tail, err := io.ReadAll(io.NewSectionReader(f, off, st.Size()-off))
+	if err != nil {
+		return nil, err
+	}
+	tail = bytes.TrimRight(tail, "\n")
+	if len(tail) == 0 {
+		return nil, nil
+	}
+	if i := bytes.LastIndexByte(tail, '\n'); i >= 0 {
+		tail = tail[i+1:]
+	} else if off > 0 {
+		return nil, fmt.Errorf("%s: last record is longer than %d bytes", path, AUDIT_TAIL_SIZE)
+	}
+	var r auditRecord
+	if err := json.Unmarshal(tail, &r); err != nil {
+		return nil, fmt.Errorf("%s: last record is damaged: %v", path, err)
+	}
+	return &r, nil
+}
+
+// LogTransaction appends the record of an audited operation
+func (a *auditLog) LogTransaction(t *forkspoon.Transaction) {
+	r := auditRecord{
+		Time:    t.Time.Format(time.RFC3339Nano),
+		Mount:   t.Mount,
+		Op:      t.Op,
+		Path:    t.Path,
+		Flags:   t.Flags,
+		Errno:   int(t.Errno),
+		Uid:     t.Uid,
+		Gid:     t.Gid,
+		Pid:     t.Pid,
+		Process: t.Process,
+	}
+	if r.Process == "" && t.Pid != 0 {
+		r.Process = forkspoon.ProcessName(t.Pid)
+	}
+	if t.Errno != 0 {
+		r.Error = t.Errno.Error()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	r.Seq = a.seq + 1
+	if a.chain {
+		r.Prev = a.hash
+		r.Hash = auditHash(&r)
+	}
+	line, err := json.Marshal(&r)
+	if err == nil {
+		_, err = a.file.Write(append(line, '\n'))
+	}
+	if err != nil {
+		// Reported once per failing streak, not per record
+		if a.errors == 0 {
+			log.Printf("Audit log %s: write failed: %v", a.path, err)
+		}
+		a.errors++
+		return
+	}
+	a.errors = 0
+	a.seq, a.hash = r.Seq, r.Hash
+}
+
+// Close closes the file
+func (a *auditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// auditHash returns the hash of a record: the SHA-256 of its JSON with Hash
+// empty, which covers Prev
+func auditHash(r *auditRecord) string {
+	c := *r
+	c.Hash = ""
+	line, _ := json.Marshal(&c)
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyAuditLog checks the records of an audit log: that sequence numbers
+// follow each other and, for chained records, that every hash matches its
+// record and the next record's prev. It returns how many records it read.
+func verifyAuditLog(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), AUDIT_TAIL_SIZE)
+	var prev *auditRecord
+	n := 0
+	for scanner.Scan() {
+		n++
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return n, fmt.Errorf("line %d: %v", n, err)
+		}
+		if prev != nil && rec.Seq != prev.Seq+1 {
+			return n, fmt.Errorf("line %d: record %d follows record %d", n, rec.Seq, prev.Seq)
+		}
+		if rec.Hash != "" || rec.Prev != "" {
+			if rec.Hash != auditHash(&rec) {
+				return n, fmt.Errorf("line %d: record %d does not match its hash", n, rec.Seq)
+			}
+			if prev != nil && rec.Prev != prev.Hash {
+				return n, fmt.Errorf("line %d: record %d does not chain to record %d", n, rec.Seq, prev.Seq)
+			}
+		}
+		prev = &rec
+	}
+	return n, scanner.Err()
+}
+
+// runVerifyAudit is "forkspoon verify-audit <file>..."
+func runVerifyAudit(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s verify-audit <file>...\n", os.Args[0])
+		return 2
+	}
+	status := 0
+	for _, path := range args {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			status = 1
+			continue
+		}
+		n, err := verifyAuditLog(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			status = 1
+			continue
+		}
+		fmt.Printf("%s: %d records OK\n", path, n)
+	}
+	return status
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/yourusername/forkspoon/pkg/forkspoon"
+)
+
+func TestAuditLogChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	write := func(ops ...string) {
+		t.Helper()
+		a, err := openAuditLog(path, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, op := range ops {
+			a.LogTransaction(&forkspoon.Transaction{Time: time.Now(), Mount: "m", Op: op, Path: "/nfs/" + op, Uid: 1000, Pid: 42, Process: "sh"})
+		}
+		a.Close()
+	}
+	// Reopening continues the sequence and the chain
+	write("CREATE", "MKDIR")
+	write("UNLINK")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := verifyAuditLog(bytes.NewReader(data)); n != 3 || err != nil {
+		t.Fatalf("verify: %d records, %v", n, err)
+	}
+	if !strings.Contains(string(data), `"seq":3,`) || !strings.Contains(string(data), `"process":"sh"`) {
+		t.Errorf("unexpected records:\n%s", data)
+	}
+
+	lines := strings.SplitAfter(string(data), "\n")
+	for name, tampered := range map[string]string{
+		"edited":  strings.Replace(string(data), "/nfs/MKDIR", "/nfs/other", 1),
+		"removed": lines[0] + lines[2],
+		"swapped": lines[1] + lines[0] + lines[2],
+	} {
+		if _, err := verifyAuditLog(strings.NewReader(tampered)); err == nil {
+			t.Errorf("%s record not detected", name)
+		}
+	}
+}
+
+func TestAuditLogRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := openAuditLog(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.LogTransaction(&forkspoon.Transaction{Time: time.Now(), Op: "OPEN", Path: "/nfs/f", Flags: syscall.O_WRONLY, Errno: syscall.EROFS})
+	a.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"seq":1,`, `"flags":1,`, `"errno":30,`, `"error":"read-only file system"`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("record lacks %s: %s", want, data)
+		}
+	}
+	if strings.Contains(string(data), `"hash"`) {
+		t.Errorf("unchained record has a hash: %s", data)
+	}
+}
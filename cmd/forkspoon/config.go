@@ -0,0 +1,886 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/yourusername/forkspoon/pkg/forkspoon"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Default interval of the periodic "Cache Stats" log line
+	DEFAULT_REPORT_INTERVAL = 10 * time.Second
+
+	// Upper bound for -readdir-stat-workers
+	MAX_READDIR_STAT_WORKERS = 1024
+
+	// Upper bound for the write-back buffer of one file
+	MAX_WRITE_BACK_SIZE = 64 << 20
+
+	// Transaction log formats
+	TRANS_LOG_TEXT = "text"
+	TRANS_LOG_JSON = "json"
+)
+
+// Config is the complete forkspoon configuration. It is read from the
+// -config file (YAML, or TOML for *.toml files), and every command-line flag
+// maps onto one of its fields:
+//
+//	backend: /mnt/nfs                   # -backend: the mount named "default"
+//	mountpoint: /mnt/cache              # -mountpoint
+//	allow_other: true                   # -allow-other
+//	read_only: false                    # -read-only: all mounts reject changes
+//	                                    # with EROFS; cache.ttl defaults to 10m
+//	debug: false                        # -debug
+//	verbose: false                      # -verbose
+//
+//	id_map:                             # file ownership on the mounts vs. the
+//	                                    # backends; unlisted ids pass through
+//	  uids: 1000:5001,100000:200000:65536  # -uid-map: mount:backend[:count],...
+//	  gids: 100:5000                    # -gid-map
+//	  squash: root                      # -squash: root or all; new files of
+//	                                    # squashed callers are owned by
+//	  anon_uid: 65534                   # these ids (default 65534)
+//	  anon_gid: 65534
+//
+//	filter:                             # what the mounts expose; globs on paths
+//	                                    # relative to the mount root
+//	  include: [/teams/*/shared]        # -include: only these subtrees (and
+//	                                    # the directories leading to them)
+//	  exclude: [.snapshot, lost+found]  # -exclude: never these; a pattern
+//	                                    # without / matches names anywhere
+//
+//	cache:
+//	  ttl: 5m                           # -cache-ttl                  [reloadable]
+//	  readdir_attrs: true               # -readdir-attrs              [reloadable]
+//	  readdir_stat_workers: 8           # -readdir-stat-workers       [reloadable]
+//	  readdir_stream_threshold: 100000  # -readdir-stream-threshold   [reloadable]
+//	  policies:                         # per-path TTLs               [reloadable]
+//	    - path: /scratch                # relative to the mount root,
+//	      ttl: 0s                       # the longest matching path wins
+//	  memory_limit: 512MiB              # -cache-memory-limit, shared by  [reloadable]
+//	                                    # all mounts; 0 = unlimited
+//	  data_cache:                       # file data on local disk, shared by all mounts
+//	    dir: /var/cache/forkspoon       # -data-cache-dir; unset = no data cache
+//	    size: 100GiB                    # -data-cache-size; 0 = unlimited  [reloadable]
+//	    paths: [/toolchains, /datasets] # subtrees cached; default all    [reloadable]
+//	    max_file_size: 0                # larger files bypass it; 0 = no limit  [reloadable]
+//	  write_back:                       # buffer and coalesce writes  [reloadable]
+//	    paths: [/scratch]               # subtrees in write-back mode; default none
+//	    write_through: [/scratch/db]    # subtrees inside them that stay write-through
+//	    size: 1MiB                      # flush a file's buffer at this size
+//	    delay: 1s                       # or this long after its first write
+//	  invalidation:                     # tell the other hosts serving the
+//	                                    # same exports about changes
+//	    transport: multicast            # -invalidation: multicast or unix; unset = off
+//	    address: 239.255.70.83:7946     # -invalidation-address: group:port, or the
+//	                                    # socket directory shared with local peers
+//	    interface: eth0                 # multicast interface; default the system's
+//
+//	mounts:                             # more backends served by the   [reloadable]
+//	  - name: home                      # same daemon; names label metrics
+//	    backend: /mnt/nfs/home
+//	    mountpoint: /mnt/cache-home
+//	    ttl: 1m                         # default: cache.ttl
+//	    export: nfs1:/export/home       # names the backend on the invalidation
+//	                                    # bus; default the backend path
+//	    policies:                       # merged over cache.policies
+//	      - {path: /tmp, ttl: 0s}
+//
+//	logging:
+//	  cache_log: /opt/forkspoon/forkspoon.log  # -cache-log
+//	  trans_log: /var/log/forkspoon/transactions.log  # -trans-log  [reloadable]
+//	  trans_log_format: text            # -trans-log-format: text or  [reloadable]
+//	                                    # json (one object per line)
+//	  audit_log: /var/log/forkspoon/audit.log  # -audit-log: every change made
+//	                                    # through the mounts, with the caller;
+//	                                    # appended to, never rotated
+//	  audit_chain: true                 # -audit-chain: hash-chain its records
+//	  queue_size: 65536                 # -log-queue-size: records waiting
+//	                                    # to be written; more are dropped
+//	  sample: 1                         # -log-sample: log 1 in N ops  [reloadable]
+//	  include_ops: [READ, WRITE]        # only these operations       [reloadable]
+//	  exclude_ops: [GETATTR]            # never these                 [reloadable]
+//	  include_paths: [/mnt/nfs/proj*]   # only below these globs      [reloadable]
+//	  exclude_paths: [/mnt/nfs/tmp]     # never below these           [reloadable]
+//	  rotation:                         # both logs                   [reloadable]
+//	    max_size: 2GiB                  # -log-max-size (0 = no limit)
+//	    interval: daily                 # -log-rotate: hourly, daily or ""
+//	    max_backups: 6                  # -log-max-backups (0 = keep all)
+//	    max_age: 168h                   # -log-max-age (0 = keep forever)
+//	    compress: true                  # -log-compress: gzip rotated files
+//
+//	metrics:
+//	  stats_file: /var/log/forkspoon/stats.json  # -stats-file       [reloadable]
+//	  report_interval: 10s              # 0 disables the log line     [reloadable]
+//
+//	service:
+//	  daemon: false                     # -daemon
+//	  daemon_log: ""                    # -daemon-log
+//	  pidfile: /run/forkspoon.pid       # -pidfile
+//	  control_socket: /run/forkspoon.sock  # -control-socket
+//	  ready_timeout: 30s                # -ready-timeout
+//	  shutdown_timeout: 10s             # -shutdown-timeout           [reloadable]
+//	  unmount_stale: true               # -unmount-stale
+//	  allow_nonempty: false             # -allow-nonempty
+//
+// Precedence is built-in defaults, then the file, then flags given on the
+// command line. Reloadable settings are re-read on SIGHUP and the control
+// socket's "reload" command; the others need a restart.
+type Config struct {
+	Backend    string `yaml:"backend" toml:"backend"`
+	Mountpoint string `yaml:"mountpoint" toml:"mountpoint"`
+	AllowOther bool   `yaml:"allow_other" toml:"allow_other"`
+	ReadOnly   bool   `yaml:"read_only" toml:"read_only"`
+	Debug      bool   `yaml:"debug" toml:"debug"`
+	Verbose    bool   `yaml:"verbose" toml:"verbose"`
+
+	IDMap   IDMapConfig   `yaml:"id_map" toml:"id_map"`
+	Filter  FilterConfig  `yaml:"filter" toml:"filter"`
+	Cache   CacheConfig   `yaml:"cache" toml:"cache"`
+	Mounts  []MountConfig `yaml:"mounts" toml:"mounts"`
+	Logging LoggingConfig `yaml:"logging" toml:"logging"`
+	Metrics MetricsConfig `yaml:"metrics" toml:"metrics"`
+	Service ServiceConfig `yaml:"service" toml:"service"`
+
+	// Path of the file this configuration was read from (-config)
+	File string `yaml:"-" toml:"-"`
+}
+
+// IDMapConfig translates file ownership between the mounts and their
+// backends; see forkspoon.IDMap
+type IDMapConfig struct {
+	UIDs    IDRanges `yaml:"uids" toml:"uids"`
+	GIDs    IDRanges `yaml:"gids" toml:"gids"`
+	Squash  string   `yaml:"squash" toml:"squash"`
+	AnonUID uint32   `yaml:"anon_uid" toml:"anon_uid"`
+	AnonGID uint32   `yaml:"anon_gid" toml:"anon_gid"`
+}
+
+// FilterConfig hides parts of the backends; see forkspoon.PathFilter
+type FilterConfig struct {
+	Include Patterns `yaml:"include" toml:"include"`
+	Exclude Patterns `yaml:"exclude" toml:"exclude"`
+}
+
+// Patterns is a list of globs, comma-separated on the command line
+type Patterns []string
+
+func (p Patterns) String() string {
+	return strings.Join(p, ",")
+}
+
+// Set implements flag.Value
+func (p *Patterns) Set(s string) error {
+	*p = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*p = append(*p, item)
+		}
+	}
+	return nil
+}
+
+// CacheConfig controls the metadata caches
+type CacheConfig struct {
+	TTL                    Duration     `yaml:"ttl" toml:"ttl"`
+	ReaddirAttrs           bool         `yaml:"readdir_attrs" toml:"readdir_attrs"`
+	ReaddirStatWorkers     int          `yaml:"readdir_stat_workers" toml:"readdir_stat_workers"`
+	ReaddirStreamThreshold int          `yaml:"readdir_stream_threshold" toml:"readdir_stream_threshold"`
+	Policies               []PathPolicy `yaml:"policies" toml:"policies"`
+	MemoryLimit            ByteSize     `yaml:"memory_limit" toml:"memory_limit"`
+
+	DataCache    DataCacheConfig    `yaml:"data_cache" toml:"data_cache"`
+	WriteBack    WriteBackConfig    `yaml:"write_back" toml:"write_back"`
+	Invalidation InvalidationConfig `yaml:"invalidation" toml:"invalidation"`
+}
+
+// InvalidationConfig sets up the bus keeping the caches of forkspoon
+// instances serving the same exports coherent
+type InvalidationConfig struct {
+	Transport string `yaml:"transport" toml:"transport"`
+	Address   string `yaml:"address" toml:"address"`
+	Interface string `yaml:"interface" toml:"interface"`
+}
+
+// WriteBackConfig selects the subtrees whose writes are buffered. Paths
+// are relative to the mount root; the longest match wins.
+type WriteBackConfig struct {
+	Paths        []string `yaml:"paths" toml:"paths"`
+	WriteThrough []string `yaml:"write_through" toml:"write_through"`
+	Size         ByteSize `yaml:"size" toml:"size"`
+	Delay        Duration `yaml:"delay" toml:"delay"`
+}
+
+// DataCacheConfig sets up the local disk cache for file data. Paths are
+// relative to the mount root, like policies.
+type DataCacheConfig struct {
+	Dir         string   `yaml:"dir" toml:"dir"`
+	Size        ByteSize `yaml:"size" toml:"size"`
+	Paths       []string `yaml:"paths" toml:"paths"`
+	MaxFileSize ByteSize `yaml:"max_file_size" toml:"max_file_size"`
+}
+
+// MountConfig is one backend/mountpoint pair. Its TTL and policies default
+// to those under cache.
+type MountConfig struct {
+	Name       string       `yaml:"name" toml:"name"`
+	Backend    string       `yaml:"backend" toml:"backend"`
+	Mountpoint string       `yaml:"mountpoint" toml:"mountpoint"`
+	TTL        *Duration    `yaml:"ttl,omitempty" toml:"ttl,omitempty"`
+	Policies   []PathPolicy `yaml:"policies,omitempty" toml:"policies,omitempty"`
+	Export     string       `yaml:"export,omitempty" toml:"export,omitempty"`
+}
+
+// PathPolicy overrides the cache TTL for a subtree of the mount
+type PathPolicy struct {
+	Path string   `yaml:"path" toml:"path"`
+	TTL  Duration `yaml:"ttl" toml:"ttl"`
+}
+
+// LoggingConfig names the log files
+type LoggingConfig struct {
+	CacheLog string `yaml:"cache_log" toml:"cache_log"`
+	TransLog string `yaml:"trans_log" toml:"trans_log"`
+
+	// TransLogFormat is TRANS_LOG_TEXT or TRANS_LOG_JSON
+	TransLogFormat string `yaml:"trans_log_format" toml:"trans_log_format"`
+
+	// The audit log, and whether its records are hash-chained: see auditLog
+	AuditLog   string `yaml:"audit_log" toml:"audit_log"`
+	AuditChain bool   `yaml:"audit_chain" toml:"audit_chain"`
+
+	// What reaches the cache and transaction logs: see logFilter
+	QueueSize    int      `yaml:"queue_size" toml:"queue_size"`
+	Sample       int      `yaml:"sample" toml:"sample"`
+	IncludeOps   []string `yaml:"include_ops" toml:"include_ops"`
+	ExcludeOps   []string `yaml:"exclude_ops" toml:"exclude_ops"`
+	IncludePaths []string `yaml:"include_paths" toml:"include_paths"`
+	ExcludePaths []string `yaml:"exclude_paths" toml:"exclude_paths"`
+
+	Rotation RotationConfig `yaml:"rotation" toml:"rotation"`
+}
+
+// RotationConfig controls rotation of the cache and transaction logs
+type RotationConfig struct {
+	MaxSize    ByteSize `yaml:"max_size" toml:"max_size"`
+	Interval   string   `yaml:"interval" toml:"interval"`
+	MaxBackups int      `yaml:"max_backups" toml:"max_backups"`
+	MaxAge     Duration `yaml:"max_age" toml:"max_age"`
+	Compress   bool     `yaml:"compress" toml:"compress"`
+}
+
+// options converts the settings for RotatingLogger
+func (r RotationConfig) options() RotationOptions {
+	return RotationOptions{
+		MaxSize:    int64(r.MaxSize),
+		Interval:   r.Interval,
+		MaxBackups: r.MaxBackups,
+		MaxAge:     time.Duration(r.MaxAge),
+		Compress:   r.Compress,
+	}
+}
+
+// MetricsConfig controls statistics output
+type MetricsConfig struct {
+	StatsFile      string   `yaml:"stats_file" toml:"stats_file"`
+	ReportInterval Duration `yaml:"report_interval" toml:"report_interval"`
+}
+
+// ServiceConfig controls process lifecycle
+type ServiceConfig struct {
+	Daemon          bool     `yaml:"daemon" toml:"daemon"`
+	DaemonLog       string   `yaml:"daemon_log" toml:"daemon_log"`
+	Pidfile         string   `yaml:"pidfile" toml:"pidfile"`
+	ControlSocket   string   `yaml:"control_socket" toml:"control_socket"`
+	ReadyTimeout    Duration `yaml:"ready_timeout" toml:"ready_timeout"`
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	UnmountStale    bool     `yaml:"unmount_stale" toml:"unmount_stale"`
+	AllowNonEmpty   bool     `yaml:"allow_nonempty" toml:"allow_nonempty"`
+}
+
+// Duration is a time.Duration written as "30s", "5m" in config files
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid duration %q (use e.g. 30s, 5m, 1h)", text)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// defaultConfig returns the built-in defaults
+func defaultConfig() *Config {
+	return &Config{
+		Cache: CacheConfig{
+			TTL:                    Duration(forkspoon.DEFAULT_CACHE_TTL),
+			ReaddirAttrs:           true,
+			ReaddirStatWorkers:     forkspoon.DEFAULT_READDIR_STAT_WORKERS,
+			ReaddirStreamThreshold: forkspoon.DEFAULT_READDIR_STREAM_THRESHOLD,
+			WriteBack: WriteBackConfig{
+				Size:  forkspoon.DEFAULT_WRITE_BACK_SIZE,
+				Delay: Duration(forkspoon.DEFAULT_WRITE_BACK_DELAY),
+			},
+		},
+		Logging: LoggingConfig{
+			TransLogFormat: TRANS_LOG_TEXT,
+			QueueSize:      DEFAULT_LOG_QUEUE_SIZE,
+			Sample:         1,
+			Rotation: RotationConfig{
+				MaxSize:    DEFAULT_LOG_MAX_SIZE,
+				MaxBackups: DEFAULT_LOG_MAX_BACKUPS,
+				Compress:   true,
+			},
+		},
+		Metrics: MetricsConfig{
+			ReportInterval: Duration(DEFAULT_REPORT_INTERVAL),
+		},
+		Service: ServiceConfig{
+			ReadyTimeout:    Duration(forkspoon.DEFAULT_READY_TIMEOUT),
+			ShutdownTimeout: Duration(DEFAULT_SHUTDOWN_TIMEOUT),
+		},
+	}
+}
+
+// newFlagSet binds the command-line flags to the fields of cfg
+func newFlagSet(cfg *Config, errorHandling flag.ErrorHandling) *flag.FlagSet {
+	f := flag.NewFlagSet(os.Args[0], errorHandling)
+
+	f.StringVar(&cfg.File, "config", cfg.File, "Configuration file (YAML, or TOML for *.toml); flags override it")
+	f.StringVar(&cfg.Backend, "backend", cfg.Backend, "Path to the backend directory (required)")
+	f.StringVar(&cfg.Mountpoint, "mountpoint", cfg.Mountpoint, "Path to the mount point directory (required)")
+	f.BoolVar(&cfg.Verbose, "verbose", cfg.Verbose, "Enable verbose logging")
+	f.BoolVar(&cfg.Debug, "debug", cfg.Debug, "Enable FUSE debug logging")
+	f.DurationVar((*time.Duration)(&cfg.Cache.TTL), "cache-ttl", time.Duration(cfg.Cache.TTL), "Cache TTL duration (e.g., 5m, 30s)")
+	f.BoolVar(&cfg.AllowOther, "allow-other", cfg.AllowOther, "Allow other users to access the mount")
+	f.BoolVar(&cfg.ReadOnly, "read-only", cfg.ReadOnly, "Mount read-only: reject every change with EROFS and cache more aggressively")
+	f.Var(&cfg.IDMap.UIDs, "uid-map", "Map file owners: mount:backend[:count],... (e.g. 1000:5001)")
+	f.Var(&cfg.IDMap.GIDs, "gid-map", "Map file groups: mount:backend[:count],...")
+	f.Var(&cfg.Filter.Include, "include", "Expose only these subtrees: comma-separated globs like /teams/*/shared")
+	f.Var(&cfg.Filter.Exclude, "exclude", "Hide these: comma-separated globs like /teams/beta, or names like .snapshot")
+	f.StringVar(&cfg.IDMap.Squash, "squash", cfg.IDMap.Squash, "Create files of root (root) or of every caller (all) as the anonymous user")
+	f.StringVar(&cfg.Logging.CacheLog, "cache-log", cfg.Logging.CacheLog, "Cache log file path (default: /opt/forkspoon/forkspoon.log, or ~/forkspoon.log)")
+	f.StringVar(&cfg.Logging.TransLog, "trans-log", cfg.Logging.TransLog, "Transaction log file path")
+	f.StringVar(&cfg.Logging.TransLogFormat, "trans-log-format", cfg.Logging.TransLogFormat, "Transaction log format: text, or json for one object per line with caller, errno and latency")
+	f.StringVar(&cfg.Logging.AuditLog, "audit-log", cfg.Logging.AuditLog, "Append a JSON record of every change made through the mounts (create, mkdir, unlink, rmdir, rename, setattr, write open) to this file")
+	f.BoolVar(&cfg.Logging.AuditChain, "audit-chain", cfg.Logging.AuditChain, "Hash-chain the audit log records, so edits and removals can be detected (forkspoon verify-audit)")
+	f.IntVar(&cfg.Logging.QueueSize, "log-queue-size", cfg.Logging.QueueSize, "Log records waiting to be written before new ones are dropped")
+	f.IntVar(&cfg.Logging.Sample, "log-sample", cfg.Logging.Sample, "Log only 1 in N operations (1 = all)")
+	f.Var(&cfg.Logging.Rotation.MaxSize, "log-max-size", "Rotate the cache and transaction logs at this size (e.g. 512MiB; 0 = no limit)")
+	f.StringVar(&cfg.Logging.Rotation.Interval, "log-rotate", cfg.Logging.Rotation.Interval, "Also rotate the logs by time: hourly or daily")
+	f.IntVar(&cfg.Logging.Rotation.MaxBackups, "log-max-backups", cfg.Logging.Rotation.MaxBackups, "Rotated log files to keep (0 = all)")
+	f.DurationVar((*time.Duration)(&cfg.Logging.Rotation.MaxAge), "log-max-age", time.Duration(cfg.Logging.Rotation.MaxAge), "Delete rotated log files older than this (e.g. 168h; 0 = never)")
+	f.BoolVar(&cfg.Logging.Rotation.Compress, "log-compress", cfg.Logging.Rotation.Compress, "Gzip rotated log files")
+	f.StringVar(&cfg.Metrics.StatsFile, "stats-file", cfg.Metrics.StatsFile, "Save statistics to JSON file on exit (and on SIGUSR1)")
+	f.DurationVar((*time.Duration)(&cfg.Service.ShutdownTimeout), "shutdown-timeout", time.Duration(cfg.Service.ShutdownTimeout), "How long SIGINT/SIGTERM waits for in-flight requests before unmounting")
+	f.BoolVar(&cfg.Service.Daemon, "daemon", cfg.Service.Daemon, "Fork into the background once the mount is ready (for Type=forking)")
+	f.StringVar(&cfg.Service.DaemonLog, "daemon-log", cfg.Service.DaemonLog, "File receiving stdout/stderr in -daemon mode (default: discarded)")
+	f.StringVar(&cfg.Service.Pidfile, "pidfile", cfg.Service.Pidfile, "Write the daemon's pid to this file")
+	f.StringVar(&cfg.Service.ControlSocket, "control-socket", cfg.Service.ControlSocket, "Serve control commands (reload, stats, ...) on this Unix socket")
+	f.BoolVar(&cfg.Service.UnmountStale, "unmount-stale", cfg.Service.UnmountStale, "Lazily unmount a dead FUSE mount left at the mountpoint by a crash")
+	f.BoolVar(&cfg.Service.AllowNonEmpty, "allow-nonempty", cfg.Service.AllowNonEmpty, "Allow mounting over a non-empty mountpoint directory")
+	f.DurationVar((*time.Duration)(&cfg.Service.ReadyTimeout), "ready-timeout", time.Duration(cfg.Service.ReadyTimeout), "How long startup waits for the backend and mount to respond")
+	f.BoolVar(&cfg.Cache.ReaddirAttrs, "readdir-attrs", cfg.Cache.ReaddirAttrs, "Stat directory entries during READDIR to seed the lookup/attr caches")
+	f.IntVar(&cfg.Cache.ReaddirStatWorkers, "readdir-stat-workers", cfg.Cache.ReaddirStatWorkers, "Parallel stat workers per READDIR when -readdir-attrs is set")
+	f.Var(&cfg.Cache.MemoryLimit, "cache-memory-limit", "Memory limit for the metadata caches of all mounts (e.g. 512MiB; 0 = unlimited)")
+	f.StringVar(&cfg.Cache.DataCache.Dir, "data-cache-dir", cfg.Cache.DataCache.Dir, "Cache file data in this local directory (e.g. on an SSD)")
+	f.Var(&cfg.Cache.DataCache.Size, "data-cache-size", "Size limit of the data cache (e.g. 100GiB; 0 = unlimited)")
+	f.StringVar(&cfg.Cache.Invalidation.Transport, "invalidation", cfg.Cache.Invalidation.Transport, "Share cache invalidations with other instances over multicast or unix sockets")
+	f.StringVar(&cfg.Cache.Invalidation.Address, "invalidation-address", cfg.Cache.Invalidation.Address, "Multicast group:port, or the socket directory for -invalidation unix")
+	f.IntVar(&cfg.Cache.ReaddirStreamThreshold, "readdir-stream-threshold", cfg.Cache.ReaddirStreamThreshold, "Stream (and don't cache) directories with more entries than this (0 = never)")
+
+	return f
+}
+
+// parseConfig builds the effective configuration from the command line:
+// built-in defaults, overlaid by the -config file if one is given, overlaid
+// by the flags that were set explicitly.
+func parseConfig(args []string, errorHandling flag.ErrorHandling) (*Config, error) {
+	cfg := defaultConfig()
+	f := newFlagSet(cfg, errorHandling)
+	if errorHandling == flag.ContinueOnError {
+		f.SetOutput(io.Discard)
+	}
+	if err := f.Parse(args); err != nil {
+		return nil, err
+	}
+	if f.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", f.Arg(0))
+	}
+	if cfg.File == "" {
+		if cfg.ReadOnly && !flagGiven(f, "cache-ttl") {
+			cfg.Cache.TTL = Duration(forkspoon.DEFAULT_READ_ONLY_CACHE_TTL)
+		}
+		return cfg, nil
+	}
+
+	// The TTL's default depends on read_only, which may be set anywhere
+	fileCfg := defaultConfig()
+	fileCfg.Cache.TTL = -1
+	if err := loadConfigFile(cfg.File, fileCfg); err != nil {
+		return nil, err
+	}
+
+	// Flags win: parsing them again only touches the ones that were given
+	f = newFlagSet(fileCfg, flag.ContinueOnError)
+	f.SetOutput(io.Discard)
+	if err := f.Parse(args); err != nil {
+		return nil, err
+	}
+	if fileCfg.Cache.TTL == -1 {
+		fileCfg.Cache.TTL = Duration(forkspoon.DEFAULT_CACHE_TTL)
+		if fileCfg.ReadOnly {
+			fileCfg.Cache.TTL = Duration(forkspoon.DEFAULT_READ_ONLY_CACHE_TTL)
+		}
+	}
+	return fileCfg, nil
+}
+
+// flagGiven reports whether the named flag was set on the command line
+func flagGiven(f *flag.FlagSet, name string) bool {
+	given := false
+	f.Visit(func(fl *flag.Flag) {
+		given = given || fl.Name == name
+	})
+	return given
+}
+
+// loadConfigFile decodes the file at path into cfg. Keys that are not part
+// of the schema are rejected, so a typo doesn't silently fall back to a
+// default.
+func loadConfigFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %v", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		dec := toml.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	default:
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && err != io.EOF {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// validate checks the configuration for values that can't work, naming the
+// offending key in the error
+func (c *Config) validate() error {
+	if c.Backend == "" && (c.Mountpoint != "" || len(c.Mounts) == 0) {
+		return fmt.Errorf("backend is required")
+	}
+	if c.Mountpoint == "" && c.Backend != "" {
+		return fmt.Errorf("mountpoint is required")
+	}
+	if err := c.IDMap.validate(); err != nil {
+		return err
+	}
+	if f := c.Filter.pathFilter(); f != nil {
+		if err := f.Validate(); err != nil {
+			return fmt.Errorf("filter.%v", err)
+		}
+	}
+	if c.Cache.TTL < 0 {
+		return fmt.Errorf("cache.ttl: must not be negative (got %v)", time.Duration(c.Cache.TTL))
+	}
+	if c.Cache.ReaddirStatWorkers < 1 || c.Cache.ReaddirStatWorkers > MAX_READDIR_STAT_WORKERS {
+		return fmt.Errorf("cache.readdir_stat_workers: must be between 1 and %d (got %d)", MAX_READDIR_STAT_WORKERS, c.Cache.ReaddirStatWorkers)
+	}
+	if c.Cache.ReaddirStreamThreshold < 0 {
+		return fmt.Errorf("cache.readdir_stream_threshold: must not be negative (got %d)", c.Cache.ReaddirStreamThreshold)
+	}
+
+	if err := validatePolicies("cache.policies", c.Cache.Policies); err != nil {
+		return err
+	}
+	if c.Cache.MemoryLimit < 0 {
+		return fmt.Errorf("cache.memory_limit: must not be negative (got %d)", c.Cache.MemoryLimit)
+	}
+	if err := c.Cache.DataCache.validate(); err != nil {
+		return err
+	}
+	if err := c.Cache.WriteBack.validate(); err != nil {
+		return err
+	}
+	if err := c.Cache.Invalidation.validate(); err != nil {
+		return err
+	}
+
+	names := make(map[string]bool)
+	mountpoints := make(map[string]string)
+	all := c.mountConfigs()
+	offset := len(all) - len(c.Mounts)
+	for i, mc := range all {
+		// The top-level backend/mountpoint were checked above
+		key := fmt.Sprintf("mounts[%d]", i-offset)
+		if i < offset {
+			key = "mountpoint"
+		}
+		if !mountNamePattern.MatchString(mc.Name) {
+			return fmt.Errorf("%s.name: %q must be non-empty and consist of letters, digits, '.', '_' and '-'", key, mc.Name)
+		}
+		if names[mc.Name] {
+			return fmt.Errorf("%s.name: %q is used twice", key, mc.Name)
+		}
+		names[mc.Name] = true
+		if mc.Backend == "" {
+			return fmt.Errorf("%s.backend is required", key)
+		}
+		if mc.Mountpoint == "" {
+			return fmt.Errorf("%s.mountpoint is required", key)
+		}
+		mp := filepath.Clean(mc.Mountpoint)
+		if other, ok := mountpoints[mp]; ok {
+			return fmt.Errorf("%s.mountpoint: %s is also the mountpoint of %q", key, mc.Mountpoint, other)
+		}
+		mountpoints[mp] = mc.Name
+		if mc.TTL != nil && *mc.TTL < 0 {
+			return fmt.Errorf("%s.ttl: must not be negative (got %v)", key, time.Duration(*mc.TTL))
+		}
+		if err := validatePolicies(key+".policies", mc.Policies); err != nil {
+			return err
+		}
+	}
+
+	if c.Logging.TransLogFormat != TRANS_LOG_TEXT && c.Logging.TransLogFormat != TRANS_LOG_JSON {
+		return fmt.Errorf("logging.trans_log_format: must be %q or %q (got %q)", TRANS_LOG_TEXT, TRANS_LOG_JSON, c.Logging.TransLogFormat)
+	}
+	if err := validateLogFilters(c.Logging); err != nil {
+		return err
+	}
+	if c.Logging.AuditChain && c.Logging.AuditLog == "" {
+		return fmt.Errorf("logging.audit_chain: needs logging.audit_log")
+	}
+	if err := c.Logging.Rotation.validate(); err != nil {
+		return err
+	}
+	if c.Metrics.ReportInterval < 0 {
+		return fmt.Errorf("metrics.report_interval: must not be negative (got %v)", time.Duration(c.Metrics.ReportInterval))
+	}
+	if c.Service.ReadyTimeout <= 0 {
+		return fmt.Errorf("service.ready_timeout: must be positive (got %v)", time.Duration(c.Service.ReadyTimeout))
+	}
+	if c.Service.ShutdownTimeout < 0 {
+		return fmt.Errorf("service.shutdown_timeout: must not be negative (got %v)", time.Duration(c.Service.ShutdownTimeout))
+	}
+	return nil
+}
+
+// validate checks the rotation settings
+func (r RotationConfig) validate() error {
+	if r.MaxSize < 0 {
+		return fmt.Errorf("logging.rotation.max_size: must not be negative (got %d)", r.MaxSize)
+	}
+	if r.Interval != "" && r.Interval != ROTATE_HOURLY && r.Interval != ROTATE_DAILY {
+		return fmt.Errorf("logging.rotation.interval: must be %q, %q or empty (got %q)", ROTATE_HOURLY, ROTATE_DAILY, r.Interval)
+	}
+	if r.MaxBackups < 0 {
+		return fmt.Errorf("logging.rotation.max_backups: must not be negative (got %d)", r.MaxBackups)
+	}
+	if r.MaxAge < 0 {
+		return fmt.Errorf("logging.rotation.max_age: must not be negative (got %v)", time.Duration(r.MaxAge))
+	}
+	return nil
+}
+
+// validate checks the data cache settings
+func (d DataCacheConfig) validate() error {
+	if d.Size < 0 {
+		return fmt.Errorf("cache.data_cache.size: must not be negative (got %d)", d.Size)
+	}
+	if d.MaxFileSize < 0 {
+		return fmt.Errorf("cache.data_cache.max_file_size: must not be negative (got %d)", d.MaxFileSize)
+	}
+	for i, p := range d.Paths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("cache.data_cache.paths[%d]: %q must start with / (paths are relative to the mount root)", i, p)
+		}
+	}
+	return nil
+}
+
+// validate checks the write-back settings
+func (w WriteBackConfig) validate() error {
+	for _, list := range []struct {
+		key   string
+		paths []string
+	}{{"cache.write_back.paths", w.Paths}, {"cache.write_back.write_through", w.WriteThrough}} {
+		for i, p := range list.paths {
+			if !strings.HasPrefix(p, "/") {
+				return fmt.Errorf("%s[%d]: %q must start with / (paths are relative to the mount root)", list.key, i, p)
+			}
+		}
+	}
+	if w.Size < 1 || w.Size > MAX_WRITE_BACK_SIZE {
+		return fmt.Errorf("cache.write_back.size: must be between 1B and %s (got %s)", ByteSize(MAX_WRITE_BACK_SIZE), w.Size)
+	}
+	if w.Delay <= 0 {
+		return fmt.Errorf("cache.write_back.delay: must be positive (got %v)", time.Duration(w.Delay))
+	}
+	return nil
+}
+
+// validate checks the id mapping
+func (i IDMapConfig) validate() error {
+	switch i.Squash {
+	case forkspoon.SQUASH_NONE, forkspoon.SQUASH_ROOT, forkspoon.SQUASH_ALL:
+	default:
+		return fmt.Errorf("id_map.squash: must be %q, %q or empty (got %q)", forkspoon.SQUASH_ROOT, forkspoon.SQUASH_ALL, i.Squash)
+	}
+	if im := i.idMap(); im != nil {
+		if err := im.Validate(); err != nil {
+			return fmt.Errorf("id_map: %v", err)
+		}
+	}
+	return nil
+}
+
+// idMap converts the settings for the mounts: nil when there is nothing to
+// map or squash
+func (i IDMapConfig) idMap() *forkspoon.IDMap {
+	if len(i.UIDs) == 0 && len(i.GIDs) == 0 && i.Squash == forkspoon.SQUASH_NONE {
+		return nil
+	}
+	return &forkspoon.IDMap{
+		UIDs:    i.UIDs,
+		GIDs:    i.GIDs,
+		Squash:  i.Squash,
+		AnonUID: i.AnonUID,
+		AnonGID: i.AnonGID,
+	}
+}
+
+// pathFilter converts the settings for the mounts: nil when nothing is
+// filtered
+func (f FilterConfig) pathFilter() *forkspoon.PathFilter {
+	if len(f.Include) == 0 && len(f.Exclude) == 0 {
+		return nil
+	}
+	return &forkspoon.PathFilter{Include: f.Include, Exclude: f.Exclude}
+}
+
+// validate checks the invalidation bus settings
+func (i InvalidationConfig) validate() error {
+	switch i.Transport {
+	case "":
+		return nil
+	case forkspoon.INVALIDATION_MULTICAST, forkspoon.INVALIDATION_UNIX:
+	default:
+		return fmt.Errorf("cache.invalidation.transport: must be %q, %q or empty (got %q)", forkspoon.INVALIDATION_MULTICAST, forkspoon.INVALIDATION_UNIX, i.Transport)
+	}
+	if i.Address == "" {
+		return fmt.Errorf("cache.invalidation.address is required with transport %q", i.Transport)
+	}
+	if i.Transport == forkspoon.INVALIDATION_UNIX && i.Interface != "" {
+		return fmt.Errorf("cache.invalidation.interface: only applies to transport %q", forkspoon.INVALIDATION_MULTICAST)
+	}
+	return nil
+}
+
+// newTransport opens the configured transport
+func (i InvalidationConfig) newTransport() (forkspoon.InvalidationTransport, error) {
+	if i.Transport == forkspoon.INVALIDATION_UNIX {
+		return forkspoon.NewUnixTransport(i.Address)
+	}
+	return forkspoon.NewMulticastTransport(i.Address, i.Interface)
+}
+
+// validatePolicies checks a list of path policies; key names the list in
+// errors
+func validatePolicies(key string, policies []PathPolicy) error {
+	seen := make(map[string]bool)
+	for i, p := range policies {
+		if !strings.HasPrefix(p.Path, "/") {
+			return fmt.Errorf("%s[%d].path: %q must start with / (paths are relative to the mount root)", key, i, p.Path)
+		}
+		clean := path.Clean(p.Path)
+		if clean != p.Path && clean+"/" != p.Path {
+			return fmt.Errorf("%s[%d].path: %q is not a clean path (did you mean %q?)", key, i, p.Path, clean)
+		}
+		if seen[clean] {
+			return fmt.Errorf("%s[%d].path: %q is listed twice", key, i, p.Path)
+		}
+		seen[clean] = true
+		if p.TTL < 0 {
+			return fmt.Errorf("%s[%d].ttl: must not be negative (got %v)", key, i, time.Duration(p.TTL))
+		}
+	}
+	return nil
+}
+
+// mountConfigs returns the mounts to serve: the top-level backend and
+// mountpoint as the mount named "default", followed by the mounts list
+func (c *Config) mountConfigs() []MountConfig {
+	var mounts []MountConfig
+	if c.Backend != "" || c.Mountpoint != "" {
+		mounts = append(mounts, MountConfig{
+			Name:       DEFAULT_MOUNT_NAME,
+			Backend:    c.Backend,
+			Mountpoint: c.Mountpoint,
+		})
+	}
+	return append(mounts, c.Mounts...)
+}
+
+// restartRequired lists the settings that differ between c and next but
+// only take effect on a restart
+func (c *Config) restartRequired(next *Config) []string {
+	var changed []string
+	check := func(name string, differs bool) {
+		if differs {
+			changed = append(changed, name)
+		}
+	}
+	check("allow_other", c.AllowOther != next.AllowOther)
+	check("read_only", c.ReadOnly != next.ReadOnly)
+	check("debug", c.Debug != next.Debug)
+	check("id_map", !reflect.DeepEqual(c.IDMap, next.IDMap))
+	check("filter", !reflect.DeepEqual(c.Filter, next.Filter))
+	check("verbose", c.Verbose != next.Verbose)
+	check("cache.data_cache.dir", c.Cache.DataCache.Dir != next.Cache.DataCache.Dir)
+	check("cache.invalidation", c.Cache.Invalidation != next.Cache.Invalidation)
+	check("logging.cache_log", c.Logging.CacheLog != next.Logging.CacheLog)
+	check("logging.queue_size", c.Logging.QueueSize != next.Logging.QueueSize)
+	check("logging.audit_log", c.Logging.AuditLog != next.Logging.AuditLog)
+	check("logging.audit_chain", c.Logging.AuditChain != next.Logging.AuditChain)
+	check("service.daemon", c.Service.Daemon != next.Service.Daemon)
+	check("service.daemon_log", c.Service.DaemonLog != next.Service.DaemonLog)
+	check("service.pidfile", c.Service.Pidfile != next.Service.Pidfile)
+	check("service.control_socket", c.Service.ControlSocket != next.Service.ControlSocket)
+	check("service.ready_timeout", c.Service.ReadyTimeout != next.Service.ReadyTimeout)
+	check("service.unmount_stale", c.Service.UnmountStale != next.Service.UnmountStale)
+	check("service.allow_nonempty", c.Service.AllowNonEmpty != next.Service.AllowNonEmpty)
+	return changed
+}
+
+// reloadConfig parses the command line again, which re-reads the config
+// file, and switches to its reloadable settings, mounting and unmounting
+// to match its mounts. Changes to the others are reported and ignored until
+// the next restart.
+func (l *lifecycle) reloadConfig() error {
+	current := l.config()
+	if current.File == "" {
+		return nil
+	}
+
+	next, err := parseConfig(l.args, flag.ContinueOnError)
+	if err == nil {
+		err = next.validate()
+	}
+	if err != nil {
+		return fmt.Errorf("%v (keeping current settings)", err)
+	}
+	if changed := current.restartRequired(next); len(changed) > 0 {
+		log.Printf("Config changes that need a restart were not applied: %s", strings.Join(changed, ", "))
+	}
+
+	applied := *current
+	applied.Backend = next.Backend
+	applied.Mountpoint = next.Mountpoint
+	applied.Cache = next.Cache
+	applied.Mounts = next.Mounts
+	applied.Logging.TransLog = next.Logging.TransLog
+	applied.Logging.TransLogFormat = next.Logging.TransLogFormat
+	applied.Logging.Sample = next.Logging.Sample
+	applied.Logging.IncludeOps = next.Logging.IncludeOps
+	applied.Logging.ExcludeOps = next.Logging.ExcludeOps
+	applied.Logging.IncludePaths = next.Logging.IncludePaths
+	applied.Logging.ExcludePaths = next.Logging.ExcludePaths
+	applied.Logging.Rotation = next.Logging.Rotation
+	applied.Metrics = next.Metrics
+	applied.Service.ShutdownTimeout = next.Service.ShutdownTimeout
+
+	l.mu.Lock()
+	l.cfg = &applied
+	l.mu.Unlock()
+
+	cacheBudget.SetLimit(int64(applied.Cache.MemoryLimit))
+	if dataCache != nil {
+		dataCache.SetLimit(int64(applied.Cache.DataCache.Size))
+	}
+	if txLog != nil {
+		txLog.SetFilter(newLogFilter(applied.Logging))
+	}
+	if cacheLog != nil {
+		cacheLog.SetOptions(applied.Logging.Rotation.options())
+	}
+	mountErr := reconcileMounts(&applied)
+
+	log.Printf("Configuration reloaded from %s (cache TTL %v, %d path policies, %d mounts)",
+		current.File, time.Duration(applied.Cache.TTL), len(applied.Cache.Policies), len(registry.list()))
+	if mountErr != nil {
+		return fmt.Errorf("configuration applied, but not all mounts could be updated: %v", mountErr)
+	}
+	return nil
+}
+
+// newCacheOptions builds the cache settings of mount mc under cfg. The
+// mount's own TTL and policies take precedence over those under cache.
+func newCacheOptions(cfg *Config, mc MountConfig) forkspoon.CacheOptions {
+	o := forkspoon.CacheOptions{
+		TTL:                    time.Duration(cfg.Cache.TTL),
+		ReaddirAttrs:           cfg.Cache.ReaddirAttrs,
+		ReaddirStatWorkers:     cfg.Cache.ReaddirStatWorkers,
+		ReaddirStreamThreshold: cfg.Cache.ReaddirStreamThreshold,
+		DataCachePaths:         cfg.Cache.DataCache.Paths,
+		DataCacheMaxFileSize:   int64(cfg.Cache.DataCache.MaxFileSize),
+		WriteBackPaths:         cfg.Cache.WriteBack.Paths,
+		WriteThroughPaths:      cfg.Cache.WriteBack.WriteThrough,
+		WriteBackSize:          int(cfg.Cache.WriteBack.Size),
+		WriteBackDelay:         time.Duration(cfg.Cache.WriteBack.Delay),
+	}
+	if len(o.DataCachePaths) == 0 {
+		o.DataCachePaths = []string{"/"}
+	}
+	if mc.TTL != nil {
+		o.TTL = time.Duration(*mc.TTL)
+	}
+
+	byPath := make(map[string]PathPolicy)
+	for _, list := range [][]PathPolicy{cfg.Cache.Policies, mc.Policies} {
+		for _, pp := range list {
+			pp.Path = path.Clean(pp.Path)
+			byPath[pp.Path] = pp
+		}
+	}
+	for _, pp := range byPath {
+		o.Policies = append(o.Policies, forkspoon.PathPolicy{Path: pp.Path, TTL: time.Duration(pp.TTL)})
+	}
+	sort.Slice(o.Policies, func(i, j int) bool { return o.Policies[i].Path < o.Policies[j].Path })
+	return o
+}
+
+// marshalConfig renders cfg in the format of its config file (YAML unless
+// it was read from TOML)
+func marshalConfig(cfg *Config) ([]byte, error) {
+	if strings.ToLower(filepath.Ext(cfg.File)) == ".toml" {
+		return toml.Marshal(cfg)
+	}
+	return yaml.Marshal(cfg)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := writeConfig(t, "forkspoon.yaml", `
+backend: /srv/nfs
+mountpoint: /mnt/cache
+cache:
+  ttl: 5m
+  readdir_stat_workers: 4
+metrics:
+  stats_file: /tmp/from-file.json
+`)
+
+	cfg, err := parseConfig([]string{"-config", path, "-cache-ttl", "1m", "-mountpoint", "/mnt/other"}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flags beat the file
+	if got := time.Duration(cfg.Cache.TTL); got != time.Minute {
+		t.Errorf("cache.ttl = %v, want the -cache-ttl value 1m", got)
+	}
+	if cfg.Mountpoint != "/mnt/other" {
+		t.Errorf("mountpoint = %q, want the -mountpoint value", cfg.Mountpoint)
+	}
+	// The file beats defaults
+	if cfg.Backend != "/srv/nfs" || cfg.Cache.ReaddirStatWorkers != 4 || cfg.Metrics.StatsFile != "/tmp/from-file.json" {
+		t.Errorf("file settings not applied: %+v", cfg)
+	}
+	// Defaults fill the rest
+	if !cfg.Cache.ReaddirAttrs || time.Duration(cfg.Service.ShutdownTimeout) != DEFAULT_SHUTDOWN_TIMEOUT {
+		t.Errorf("defaults not applied: %+v", cfg)
+	}
+	if cfg.File != path {
+		t.Errorf("File = %q, want %q", cfg.File, path)
+	}
+}
+
+func TestConfigFilter(t *testing.T) {
+	path := writeConfig(t, "forkspoon.yaml", `
+backend: /srv/nfs
+mountpoint: /mnt/cache
+filter:
+  include: [/proj]
+  exclude: [.snapshot, lost+found]
+`)
+	cfg, err := parseConfig([]string{"-config", path, "-include", "/teams/*/shared, /README"}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	f := cfg.Filter.pathFilter()
+	if strings.Join(f.Include, " ") != "/teams/*/shared /README" || strings.Join(f.Exclude, " ") != ".snapshot lost+found" {
+		t.Errorf("filter = %+v", f)
+	}
+	if (FilterConfig{}).pathFilter() != nil {
+		t.Error("empty filter settings give a filter")
+	}
+}
+
+func TestConfigReadOnlyTTL(t *testing.T) {
+	readOnly := writeConfig(t, "ro.yaml", "backend: /a\nmountpoint: /b\nread_only: true\n")
+	explicit := writeConfig(t, "ttl.yaml", "backend: /a\nmountpoint: /b\nread_only: true\ncache:\n  ttl: 45s\n")
+	plain := writeConfig(t, "plain.yaml", "backend: /a\nmountpoint: /b\n")
+	for _, tc := range []struct {
+		args []string
+		want time.Duration
+	}{
+		{[]string{"-backend", "/a", "-mountpoint", "/b", "-read-only"}, 10 * time.Minute},
+		{[]string{"-backend", "/a", "-mountpoint", "/b", "-read-only", "-cache-ttl", "1m"}, time.Minute},
+		{[]string{"-config", readOnly}, 10 * time.Minute},
+		{[]string{"-config", explicit}, 45 * time.Second},
+		{[]string{"-config", plain}, 30 * time.Second},
+		{[]string{"-config", plain, "-read-only"}, 10 * time.Minute},
+	} {
+		cfg, err := parseConfig(tc.args, flag.ContinueOnError)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := time.Duration(cfg.Cache.TTL); got != tc.want {
+			t.Errorf("%v: cache.ttl = %v, want %v", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestConfigTOML(t *testing.T) {
+	path := writeConfig(t, "forkspoon.toml", `
+backend = "/srv/nfs"
+mountpoint = "/mnt/cache"
+
+[cache]
+ttl = "2m"
+
+[[cache.policies]]
+path = "/scratch"
+ttl = "0s"
+`)
+
+	cfg, err := parseConfig([]string{"-config", path}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(cfg.Cache.TTL) != 2*time.Minute || len(cfg.Cache.Policies) != 1 || cfg.Cache.Policies[0].Path != "/scratch" {
+		t.Errorf("TOML not decoded: %+v", cfg.Cache)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, content, want string
+	}{
+		{"unknown key", "backend: /a\nmountpoint: /b\ncache:\n  tll: 5m\n", "tll"},
+		{"bad duration", "backend: /a\nmountpoint: /b\ncache:\n  ttl: five minutes\n", "five minutes"},
+		{"negative ttl", "backend: /a\nmountpoint: /b\ncache:\n  ttl: -1s\n", "cache.ttl"},
+		{"workers", "backend: /a\nmountpoint: /b\ncache:\n  readdir_stat_workers: 0\n", "cache.readdir_stat_workers"},
+		{"relative policy", "backend: /a\nmountpoint: /b\ncache:\n  policies:\n    - path: scratch\n      ttl: 1s\n", "cache.policies[0].path"},
+		{"duplicate policy", "backend: /a\nmountpoint: /b\ncache:\n  policies:\n    - {path: /x, ttl: 1s}\n    - {path: /x/, ttl: 2s}\n", "cache.policies[1].path"},
+		{"missing backend", "mountpoint: /b\n", "backend"},
+		{"trans log format", "backend: /a\nmountpoint: /b\nlogging:\n  trans_log_format: csv\n", "logging.trans_log_format"},
+		{"relative write-back path", "backend: /a\nmountpoint: /b\ncache:\n  write_back:\n    write_through: [db]\n", "cache.write_back.write_through[0]"},
+		{"write-back size", "backend: /a\nmountpoint: /b\ncache:\n  write_back:\n    size: 1GiB\n", "cache.write_back.size"},
+		{"invalidation transport", "backend: /a\nmountpoint: /b\ncache:\n  invalidation:\n    transport: tcp\n", "cache.invalidation.transport"},
+		{"invalidation address", "backend: /a\nmountpoint: /b\ncache:\n  invalidation:\n    transport: unix\n", "cache.invalidation.address"},
+		{"squash", "backend: /a\nmountpoint: /b\nid_map:\n  squash: everyone\n", "id_map.squash"},
+		{"id range", "backend: /a\nmountpoint: /b\nid_map:\n  uids: 1000-5001\n", "1000-5001"},
+		{"overlapping ids", "backend: /a\nmountpoint: /b\nid_map:\n  gids: 0:100000:65536,1000:5000\n", "id_map: gid ranges"},
+		{"audit chain", "backend: /a\nmountpoint: /b\nlogging:\n  audit_chain: true\n", "logging.audit_chain"},
+		{"filter include", "backend: /a\nmountpoint: /b\nfilter:\n  include: [teams]\n", "filter.include[0]"},
+		{"filter exclude", "backend: /a\nmountpoint: /b\nfilter:\n  exclude: [.snapshot, \"[a\"]\n", "filter.exclude[1]"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeConfig(t, "forkspoon.yaml", tc.content)
+			cfg, err := parseConfig([]string{"-config", path}, flag.ContinueOnError)
+			if err == nil {
+				err = cfg.validate()
+			}
+			if err == nil {
+				t.Fatal("config accepted")
+			}
+			if !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("error %q does not mention %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestPolicyTTL(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Backend = "/srv/nfs"
+	cfg.Cache.TTL = Duration(time.Minute)
+	cfg.Cache.Policies = []PathPolicy{
+		{Path: "/build", TTL: Duration(5 * time.Second)},
+		{Path: "/build/release", TTL: Duration(time.Hour)},
+		{Path: "/scratch/", TTL: 0},
+	}
+	o := newCacheOptions(cfg, cfg.mountConfigs()[0])
+
+	for path, want := range map[string]time.Duration{
+		"":                    time.Minute,
+		"src/main.go":         time.Minute,
+		"build":               5 * time.Second,
+		"build/obj/a.o":       5 * time.Second,
+		"build/release/v1":    time.Hour,
+		"build-tools/x":       time.Minute,
+		"scratch/tmp/file":    0,
+		"scratchpad/notes.md": time.Minute,
+	} {
+		if got := o.TTLFor(path); got != want {
+			t.Errorf("TTLFor(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestExampleConfig(t *testing.T) {
+	cfg, err := parseConfig([]string{"-config", "../../examples/forkspoon.yaml"}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigMounts(t *testing.T) {
+	path := writeConfig(t, "forkspoon.yaml", `
+backend: /srv/nfs
+mountpoint: /mnt/cache
+cache:
+  ttl: 5m
+  memory_limit: 64MiB
+  policies:
+    - {path: /scratch, ttl: 0s}
+    - {path: /build, ttl: 10s}
+mounts:
+  - name: home
+    backend: /srv/home
+    mountpoint: /mnt/home
+    ttl: 1m
+    policies:
+      - {path: /build, ttl: 1h}
+`)
+	cfg, err := parseConfig([]string{"-config", path}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Cache.MemoryLimit != 64<<20 {
+		t.Errorf("cache.memory_limit = %d, want 64MiB", cfg.Cache.MemoryLimit)
+	}
+
+	mounts := cfg.mountConfigs()
+	if len(mounts) != 2 || mounts[0].Name != DEFAULT_MOUNT_NAME || mounts[1].Name != "home" {
+		t.Fatalf("mountConfigs() = %+v", mounts)
+	}
+
+	// The mount's TTL and policies override the global ones path by path
+	o := newCacheOptions(cfg, mounts[1])
+	for path, want := range map[string]time.Duration{
+		"src":       time.Minute,
+		"scratch/x": 0,
+		"build/x":   time.Hour,
+	} {
+		if got := o.TTLFor(path); got != want {
+			t.Errorf("home: TTLFor(%q) = %v, want %v", path, got, want)
+		}
+	}
+	if o := newCacheOptions(cfg, mounts[0]); o.TTLFor("build/x") != 10*time.Second {
+		t.Errorf("default: TTLFor(build/x) = %v, want 10s", o.TTLFor("build/x"))
+	}
+}
+
+func TestConfigMountErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, content, want string
+	}{
+		{"duplicate name", "mounts:\n  - {name: a, backend: /a, mountpoint: /m1}\n  - {name: a, backend: /b, mountpoint: /m2}\n", "mounts[1].name"},
+		{"default name taken", "backend: /a\nmountpoint: /m1\nmounts:\n  - {name: default, backend: /b, mountpoint: /m2}\n", "mounts[0].name"},
+		{"bad name", "mounts:\n  - {name: 'my mount', backend: /a, mountpoint: /m1}\n", "mounts[0].name"},
+		{"shared mountpoint", "backend: /a\nmountpoint: /m1\nmounts:\n  - {name: b, backend: /b, mountpoint: /m1/}\n", "mounts[0].mountpoint"},
+		{"missing backend", "mounts:\n  - {name: b, mountpoint: /m1}\n", "mounts[0].backend"},
+		{"bad policy", "mounts:\n  - {name: b, backend: /b, mountpoint: /m1, policies: [{path: x, ttl: 1s}]}\n", "mounts[0].policies[0].path"},
+		{"bad memory limit", "backend: /a\nmountpoint: /b\ncache:\n  memory_limit: lots\n", "lots"},
+		{"nothing to mount", "cache:\n  ttl: 1m\n", "backend"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeConfig(t, "forkspoon.yaml", tc.content)
+			cfg, err := parseConfig([]string{"-config", path}, flag.ContinueOnError)
+			if err == nil {
+				err = cfg.validate()
+			}
+			if err == nil {
+				t.Fatal("config accepted")
+			}
+			if !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("error %q does not mention %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for in, want := range map[string]ByteSize{
+		"0":      0,
+		"4096":   4096,
+		"512KiB": 512 << 10,
+		"64mib":  64 << 20,
+		"2G":     2 << 30,
+		"1.5GiB": 3 << 29,
+		"10MB":   10e6,
+		"100 B":  100,
+	} {
+		got, err := parseByteSize(in)
+		if err != nil || got != want {
+			t.Errorf("parseByteSize(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "lots", "-1G", "1X"} {
+		if _, err := parseByteSize(in); err == nil {
+			t.Errorf("parseByteSize(%q) accepted", in)
+		}
+	}
+	if s := ByteSize(64 << 20).String(); s != "64MiB" {
+		t.Errorf("String() = %q, want 64MiB", s)
+	}
+}
+
+func TestParseIDRanges(t *testing.T) {
+	path := writeConfig(t, "forkspoon.yaml", "backend: /a\nmountpoint: /b\nid_map:\n  uids: 1000:5001, 2000:100000:65536\n")
+	cfg, err := parseConfig([]string{"-config", path, "-gid-map", "100:5000", "-squash", "root"}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	im := cfg.IDMap.idMap()
+	if im == nil || len(im.UIDs) != 2 || im.UIDs[1].Count != 65536 || len(im.GIDs) != 1 || im.GIDs[0].Backend != 5000 || im.Squash != "root" {
+		t.Fatalf("id map = %+v", im)
+	}
+	if s := cfg.IDMap.UIDs.String(); s != "1000:5001,2000:100000:65536" {
+		t.Errorf("String() = %q", s)
+	}
+	if (IDMapConfig{}).idMap() != nil {
+		t.Error("empty id_map maps ids")
+	}
+	for _, in := range []string{"1000", "a:b", "1:2:3:4", "1:2:0", "-1:5"} {
+		if _, err := parseIDRanges(in); err == nil {
+			t.Errorf("parseIDRanges(%q) accepted", in)
+		}
+	}
+}
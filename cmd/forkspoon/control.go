@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// Socket `forkspoon ctl` talks to unless -socket says otherwise
+	DEFAULT_CONTROL_SOCKET = "/run/forkspoon.sock"
+
+	// How long a control client may take to send its command
+	CONTROL_READ_TIMEOUT = 5 * time.Second
+)
+
+// controlServer accepts operator commands on a Unix socket. The protocol is
+// one command line per connection; the reply is free-form text ending in a
+// final "OK" or "ERROR: <reason>" line.
+//
+//	ping                          check that the daemon is alive
+//	reload                        same as SIGHUP: re-read the config file and reopen the logs
+//	stats                         current statistics as JSON
+//	config                        the configuration in effect
+//	mounts                        list the running mounts
+//	mount <name> <backend> <mountpoint> [ttl]
+//	                              serve another backend until unmounted or restart
+//	unmount <name>                take a mount down
+type controlServer struct {
+	listener *net.UnixListener
+	lc       *lifecycle
+}
+
+// startControlServer listens on path. The socket is only accessible to
+// the owner: reload and config are administrative operations.
+func startControlServer(path string, lc *lifecycle) (*controlServer, error) {
+	// A socket left behind by a previous run can't be listened on again
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("control socket %s is in use by another process", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove old control socket: %v", err)
+	}
+
+	oldMask := syscall.Umask(0077)
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	syscall.Umask(oldMask)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket: %v", err)
+	}
+
+	s := &controlServer{listener: listener, lc: lc}
+	go s.serve()
+	log.Printf("Control socket: %s", path)
+	return s, nil
+}
+
+func (s *controlServer) serve() {
+	for {
+		conn, err := s.listener.AcceptUnix()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("[CONTROL] Accept failed: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *controlServer) handle(conn *net.UnixConn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(CONTROL_READ_TIMEOUT))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		fmt.Fprintln(conn, "ERROR: empty command")
+		return
+	}
+
+	if verbose {
+		log.Printf("[CONTROL] %s", strings.Join(args, " "))
+	}
+
+	var out bytes.Buffer
+	if err := s.dispatch(args, &out); err != nil {
+		out.WriteString("ERROR: " + err.Error() + "\n")
+	} else {
+		out.WriteString("OK\n")
+	}
+	conn.Write(out.Bytes())
+}
+
+// dispatch runs one control command, writing its output to w
+func (s *controlServer) dispatch(args []string, w io.Writer) error {
+	switch args[0] {
+	case "ping":
+		fmt.Fprintf(w, "forkspoon pid %d serving %d mounts\n", os.Getpid(), len(registry.list()))
+		return nil
+	case "reload":
+		log.Printf("Control socket: reloading configuration and reopening logs")
+		return s.lc.reload()
+	case "stats":
+		data, err := json.MarshalIndent(statisticsMap(), "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\n", data)
+		return nil
+	case "config":
+		data, err := marshalConfig(s.lc.config())
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	case "mounts":
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tBACKEND\tMOUNTPOINT\tTTL\tCACHE MEMORY\tOPS\tHIT RATE\tSOURCE")
+		for _, m := range registry.list() {
+			total, hits := m.Metrics().Snapshot().CacheTotals()
+			source := "config"
+			if !m.fromConfig {
+				source = "runtime"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t%s\t%d\t%.1f%%\t%s\n",
+				m.Name(), m.config.Backend, m.Mountpoint(), m.CacheOptions().TTL,
+				ByteSize(m.MemoryUsed()), total, getHitRate(hits, total-hits), source)
+		}
+		return tw.Flush()
+	case "mount":
+		if len(args) != 4 && len(args) != 5 {
+			return fmt.Errorf("usage: mount <name> <backend> <mountpoint> [ttl]")
+		}
+		mc := MountConfig{Name: args[1], Backend: args[2], Mountpoint: args[3]}
+		if len(args) == 5 {
+			var ttl Duration
+			if err := ttl.UnmarshalText([]byte(args[4])); err != nil {
+				return err
+			}
+			mc.TTL = &ttl
+		}
+		return s.mount(mc, w)
+	case "unmount":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: unmount <name>")
+		}
+		return unmountByName(args[1])
+	}
+	return fmt.Errorf("unknown command %q (try ping, reload, stats, config, mounts, mount, unmount)", args[0])
+}
+
+// mount adds a mount at runtime. It lasts until it is unmounted or the
+// daemon restarts; to keep it, add it to the config file as well.
+func (s *controlServer) mount(mc MountConfig, w io.Writer) error {
+	if !mountNamePattern.MatchString(mc.Name) {
+		return fmt.Errorf("invalid mount name %q (letters, digits, '.', '_' and '-')", mc.Name)
+	}
+	if !filepath.IsAbs(mc.Backend) || !filepath.IsAbs(mc.Mountpoint) {
+		return fmt.Errorf("backend and mountpoint must be absolute paths")
+	}
+	if mc.TTL != nil && *mc.TTL < 0 {
+		return fmt.Errorf("ttl must not be negative")
+	}
+
+	log.Printf("Control socket: mounting %s on %s as %s", mc.Backend, mc.Mountpoint, mc.Name)
+	m, err := startMount(mc, s.lc.config(), false)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "mounted %s on %s\n", m.config.Backend, m.Mountpoint())
+	return nil
+}
+
+// Close stops accepting commands and removes the socket
+func (s *controlServer) Close() {
+	s.listener.Close()
+}
+
+// runCtl implements `forkspoon ctl`: it sends one command to a running
+// instance, prints the reply and returns the exit status
+func runCtl(args []string) int {
+	f := flag.NewFlagSet("forkspoon ctl", flag.ExitOnError)
+	socket := f.String("socket", DEFAULT_CONTROL_SOCKET, "Control socket of the running instance")
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s ctl [-socket <path>] ping|reload|stats|config|mounts\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s ctl [-socket <path>] mount <name> <backend> <mountpoint> [ttl]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s ctl [-socket <path>] unmount <name>\n", os.Args[0])
+		f.PrintDefaults()
+	}
+	f.Parse(args)
+	if f.NArg() == 0 {
+		f.Usage()
+		return 2
+	}
+
+	conn, err := net.Dial("unix", *socket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "forkspoon ctl: %v\n", err)
+		return 1
+	}
+	defer conn.Close()
+
+	if _, err := fmt.Fprintln(conn, strings.Join(f.Args(), " ")); err != nil {
+		fmt.Fprintf(os.Stderr, "forkspoon ctl: %v\n", err)
+		return 1
+	}
+
+	status := 1
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "OK":
+			status = 0
+		case strings.HasPrefix(line, "ERROR: "):
+			fmt.Fprintln(os.Stderr, strings.TrimPrefix(line, "ERROR: "))
+		default:
+			fmt.Println(line)
+		}
+	}
+	return status
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// Set in the environment of the re-executed daemon child; the value is
+	// the file descriptor of the readiness pipe back to the parent
+	DAEMON_READY_FD_ENV = "FORKSPOON_DAEMON_READY_FD"
+)
+
+// sdNotify sends a state update ("READY=1", "STATUS=...") to systemd over
+// $NOTIFY_SOCKET. It is a no-op when not started by systemd with
+// Type=notify. Abstract socket names ("@...") are handled by the net package.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to notify socket: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to notify systemd: %v", err)
+	}
+	return nil
+}
+
+// notifyStatus updates the free-form status line shown by `systemctl status`
+func notifyStatus(format string, args ...interface{}) {
+	if err := sdNotify("STATUS=" + fmt.Sprintf(format, args...)); err != nil && verbose {
+		log.Printf("[SYSTEMD] %v", err)
+	}
+}
+
+// startWatchdog pings systemd's watchdog (WatchdogSec=) at half the
+// configured interval for as long as the backends keep answering, so a hung
+// filer gets the service restarted instead of wedging every client.
+func startWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	interval := time.Duration(usec) * time.Microsecond / 2
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			healthy := true
+			for _, m := range registry.list() {
+				if err := m.CheckBackend(interval); err != nil {
+					log.Printf("[SYSTEMD] Backend of %s not responding, withholding watchdog ping: %v", m.Name(), err)
+					healthy = false
+					break
+				}
+			}
+			if healthy {
+				sdNotify("WATCHDOG=1")
+			}
+		}
+	}()
+}
+
+// daemonize re-executes the binary detached from the terminal and waits
+// until the child reports that the mount is ready. It only returns in the
+// child; the parent exits with the child's readiness result, which is what
+// systemd's Type=forking expects.
+func daemonize(logPath string) {
+	if os.Getenv(DAEMON_READY_FD_ENV) != "" {
+		return
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Daemon mode: cannot find own executable: %v", err)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		log.Fatalf("Daemon mode: %v", err)
+	}
+
+	if logPath == "" {
+		logPath = os.DevNull
+	}
+	out, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatalf("Daemon mode: failed to open daemon log: %v", err)
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), DAEMON_READY_FD_ENV+"=3")
+	cmd.ExtraFiles = []*os.File{readyW}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		log.Fatalf("Daemon mode: failed to start: %v", err)
+	}
+	readyW.Close()
+	out.Close()
+
+	line, _ := bufio.NewReader(readyR).ReadString('\n')
+	line = strings.TrimSpace(line)
+	if line != "READY" {
+		if line == "" {
+			line = "daemon exited before becoming ready"
+		}
+		fmt.Fprintf(os.Stderr, "forkspoon: %s (see %s)\n", line, logPath)
+		os.Exit(1)
+	}
+
+	fmt.Printf("forkspoon: running in background, pid %d\n", cmd.Process.Pid)
+	os.Exit(0)
+}
+
+// reportDaemonReady tells the waiting parent (if any) that startup is done.
+// A non-nil err is passed along as the reason startup failed.
+func reportDaemonReady(err error) {
+	fdStr := os.Getenv(DAEMON_READY_FD_ENV)
+	if fdStr == "" {
+		return
+	}
+	os.Unsetenv(DAEMON_READY_FD_ENV)
+
+	fd, convErr := strconv.Atoi(fdStr)
+	if convErr != nil {
+		return
+	}
+	pipe := os.NewFile(uintptr(fd), "ready")
+	defer pipe.Close()
+
+	if err != nil {
+		fmt.Fprintf(pipe, "ERROR: %v\n", err)
+		return
+	}
+	fmt.Fprintln(pipe, "READY")
+}
+
+// writePidfile records our pid for init scripts and systemd's PIDFile=
+func writePidfile(path string) error {
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/yourusername/forkspoon/pkg/forkspoon"
+)
+
+// IDRanges is a list of uid or gid ranges written as "1000:5001,0:100000:65536"
+// in config files and flags: the id on the mount, the id on the backend and
+// optionally how many consecutive ids the pair covers (default 1).
+type IDRanges []forkspoon.IDRange
+
+func parseIDRanges(s string) (IDRanges, error) {
+	var ranges IDRanges
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, ":")
+		if len(parts) != 2 && len(parts) != 3 {
+			return nil, fmt.Errorf("invalid id range %q (use mount:backend or mount:backend:count)", item)
+		}
+		var n [3]uint32
+		for i, p := range parts {
+			v, err := strconv.ParseUint(strings.TrimSpace(p), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid id range %q (use mount:backend or mount:backend:count)", item)
+			}
+			n[i] = uint32(v)
+		}
+		if len(parts) == 3 && n[2] == 0 {
+			return nil, fmt.Errorf("invalid id range %q: count must be positive", item)
+		}
+		ranges = append(ranges, forkspoon.IDRange{Mount: n[0], Backend: n[1], Count: n[2]})
+	}
+	return ranges, nil
+}
+
+func (r IDRanges) String() string {
+	items := make([]string, len(r))
+	for i, ir := range r {
+		items[i] = fmt.Sprintf("%d:%d", ir.Mount, ir.Backend)
+		if ir.Count > 1 {
+			items[i] += fmt.Sprintf(":%d", ir.Count)
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+// Set implements flag.Value
+func (r *IDRanges) Set(s string) error {
+	v, err := parseIDRanges(s)
+	if err != nil {
+		return err
+	}
+	*r = v
+	return nil
+}
+
+func (r IDRanges) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *IDRanges) UnmarshalText(text []byte) error {
+	return r.Set(string(text))
+}
@@ -4,70 +4,172 @@ import (
 	"compress/gzip"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
 const (
-	MAX_LOG_SIZE   = 2 * 1024 * 1024 * 1024 // 2GB
-	MAX_OLD_FILES  = 6
+	DEFAULT_LOG_MAX_SIZE    = 2 * 1024 * 1024 * 1024 // 2GB
+	DEFAULT_LOG_MAX_BACKUPS = 6
 	LOG_CHECK_INTERVAL = 30 * time.Second
+
+	// Rotation intervals
+	ROTATE_HOURLY = "hourly"
+	ROTATE_DAILY  = "daily"
+
+	// Suffix of rotated files: <log>.20060102-150405[-N][.gz]. The -N
+	// sequence number tells apart files rotated within the same second.
+	ROTATED_TIME_FORMAT = "20060102-150405"
+
+	// Suffix of a file being compressed; renamed to .gz when complete
+	COMPRESS_TMP_SUFFIX = ".tmp"
 )
 
+var rotatedSuffix = regexp.MustCompile(`^\.(\d{8}-\d{6})(?:-(\d+))?(\.gz)?(\.tmp)?$`)
+
+// RotationOptions controls when a RotatingLogger starts a new file and how
+// many old ones it keeps
+type RotationOptions struct {
+	// Rotate once the file reaches this size (0 = no size limit)
+	MaxSize int64
+
+	// Rotate at the start of every hour or day (ROTATE_HOURLY,
+	// ROTATE_DAILY; "" = never)
+	Interval string
+
+	// Rotated files to keep, and how old they may get (0 = no limit)
+	MaxBackups int
+	MaxAge     time.Duration
+
+	// Gzip rotated files
+	Compress bool
+}
+
+// nextRotation returns when a file last written at t is due for rotation
+// by time, or the zero time if it isn't
+func (o RotationOptions) nextRotation(t time.Time) time.Time {
+	y, m, d := t.Date()
+	switch o.Interval {
+	case ROTATE_HOURLY:
+		return time.Date(y, m, d, t.Hour()+1, 0, 0, 0, t.Location())
+	case ROTATE_DAILY:
+		return time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+	}
+	return time.Time{}
+}
+
 type RotatingLogger struct {
 	mu          sync.Mutex
 	file        *os.File
 	path        string
 	currentSize int64
-	maxSize     int64
-	maxBackups  int
+	opts        RotationOptions
+
+	// When the current file is due for rotation by time
+	next time.Time
+
+	// When rotation last failed; it isn't retried before the next check
+	failedAt time.Time
+
+	// Rotated files are compressed and expired by one worker, woken
+	// through wake. Close waits for it on stopped.
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
 }
 
-func NewRotatingLogger(path string) (*RotatingLogger, error) {
+func NewRotatingLogger(path string, opts RotationOptions) (*RotatingLogger, error) {
 	dir := filepath.Dir(path)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create log directory: %v", err)
 	}
 
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	logger := &RotatingLogger{
+		path:    path,
+		opts:    opts,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if err := logger.open(); err != nil {
+		return nil, err
+	}
+
+	// Start rotation checker, and the worker with a first pass that
+	// finishes what a crash may have left behind
+	go logger.rotationChecker()
+	go logger.worker()
+	logger.wake <- struct{}{}
+
+	return logger, nil
+}
+
+// open (re)opens the file at l.path. A file left over from an earlier
+// period is rotated on the next write.
+func (l *RotatingLogger) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open log file: %v", err)
+		return fmt.Errorf("failed to open log file: %v", err)
 	}
 
 	info, err := file.Stat()
 	if err != nil {
 		file.Close()
-		return nil, fmt.Errorf("failed to stat log file: %v", err)
+		return fmt.Errorf("failed to stat log file: %v", err)
 	}
 
-	logger := &RotatingLogger{
-		file:        file,
-		path:        path,
-		currentSize: info.Size(),
-		maxSize:     MAX_LOG_SIZE,
-		maxBackups:  MAX_OLD_FILES,
+	if l.file != nil {
+		l.file.Close()
 	}
-
-	// Start rotation checker
-	go logger.rotationChecker()
-
-	return logger, nil
+	l.file = file
+	l.currentSize = info.Size()
+	since := time.Now()
+	if info.Size() > 0 {
+		since = info.ModTime()
+	}
+	l.next = l.opts.nextRotation(since)
+	return nil
 }
 
-func (l *RotatingLogger) Write(format string, args ...interface{}) error {
+// SetOptions changes the rotation settings, e.g. on reload
+func (l *RotatingLogger) SetOptions(opts RotationOptions) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if opts.Interval != l.opts.Interval {
+		l.next = opts.nextRotation(time.Now())
+	}
+	l.opts = opts
+	l.notify()
+}
 
+func (l *RotatingLogger) Write(format string, args ...interface{}) error {
 	msg := fmt.Sprintf(format, args...)
 	if !strings.HasSuffix(msg, "\n") {
 		msg += "\n"
 	}
+	return l.WriteBytes([]byte(msg))
+}
 
-	n, err := l.file.WriteString(msg)
+// WriteBytes appends p as is
+func (l *RotatingLogger) WriteBytes(p []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// A new hour or day starts a new file before anything is written to it
+	if l.timeDue() && l.canRetry() {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate log: %v", err)
+		}
+	}
+
+	n, err := l.file.Write(p)
 	if err != nil {
 		return err
 	}
@@ -75,7 +177,7 @@ func (l *RotatingLogger) Write(format string, args ...interface{}) error {
 	l.currentSize += int64(n)
 
 	// Check if rotation needed
-	if l.currentSize >= l.maxSize {
+	if l.opts.MaxSize > 0 && l.currentSize >= l.opts.MaxSize && l.canRetry() {
 		if err := l.rotate(); err != nil {
 			return fmt.Errorf("failed to rotate log: %v", err)
 		}
@@ -84,55 +186,185 @@ func (l *RotatingLogger) Write(format string, args ...interface{}) error {
 	return nil
 }
 
-func (l *RotatingLogger) rotate() error {
-	// Close current file
-	l.file.Close()
+// due reports whether the current file has to be rotated
+func (l *RotatingLogger) due() bool {
+	return (l.opts.MaxSize > 0 && l.currentSize >= l.opts.MaxSize) || l.timeDue()
+}
 
-	// Generate new filename with timestamp
-	timestamp := time.Now().Format("20060102-150405")
-	newName := fmt.Sprintf("%s.%s", l.path, timestamp)
+// timeDue reports whether the current file belongs to an earlier hour or
+// day. Empty files are not rotated.
+func (l *RotatingLogger) timeDue() bool {
+	return !l.next.IsZero() && !time.Now().Before(l.next) && l.currentSize > 0
+}
 
-	// Rename current file
-	if err := os.Rename(l.path, newName); err != nil {
+// canRetry reports whether rotation may be tried again after a failure
+func (l *RotatingLogger) canRetry() bool {
+	return time.Since(l.failedAt) >= LOG_CHECK_INTERVAL
+}
+
+// rotate moves the current file aside and starts a new one. If that fails,
+// logging goes on in the current file. Compression and retention are left
+// to the worker.
+func (l *RotatingLogger) rotate() error {
+	err := l.rotateFile()
+	if err != nil {
+		l.failedAt = time.Now()
+		log.Printf("Failed to rotate %s: %v", l.path, err)
 		return err
 	}
+	l.failedAt = time.Time{}
+	l.notify()
+	return nil
+}
 
-	// Compress the rotated file
-	go l.compressFile(newName)
+func (l *RotatingLogger) rotateFile() error {
+	newName, err := l.rotatedName(time.Now())
+	if err != nil {
+		return err
+	}
 
-	// Clean up old files
-	go l.cleanupOldFiles()
+	// Rename current file; it stays open for writing until the new one is
+	if err := os.Rename(l.path, newName); err != nil {
+		return err
+	}
 
 	// Open new file
 	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
-		return err
+		// Put the old one back rather than lose the log
+		if os.Rename(newName, l.path) == nil {
+			return err
+		}
+		return fmt.Errorf("%v (log continues in %s)", err, newName)
 	}
 
+	l.file.Close()
 	l.file = file
 	l.currentSize = 0
+	l.next = l.opts.nextRotation(time.Now())
 
 	return nil
 }
 
-func (l *RotatingLogger) compressFile(path string) error {
+// rotatedName returns a name for the current file rotated at t that no
+// existing backup uses
+func (l *RotatingLogger) rotatedName(t time.Time) (string, error) {
+	base := fmt.Sprintf("%s.%s", l.path, t.Format(ROTATED_TIME_FORMAT))
+	name := base
+	for seq := 1; ; seq++ {
+		taken := false
+		for _, suffix := range []string{"", ".gz", ".gz" + COMPRESS_TMP_SUFFIX} {
+			if _, err := os.Lstat(name + suffix); err == nil {
+				taken = true
+			} else if !os.IsNotExist(err) {
+				return "", err
+			}
+		}
+		if !taken {
+			return name, nil
+		}
+		name = fmt.Sprintf("%s-%d", base, seq)
+	}
+}
+
+// notify wakes the worker
+func (l *RotatingLogger) notify() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// worker compresses and expires rotated files, one pass at a time. Each pass
+// works from what is on disk, so the first one also picks up files left
+// uncompressed, or half compressed, by a crash.
+func (l *RotatingLogger) worker() {
+	defer close(l.stopped)
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-l.wake:
+		}
+
+		l.mu.Lock()
+		opts := l.opts
+		l.mu.Unlock()
+
+		if opts.Compress {
+			l.compressBackups()
+		}
+		if err := l.cleanupOldFiles(opts); err != nil {
+			log.Printf("Failed to remove old logs of %s: %v", l.path, err)
+		}
+	}
+}
+
+// compressBackups compresses the uncompressed backups, oldest first. It
+// stops early when the logger is closed.
+func (l *RotatingLogger) compressBackups() {
+	files, err := l.backups()
+	if err != nil {
+		log.Printf("Failed to list rotated logs of %s: %v", l.path, err)
+		return
+	}
+
+	for _, b := range files {
+		select {
+		case <-l.done:
+			return
+		default:
+		}
+
+		switch {
+		case b.tmp:
+			// Interrupted compression; the original is still there
+			os.Remove(b.path)
+		case !b.gz:
+			if err := compressFile(b.path); err != nil {
+				log.Printf("Failed to compress rotated log %s: %v", b.path, err)
+			}
+		}
+	}
+}
+
+// compressFile writes path.gz and removes path. The data goes to a
+// temporary file first, so path.gz is either complete or absent.
+func compressFile(path string) error {
+	destPath := path + ".gz"
+	if _, err := os.Stat(destPath); err == nil {
+		// Compressed before a crash; only the removal is missing
+		return os.Remove(path)
+	}
+
 	source, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer source.Close()
 
-	destPath := path + ".gz"
-	dest, err := os.Create(destPath)
+	tmpPath := destPath + COMPRESS_TMP_SUFFIX
+	dest, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
-	defer dest.Close()
 
 	gzWriter := gzip.NewWriter(dest)
-	defer gzWriter.Close()
-
-	if _, err := io.Copy(gzWriter, source); err != nil {
+	_, err = io.Copy(gzWriter, source)
+	if err == nil {
+		err = gzWriter.Close()
+	}
+	if err == nil {
+		err = dest.Sync()
+	}
+	if cerr := dest.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, destPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
 		return err
 	}
 
@@ -140,31 +372,76 @@ func (l *RotatingLogger) compressFile(path string) error {
 	return os.Remove(path)
 }
 
-func (l *RotatingLogger) cleanupOldFiles() error {
-	// Find all backup files
+// backup is a rotated file of the log
+type backup struct {
+	path  string
+	stamp string
+	seq   int
+	gz    bool
+	tmp   bool
+}
+
+// backups lists the rotated files of the log, oldest first
+func (l *RotatingLogger) backups() ([]backup, error) {
 	dir := filepath.Dir(l.path)
 	base := filepath.Base(l.path)
 
-	files, err := filepath.Glob(filepath.Join(dir, base+".*.gz"))
+	matches, err := filepath.Glob(filepath.Join(dir, base+".*"))
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	if len(files) <= l.maxBackups {
-		return nil
+	var files []backup
+	for _, f := range matches {
+		m := rotatedSuffix.FindStringSubmatch(strings.TrimPrefix(filepath.Base(f), base))
+		if m == nil || (m[4] != "" && m[3] == "") {
+			continue
+		}
+		b := backup{path: f, stamp: m[1], gz: m[3] != "", tmp: m[4] != ""}
+		if m[2] != "" {
+			b.seq, _ = strconv.Atoi(m[2])
+		}
+		files = append(files, b)
 	}
 
-	// Sort by modification time
 	sort.Slice(files, func(i, j int) bool {
-		fiInfo, _ := os.Stat(files[i])
-		fjInfo, _ := os.Stat(files[j])
-		return fiInfo.ModTime().Before(fjInfo.ModTime())
+		if files[i].stamp != files[j].stamp {
+			return files[i].stamp < files[j].stamp
+		}
+		return files[i].seq < files[j].seq
 	})
+	return files, nil
+}
 
-	// Remove oldest files
-	toRemove := len(files) - l.maxBackups
-	for i := 0; i < toRemove; i++ {
-		os.Remove(files[i])
+// cleanupOldFiles removes rotated files beyond opts.MaxBackups and those
+// older than opts.MaxAge. Files still being compressed are not counted.
+func (l *RotatingLogger) cleanupOldFiles(opts RotationOptions) error {
+	files, err := l.backups()
+	if err != nil {
+		return err
+	}
+
+	var kept []backup
+	for _, b := range files {
+		if !b.tmp {
+			kept = append(kept, b)
+		}
+	}
+
+	toRemove := 0
+	if opts.MaxBackups > 0 && len(kept) > opts.MaxBackups {
+		toRemove = len(kept) - opts.MaxBackups
+	}
+	for i, b := range kept {
+		expired := i < toRemove
+		if !expired && opts.MaxAge > 0 {
+			info, err := os.Stat(b.path)
+			expired = err == nil && time.Since(info.ModTime()) > opts.MaxAge
+		}
+		if expired {
+			if err := os.Remove(b.path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
 	}
 
 	return nil
@@ -174,20 +451,42 @@ func (l *RotatingLogger) rotationChecker() {
 	ticker := time.NewTicker(LOG_CHECK_INTERVAL)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		}
+
 		l.mu.Lock()
 		info, err := l.file.Stat()
 		if err == nil {
 			l.currentSize = info.Size()
-			if l.currentSize >= l.maxSize {
+			if l.due() {
 				l.rotate()
 			}
 		}
 		l.mu.Unlock()
+
+		// Backups also expire when nothing is rotated
+		l.notify()
 	}
 }
 
+// Reopen closes the log file and opens it again by path, so that an
+// external logrotate that moved the file away takes effect (SIGHUP)
+func (l *RotatingLogger) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.open()
+}
+
+// Close closes the log once the worker has finished the file at hand.
+// Backups it didn't get to are compressed on the next start.
 func (l *RotatingLogger) Close() error {
+	close(l.done)
+	<-l.stopped
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	return l.file.Close()
@@ -197,4 +496,4 @@ func (l *RotatingLogger) Close() error {
 func (l *RotatingLogger) WriteHeader(backend, mount string, ttl time.Duration) error {
 	return l.Write("=== FORKSPOON CACHE LOG ===\nStarted: %s\nBackend: %s\nMount: %s\nCache TTL: %v\n==========================================",
 		time.Now().Format(time.RFC3339), backend, mount, ttl)
-}
\ No newline at end of file
+}
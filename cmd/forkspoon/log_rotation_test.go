@@ -0,0 +1,210 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForBackups waits until the log has n rotated files, all of them
+// ending in suffix
+func waitForBackups(t *testing.T, l *RotatingLogger, n int, suffix string) []backup {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		files, err := l.backups()
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := len(files) == n
+		for _, b := range files {
+			done = done && strings.HasSuffix(b.path, suffix)
+		}
+		if done {
+			return files
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("rotated files = %v, want %d ending in %q", files, n, suffix)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRotatingLoggerRotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.log")
+	l, err := NewRotatingLogger(path, RotationOptions{MaxSize: 100, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if err := l.Write("%s", strings.Repeat("x", 150)); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Write("after"); err != nil {
+		t.Fatal(err)
+	}
+
+	files := waitForBackups(t, l, 1, ".gz")
+	if !strings.HasPrefix(filepath.Base(files[0].path), "cache.log.") {
+		t.Errorf("rotated file %s is not named after the log", files[0].path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "after\n" {
+		t.Errorf("current log = %q, want the write after the rotation", data)
+	}
+}
+
+func TestRotatingLoggerRetention(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "trans.log")
+
+	// Rotated files from earlier runs: two old enough to expire, and
+	// files of other logs that must be left alone
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{"trans.log.20200101-000000.gz", "trans.log.20200102-000000", "trans.log.bak", "other.log.20200101-000000"} {
+		f := filepath.Join(dir, name)
+		if err := os.WriteFile(f, []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(f, old, old)
+	}
+
+	l, err := NewRotatingLogger(path, RotationOptions{MaxSize: 10, MaxBackups: 2, MaxAge: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Uncompressed, at most two, none older than a day. The rotations
+	// happen within the same second and must not overwrite each other.
+	for i := 0; i < 3; i++ {
+		if err := l.Write("line %d, padded to rotate", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := waitForBackups(t, l, 2, "")
+	for i, b := range files {
+		if b.gz || b.stamp < "2021" {
+			t.Errorf("unexpected rotated file %s", b.path)
+			continue
+		}
+		data, _ := os.ReadFile(b.path)
+		if want := fmt.Sprintf("line %d, padded to rotate\n", i+1); string(data) != want {
+			t.Errorf("%s = %q, want %q", b.path, data, want)
+		}
+	}
+	for _, name := range []string{"trans.log.bak", "other.log.20200101-000000"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s was removed: %v", name, err)
+		}
+	}
+}
+
+func TestRotationOptionsNextRotation(t *testing.T) {
+	at := time.Date(2024, 3, 31, 23, 40, 5, 0, time.UTC)
+	for _, tc := range []struct {
+		interval string
+		want     time.Time
+	}{
+		{"", time.Time{}},
+		{ROTATE_HOURLY, time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{ROTATE_DAILY, time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		if got := (RotationOptions{Interval: tc.interval}).nextRotation(at); !got.Equal(tc.want) {
+			t.Errorf("%q: next rotation = %v, want %v", tc.interval, got, tc.want)
+		}
+	}
+	if got := (RotationOptions{Interval: ROTATE_HOURLY}).nextRotation(at.Add(-time.Hour)); !got.Equal(time.Date(2024, 3, 31, 23, 0, 0, 0, time.UTC)) {
+		t.Errorf("hourly: next rotation = %v", got)
+	}
+}
+
+func TestRotatingLoggerRotatesByTime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.log")
+
+	// Left over from yesterday: rotated on the first write
+	if err := os.WriteFile(path, []byte("yesterday\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	yesterday := time.Now().Add(-24 * time.Hour)
+	os.Chtimes(path, yesterday, yesterday)
+
+	l, err := NewRotatingLogger(path, RotationOptions{Interval: ROTATE_DAILY})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if err := l.Write("today"); err != nil {
+		t.Fatal(err)
+	}
+	files := waitForBackups(t, l, 1, "")
+	data, err := os.ReadFile(files[0].path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "yesterday\n" {
+		t.Errorf("rotated log = %q, want only yesterday's line", data)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "today\n" {
+		t.Errorf("current log = %q, want today's line", data)
+	}
+}
+
+func TestRotatingLoggerRecoversAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cache.log")
+
+	// A crash left a rotated file uncompressed, one half compressed, and
+	// one compressed but not yet removed
+	for name, data := range map[string]string{
+		"cache.log.20240101-000000":        "first\n",
+		"cache.log.20240102-000000":        "second\n",
+		"cache.log.20240102-000000.gz.tmp": "partial",
+		"cache.log.20240103-000000":        "third\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gz, err := os.Create(filepath.Join(dir, "cache.log.20240103-000000.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := gzip.NewWriter(gz)
+	w.Write([]byte("third\n"))
+	w.Close()
+	gz.Close()
+
+	l, err := NewRotatingLogger(path, RotationOptions{Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	files := waitForBackups(t, l, 3, ".gz")
+	for i, want := range []string{"first\n", "second\n", "third\n"} {
+		f, err := os.Open(files[i].path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("%s: %v", files[i].path, err)
+		}
+		data, _ := io.ReadAll(r)
+		f.Close()
+		if string(data) != want {
+			t.Errorf("%s = %q, want %q", files[i].path, data, want)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -9,269 +8,23 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
-	"sync/atomic"
-	"syscall"
 	"time"
 
-	"github.com/hanwen/go-fuse/v2/fs"
-	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/yourusername/forkspoon/pkg/forkspoon"
 )
 
-const (
-	// Default cache metadata TTL
-	DEFAULT_CACHE_TTL = 30 * time.Second // Changed to 30s for easier testing
-)
-
-// CacheMetrics tracks cache hit/miss statistics
-type CacheMetrics struct {
-	GetattrHits    uint64
-	GetattrMisses  uint64
-	LookupHits     uint64
-	LookupMisses   uint64
-	ReaddirHits    uint64
-	ReaddirMisses  uint64
-
-	// Passthrough operations (never cached)
-	OpenOps        uint64
-	CreateOps      uint64
-	WriteOps       uint64
-	ReadOps        uint64
-	UnlinkOps      uint64
-	RenameOps      uint64
-	MkdirOps       uint64
-	RmdirOps       uint64
-
-	mu sync.RWMutex
-	startTime time.Time
-}
-
-// DirCacheEntry holds cached directory entries
-type DirCacheEntry struct {
-	entries []fuse.DirEntry
-	expiry  time.Time
-}
-
-// DirCache is our in-memory directory cache
-type DirCache struct {
-	mu      sync.RWMutex
-	entries map[string]*DirCacheEntry
-}
-
-// LookupCacheEntry holds cached lookup results
-type LookupCacheEntry struct {
-	inode  *fs.Inode
-	entry  fuse.EntryOut
-	expiry time.Time
-}
-
-// LookupCache caches LOOKUP operations
-type LookupCache struct {
-	mu      sync.RWMutex
-	entries map[string]*LookupCacheEntry
-}
-
-// AttrCacheEntry holds cached getattr results
-type AttrCacheEntry struct {
-	attr   fuse.AttrOut
-	expiry time.Time
-}
-
-// AttrCache caches GETATTR operations
-type AttrCache struct {
-	mu      sync.RWMutex
-	entries map[string]*AttrCacheEntry
-}
-
-// Global configuration and metrics
+// Global configuration and logs. Caches and metrics belong to each mount
+// (see pkg/forkspoon).
 var (
-	cacheTTL     time.Duration
 	verbose      bool
-	metrics      = &CacheMetrics{startTime: time.Now()}
-	transLog     *os.File
-	transLogMu   sync.Mutex
+
+	transLog       *RotatingLogger
+	transLogFormat string
+	transLogMu     sync.Mutex
 	cacheLog     *RotatingLogger
-	dirCache     = &DirCache{entries: make(map[string]*DirCacheEntry)}
-	lookupCache  = &LookupCache{entries: make(map[string]*LookupCacheEntry)}
-	attrCache    = &AttrCache{entries: make(map[string]*AttrCacheEntry)}
+	audit        *auditLog
 )
 
-// Get retrieves cached directory entries if not expired
-func (dc *DirCache) Get(path string) ([]fuse.DirEntry, bool) {
-	dc.mu.RLock()
-	defer dc.mu.RUnlock()
-
-	entry, exists := dc.entries[path]
-	if !exists {
-		return nil, false
-	}
-
-	if time.Now().After(entry.expiry) {
-		// Expired, remove it
-		go dc.Remove(path)
-		return nil, false
-	}
-
-	return entry.entries, true
-}
-
-// Put stores directory entries in cache
-func (dc *DirCache) Put(path string, entries []fuse.DirEntry, ttl time.Duration) {
-	dc.mu.Lock()
-	defer dc.mu.Unlock()
-
-	dc.entries[path] = &DirCacheEntry{
-		entries: entries,
-		expiry:  time.Now().Add(ttl),
-	}
-}
-
-// Remove deletes a cache entry
-func (dc *DirCache) Remove(path string) {
-	dc.mu.Lock()
-	defer dc.mu.Unlock()
-	delete(dc.entries, path)
-}
-
-// Get retrieves cached lookup result
-func (lc *LookupCache) Get(key string) (*LookupCacheEntry, bool) {
-	lc.mu.RLock()
-	defer lc.mu.RUnlock()
-
-	entry, exists := lc.entries[key]
-	if !exists {
-		return nil, false
-	}
-
-	if time.Now().After(entry.expiry) {
-		go lc.Remove(key)
-		return nil, false
-	}
-
-	return entry, true
-}
-
-// Put stores lookup result in cache
-func (lc *LookupCache) Put(key string, inode *fs.Inode, entry fuse.EntryOut, ttl time.Duration) {
-	lc.mu.Lock()
-	defer lc.mu.Unlock()
-
-	lc.entries[key] = &LookupCacheEntry{
-		inode:  inode,
-		entry:  entry,
-		expiry: time.Now().Add(ttl),
-	}
-}
-
-// Remove deletes a lookup cache entry
-func (lc *LookupCache) Remove(key string) {
-	lc.mu.Lock()
-	defer lc.mu.Unlock()
-	delete(lc.entries, key)
-}
-
-// Get retrieves cached attr result
-func (ac *AttrCache) Get(path string) (*fuse.AttrOut, bool) {
-	ac.mu.RLock()
-	defer ac.mu.RUnlock()
-
-	entry, exists := ac.entries[path]
-	if !exists {
-		return nil, false
-	}
-
-	if time.Now().After(entry.expiry) {
-		go ac.Remove(path)
-		return nil, false
-	}
-
-	return &entry.attr, true
-}
-
-// Put stores attr result in cache
-func (ac *AttrCache) Put(path string, attr fuse.AttrOut, ttl time.Duration) {
-	ac.mu.Lock()
-	defer ac.mu.Unlock()
-
-	ac.entries[path] = &AttrCacheEntry{
-		attr:   attr,
-		expiry: time.Now().Add(ttl),
-	}
-}
-
-// Remove deletes an attr cache entry
-func (ac *AttrCache) Remove(path string) {
-	ac.mu.Lock()
-	defer ac.mu.Unlock()
-	delete(ac.entries, path)
-}
-
-// logTransaction logs cache hits/misses and passthrough operations
-func logTransaction(op string, path string, cached bool) {
-	timestamp := time.Now().Format("2006-01-02 15:04:05.000")
-
-	// Determine cache status
-	cacheStatus := "PASSTHROUGH"
-	if op == "GETATTR" || op == "LOOKUP" || op == "READDIR" {
-		if cached {
-			cacheStatus = "CACHE_HIT"
-		} else {
-			cacheStatus = "CACHE_MISS"
-		}
-	}
-
-	// Log to rotating cache log
-	if cacheLog != nil && (op == "GETATTR" || op == "LOOKUP" || op == "READDIR") {
-		cacheLog.Write("%s | %-10s | %-12s | %s", timestamp, op, cacheStatus, path)
-	}
-
-	// Log everything to transaction log if enabled
-	if transLog != nil {
-		transLogMu.Lock()
-		defer transLogMu.Unlock()
-		fmt.Fprintf(transLog, "%s | %-10s | %-12s | %s\n", timestamp, op, cacheStatus, path)
-	}
-}
-
-// updateMetrics updates the cache metrics
-func updateMetrics(op string, hit bool) {
-	switch op {
-	case "GETATTR":
-		if hit {
-			atomic.AddUint64(&metrics.GetattrHits, 1)
-		} else {
-			atomic.AddUint64(&metrics.GetattrMisses, 1)
-		}
-	case "LOOKUP":
-		if hit {
-			atomic.AddUint64(&metrics.LookupHits, 1)
-		} else {
-			atomic.AddUint64(&metrics.LookupMisses, 1)
-		}
-	case "READDIR":
-		if hit {
-			atomic.AddUint64(&metrics.ReaddirHits, 1)
-		} else {
-			atomic.AddUint64(&metrics.ReaddirMisses, 1)
-		}
-	case "OPEN":
-		atomic.AddUint64(&metrics.OpenOps, 1)
-	case "CREATE":
-		atomic.AddUint64(&metrics.CreateOps, 1)
-	case "WRITE":
-		atomic.AddUint64(&metrics.WriteOps, 1)
-	case "READ":
-		atomic.AddUint64(&metrics.ReadOps, 1)
-	case "UNLINK":
-		atomic.AddUint64(&metrics.UnlinkOps, 1)
-	case "RENAME":
-		atomic.AddUint64(&metrics.RenameOps, 1)
-	case "MKDIR":
-		atomic.AddUint64(&metrics.MkdirOps, 1)
-	case "RMDIR":
-		atomic.AddUint64(&metrics.RmdirOps, 1)
-	}
-}
-
 // getHitRate calculates hit rate for an operation
 func getHitRate(hits, misses uint64) float64 {
 	total := hits + misses
@@ -281,15 +34,37 @@ func getHitRate(hits, misses uint64) float64 {
 	return float64(hits) * 100 / float64(total)
 }
 
-// PrintStatistics prints cache statistics
+// totalMetrics sums the metrics of mounts
+func totalMetrics(mounts []*mount) *forkspoon.CacheMetrics {
+	total := &forkspoon.CacheMetrics{StartTime: processStart}
+	for _, m := range mounts {
+		total.Add(m.Metrics().Snapshot())
+	}
+	return total
+}
+
+// PrintStatistics prints cache statistics, summed over all mounts and then
+// per mount when there are several
 func PrintStatistics() {
-	metrics.mu.RLock()
-	defer metrics.mu.RUnlock()
+	mounts := registry.reported()
+	metrics := totalMetrics(mounts)
 
-	elapsed := time.Since(metrics.startTime)
+	elapsed := time.Since(metrics.StartTime)
 
 	fmt.Println("\n=== Cache Statistics ===")
 	fmt.Printf("Uptime: %v\n", elapsed.Round(time.Second))
+	fmt.Printf("Cache memory: %s", ByteSize(cacheBudget.Used()))
+	if limit := cacheBudget.Limit(); limit > 0 {
+		fmt.Printf(" of %s, %d entries evicted", ByteSize(limit), metrics.Evictions)
+	}
+	fmt.Println()
+	if dataCache != nil {
+		fmt.Printf("Data cache: %s", ByteSize(dataCache.Used()))
+		if limit := dataCache.Limit(); limit > 0 {
+			fmt.Printf(" of %s, %d blocks evicted", ByteSize(limit), dataCache.Evictions())
+		}
+		fmt.Println()
+	}
 	fmt.Println("\nCached Operations (with hit rates):")
 	fmt.Printf("  GETATTR: %d hits, %d misses (%.1f%% hit rate)\n",
 		metrics.GetattrHits, metrics.GetattrMisses,
@@ -300,6 +75,18 @@ func PrintStatistics() {
 	fmt.Printf("  READDIR: %d hits, %d misses (%.1f%% hit rate)\n",
 		metrics.ReaddirHits, metrics.ReaddirMisses,
 		getHitRate(metrics.ReaddirHits, metrics.ReaddirMisses))
+	fmt.Printf("  Seeded from READDIR: %d entries\n", metrics.SeededEntries)
+	fmt.Printf("  Attributes in READDIRPLUS: %d entries\n", metrics.PlusEntries)
+	fmt.Printf("  Streamed (uncached) READDIR: %d listings\n", metrics.ReaddirStreamed)
+	fmt.Printf("  Inodes forgotten: %d, re-created from cache: %d\n", metrics.InodesForgotten, metrics.InodesRecreated)
+	if metrics.FilteredLookups > 0 || metrics.FilteredEntries > 0 {
+		fmt.Printf("  Filtered: %d lookups, %d directory entries\n", metrics.FilteredLookups, metrics.FilteredEntries)
+	}
+	if dataCache != nil {
+		fmt.Printf("  READ (data cache): %d hits, %d misses (%.1f%% hit rate), %s served from cache\n",
+			metrics.DataCacheHits, metrics.DataCacheMisses,
+			getHitRate(metrics.DataCacheHits, metrics.DataCacheMisses), ByteSize(metrics.DataCacheHitBytes))
+	}
 
 	fmt.Println("\nPassthrough Operations (never cached):")
 	fmt.Printf("  OPEN:    %d operations\n", metrics.OpenOps)
@@ -310,25 +97,101 @@ func PrintStatistics() {
 	fmt.Printf("  RENAME:  %d operations\n", metrics.RenameOps)
 	fmt.Printf("  MKDIR:   %d operations\n", metrics.MkdirOps)
 	fmt.Printf("  RMDIR:   %d operations\n", metrics.RmdirOps)
+	fmt.Printf("  SETATTR: %d operations\n", metrics.SetattrOps)
+	if metrics.WriteBackFlushes > 0 {
+		fmt.Printf("  Write-back: %d writes coalesced into %d backend writes\n", metrics.WritesCoalesced, metrics.WriteBackFlushes)
+	}
 
-	totalCached := metrics.GetattrHits + metrics.GetattrMisses +
-		metrics.LookupHits + metrics.LookupMisses +
-		metrics.ReaddirHits + metrics.ReaddirMisses
-	totalCacheHits := metrics.GetattrHits + metrics.LookupHits + metrics.ReaddirHits
+	totalCached, totalCacheHits := metrics.CacheTotals()
 
 	fmt.Printf("\nOverall Cache Hit Rate: %.1f%%\n",
 		getHitRate(totalCacheHits, totalCached-totalCacheHits))
+
+	if invalidationBus != nil {
+		fmt.Printf("\nInvalidation bus: %d events published, %d dropped, %d received, %d lost\n",
+			invalidationBus.Published(), invalidationBus.Dropped(), invalidationBus.Received(), invalidationBus.Lost())
+	}
+
+	if txLog != nil {
+		ls := txLog.stats()
+		fmt.Printf("\nLogging: %d records written, %d dropped (queue full), %d filtered, %d sampled out\n",
+			ls["written"], ls["dropped"], ls["filtered"], ls["sampled_out"])
+	}
+
+	if len(mounts) > 1 {
+		fmt.Println("\nPer Mount:")
+		for _, m := range mounts {
+			mm := m.Metrics().Snapshot()
+			cached, hits := mm.CacheTotals()
+			fmt.Printf("  %-12s %s -> %s: %d cached ops (%.1f%% hit rate), %s cache memory\n",
+				m.Name(), m.config.Backend, m.Mountpoint(), cached,
+				getHitRate(hits, cached-hits), ByteSize(m.MemoryUsed()))
+		}
+	}
 }
 
 // SaveStatisticsJSON saves statistics to JSON file
 func SaveStatisticsJSON(filename string) error {
-	metrics.mu.RLock()
-	defer metrics.mu.RUnlock()
+	data, err := json.MarshalIndent(statisticsMap(), "", "  ")
+	if err != nil {
+		return err
+	}
 
-	stats := map[string]interface{}{
-		"timestamp": time.Now().Format(time.RFC3339),
-		"uptime_seconds": time.Since(metrics.startTime).Seconds(),
-		"cache_ttl_seconds": cacheTTL.Seconds(),
+	return os.WriteFile(filename, data, 0644)
+}
+
+// statisticsMap collects the statistics in the layout of the JSON file: the
+// totals over all mounts at the top level, as before there were several,
+// and each mount's own under "mounts"
+func statisticsMap() map[string]interface{} {
+	mounts := registry.reported()
+
+	stats := operationStats(totalMetrics(mounts))
+	stats["timestamp"] = time.Now().Format(time.RFC3339)
+	if len(mounts) == 1 {
+		stats["cache_ttl_seconds"] = mounts[0].CacheOptions().TTL.Seconds()
+	}
+	stats["memory"] = map[string]interface{}{
+		"used_bytes": cacheBudget.Used(),
+		"limit_bytes": cacheBudget.Limit(),
+	}
+	if dataCache != nil {
+		stats["data_cache"] = map[string]interface{}{
+			"used_bytes": dataCache.Used(),
+			"limit_bytes": dataCache.Limit(),
+			"evictions": dataCache.Evictions(),
+		}
+	}
+	if invalidationBus != nil {
+		stats["invalidation"] = map[string]interface{}{
+			"published": invalidationBus.Published(),
+			"dropped": invalidationBus.Dropped(),
+			"received": invalidationBus.Received(),
+			"lost": invalidationBus.Lost(),
+		}
+	}
+	if txLog != nil {
+		stats["logging"] = txLog.stats()
+	}
+
+	perMount := make(map[string]interface{})
+	for _, m := range mounts {
+		ms := operationStats(m.Metrics().Snapshot())
+		ms["backend"] = m.config.Backend
+		ms["mountpoint"] = m.Mountpoint()
+		ms["mounted"] = m.Running()
+		ms["cache_ttl_seconds"] = m.CacheOptions().TTL.Seconds()
+		ms["memory_bytes"] = m.MemoryUsed()
+		perMount[m.Name()] = ms
+	}
+	stats["mounts"] = perMount
+	return stats
+}
+
+// operationStats lays out one set of counters
+func operationStats(metrics *forkspoon.CacheMetrics) map[string]interface{} {
+	return map[string]interface{}{
+		"uptime_seconds": time.Since(metrics.StartTime).Seconds(),
 		"cached_operations": map[string]interface{}{
 			"getattr": map[string]interface{}{
 				"hits": metrics.GetattrHits,
@@ -339,12 +202,29 @@ func SaveStatisticsJSON(filename string) error {
 				"hits": metrics.LookupHits,
 				"misses": metrics.LookupMisses,
 				"hit_rate": getHitRate(metrics.LookupHits, metrics.LookupMisses),
+				"inodes_forgotten": metrics.InodesForgotten,
+				"inodes_recreated": metrics.InodesRecreated,
 			},
 			"readdir": map[string]interface{}{
 				"hits": metrics.ReaddirHits,
 				"misses": metrics.ReaddirMisses,
 				"hit_rate": getHitRate(metrics.ReaddirHits, metrics.ReaddirMisses),
+				"seeded_entries": metrics.SeededEntries,
+				"plus_entries": metrics.PlusEntries,
+				"streamed": metrics.ReaddirStreamed,
+			},
+			"data": map[string]interface{}{
+				"hits": metrics.DataCacheHits,
+				"misses": metrics.DataCacheMisses,
+				"hit_rate": getHitRate(metrics.DataCacheHits, metrics.DataCacheMisses),
+				"hit_bytes": metrics.DataCacheHitBytes,
+				"miss_bytes": metrics.DataCacheMissBytes,
 			},
+			"evictions": metrics.Evictions,
+		},
+		"filtered": map[string]uint64{
+			"lookups": metrics.FilteredLookups,
+			"entries": metrics.FilteredEntries,
 		},
 		"passthrough_operations": map[string]uint64{
 			"open": metrics.OpenOps,
@@ -355,646 +235,72 @@ func SaveStatisticsJSON(filename string) error {
 			"rename": metrics.RenameOps,
 			"mkdir": metrics.MkdirOps,
 			"rmdir": metrics.RmdirOps,
+			"setattr": metrics.SetattrOps,
+		},
+		"write_back": map[string]uint64{
+			"coalesced": metrics.WritesCoalesced,
+			"flushes": metrics.WriteBackFlushes,
+		},
+		"invalidations": map[string]uint64{
+			"published": metrics.InvalidationsPublished,
+			"received": metrics.InvalidationsReceived,
 		},
 	}
-
-	data, err := json.MarshalIndent(stats, "", "  ")
-	if err != nil {
-		return err
-	}
-
-	return os.WriteFile(filename, data, 0644)
-}
-
-// loopbackNode is a filesystem node that passes through to an underlying path
-type loopbackNode struct {
-	fs.Inode
-}
-
-// rootNode is the root of the loopback filesystem
-type rootNode struct {
-	fs.Inode
-	rootPath string
-}
-
-// Path helpers
-func (r *rootNode) path() string {
-	return r.rootPath
-}
-
-func (n *loopbackNode) path() string {
-	path := n.Path(n.Root())
-	root := n.Root().Operations().(*rootNode)
-	return filepath.Join(root.rootPath, path)
-}
-
-// ============ METADATA OPERATIONS (CACHED) ============
-
-// Getattr for loopbackNode - NOW WITH CACHING!
-func (n *loopbackNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
-	p := n.path()
-
-	// Check cache first
-	if cached, hit := attrCache.Get(p); hit {
-		// Cache HIT!
-		updateMetrics("GETATTR", true)
-		logTransaction("GETATTR", p, true)
-
-		if verbose {
-			log.Printf("[GETATTR] CACHE HIT for: %s", p)
-		}
-
-		*out = *cached
-		return 0
-	}
-
-	// Cache MISS - do actual getattr
-	updateMetrics("GETATTR", false)
-	logTransaction("GETATTR", p, false)
-
-	if verbose {
-		log.Printf("[GETATTR] CACHE MISS for: %s", p)
-	}
-
-	var st syscall.Stat_t
-	err := syscall.Lstat(p, &st)
-	if err != nil {
-		return fs.ToErrno(err)
-	}
-	out.FromStat(&st)
-
-	// Set cache timeout - this enables kernel caching
-	out.SetTimeout(cacheTTL)
-
-	// Store in our cache
-	attrCache.Put(p, *out, cacheTTL)
-
-	if verbose {
-		log.Printf("[GETATTR] Cached attributes for: %s (TTL: %v)", p, cacheTTL)
-	}
-
-	return 0
-}
-
-// Getattr for rootNode - NOW WITH CACHING!
-func (r *rootNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
-	// Check cache first
-	if cached, hit := attrCache.Get(r.rootPath); hit {
-		// Cache HIT!
-		updateMetrics("GETATTR", true)
-		logTransaction("GETATTR", r.rootPath, true)
-
-		if verbose {
-			log.Printf("[GETATTR] CACHE HIT for root: %s", r.rootPath)
-		}
-
-		*out = *cached
-		return 0
-	}
-
-	// Cache MISS - do actual getattr
-	updateMetrics("GETATTR", false)
-	logTransaction("GETATTR", r.rootPath, false)
-
-	if verbose {
-		log.Printf("[GETATTR] CACHE MISS for root: %s", r.rootPath)
-	}
-
-	var st syscall.Stat_t
-	err := syscall.Lstat(r.rootPath, &st)
-	if err != nil {
-		return fs.ToErrno(err)
-	}
-	out.FromStat(&st)
-
-	out.SetTimeout(cacheTTL)
-
-	// Store in our cache
-	attrCache.Put(r.rootPath, *out, cacheTTL)
-
-	if verbose {
-		log.Printf("[GETATTR] Cached attributes for root (TTL: %v)", cacheTTL)
-	}
-
-	return 0
-}
-
-// Lookup for rootNode - NOW WITH CACHING!
-func (r *rootNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
-	p := filepath.Join(r.rootPath, name)
-	cacheKey := p
-
-	// Check cache first
-	if cached, hit := lookupCache.Get(cacheKey); hit {
-		// Cache HIT!
-		updateMetrics("LOOKUP", true)
-		logTransaction("LOOKUP", name, true)
-
-		if verbose {
-			log.Printf("[LOOKUP] CACHE HIT for: %s", name)
-		}
-
-		// Use cached attributes
-		*out = cached.entry
-		return cached.inode, 0
-	}
-
-	// Cache MISS - do actual lookup
-	updateMetrics("LOOKUP", false)
-	logTransaction("LOOKUP", name, false)
-
-	if verbose {
-		log.Printf("[LOOKUP] CACHE MISS for: %s", name)
-	}
-
-	var st syscall.Stat_t
-	err := syscall.Lstat(p, &st)
-	if err != nil {
-		return nil, fs.ToErrno(err)
-	}
-
-	out.FromStat(&st)
-
-	// Set cache timeouts - enables kernel caching
-	out.SetEntryTimeout(cacheTTL)
-	out.SetAttrTimeout(cacheTTL)
-
-	if verbose {
-		log.Printf("[LOOKUP] Caching entry for: %s (TTL: %v)", name, cacheTTL)
-	}
-
-	node := &loopbackNode{}
-	inode := r.NewInode(ctx, node, fs.StableAttr{Mode: st.Mode, Ino: st.Ino})
-
-	// Store in cache
-	lookupCache.Put(cacheKey, inode, *out, cacheTTL)
-
-	return inode, 0
-}
-
-// Lookup for loopbackNode - NOW WITH CACHING!
-func (n *loopbackNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
-	p := filepath.Join(n.path(), name)
-	cacheKey := p
-
-	// Check cache first
-	if cached, hit := lookupCache.Get(cacheKey); hit {
-		// Cache HIT!
-		updateMetrics("LOOKUP", true)
-		logTransaction("LOOKUP", p, true)
-
-		if verbose {
-			log.Printf("[LOOKUP] CACHE HIT for: %s/%s", n.path(), name)
-		}
-
-		// Use cached attributes
-		*out = cached.entry
-		return cached.inode, 0
-	}
-
-	// Cache MISS - do actual lookup
-	updateMetrics("LOOKUP", false)
-	logTransaction("LOOKUP", p, false)
-
-	if verbose {
-		log.Printf("[LOOKUP] CACHE MISS for: %s/%s", n.path(), name)
-	}
-
-	var st syscall.Stat_t
-	err := syscall.Lstat(p, &st)
-	if err != nil {
-		return nil, fs.ToErrno(err)
-	}
-
-	out.FromStat(&st)
-	out.SetEntryTimeout(cacheTTL)
-	out.SetAttrTimeout(cacheTTL)
-
-	if verbose {
-		log.Printf("[LOOKUP] Caching entry for: %s (TTL: %v)", name, cacheTTL)
-	}
-
-	node := &loopbackNode{}
-	inode := n.NewInode(ctx, node, fs.StableAttr{Mode: st.Mode, Ino: st.Ino})
-
-	// Store in cache
-	lookupCache.Put(cacheKey, inode, *out, cacheTTL)
-
-	return inode, 0
-}
-
-// CachedDirStream wraps directory entries for caching
-type CachedDirStream struct {
-	entries []fuse.DirEntry
-	index   int
-}
-
-func (s *CachedDirStream) HasNext() bool {
-	return s.index < len(s.entries)
-}
-
-func (s *CachedDirStream) Next() (fuse.DirEntry, syscall.Errno) {
-	if !s.HasNext() {
-		return fuse.DirEntry{}, syscall.ENOENT
-	}
-	entry := s.entries[s.index]
-	s.index++
-	return entry, 0
-}
-
-func (s *CachedDirStream) Close() {}
-
-// Readdir - NOW WITH ACTUAL CACHING!
-func (n *loopbackNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
-	dirPath := n.path()
-
-	// Check cache first
-	if cachedEntries, hit := dirCache.Get(dirPath); hit {
-		// Cache HIT!
-		updateMetrics("READDIR", true)
-		logTransaction("READDIR", dirPath, true)
-
-		if verbose {
-			log.Printf("[READDIR] CACHE HIT for: %s", dirPath)
-		}
-
-		// Return cached entries
-		return &CachedDirStream{entries: cachedEntries}, 0
-	}
-
-	// Cache MISS - read from filesystem
-	updateMetrics("READDIR", false)
-	logTransaction("READDIR", dirPath, false)
-
-	if verbose {
-		log.Printf("[READDIR] CACHE MISS for: %s", dirPath)
-	}
-
-	// Read directory entries
-	f, err := os.Open(dirPath)
-	if err != nil {
-		return nil, fs.ToErrno(err)
-	}
-	defer f.Close()
-
-	entries, err := f.Readdir(-1)
-	if err != nil {
-		return nil, fs.ToErrno(err)
-	}
-
-	// Convert to fuse.DirEntry and cache
-	fuseEntries := make([]fuse.DirEntry, 0, len(entries))
-	for _, e := range entries {
-		var stat syscall.Stat_t
-		if err := syscall.Lstat(filepath.Join(dirPath, e.Name()), &stat); err == nil {
-			fuseEntries = append(fuseEntries, fuse.DirEntry{
-				Name: e.Name(),
-				Mode: uint32(stat.Mode),
-				Ino:  stat.Ino,
-			})
-		}
-	}
-
-	// Store in cache
-	dirCache.Put(dirPath, fuseEntries, cacheTTL)
-
-	if verbose {
-		log.Printf("[READDIR] Cached %d entries for: %s (TTL: %v)", len(fuseEntries), dirPath, cacheTTL)
-	}
-
-	return &CachedDirStream{entries: fuseEntries}, 0
-}
-
-// ============ DATA OPERATIONS (PASSTHROUGH - NEVER CACHED) ============
-
-// Open - PASSTHROUGH
-func (n *loopbackNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
-	p := n.path()
-
-	updateMetrics("OPEN", false)
-	logTransaction("OPEN", p, false)
-
-	if verbose {
-		log.Printf("[OPEN] File: %s with flags: %d", p, flags)
-	}
-
-	f, err := syscall.Open(p, int(flags), 0)
-	if err != nil {
-		return nil, 0, fs.ToErrno(err)
-	}
-
-	return &loopbackFile{fd: f, path: p}, 0, 0
-}
-
-// Create for rootNode - PASSTHROUGH
-func (r *rootNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
-	p := filepath.Join(r.rootPath, name)
-
-	updateMetrics("CREATE", false)
-	logTransaction("CREATE", p, false)
-
-	if verbose {
-		log.Printf("[CREATE] File: %s", p)
-	}
-
-	fd, err := syscall.Open(p, int(flags)|os.O_CREATE, mode)
-	if err != nil {
-		return nil, nil, 0, fs.ToErrno(err)
-	}
-
-	var st syscall.Stat_t
-	if err := syscall.Fstat(fd, &st); err != nil {
-		syscall.Close(fd)
-		return nil, nil, 0, fs.ToErrno(err)
-	}
-
-	out.FromStat(&st)
-	out.SetEntryTimeout(cacheTTL)
-	out.SetAttrTimeout(cacheTTL)
-
-	node := &loopbackNode{}
-	return r.NewInode(ctx, node, fs.StableAttr{Mode: st.Mode, Ino: st.Ino}),
-		&loopbackFile{fd: fd, path: p}, 0, 0
-}
-
-// Create for loopbackNode - PASSTHROUGH
-func (n *loopbackNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
-	p := filepath.Join(n.path(), name)
-
-	updateMetrics("CREATE", false)
-	logTransaction("CREATE", p, false)
-
-	if verbose {
-		log.Printf("[CREATE] File: %s/%s", n.path(), name)
-	}
-
-	fd, err := syscall.Open(p, int(flags)|os.O_CREATE, mode)
-	if err != nil {
-		return nil, nil, 0, fs.ToErrno(err)
-	}
-
-	var st syscall.Stat_t
-	if err := syscall.Fstat(fd, &st); err != nil {
-		syscall.Close(fd)
-		return nil, nil, 0, fs.ToErrno(err)
-	}
-
-	out.FromStat(&st)
-	out.SetEntryTimeout(cacheTTL)
-	out.SetAttrTimeout(cacheTTL)
-
-	node := &loopbackNode{}
-	return n.NewInode(ctx, node, fs.StableAttr{Mode: st.Mode, Ino: st.Ino}),
-		&loopbackFile{fd: fd, path: p}, 0, 0
-}
-
-// Mkdir for rootNode - PASSTHROUGH
-func (r *rootNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
-	p := filepath.Join(r.rootPath, name)
-
-	updateMetrics("MKDIR", false)
-	logTransaction("MKDIR", p, false)
-
-	if verbose {
-		log.Printf("[MKDIR] Directory: %s", p)
-	}
-
-	err := syscall.Mkdir(p, mode)
-	if err != nil {
-		return nil, fs.ToErrno(err)
-	}
-
-	var st syscall.Stat_t
-	if err := syscall.Lstat(p, &st); err != nil {
-		return nil, fs.ToErrno(err)
-	}
-
-	out.FromStat(&st)
-	out.SetEntryTimeout(cacheTTL)
-	out.SetAttrTimeout(cacheTTL)
-
-	node := &loopbackNode{}
-	return r.NewInode(ctx, node, fs.StableAttr{Mode: st.Mode, Ino: st.Ino}), 0
-}
-
-// Mkdir for loopbackNode - PASSTHROUGH
-func (n *loopbackNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
-	p := filepath.Join(n.path(), name)
-
-	updateMetrics("MKDIR", false)
-	logTransaction("MKDIR", p, false)
-
-	if verbose {
-		log.Printf("[MKDIR] Directory: %s/%s", n.path(), name)
-	}
-
-	err := syscall.Mkdir(p, mode)
-	if err != nil {
-		return nil, fs.ToErrno(err)
-	}
-
-	var st syscall.Stat_t
-	if err := syscall.Lstat(p, &st); err != nil {
-		return nil, fs.ToErrno(err)
-	}
-
-	out.FromStat(&st)
-	out.SetEntryTimeout(cacheTTL)
-	out.SetAttrTimeout(cacheTTL)
-
-	node := &loopbackNode{}
-	return n.NewInode(ctx, node, fs.StableAttr{Mode: st.Mode, Ino: st.Ino}), 0
-}
-
-// Unlink for rootNode - PASSTHROUGH
-func (r *rootNode) Unlink(ctx context.Context, name string) syscall.Errno {
-	p := filepath.Join(r.rootPath, name)
-
-	updateMetrics("UNLINK", false)
-	logTransaction("UNLINK", p, false)
-
-	if verbose {
-		log.Printf("[UNLINK] File: %s", p)
-	}
-
-	err := syscall.Unlink(p)
-	return fs.ToErrno(err)
-}
-
-// Unlink for loopbackNode - PASSTHROUGH
-func (n *loopbackNode) Unlink(ctx context.Context, name string) syscall.Errno {
-	p := filepath.Join(n.path(), name)
-
-	updateMetrics("UNLINK", false)
-	logTransaction("UNLINK", p, false)
-
-	if verbose {
-		log.Printf("[UNLINK] File: %s/%s", n.path(), name)
-	}
-
-	err := syscall.Unlink(p)
-	return fs.ToErrno(err)
-}
-
-// Rmdir for rootNode - PASSTHROUGH
-func (r *rootNode) Rmdir(ctx context.Context, name string) syscall.Errno {
-	p := filepath.Join(r.rootPath, name)
-
-	updateMetrics("RMDIR", false)
-	logTransaction("RMDIR", p, false)
-
-	if verbose {
-		log.Printf("[RMDIR] Directory: %s", p)
-	}
-
-	err := syscall.Rmdir(p)
-	return fs.ToErrno(err)
-}
-
-// Rmdir for loopbackNode - PASSTHROUGH
-func (n *loopbackNode) Rmdir(ctx context.Context, name string) syscall.Errno {
-	p := filepath.Join(n.path(), name)
-
-	updateMetrics("RMDIR", false)
-	logTransaction("RMDIR", p, false)
-
-	if verbose {
-		log.Printf("[RMDIR] Directory: %s/%s", n.path(), name)
-	}
-
-	err := syscall.Rmdir(p)
-	return fs.ToErrno(err)
-}
-
-// Rename for rootNode - PASSTHROUGH
-func (r *rootNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
-	oldPath := filepath.Join(r.rootPath, name)
-	newPath := ""
-
-	switch parent := newParent.(type) {
-	case *rootNode:
-		newPath = filepath.Join(parent.rootPath, newName)
-	case *loopbackNode:
-		newPath = filepath.Join(parent.path(), newName)
-	}
-
-	updateMetrics("RENAME", false)
-	logTransaction("RENAME", fmt.Sprintf("%s -> %s", oldPath, newPath), false)
-
-	if verbose {
-		log.Printf("[RENAME] From: %s To: %s", oldPath, newPath)
-	}
-
-	err := syscall.Rename(oldPath, newPath)
-	return fs.ToErrno(err)
 }
 
-// Rename for loopbackNode - PASSTHROUGH
-func (n *loopbackNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
-	oldPath := filepath.Join(n.path(), name)
-	newPath := ""
-
-	switch parent := newParent.(type) {
-	case *rootNode:
-		newPath = filepath.Join(parent.rootPath, newName)
-	case *loopbackNode:
-		newPath = filepath.Join(parent.path(), newName)
+func main() {
+	// Control client: forkspoon ctl [-socket path] <command>
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(runCtl(os.Args[2:]))
 	}
-
-	updateMetrics("RENAME", false)
-	logTransaction("RENAME", fmt.Sprintf("%s -> %s", oldPath, newPath), false)
-
-	if verbose {
-		log.Printf("[RENAME] From: %s To: %s", oldPath, newPath)
+	if len(os.Args) > 1 && os.Args[1] == "verify-audit" {
+		os.Exit(runVerifyAudit(os.Args[2:]))
 	}
 
-	err := syscall.Rename(oldPath, newPath)
-	return fs.ToErrno(err)
-}
-
-// loopbackFile represents an open file
-type loopbackFile struct {
-	fd   int
-	path string
-}
-
-// Read - PASSTHROUGH
-func (f *loopbackFile) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
-	updateMetrics("READ", false)
-	logTransaction("READ", f.path, false)
-
-	n, err := syscall.Pread(f.fd, dest, off)
+	// Command-line flags, layered over the -config file if there is one
+	cfg, err := parseConfig(os.Args[1:], flag.ExitOnError)
 	if err != nil {
-		return nil, fs.ToErrno(err)
-	}
-	return fuse.ReadResultData(dest[:n]), 0
-}
-
-// Write - PASSTHROUGH
-func (f *loopbackFile) Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno) {
-	updateMetrics("WRITE", false)
-	logTransaction("WRITE", f.path, false)
-
-	n, err := syscall.Pwrite(f.fd, data, off)
-	return uint32(n), fs.ToErrno(err)
-}
-
-// Release closes the file
-func (f *loopbackFile) Release(ctx context.Context) syscall.Errno {
-	err := syscall.Close(f.fd)
-	return fs.ToErrno(err)
-}
-
-// Opendir - Required for directory operations
-func (n *loopbackNode) Opendir(ctx context.Context) syscall.Errno {
-	if verbose {
-		log.Printf("[OPENDIR] Directory: %s", n.path())
+		log.Fatalf("Configuration error: %v", err)
 	}
-	return 0
-}
-
-func main() {
-	// Command-line flags
-	backendPtr := flag.String("backend", "", "Path to the backend directory (required)")
-	mountpointPtr := flag.String("mountpoint", "", "Path to the mount point directory (required)")
-	verbosePtr := flag.Bool("verbose", false, "Enable verbose logging")
-	debugPtr := flag.Bool("debug", false, "Enable FUSE debug logging")
-	cacheTTLPtr := flag.Duration("cache-ttl", DEFAULT_CACHE_TTL, "Cache TTL duration (e.g., 5m, 30s)")
-	allowOtherPtr := flag.Bool("allow-other", false, "Allow other users to access the mount")
-	transLogPtr := flag.String("trans-log", "", "Transaction log file path")
-	statsFilePtr := flag.String("stats-file", "", "Save statistics to JSON file on exit")
-
-	flag.Parse()
-
-	// Set global configuration
-	cacheTTL = *cacheTTLPtr
-	verbose = *verbosePtr
 
 	// Validate required flags
-	if *backendPtr == "" || *mountpointPtr == "" {
+	if len(cfg.mountConfigs()) == 0 {
 		fmt.Fprintf(os.Stderr, "Usage: %s -backend <dir> -mountpoint <dir> [options]\n", os.Args[0])
-		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "       %s -config <file> [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s ctl [-socket <path>] <command>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s verify-audit <file>...\n", os.Args[0])
+		newFlagSet(defaultConfig(), flag.ContinueOnError).PrintDefaults()
 		os.Exit(1)
 	}
-
-	// Check backend
-	backendInfo, err := os.Stat(*backendPtr)
-	if err != nil {
-		log.Fatalf("Backend directory error: %v", err)
+	if err := cfg.validate(); err != nil {
+		log.Fatalf("Configuration error: %v", err)
 	}
-	if !backendInfo.IsDir() {
-		log.Fatalf("Backend path is not a directory: %s", *backendPtr)
+
+	// Set global configuration
+	verbose = cfg.Verbose
+	cacheTTL := time.Duration(cfg.Cache.TTL)
+	cacheBudget.SetLimit(int64(cfg.Cache.MemoryLimit))
+
+	// In -daemon mode the parent stops here, once the child is ready
+	if cfg.Service.Daemon {
+		daemonize(cfg.Service.DaemonLog)
 	}
 
-	// Create/check mountpoint
-	if err := os.MkdirAll(*mountpointPtr, 0755); err != nil {
-		log.Fatalf("Failed to create mountpoint: %v", err)
+	// Opening the data cache indexes the whole directory: only the process
+	// that serves the mounts does it
+	if dc := cfg.Cache.DataCache; dc.Dir != "" {
+		dataCache, err = forkspoon.NewDataCache(dc.Dir, int64(dc.Size))
+		if err != nil {
+			log.Fatalf("Failed to open data cache: %v", err)
+		}
 	}
 
 	// Initialize rotating cache log
 	// Use home directory if /opt/forkspoon is not writable
 	logPath := "/opt/forkspoon/forkspoon.log"
-	if _, err := os.Stat("/opt/forkspoon"); os.IsNotExist(err) {
+	if cfg.Logging.CacheLog != "" {
+		logPath = cfg.Logging.CacheLog
+	} else if _, err := os.Stat("/opt/forkspoon"); os.IsNotExist(err) {
 		// Try to create the directory
 		if err := os.MkdirAll("/opt/forkspoon", 0755); err != nil {
 			// Fall back to home directory
@@ -1003,71 +309,97 @@ func main() {
 			log.Printf("Using fallback log location: %s", logPath)
 		}
 	}
-	cacheLog, err = NewRotatingLogger(logPath)
+	rotation := cfg.Logging.Rotation.options()
+	cacheLog, err = NewRotatingLogger(logPath, rotation)
 	if err != nil {
 		log.Printf("Warning: Failed to create rotating cache log: %v", err)
 		// Continue without rotating log
 	} else {
 		defer cacheLog.Close()
-		cacheLog.WriteHeader(*backendPtr, *mountpointPtr, cacheTTL)
 	}
 
 	// Open transaction log if requested
-	if *transLogPtr != "" {
-		var err error
-		transLog, err = os.OpenFile(*transLogPtr, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-		if err != nil {
+	if cfg.Logging.TransLog != "" {
+		if err := reopenTransLog(cfg.Logging.TransLog, cfg.Logging.TransLogFormat, rotation); err != nil {
 			log.Fatalf("Failed to open transaction log: %v", err)
 		}
-		defer transLog.Close()
+		defer closeTransLog()
 
-		// Write header
-		fmt.Fprintln(transLog, "=== FUSE Cache Transaction Log ===")
-		fmt.Fprintf(transLog, "Started: %s\n", time.Now().Format(time.RFC3339))
-		fmt.Fprintf(transLog, "Backend: %s\n", *backendPtr)
-		fmt.Fprintf(transLog, "Mount: %s\n", *mountpointPtr)
-		fmt.Fprintf(transLog, "Cache TTL: %v\n", cacheTTL)
-		fmt.Fprintln(transLog, "==========================================")
-		fmt.Fprintln(transLog, "Timestamp              | Operation  | Status       | Path")
-		fmt.Fprintln(transLog, "---------------------- | ---------- | ------------ | ----")
+		// Write header (JSON lines have none, each line stands alone)
+		if transLogFormat == TRANS_LOG_TEXT {
+			header := fmt.Sprintf("=== FUSE Cache Transaction Log ===\nStarted: %s\n", time.Now().Format(time.RFC3339))
+			for _, mc := range cfg.mountConfigs() {
+				header += fmt.Sprintf("Backend: %s\nMount: %s\n", mc.Backend, mc.Mountpoint)
+			}
+			header += fmt.Sprintf("Cache TTL: %v\n", cacheTTL)
+			header += "==========================================\n"
+			header += "Timestamp              | Operation  | Status       | Path\n"
+			header += "---------------------- | ---------- | ------------ | ----\n"
+			transLog.WriteBytes([]byte(header))
+		}
 	}
 
-	// Create root node
-	root := &rootNode{
-		rootPath: *backendPtr,
+	// The audit log is written by the request handlers themselves
+	if cfg.Logging.AuditLog != "" {
+		audit, err = openAuditLog(cfg.Logging.AuditLog, cfg.Logging.AuditChain)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		defer audit.Close()
 	}
 
-	// Mount options - CRITICAL: Set non-zero defaults to enable caching
-	opts := &fs.Options{
-		// These are the DEFAULT timeouts. Individual operations can override them.
-		// Setting these to non-zero enables kernel caching!
-		AttrTimeout:     &cacheTTL,
-		EntryTimeout:    &cacheTTL,
-		NegativeTimeout: &cacheTTL,
+	// Log records are written in the background; whatever is still queued
+	// goes out before the logs are closed
+	txLog = newLogPipeline(cfg.Logging.QueueSize, newLogFilter(cfg.Logging))
+	defer txLog.flush()
 
-		MountOptions: fuse.MountOptions{
-			AllowOther: *allowOtherPtr,
-			FsName:     "forkspoon-cache",
-			Debug:      *debugPtr,
-		},
+	// Join the invalidation bus before anything is cached
+	if inv := cfg.Cache.Invalidation; inv.Transport != "" {
+		transport, err := inv.newTransport()
+		if err != nil {
+			log.Fatalf("Failed to join invalidation bus: %v", err)
+		}
+		invalidationBus = forkspoon.NewInvalidationBus(transport)
+		defer invalidationBus.Close()
+	}
+
+	// SIGINT/SIGTERM unmount cleanly, which ends the wait below and runs
+	// the cleanup; SIGHUP reloads, SIGUSR1 dumps statistics
+	lc := newLifecycle(cfg, os.Args[1:])
+	lc.handleSignals()
+
+	// Mount everything, clearing mounts left behind by a crash. Startup
+	// fails as a whole if any mount does.
+	registry.hold()
+	for _, mc := range cfg.mountConfigs() {
+		if _, err := startMount(mc, cfg, true); err != nil {
+			log.Printf("Startup failed: mount %s: %v", mc.Name, err)
+			reportDaemonReady(err)
+			lc.shutdown()
+			os.Exit(1)
+		}
 	}
+	registry.release()
 
-	// Mount filesystem
-	server, err := fs.Mount(*mountpointPtr, root, opts)
-	if err != nil {
-		log.Fatalf("Mount failed: %v", err)
+	// Control socket: reload, stats, config and mounts on demand
+	if cfg.Service.ControlSocket != "" {
+		ctl, err := startControlServer(cfg.Service.ControlSocket, lc)
+		if err != nil {
+			log.Printf("Warning: Control socket disabled: %v", err)
+		} else {
+			defer ctl.Close()
+		}
 	}
 
 	// Setup cleanup
 	defer func() {
-		server.Unmount()
 		PrintStatistics()
 
-		if *statsFilePtr != "" {
-			if err := SaveStatisticsJSON(*statsFilePtr); err != nil {
+		if statsFile := lc.config().Metrics.StatsFile; statsFile != "" {
+			if err := SaveStatisticsJSON(statsFile); err != nil {
 				log.Printf("Failed to save statistics: %v", err)
 			} else {
-				log.Printf("Statistics saved to: %s", *statsFilePtr)
+				log.Printf("Statistics saved to: %s", statsFile)
 			}
 		}
 	}()
@@ -1076,41 +408,86 @@ func main() {
 	log.Println("Forkspoon Caching FUSE Filesystem v2.0")
 	log.Printf("Built: %s", time.Now().Format("2006-01-02 15:04:05"))
 	log.Println("==========================================")
-	log.Printf("Backend:     %s", *backendPtr)
-	log.Printf("Mount:       %s", *mountpointPtr)
+	for _, m := range registry.list() {
+		log.Printf("Mount %-7s %s -> %s (TTL %v)", m.Name()+":", m.config.Backend, m.Mountpoint(), m.CacheOptions().TTL)
+	}
 	log.Printf("Cache TTL:   %v", cacheTTL)
+	if cfg.ReadOnly {
+		log.Println("Read-only:   all changes are rejected with EROFS")
+	}
+	if cfg.IDMap.idMap() != nil {
+		log.Printf("ID Map:      uids %q, gids %q, squash %q", cfg.IDMap.UIDs, cfg.IDMap.GIDs, cfg.IDMap.Squash)
+	}
+	if cfg.Filter.pathFilter() != nil {
+		log.Printf("Filter:      include %q, exclude %q", cfg.Filter.Include, cfg.Filter.Exclude)
+	}
+	if len(cfg.Cache.Policies) > 0 {
+		log.Printf("TTL Policies: %d paths", len(cfg.Cache.Policies))
+	}
+	if cfg.Cache.MemoryLimit > 0 {
+		log.Printf("Cache Limit: %s (shared by all mounts)", cfg.Cache.MemoryLimit)
+	}
+	if cfg.File != "" {
+		log.Printf("Config:      %s", cfg.File)
+	}
 	log.Printf("Cache Log:   %s", logPath)
-	if *transLogPtr != "" {
-		log.Printf("Trans Log:   %s", *transLogPtr)
+	if cfg.Logging.TransLog != "" {
+		log.Printf("Trans Log:   %s", cfg.Logging.TransLog)
+	}
+	if cfg.Logging.AuditLog != "" {
+		log.Printf("Audit Log:   %s (chained: %v)", cfg.Logging.AuditLog, cfg.Logging.AuditChain)
 	}
 	log.Println("==========================================")
 	log.Println("Caching Strategy:")
 	log.Println("  • LOOKUP: In-memory cache (fixes wildcard issue!)")
 	log.Println("  • GETATTR: In-memory cache")
-	log.Println("  • READDIR: In-memory cache")
+	log.Println("  • READDIR: In-memory cache (seeds LOOKUP/GETATTR)")
 	log.Println("  • All cache hits/misses are logged!")
 	log.Println("==========================================")
 
 	// Start metrics reporter
 	go func() {
-		ticker := time.NewTicker(10 * time.Second)
-		defer ticker.Stop()
-		for range ticker.C {
-			totalHits := metrics.GetattrHits + metrics.LookupHits + metrics.ReaddirHits
-			totalMisses := metrics.GetattrMisses + metrics.LookupMisses + metrics.ReaddirMisses
-			total := totalHits + totalMisses
-
-			if total > 0 {
-				hitRate := float64(totalHits) * 100 / float64(total)
-				log.Printf("Cache Stats: %d ops (%.1f%% hit rate) | Hits: %d | Misses: %d | READDIR H:%d/M:%d",
-					total, hitRate, totalHits, totalMisses,
-					metrics.ReaddirHits, metrics.ReaddirMisses)
+		for {
+			interval := time.Duration(lc.config().Metrics.ReportInterval)
+			if interval <= 0 {
+				// Disabled; look again later in case a reload turns it on
+				time.Sleep(DEFAULT_REPORT_INTERVAL)
+				continue
+			}
+			time.Sleep(interval)
+
+			mounts := registry.list()
+			for _, m := range mounts {
+				metrics := m.Metrics().Snapshot()
+				total, totalHits := metrics.CacheTotals()
+				if total > 0 {
+					hitRate := float64(totalHits) * 100 / float64(total)
+					log.Printf("Cache Stats [%s]: %d ops (%.1f%% hit rate) | Hits: %d | Misses: %d | READDIR H:%d/M:%d | Mem: %s",
+						m.Name(), total, hitRate, totalHits, total-totalHits,
+						metrics.ReaddirHits, metrics.ReaddirMisses, ByteSize(m.MemoryUsed()))
+				}
+			}
+			if total, totalHits := totalMetrics(mounts).CacheTotals(); total > 0 {
+				notifyStatus("Serving %d mounts: %d ops, %.1f%% cache hit rate", len(mounts), total, float64(totalHits)*100/float64(total))
 			}
 		}
 	}()
 
-	log.Println("Press Ctrl+C to unmount and see statistics")
+	if cfg.Service.Pidfile != "" {
+		if err := writePidfile(cfg.Service.Pidfile); err != nil {
+			log.Printf("Warning: Failed to write pidfile: %v", err)
+		} else {
+			defer os.Remove(cfg.Service.Pidfile)
+		}
+	}
+	if err := sdNotify(fmt.Sprintf("READY=1\nMAINPID=%d\nSTATUS=Serving %d mounts", os.Getpid(), len(registry.list()))); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	reportDaemonReady(nil)
+	startWatchdog()
+
+	log.Println("Press Ctrl+C to unmount and see statistics (SIGUSR1 dumps them while running)")
 
-	// Wait for unmount
-	server.Wait()
+	// Wait until the last mount is gone
+	<-registry.done()
 }
\ No newline at end of file
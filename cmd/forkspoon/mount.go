@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yourusername/forkspoon/pkg/forkspoon"
+)
+
+const (
+	// Name of the mount given by the top-level backend/mountpoint settings
+	DEFAULT_MOUNT_NAME = "default"
+)
+
+// Mount names label metrics and are typed on the ctl command line
+var mountNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// processStart is when the daemon started, for the overall uptime
+var processStart = time.Now()
+
+// cacheBudget is the cache memory limit shared by the daemon's mounts
+var cacheBudget = forkspoon.NewMemoryBudget(0)
+
+// dataCache is the local disk cache for file data shared by the daemon's
+// mounts, nil without -data-cache-dir
+var dataCache *forkspoon.DataCache
+
+// invalidationBus shares cache invalidations with other forkspoon instances,
+// nil without -invalidation
+var invalidationBus *forkspoon.InvalidationBus
+
+// mount is one backend directory served at one mountpoint. Every mount has
+// its own caches, TTL policy and metrics; they share the daemon's cache
+// memory budget, logs and control socket.
+type mount struct {
+	*forkspoon.Mount
+	config MountConfig
+
+	// Defined in the config file, as opposed to added over the control
+	// socket; reload only manages mounts from the config
+	fromConfig bool
+}
+
+// newMount builds the library mount for mc under cfg. Nothing is mounted
+// until start.
+func newMount(mc MountConfig, cfg *Config) (*mount, error) {
+	m := &mount{config: mc}
+	var auditLogger forkspoon.TransactionLogger
+	if audit != nil {
+		auditLogger = audit
+	}
+	fm, err := forkspoon.New(forkspoon.Config{
+		Name:               mc.Name,
+		BackendPath:        mc.Backend,
+		Mountpoint:         mc.Mountpoint,
+		Cache:              newCacheOptions(cfg, mc),
+		AllowOther:         cfg.AllowOther,
+		ReadOnly:           cfg.ReadOnly,
+		IDMap:              cfg.IDMap.idMap(),
+		Filter:             cfg.Filter.pathFilter(),
+		Debug:              cfg.Debug,
+		UnmountStale:       cfg.Service.UnmountStale,
+		AllowNonEmpty:      cfg.Service.AllowNonEmpty,
+		ReadyTimeout:       time.Duration(cfg.Service.ReadyTimeout),
+		CheckMountpoint:    m.checkMountpoint,
+		Budget:             cacheBudget,
+		DataCache:          dataCache,
+		Invalidation:       invalidationBus,
+		InvalidationExport: mc.Export,
+		TransactionLog:     txLog,
+		AuditLog:           auditLogger,
+		Verbose:            cfg.Verbose,
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.Mount = fm
+	return m, nil
+}
+
+// startMount mounts a backend and adds it to the registry
+func startMount(mc MountConfig, cfg *Config, fromConfig bool) (*mount, error) {
+	m, err := newMount(mc, cfg)
+	if err != nil {
+		return nil, err
+	}
+	m.fromConfig = fromConfig
+	if err := m.start(); err != nil {
+		return nil, err
+	}
+
+	ttl := m.CacheOptions().TTL
+	log.Printf("Mounted %s: %s on %s (cache TTL %v)", m.Name(), mc.Backend, m.Mountpoint(), ttl)
+	if cacheLog != nil {
+		cacheLog.WriteHeader(mc.Backend, m.Mountpoint(), ttl)
+	}
+	return m, nil
+}
+
+// start mounts m, waits until the mount answers and registers it. The mount
+// leaves the registry by itself once it is unmounted, from here or from
+// outside (fusermount -u).
+func (m *mount) start() error {
+	if err := m.Start(); err != nil {
+		return err
+	}
+	go func() {
+		<-m.Done()
+		registry.remove(m)
+	}()
+	if err := registry.add(m); err != nil {
+		if uerr := m.unmount(); uerr != nil {
+			log.Printf("%v", uerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// checkMountpoint keeps the resolved mountpoint from overlapping with the
+// running mounts
+func (m *mount) checkMountpoint(mountpoint string) error {
+	return registry.check(m.config.Name, m.config.Backend, mountpoint)
+}
+
+// unmount takes the mount down, waits until it has ended and unregisters
+// it, so that a mount of the same name can be started right away. On
+// failure (EBUSY...) the mount keeps running and stays registered.
+func (m *mount) unmount() error {
+	if err := m.Unmount(); err != nil {
+		return fmt.Errorf("unmount of %s failed: %v", m.Mountpoint(), err)
+	}
+	registry.remove(m)
+	return nil
+}
+
+// forceUnmount detaches the mount without waiting for it to become idle
+func (m *mount) forceUnmount() {
+	if err := m.ForceUnmount(); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// mountRegistry holds the running mounts by name
+type mountRegistry struct {
+	mu     sync.Mutex
+	mounts map[string]*mount
+
+	// The last mount of each name that has ended, kept for the statistics
+	ended map[string]*mount
+
+	// While held (startup, reload), running out of mounts doesn't end
+	// the daemon: a mount is being replaced
+	holds  int
+	empty  chan struct{}
+	closed bool
+}
+
+var registry = newMountRegistry()
+
+func newMountRegistry() *mountRegistry {
+	return &mountRegistry{
+		mounts: make(map[string]*mount),
+		ended:  make(map[string]*mount),
+		empty:  make(chan struct{}),
+	}
+}
+
+// check refuses a mount whose name is taken or whose mountpoint would
+// overlap with a running mount
+func (r *mountRegistry) check(name, backend, mountpoint string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.checkLocked(name, backend, mountpoint, nil)
+}
+
+func (r *mountRegistry) checkLocked(name, backend, mountpoint string, self *mount) error {
+	if other, ok := r.mounts[name]; ok && other != self {
+		return fmt.Errorf("a mount named %q is already running", name)
+	}
+	for _, other := range r.mounts {
+		if other == self {
+			continue
+		}
+		switch {
+		case forkspoon.IsWithin(mountpoint, other.Mountpoint()) || forkspoon.IsWithin(other.Mountpoint(), mountpoint):
+			return fmt.Errorf("mountpoint %s overlaps %s of mount %q", mountpoint, other.Mountpoint(), other.Name())
+		case forkspoon.IsWithin(mountpoint, other.config.Backend):
+			return fmt.Errorf("mountpoint %s is inside the backend of mount %q", mountpoint, other.Name())
+		case forkspoon.IsWithin(other.config.Backend, mountpoint):
+			return fmt.Errorf("mountpoint %s would hide the backend of mount %q", mountpoint, other.Name())
+		case forkspoon.IsWithin(backend, other.Mountpoint()):
+			return fmt.Errorf("backend %s is served by mount %q; use its backend directly", backend, other.Name())
+		}
+	}
+	return nil
+}
+
+// add registers a mounted mount
+func (r *mountRegistry) add(m *mount) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.checkLocked(m.Name(), m.config.Backend, m.Mountpoint(), m); err != nil {
+		return err
+	}
+	if !m.Running() {
+		return fmt.Errorf("mount %q ended while starting", m.Name())
+	}
+	r.mounts[m.Name()] = m
+	delete(r.ended, m.Name())
+	return nil
+}
+
+// remove unregisters a mount that has ended. When it was the last one the
+// daemon's work is done.
+func (r *mountRegistry) remove(m *mount) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mounts[m.Name()] != m {
+		return
+	}
+	delete(r.mounts, m.Name())
+	r.ended[m.Name()] = m
+	r.signalLocked()
+}
+
+func (r *mountRegistry) signalLocked() {
+	if len(r.mounts) == 0 && r.holds == 0 && !r.closed {
+		r.closed = true
+		close(r.empty)
+	}
+}
+
+// hold keeps the daemon alive while mounts are being replaced
+func (r *mountRegistry) hold() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.holds++
+}
+
+func (r *mountRegistry) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.holds--
+	r.signalLocked()
+}
+
+// done is closed once the last mount has ended
+func (r *mountRegistry) done() <-chan struct{} {
+	return r.empty
+}
+
+// get returns the running mount called name
+func (r *mountRegistry) get(name string) (*mount, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.mounts[name]
+	return m, ok
+}
+
+// list returns the running mounts, sorted by name
+func (r *mountRegistry) list() []*mount {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return sortedMounts(r.mounts, nil)
+}
+
+// reported returns the mounts the statistics cover: the running ones, plus
+// those that have ended and not been replaced
+func (r *mountRegistry) reported() []*mount {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return sortedMounts(r.mounts, r.ended)
+}
+
+func sortedMounts(sets ...map[string]*mount) []*mount {
+	var mounts []*mount
+	seen := make(map[string]bool)
+	for _, set := range sets {
+		for name, m := range set {
+			if !seen[name] {
+				seen[name] = true
+				mounts = append(mounts, m)
+			}
+		}
+	}
+	sort.Slice(mounts, func(i, j int) bool { return mounts[i].Name() < mounts[j].Name() })
+	return mounts
+}
+
+// unmountByName takes down a running mount on request. The last mount
+// can't be removed this way: stop the daemon instead.
+func unmountByName(name string) error {
+	m, ok := registry.get(name)
+	if !ok {
+		return fmt.Errorf("no mount named %q", name)
+	}
+	if len(registry.list()) == 1 {
+		return fmt.Errorf("%q is the only mount; stop the daemon instead", name)
+	}
+	log.Printf("Unmounting %s (%s)", m.Name(), m.Mountpoint())
+	return m.unmount()
+}
+
+// reconcileMounts brings the mounts defined in the config in line with cfg:
+// removed ones are unmounted, new ones mounted, and ones whose backend or
+// mountpoint changed are remounted. Every mount picks up cfg's cache
+// settings. Mounts added over the control socket are otherwise left alone.
+func reconcileMounts(cfg *Config) error {
+	registry.hold()
+	defer registry.release()
+
+	wanted := make(map[string]MountConfig)
+	for _, mc := range cfg.mountConfigs() {
+		wanted[mc.Name] = mc
+	}
+
+	var errs []string
+	for _, m := range registry.list() {
+		mc, ok := wanted[m.Name()]
+		switch {
+		case !m.fromConfig:
+			m.SetCacheOptions(newCacheOptions(cfg, m.config))
+		case !ok:
+			log.Printf("Unmounting %s (%s): removed from the config", m.Name(), m.Mountpoint())
+			if err := m.unmount(); err != nil {
+				errs = append(errs, fmt.Sprintf("mount %q: %v", m.Name(), err))
+			}
+		case mc.Backend != m.config.Backend || mc.Mountpoint != m.config.Mountpoint || mc.Export != m.config.Export:
+			log.Printf("Remounting %s: now %s on %s", m.Name(), mc.Backend, mc.Mountpoint)
+			if err := m.unmount(); err != nil {
+				errs = append(errs, fmt.Sprintf("mount %q: not remounted: %v", m.Name(), err))
+			}
+		default:
+			m.SetCacheOptions(newCacheOptions(cfg, mc))
+		}
+	}
+
+	for _, mc := range cfg.mountConfigs() {
+		if m, ok := registry.get(mc.Name); ok {
+			if !m.fromConfig {
+				errs = append(errs, fmt.Sprintf("mount %q: name is taken by a mount added at runtime", mc.Name))
+			}
+			continue
+		}
+		if _, err := startMount(mc, cfg, true); err != nil {
+			errs = append(errs, fmt.Sprintf("mount %q: %v", mc.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// How long a shutdown waits for in-flight requests before unmounting
+	DEFAULT_SHUTDOWN_TIMEOUT = 10 * time.Second
+)
+
+// inflightRequests counts the FUSE requests the mounts are serving
+func inflightRequests() int64 {
+	var n int64
+	for _, m := range registry.list() {
+		n += m.InflightRequests()
+	}
+	return n
+}
+
+// reloadHooks run on SIGHUP, after the logs have been reopened
+var (
+	reloadHooks   []func() error
+	reloadHooksMu sync.Mutex
+)
+
+// onReload registers fn to run on SIGHUP
+func onReload(fn func() error) {
+	reloadHooksMu.Lock()
+	defer reloadHooksMu.Unlock()
+	reloadHooks = append(reloadHooks, fn)
+}
+
+// lifecycle drives the mounted filesystems from process signals:
+//
+//	SIGINT, SIGTERM  drain requests, unmount all; main then writes stats and exits
+//	SIGHUP           reload configuration and reopen log files
+//	SIGUSR1          dump statistics without exiting
+type lifecycle struct {
+	// Command line, applied again on top of the config file on reload
+	args []string
+
+	mu       sync.Mutex
+	cfg      *Config
+	reloadMu sync.Mutex
+
+	stopping chan struct{}
+	once     sync.Once
+}
+
+func newLifecycle(cfg *Config, args []string) *lifecycle {
+	return &lifecycle{
+		args:     args,
+		cfg:      cfg,
+		stopping: make(chan struct{}),
+	}
+}
+
+// config returns the configuration in effect. It is replaced, never
+// modified, by a reload.
+func (l *lifecycle) config() *Config {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cfg
+}
+
+// handleSignals installs the signal handlers and serves them until exit
+func (l *lifecycle) handleSignals() {
+	sigs := make(chan os.Signal, 4)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
+
+	go func() {
+		for sig := range sigs {
+			switch sig {
+			case syscall.SIGINT, syscall.SIGTERM:
+				select {
+				case <-l.stopping:
+					// Second signal while draining: stop waiting
+					log.Printf("Received %v again, unmounting immediately", sig)
+					l.forceUnmount()
+				default:
+					log.Printf("Received %v, shutting down", sig)
+					go l.shutdown()
+				}
+			case syscall.SIGHUP:
+				log.Printf("Received SIGHUP, reloading configuration and reopening logs")
+				l.reload()
+			case syscall.SIGUSR1:
+				l.dumpStatistics()
+			}
+		}
+	}()
+}
+
+// shutdown waits for in-flight requests (up to shutdownTimeout) and then
+// unmounts every mount, which makes main's wait for the registry return.
+func (l *lifecycle) shutdown() {
+	l.once.Do(func() {
+		close(l.stopping)
+		sdNotify("STOPPING=1\nSTATUS=Draining requests and unmounting")
+
+		timeout := time.Duration(l.config().Service.ShutdownTimeout)
+		deadline := time.Now().Add(timeout)
+		for inflightRequests() > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := inflightRequests(); n > 0 {
+			log.Printf("Shutdown timeout (%v) reached with %d requests in flight", timeout, n)
+		}
+
+		var wg sync.WaitGroup
+		for _, m := range registry.list() {
+			wg.Add(1)
+			go func(m *mount) {
+				defer wg.Done()
+				if err := m.unmount(); err != nil {
+					log.Printf("%v", err)
+				}
+			}(m)
+		}
+		wg.Wait()
+	})
+}
+
+// forceUnmount detaches all mounts without waiting for them to become idle
+func (l *lifecycle) forceUnmount() {
+	for _, m := range registry.list() {
+		m.forceUnmount()
+	}
+}
+
+// reload re-reads the config file, reopens the log files (for external
+// logrotate) and runs the registered reload hooks. A configuration error
+// leaves the running settings in place and is returned to the caller.
+func (l *lifecycle) reload() error {
+	l.reloadMu.Lock()
+	defer l.reloadMu.Unlock()
+
+	sdNotify("RELOADING=1")
+	defer sdNotify("READY=1")
+
+	err := l.reloadConfig()
+	if err != nil {
+		log.Printf("Configuration reload failed: %v", err)
+	}
+
+	if cacheLog != nil {
+		if err := cacheLog.Reopen(); err != nil {
+			log.Printf("Failed to reopen cache log: %v", err)
+		}
+	}
+	if path := l.config().Logging.TransLog; path != "" {
+		if err := reopenTransLog(path, l.config().Logging.TransLogFormat, l.config().Logging.Rotation.options()); err != nil {
+			log.Printf("Failed to reopen transaction log: %v", err)
+		}
+	} else {
+		closeTransLog()
+	}
+
+	reloadHooksMu.Lock()
+	hooks := append([]func() error(nil), reloadHooks...)
+	reloadHooksMu.Unlock()
+	for _, hook := range hooks {
+		if err := hook(); err != nil {
+			log.Printf("Reload failed: %v", err)
+		}
+	}
+	return err
+}
+
+// dumpStatistics prints the statistics and refreshes -stats-file
+func (l *lifecycle) dumpStatistics() {
+	PrintStatistics()
+	if statsFile := l.config().Metrics.StatsFile; statsFile != "" {
+		if err := SaveStatisticsJSON(statsFile); err != nil {
+			log.Printf("Failed to save statistics: %v", err)
+		} else {
+			log.Printf("Statistics saved to: %s", statsFile)
+		}
+	}
+}
+
+// reopenTransLog opens the transaction log at path, written in format and
+// rotated by opts from now on. If it is already open, the file is reopened,
+// which picks up a rename by an external logrotate.
+func reopenTransLog(path, format string, opts RotationOptions) error {
+	transLogMu.Lock()
+	defer transLogMu.Unlock()
+	if transLog != nil && transLog.path == path {
+		transLog.SetOptions(opts)
+		if err := transLog.Reopen(); err != nil {
+			return err
+		}
+		transLogFormat = format
+		return nil
+	}
+
+	l, err := NewRotatingLogger(path, opts)
+	if err != nil {
+		return fmt.Errorf("failed to open transaction log: %v", err)
+	}
+	if transLog != nil {
+		transLog.Close()
+	}
+	transLog = l
+	transLogFormat = format
+	return nil
+}
+
+// closeTransLog closes the transaction log
+func closeTransLog() {
+	transLogMu.Lock()
+	defer transLogMu.Unlock()
+	if transLog != nil {
+		transLog.Close()
+		transLog = nil
+	}
+}
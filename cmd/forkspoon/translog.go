@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/yourusername/forkspoon/pkg/forkspoon"
+)
+
+const (
+	// Records the log queue holds before new ones are dropped
+	DEFAULT_LOG_QUEUE_SIZE = 65536
+
+	// Most records the writer formats and writes at once
+	LOG_BATCH_SIZE = 1024
+)
+
+// Operations the log filters accept
+var logOps = []string{"GETATTR", "LOOKUP", "READDIR", "OPEN", "CREATE", "READ", "WRITE", "UNLINK", "RENAME", "MKDIR", "RMDIR", "SETATTR"}
+
+// txLog feeds the cache and transaction logs of every mount
+var txLog *logPipeline
+
+// logPipeline takes logging off the request path. Handlers only filter,
+// sample and enqueue; one writer goroutine formats the records and writes
+// them to the cache log and, one batch per write, to the transaction log.
+// When the writer can't keep up, records are dropped and counted instead of
+// slowing down the filesystem.
+type logPipeline struct {
+	queue    chan forkspoon.Transaction
+	flushReq chan chan struct{}
+	filter   atomic.Pointer[logFilter]
+	seq      atomic.Uint64
+
+	queued     atomic.Uint64
+	written    atomic.Uint64
+	dropped    atomic.Uint64
+	filtered   atomic.Uint64
+	sampledOut atomic.Uint64
+}
+
+// newLogPipeline starts a pipeline holding up to queueSize records
+func newLogPipeline(queueSize int, filter *logFilter) *logPipeline {
+	p := &logPipeline{
+		queue:    make(chan forkspoon.Transaction, queueSize),
+		flushReq: make(chan chan struct{}),
+	}
+	p.filter.Store(filter)
+	go p.run()
+	return p
+}
+
+// SetFilter switches to new filters and sampling
+func (p *logPipeline) SetFilter(f *logFilter) {
+	p.filter.Store(f)
+}
+
+// LogTransaction queues a record, unless it is filtered out, sampled out or
+// the queue is full. It never blocks.
+func (p *logPipeline) LogTransaction(t *forkspoon.Transaction) {
+	f := p.filter.Load()
+	if !f.match(t) {
+		p.filtered.Add(1)
+		return
+	}
+	if f.sample > 1 && p.seq.Add(1)%f.sample != 0 {
+		p.sampledOut.Add(1)
+		return
+	}
+	select {
+	case p.queue <- *t:
+		p.queued.Add(1)
+	default:
+		p.dropped.Add(1)
+	}
+}
+
+// run is the writer
+func (p *logPipeline) run() {
+	batch := make([]forkspoon.Transaction, 0, LOG_BATCH_SIZE)
+	for {
+		select {
+		case t := <-p.queue:
+			batch = append(batch[:0], t)
+			batch = p.take(batch)
+			p.write(batch)
+		case done := <-p.flushReq:
+			for len(p.queue) > 0 {
+				p.write(p.take(batch[:0]))
+			}
+			close(done)
+		}
+	}
+}
+
+// take adds records already waiting in the queue to batch, up to its
+// capacity
+func (p *logPipeline) take(batch []forkspoon.Transaction) []forkspoon.Transaction {
+	for len(batch) < cap(batch) {
+		select {
+		case t := <-p.queue:
+			batch = append(batch, t)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// flush waits until the records queued so far are written
+func (p *logPipeline) flush() {
+	done := make(chan struct{})
+	p.flushReq <- done
+	<-done
+}
+
+// write formats a batch and writes it out
+func (p *logPipeline) write(batch []forkspoon.Transaction) {
+	transLogMu.Lock()
+	haveTransLog, format := transLog != nil, transLogFormat
+	transLogMu.Unlock()
+
+	var buf bytes.Buffer
+	for i := range batch {
+		t := &batch[i]
+		timestamp := t.Time.Format("2006-01-02 15:04:05.000")
+		status := cacheStatus(t)
+
+		// Log to rotating cache log
+		if cacheLog != nil && (t.Op == "GETATTR" || t.Op == "LOOKUP" || t.Op == "READDIR") {
+			cacheLog.Write("%s | %-10s | %-12s | %s", timestamp, t.Op, status, t.Path)
+		}
+
+		if !haveTransLog {
+			continue
+		}
+		if format == TRANS_LOG_JSON {
+			// Only for the records kept, off the request path
+			if t.Process == "" && t.Pid != 0 {
+				t.Process = forkspoon.ProcessName(t.Pid)
+			}
+			line, err := json.Marshal(newTransactionRecord(t, status))
+			if err == nil {
+				buf.Write(line)
+				buf.WriteByte('\n')
+			}
+			continue
+		}
+		fmt.Fprintf(&buf, "%s | %-10s | %-12s | %s\n", timestamp, t.Op, status, t.Path)
+	}
+
+	if buf.Len() > 0 {
+		transLogMu.Lock()
+		if transLog != nil {
+			transLog.WriteBytes(buf.Bytes())
+		}
+		transLogMu.Unlock()
+	}
+	p.written.Add(uint64(len(batch)))
+}
+
+// stats returns the pipeline's counters
+func (p *logPipeline) stats() map[string]uint64 {
+	return map[string]uint64{
+		"queued":       p.queued.Load(),
+		"written":      p.written.Load(),
+		"dropped":      p.dropped.Load(),
+		"filtered":     p.filtered.Load(),
+		"sampled_out":  p.sampledOut.Load(),
+		"queue_length": uint64(len(p.queue)),
+	}
+}
+
+// cacheStatus classifies an operation for the logs
+func cacheStatus(t *forkspoon.Transaction) string {
+	if t.Op == "GETATTR" || t.Op == "LOOKUP" || t.Op == "READDIR" {
+		if t.Cached {
+			return "CACHE_HIT"
+		}
+		return "CACHE_MISS"
+	}
+	return "PASSTHROUGH"
+}
+
+// transactionRecord is a line of the JSON transaction log
+type transactionRecord struct {
+	Time       string `json:"time"`
+	Mount      string `json:"mount"`
+	Op         string `json:"op"`
+	Path       string `json:"path"`
+	Status     string `json:"status"`
+	Errno      int    `json:"errno"`
+	Error      string `json:"error,omitempty"`
+	DurationUs int64  `json:"duration_us"`
+	Pid        uint32 `json:"pid"`
+	Uid        uint32 `json:"uid"`
+	Gid        uint32 `json:"gid"`
+	Process    string `json:"process,omitempty"`
+
+	// Only for READ and WRITE
+	Offset *int64 `json:"offset,omitempty"`
+	Bytes  *int64 `json:"bytes,omitempty"`
+}
+
+func newTransactionRecord(t *forkspoon.Transaction, status string) *transactionRecord {
+	r := &transactionRecord{
+		Time:       t.Time.Format(time.RFC3339Nano),
+		Mount:      t.Mount,
+		Op:         t.Op,
+		Path:       t.Path,
+		Status:     status,
+		Errno:      int(t.Errno),
+		DurationUs: t.Duration.Microseconds(),
+		Pid:        t.Pid,
+		Uid:        t.Uid,
+		Gid:        t.Gid,
+		Process:    t.Process,
+	}
+	if t.Errno != 0 {
+		r.Error = t.Errno.Error()
+	}
+	if t.Op == "READ" || t.Op == "WRITE" {
+		r.Offset, r.Bytes = &t.Offset, &t.Bytes
+	}
+	return r
+}
+
+// logFilter decides which operations are logged
+type logFilter struct {
+	includeOps   map[string]bool
+	excludeOps   map[string]bool
+	includePaths []string
+	excludePaths []string
+
+	// Log one in sample of the operations that pass the filters
+	sample uint64
+}
+
+// newLogFilter builds the filter described by the logging settings, which
+// have been validated
+func newLogFilter(c LoggingConfig) *logFilter {
+	return &logFilter{
+		includeOps:   opSet(c.IncludeOps),
+		excludeOps:   opSet(c.ExcludeOps),
+		includePaths: c.IncludePaths,
+		excludePaths: c.ExcludePaths,
+		sample:       uint64(c.Sample),
+	}
+}
+
+func opSet(ops []string) map[string]bool {
+	set := make(map[string]bool, len(ops))
+	for _, op := range ops {
+		set[strings.ToUpper(op)] = true
+	}
+	return set
+}
+
+// match reports whether t passes the operation and path filters. A RENAME
+// matches the path filters if either of its paths does.
+func (f *logFilter) match(t *forkspoon.Transaction) bool {
+	if len(f.includeOps) > 0 && !f.includeOps[t.Op] {
+		return false
+	}
+	if f.excludeOps[t.Op] {
+		return false
+	}
+	if len(f.includePaths) == 0 && len(f.excludePaths) == 0 {
+		return true
+	}
+
+	paths := []string{t.Path}
+	if from, to, ok := strings.Cut(t.Path, " -> "); ok && t.Op == "RENAME" {
+		paths = []string{from, to}
+	}
+	if len(f.includePaths) > 0 && !matchAnyPath(f.includePaths, paths) {
+		return false
+	}
+	return !matchAnyPath(f.excludePaths, paths)
+}
+
+func matchAnyPath(patterns, paths []string) bool {
+	for _, pattern := range patterns {
+		for _, p := range paths {
+			if matchPath(pattern, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchPath reports whether the glob pattern matches p or one of the
+// directories above it, so "/mnt/nfs/scratch" covers everything below it
+func matchPath(pattern, p string) bool {
+	for {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+		parent := path.Dir(p)
+		if parent == p {
+			return false
+		}
+		p = parent
+	}
+}
+
+// validateLogFilters checks the filter settings
+func validateLogFilters(c LoggingConfig) error {
+	for _, list := range []struct {
+		key string
+		ops []string
+	}{{"logging.include_ops", c.IncludeOps}, {"logging.exclude_ops", c.ExcludeOps}} {
+		for i, op := range list.ops {
+			known := false
+			for _, o := range logOps {
+				known = known || strings.ToUpper(op) == o
+			}
+			if !known {
+				return fmt.Errorf("%s[%d]: unknown operation %q (known: %s)", list.key, i, op, strings.Join(logOps, ", "))
+			}
+		}
+	}
+	for _, list := range []struct {
+		key      string
+		patterns []string
+	}{{"logging.include_paths", c.IncludePaths}, {"logging.exclude_paths", c.ExcludePaths}} {
+		for i, pattern := range list.patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%s[%d]: bad pattern %q: %v", list.key, i, pattern, err)
+			}
+		}
+	}
+	if c.Sample < 1 {
+		return fmt.Errorf("logging.sample: must be at least 1 (got %d)", c.Sample)
+	}
+	if c.QueueSize < 1 {
+		return fmt.Errorf("logging.queue_size: must be at least 1 (got %d)", c.QueueSize)
+	}
+	return nil
+}
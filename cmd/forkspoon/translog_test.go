@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/yourusername/forkspoon/pkg/forkspoon"
+)
+
+func TestLogFilter(t *testing.T) {
+	f := newLogFilter(LoggingConfig{
+		Sample:       1,
+		ExcludeOps:   []string{"getattr"},
+		IncludePaths: []string{"/nfs/proj*"},
+		ExcludePaths: []string{"/nfs/project1/tmp"},
+	})
+	for _, tc := range []struct {
+		op, path string
+		want     bool
+	}{
+		{"READ", "/nfs/project1/a", true},
+		{"READ", "/nfs/project1/sub/deep/a", true},
+		{"GETATTR", "/nfs/project1/a", false},
+		{"READ", "/nfs/home/a", false},
+		{"READ", "/nfs/project1/tmp", false},
+		{"READ", "/nfs/project1/tmp/x", false},
+		{"RENAME", "/nfs/home/a -> /nfs/project2/a", true},
+		{"RENAME", "/nfs/home/a -> /nfs/home/b", false},
+	} {
+		if got := f.match(&forkspoon.Transaction{Op: tc.op, Path: tc.path}); got != tc.want {
+			t.Errorf("%s %s: match = %v, want %v", tc.op, tc.path, got, tc.want)
+		}
+	}
+
+	f = newLogFilter(LoggingConfig{Sample: 1, IncludeOps: []string{"READ", "WRITE"}})
+	if f.match(&forkspoon.Transaction{Op: "LOOKUP"}) || !f.match(&forkspoon.Transaction{Op: "WRITE"}) {
+		t.Error("include_ops not applied")
+	}
+}
+
+func TestLogFilterErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  LoggingConfig
+		want string
+	}{
+		{"unknown op", LoggingConfig{Sample: 1, QueueSize: 1, IncludeOps: []string{"READ", "STATFS"}}, "logging.include_ops[1]"},
+		{"bad pattern", LoggingConfig{Sample: 1, QueueSize: 1, ExcludePaths: []string{"/a/["}}, "logging.exclude_paths[0]"},
+		{"sample", LoggingConfig{Sample: 0, QueueSize: 1}, "logging.sample"},
+		{"queue", LoggingConfig{Sample: 1, QueueSize: 0}, "logging.queue_size"},
+	} {
+		err := validateLogFilters(tc.cfg)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: error %v does not mention %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestLogPipelineSamplesAndDrops(t *testing.T) {
+	// No writer: the queue fills up
+	p := &logPipeline{queue: make(chan forkspoon.Transaction, 5)}
+	p.SetFilter(newLogFilter(LoggingConfig{Sample: 2, ExcludeOps: []string{"GETATTR"}}))
+
+	for i := 0; i < 20; i++ {
+		p.LogTransaction(&forkspoon.Transaction{Op: "READ"})
+	}
+	p.LogTransaction(&forkspoon.Transaction{Op: "GETATTR"})
+
+	s := p.stats()
+	if s["sampled_out"] != 10 || s["queued"] != 5 || s["dropped"] != 5 || s["filtered"] != 1 {
+		t.Errorf("stats = %v, want 10 sampled out, 5 queued, 5 dropped, 1 filtered", s)
+	}
+}
+
+func TestLogPipelineWritesJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trans.log")
+	if err := reopenTransLog(path, TRANS_LOG_JSON, RotationOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	defer closeTransLog()
+
+	p := newLogPipeline(16, newLogFilter(LoggingConfig{Sample: 1}))
+	start := time.Now()
+	p.LogTransaction(&forkspoon.Transaction{Time: start, Op: "READ", Path: "/b/f", Offset: 4096, Bytes: 10, Pid: 42, Process: "make"})
+	p.LogTransaction(&forkspoon.Transaction{Time: start, Op: "LOOKUP", Path: "/b/x", Errno: syscall.ENOENT})
+	p.flush()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines: %q", len(lines), data)
+	}
+	var read, lookup map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &read); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &lookup); err != nil {
+		t.Fatal(err)
+	}
+	if read["offset"] != 4096.0 || read["bytes"] != 10.0 || read["pid"] != 42.0 || read["process"] != "make" || read["status"] != "PASSTHROUGH" {
+		t.Errorf("READ record = %v", read)
+	}
+	if _, ok := lookup["bytes"]; ok || lookup["errno"] != float64(syscall.ENOENT) || lookup["status"] != "CACHE_MISS" {
+		t.Errorf("LOOKUP record = %v", lookup)
+	}
+	if s := p.stats(); s["written"] != 2 {
+		t.Errorf("written = %d, want 2", s["written"])
+	}
+}
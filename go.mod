@@ -1,7 +1,11 @@
 module github.com/yourusername/forkspoon
 
-go 1.21
+go 1.21.0
 
-require github.com/hanwen/go-fuse/v2 v2.5.0
+require github.com/hanwen/go-fuse/v2 v2.8.0
 
-require golang.org/x/sys v0.15.0 // indirect
+require (
+	github.com/pelletier/go-toml/v2 v2.4.3
+	golang.org/x/sys v0.28.0
+	gopkg.in/yaml.v3 v3.0.1
+)
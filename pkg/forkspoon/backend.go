@@ -0,0 +1,120 @@
+package forkspoon
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Backend is the storage a mount serves. Paths are relative to the root of
+// the backend, separated by "/", with "" naming the root itself. Errors
+// should be syscall.Errno values (or wrap one) so the right errno reaches
+// the application; anything else is reported as EIO.
+//
+// A Backend is called concurrently from the FUSE request handlers.
+type Backend interface {
+	// Lstat fills st with the attributes of path, not following a
+	// symlink in the last component. Dev and Ino identify the inode in
+	// the caches, so they have to be stable.
+	Lstat(path string, st *syscall.Stat_t) error
+
+	// ReadDir opens a directory for enumeration
+	ReadDir(path string) (DirReader, error)
+
+	// Open opens a file with open(2) flags; mode applies with O_CREAT
+	Open(path string, flags int, mode uint32) (File, error)
+
+	Mkdir(path string, mode uint32) error
+	Unlink(path string) error
+	Rmdir(path string) error
+	Rename(oldPath, newPath string) error
+}
+
+// DirReader enumerates one directory
+type DirReader interface {
+	// Next returns the next entry. Mode needs only carry the file type
+	// bits, and may be zero when the type is unknown; Off is the position
+	// to Seek to for the entry after this one. ok is false once the
+	// directory is exhausted.
+	Next() (entry fuse.DirEntry, ok bool, err error)
+
+	// Seek repositions the reader at an Off previously returned by Next,
+	// or at the start for 0
+	Seek(off uint64) error
+
+	// Lstat stats an entry of the directory
+	Lstat(name string, st *syscall.Stat_t) error
+
+	Close() error
+}
+
+// File is an open file. Pread and Pwrite have the semantics of pread(2)
+// and pwrite(2): a short read at the end of the file is not an error.
+type File interface {
+	Pread(dest []byte, off int64) (int, error)
+	Pwrite(data []byte, off int64) (int, error)
+	Fstat(st *syscall.Stat_t) error
+	Close() error
+}
+
+// AttrSetter is implemented by Backends that can change attributes, for
+// SETATTR (chmod, chown, truncate, utimes) and for the ownership of new
+// files under an IDMap. Without it SETATTR fails with ENOTSUP.
+type AttrSetter interface {
+	Chmod(path string, mode uint32) error
+
+	// Lchown changes the owner of path without following a symlink; -1
+	// leaves the uid or gid as it is
+	Lchown(path string, uid, gid int) error
+
+	Truncate(path string, size int64) error
+
+	// Utimens sets the access and modification times; nil leaves one as
+	// it is
+	Utimens(path string, atime, mtime *time.Time) error
+}
+
+// DirOpener is implemented by Backends that can hold directories open. The
+// mount then works relative to the directory a request is about instead of
+// resolving a path from the root every time, and a directory renamed while
+// it is held open is still found.
+type DirOpener interface {
+	OpenDir(path string) (Dir, error)
+}
+
+// Dir is an open directory of a DirOpener: a Backend for the paths below
+// it ("" naming the directory itself), until closed
+type Dir interface {
+	Backend
+	AttrSetter
+
+	// RenameTo moves name in this directory to newName in dir, which
+	// belongs to the same backend, with the flags of renameat2(2)
+	// (RENAME_NOREPLACE, RENAME_EXCHANGE...)
+	RenameTo(name string, dir Dir, newName string, flags uint32) error
+
+	Close() error
+}
+
+// Syncer is implemented by Files that can commit their data to stable
+// storage, like fsync(2). FSYNC on a file that isn't one only flushes
+// buffered writes.
+type Syncer interface {
+	Sync() error
+}
+
+// GenLstater is implemented by Backends, Dirs and DirReaders that know the
+// generation of an inode, which tells it apart from an earlier inode with
+// the same number (on NFS, numbers are reused as soon as a file is
+// deleted). LstatGen is Lstat also returning the generation, 0 if the
+// filesystem doesn't keep one. It becomes part of the inode's identity in
+// the caches, so it has to be stable too.
+type GenLstater interface {
+	LstatGen(name string, st *syscall.Stat_t) (gen uint64, err error)
+}
+
+// GenFstater is GenLstater for Files
+type GenFstater interface {
+	FstatGen(st *syscall.Stat_t) (gen uint64, err error)
+}
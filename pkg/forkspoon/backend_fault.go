@@ -0,0 +1,304 @@
+package forkspoon
+
+import (
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Operations a Fault can target. Directory entries stat'ed through a
+// DirReader count as FAULT_LSTAT on the entry's path.
+const (
+	FAULT_LSTAT   = "LSTAT"
+	FAULT_READDIR = "READDIR"
+	FAULT_OPEN    = "OPEN"
+	FAULT_MKDIR   = "MKDIR"
+	FAULT_UNLINK  = "UNLINK"
+	FAULT_RMDIR   = "RMDIR"
+	FAULT_RENAME  = "RENAME"
+	FAULT_READ    = "READ"
+	FAULT_WRITE   = "WRITE"
+	FAULT_SETATTR = "SETATTR"
+)
+
+// Fault describes a misbehaviour injected into a FaultBackend. The steps
+// run in order: Before, then Delay, then the hang, then either Err is
+// returned or the call goes through to the wrapped backend.
+type Fault struct {
+	// Op and Path select the calls the fault applies to; empty matches
+	// every operation or every path. For RENAME, Path is the old path.
+	Op   string
+	Path string
+
+	// Times limits the fault to that many calls (0 means every call)
+	Times int
+
+	// Before runs ahead of the call, e.g. to change the backend behind
+	// the mount's back the way another client would
+	Before func()
+
+	// Delay is added latency
+	Delay time.Duration
+
+	// Hang blocks the call until Release or Clear
+	Hang bool
+
+	// Err, when set, fails the call instead of passing it on
+	Err syscall.Errno
+}
+
+// FaultBackend wraps a Backend and injects latency, errors, hangs and
+// concurrent modifications, for testing how the cache copes with a slow or
+// failing NFS server
+type FaultBackend struct {
+	Backend
+
+	mu      sync.Mutex
+	faults  []*Fault
+	calls   map[string]int
+	release chan struct{}
+	hung    int
+}
+
+// NewFaultBackend wraps b with no faults injected
+func NewFaultBackend(b Backend) *FaultBackend {
+	return &FaultBackend{
+		Backend: b,
+		calls:   make(map[string]int),
+		release: make(chan struct{}),
+	}
+}
+
+// Inject adds a fault. When several match a call, the one injected first
+// applies.
+func (f *FaultBackend) Inject(fault Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, &fault)
+}
+
+// Clear removes all faults and releases hung calls
+func (f *FaultBackend) Clear() {
+	f.mu.Lock()
+	f.faults = nil
+	f.mu.Unlock()
+	f.Release()
+}
+
+// Release unblocks the calls currently hung
+func (f *FaultBackend) Release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	close(f.release)
+	f.release = make(chan struct{})
+	f.hung = 0
+}
+
+// Hung returns the number of calls blocked by a Hang fault
+func (f *FaultBackend) Hung() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.hung
+}
+
+// Calls returns how many times op reached the backend, including calls
+// failed by a fault
+func (f *FaultBackend) Calls(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// ResetCalls zeroes the call counters
+func (f *FaultBackend) ResetCalls() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = make(map[string]int)
+}
+
+// apply counts the call and plays the first matching fault
+func (f *FaultBackend) apply(op, path string) error {
+	f.mu.Lock()
+	f.calls[op]++
+	var fault *Fault
+	for i, flt := range f.faults {
+		if (flt.Op == "" || flt.Op == op) && (flt.Path == "" || flt.Path == path) {
+			fault = flt
+			if flt.Times > 0 {
+				flt.Times--
+				if flt.Times == 0 {
+					f.faults = append(f.faults[:i:i], f.faults[i+1:]...)
+				}
+			}
+			break
+		}
+	}
+	release := f.release
+	if fault != nil && fault.Hang {
+		f.hung++
+	}
+	f.mu.Unlock()
+
+	if fault == nil {
+		return nil
+	}
+	if fault.Before != nil {
+		fault.Before()
+	}
+	if fault.Delay > 0 {
+		time.Sleep(fault.Delay)
+	}
+	if fault.Hang {
+		<-release
+	}
+	if fault.Err != 0 {
+		return fault.Err
+	}
+	return nil
+}
+
+func (f *FaultBackend) Lstat(path string, st *syscall.Stat_t) error {
+	if err := f.apply(FAULT_LSTAT, path); err != nil {
+		return err
+	}
+	return f.Backend.Lstat(path, st)
+}
+
+func (f *FaultBackend) ReadDir(path string) (DirReader, error) {
+	if err := f.apply(FAULT_READDIR, path); err != nil {
+		return nil, err
+	}
+	dir, err := f.Backend.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	return &faultDirReader{DirReader: dir, f: f, path: path}, nil
+}
+
+func (f *FaultBackend) Open(path string, flags int, mode uint32) (File, error) {
+	if err := f.apply(FAULT_OPEN, path); err != nil {
+		return nil, err
+	}
+	file, err := f.Backend.Open(path, flags, mode)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, f: f, path: path}, nil
+}
+
+func (f *FaultBackend) Mkdir(path string, mode uint32) error {
+	if err := f.apply(FAULT_MKDIR, path); err != nil {
+		return err
+	}
+	return f.Backend.Mkdir(path, mode)
+}
+
+func (f *FaultBackend) Unlink(path string) error {
+	if err := f.apply(FAULT_UNLINK, path); err != nil {
+		return err
+	}
+	return f.Backend.Unlink(path)
+}
+
+func (f *FaultBackend) Rmdir(path string) error {
+	if err := f.apply(FAULT_RMDIR, path); err != nil {
+		return err
+	}
+	return f.Backend.Rmdir(path)
+}
+
+func (f *FaultBackend) Rename(oldPath, newPath string) error {
+	if err := f.apply(FAULT_RENAME, oldPath); err != nil {
+		return err
+	}
+	return f.Backend.Rename(oldPath, newPath)
+}
+
+// setter returns the wrapped backend's AttrSetter, after applying the
+// faults for SETATTR on path
+func (f *FaultBackend) setter(path string) (AttrSetter, error) {
+	if err := f.apply(FAULT_SETATTR, path); err != nil {
+		return nil, err
+	}
+	s, ok := f.Backend.(AttrSetter)
+	if !ok {
+		return nil, syscall.ENOTSUP
+	}
+	return s, nil
+}
+
+func (f *FaultBackend) Chmod(path string, mode uint32) error {
+	s, err := f.setter(path)
+	if err != nil {
+		return err
+	}
+	return s.Chmod(path, mode)
+}
+
+func (f *FaultBackend) Lchown(path string, uid, gid int) error {
+	s, err := f.setter(path)
+	if err != nil {
+		return err
+	}
+	return s.Lchown(path, uid, gid)
+}
+
+func (f *FaultBackend) Truncate(path string, size int64) error {
+	s, err := f.setter(path)
+	if err != nil {
+		return err
+	}
+	return s.Truncate(path, size)
+}
+
+func (f *FaultBackend) Utimens(path string, atime, mtime *time.Time) error {
+	s, err := f.setter(path)
+	if err != nil {
+		return err
+	}
+	return s.Utimens(path, atime, mtime)
+}
+
+type faultDirReader struct {
+	DirReader
+	f    *FaultBackend
+	path string
+}
+
+func (d *faultDirReader) Lstat(name string, st *syscall.Stat_t) error {
+	path := name
+	if d.path != "" {
+		path = d.path + "/" + name
+	}
+	if err := d.f.apply(FAULT_LSTAT, path); err != nil {
+		return err
+	}
+	return d.DirReader.Lstat(name, st)
+}
+
+type faultFile struct {
+	File
+	f    *FaultBackend
+	path string
+}
+
+func (ff *faultFile) Pread(dest []byte, off int64) (int, error) {
+	if err := ff.f.apply(FAULT_READ, ff.path); err != nil {
+		return 0, err
+	}
+	return ff.File.Pread(dest, off)
+}
+
+func (ff *faultFile) Pwrite(data []byte, off int64) (int, error) {
+	if err := ff.f.apply(FAULT_WRITE, ff.path); err != nil {
+		return 0, err
+	}
+	return ff.File.Pwrite(data, off)
+}
+
+func (ff *faultFile) Sync() error {
+	if s, ok := ff.File.(Syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
@@ -0,0 +1,479 @@
+package forkspoon
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// MemoryBackend is a Backend that keeps a whole tree in memory. It has no
+// hard links or symlinks, but otherwise follows POSIX semantics closely
+// enough to mount forkspoon over it in tests. Its methods can also be
+// called directly to change the tree behind the mount's back, the way
+// another NFS client would.
+type MemoryBackend struct {
+	mu      sync.Mutex
+	root    *memNode
+	nextIno uint64
+}
+
+type memNode struct {
+	ino      uint64
+	mode     uint32
+	uid, gid uint32
+	data     []byte
+	children map[string]*memNode // directories only
+	atime    time.Time
+	mtime    time.Time
+	ctime    time.Time
+}
+
+// NewMemoryBackend returns an empty in-memory tree
+func NewMemoryBackend() *MemoryBackend {
+	b := &MemoryBackend{nextIno: 1}
+	b.root = b.newNode(syscall.S_IFDIR | 0755)
+	return b
+}
+
+func (b *MemoryBackend) newNode(mode uint32) *memNode {
+	now := time.Now()
+	n := &memNode{
+		ino:   b.nextIno,
+		mode:  mode,
+		uid:   uint32(os.Getuid()),
+		gid:   uint32(os.Getgid()),
+		atime: now,
+		mtime: now,
+		ctime: now,
+	}
+	b.nextIno++
+	if n.isDir() {
+		n.children = make(map[string]*memNode)
+	}
+	return n
+}
+
+func (n *memNode) isDir() bool {
+	return n.mode&syscall.S_IFMT == syscall.S_IFDIR
+}
+
+func (n *memNode) touch() {
+	n.mtime = time.Now()
+	n.ctime = n.mtime
+}
+
+func (n *memNode) stat(st *syscall.Stat_t) {
+	*st = syscall.Stat_t{
+		Ino:     n.ino,
+		Mode:    n.mode,
+		Nlink:   1,
+		Uid:     n.uid,
+		Gid:     n.gid,
+		Size:    int64(len(n.data)),
+		Blksize: 4096,
+		Blocks:  int64(len(n.data)+511) / 512,
+		Atim:    syscall.NsecToTimespec(n.atime.UnixNano()),
+		Mtim:    syscall.NsecToTimespec(n.mtime.UnixNano()),
+		Ctim:    syscall.NsecToTimespec(n.ctime.UnixNano()),
+	}
+	if n.isDir() {
+		st.Nlink = 2
+		st.Size = 4096
+		for _, c := range n.children {
+			if c.isDir() {
+				st.Nlink++
+			}
+		}
+	}
+}
+
+// walk resolves a path relative to the root. Call with b.mu held.
+func (b *MemoryBackend) walk(path string) (*memNode, error) {
+	n := b.root
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		if !n.isDir() {
+			return nil, syscall.ENOTDIR
+		}
+		child, ok := n.children[name]
+		if !ok {
+			return nil, syscall.ENOENT
+		}
+		n = child
+	}
+	return n, nil
+}
+
+// parent resolves the directory a path is in and returns it with the last
+// component. Call with b.mu held.
+func (b *MemoryBackend) parent(path string) (*memNode, string, error) {
+	path = strings.Trim(path, "/")
+	dir, name := "", path
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		dir, name = path[:i], path[i+1:]
+	}
+	if name == "" || name == "." || name == ".." {
+		return nil, "", syscall.EINVAL
+	}
+	p, err := b.walk(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	if !p.isDir() {
+		return nil, "", syscall.ENOTDIR
+	}
+	return p, name, nil
+}
+
+func (b *MemoryBackend) Lstat(path string, st *syscall.Stat_t) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, err := b.walk(path)
+	if err != nil {
+		return err
+	}
+	n.stat(st)
+	return nil
+}
+
+// ReadDir returns a snapshot of the directory, "." and ".." first and the
+// rest sorted by name
+func (b *MemoryBackend) ReadDir(path string) (DirReader, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, err := b.walk(path)
+	if err != nil {
+		return nil, err
+	}
+	if !n.isDir() {
+		return nil, syscall.ENOTDIR
+	}
+
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := []fuse.DirEntry{
+		{Name: ".", Mode: syscall.S_IFDIR, Ino: n.ino},
+		{Name: "..", Mode: syscall.S_IFDIR},
+	}
+	for _, name := range names {
+		c := n.children[name]
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: c.mode & syscall.S_IFMT, Ino: c.ino})
+	}
+	for i := range entries {
+		entries[i].Off = uint64(i + 1)
+	}
+	return &memDirReader{b: b, path: path, entries: entries}, nil
+}
+
+func (b *MemoryBackend) Open(path string, flags int, mode uint32) (File, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n, err := b.walk(path)
+	switch {
+	case err == syscall.ENOENT && flags&os.O_CREATE != 0:
+		p, name, err := b.parent(path)
+		if err != nil {
+			return nil, err
+		}
+		n = b.newNode(syscall.S_IFREG | mode&07777)
+		p.children[name] = n
+		p.touch()
+	case err != nil:
+		return nil, err
+	case flags&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, syscall.EEXIST
+	case n.isDir() && flags&(os.O_WRONLY|os.O_RDWR) != 0:
+		return nil, syscall.EISDIR
+	}
+
+	if flags&os.O_TRUNC != 0 && !n.isDir() && len(n.data) > 0 {
+		n.data = nil
+		n.touch()
+	}
+	return &memFile{b: b, n: n, flags: flags}, nil
+}
+
+func (b *MemoryBackend) Mkdir(path string, mode uint32) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p, name, err := b.parent(path)
+	if err != nil {
+		return err
+	}
+	if _, exists := p.children[name]; exists {
+		return syscall.EEXIST
+	}
+	p.children[name] = b.newNode(syscall.S_IFDIR | mode&07777)
+	p.touch()
+	return nil
+}
+
+func (b *MemoryBackend) Unlink(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p, name, err := b.parent(path)
+	if err != nil {
+		return err
+	}
+	n, ok := p.children[name]
+	if !ok {
+		return syscall.ENOENT
+	}
+	if n.isDir() {
+		return syscall.EISDIR
+	}
+	delete(p.children, name)
+	p.touch()
+	return nil
+}
+
+func (b *MemoryBackend) Rmdir(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p, name, err := b.parent(path)
+	if err != nil {
+		return err
+	}
+	n, ok := p.children[name]
+	if !ok {
+		return syscall.ENOENT
+	}
+	if !n.isDir() {
+		return syscall.ENOTDIR
+	}
+	if len(n.children) > 0 {
+		return syscall.ENOTEMPTY
+	}
+	delete(p.children, name)
+	p.touch()
+	return nil
+}
+
+func (b *MemoryBackend) Rename(oldPath, newPath string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	op, oldName, err := b.parent(oldPath)
+	if err != nil {
+		return err
+	}
+	np, newName, err := b.parent(newPath)
+	if err != nil {
+		return err
+	}
+	n, ok := op.children[oldName]
+	if !ok {
+		return syscall.ENOENT
+	}
+	// A directory can't be moved below itself
+	if n.isDir() && b.isAncestor(n, np) {
+		return syscall.EINVAL
+	}
+	if target, exists := np.children[newName]; exists {
+		if target == n {
+			return nil
+		}
+		switch {
+		case n.isDir() && !target.isDir():
+			return syscall.ENOTDIR
+		case !n.isDir() && target.isDir():
+			return syscall.EISDIR
+		case target.isDir() && len(target.children) > 0:
+			return syscall.ENOTEMPTY
+		}
+	}
+
+	delete(op.children, oldName)
+	np.children[newName] = n
+	n.ctime = time.Now()
+	op.touch()
+	np.touch()
+	return nil
+}
+
+func (b *MemoryBackend) Chmod(path string, mode uint32) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, err := b.walk(path)
+	if err != nil {
+		return err
+	}
+	n.mode = n.mode&syscall.S_IFMT | mode&07777
+	n.ctime = time.Now()
+	return nil
+}
+
+func (b *MemoryBackend) Lchown(path string, uid, gid int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, err := b.walk(path)
+	if err != nil {
+		return err
+	}
+	if uid != -1 {
+		n.uid = uint32(uid)
+	}
+	if gid != -1 {
+		n.gid = uint32(gid)
+	}
+	n.ctime = time.Now()
+	return nil
+}
+
+func (b *MemoryBackend) Truncate(path string, size int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, err := b.walk(path)
+	if err != nil {
+		return err
+	}
+	if n.isDir() {
+		return syscall.EISDIR
+	}
+	if size < 0 {
+		return syscall.EINVAL
+	}
+	data := make([]byte, size)
+	copy(data, n.data)
+	n.data = data
+	n.touch()
+	return nil
+}
+
+func (b *MemoryBackend) Utimens(path string, atime, mtime *time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, err := b.walk(path)
+	if err != nil {
+		return err
+	}
+	if atime != nil {
+		n.atime = *atime
+	}
+	if mtime != nil {
+		n.mtime = *mtime
+	}
+	n.ctime = time.Now()
+	return nil
+}
+
+// isAncestor reports whether dir is n or lies below it. Call with b.mu held.
+func (b *MemoryBackend) isAncestor(n, dir *memNode) bool {
+	if n == dir {
+		return true
+	}
+	for _, c := range n.children {
+		if c.isDir() && b.isAncestor(c, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteFile creates or replaces the file at path with data
+func (b *MemoryBackend) WriteFile(path string, data []byte, mode uint32) error {
+	f, err := b.Open(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Pwrite(data, 0)
+	return err
+}
+
+// memDirReader lists a snapshot of a directory taken at ReadDir
+type memDirReader struct {
+	b       *MemoryBackend
+	path    string
+	entries []fuse.DirEntry
+	pos     int
+}
+
+func (r *memDirReader) Next() (fuse.DirEntry, bool, error) {
+	if r.pos >= len(r.entries) {
+		return fuse.DirEntry{}, false, nil
+	}
+	e := r.entries[r.pos]
+	r.pos++
+	return e, true, nil
+}
+
+func (r *memDirReader) Seek(off uint64) error {
+	if off > uint64(len(r.entries)) {
+		return syscall.EINVAL
+	}
+	r.pos = int(off)
+	return nil
+}
+
+func (r *memDirReader) Lstat(name string, st *syscall.Stat_t) error {
+	return r.b.Lstat(r.path+"/"+name, st)
+}
+
+func (r *memDirReader) Close() error {
+	return nil
+}
+
+// memFile is an open file of a MemoryBackend. Like an open file descriptor
+// it keeps working after the file is unlinked.
+type memFile struct {
+	b     *MemoryBackend
+	n     *memNode
+	flags int
+}
+
+func (f *memFile) Pread(dest []byte, off int64) (int, error) {
+	f.b.mu.Lock()
+	defer f.b.mu.Unlock()
+	if f.n.isDir() {
+		return 0, syscall.EISDIR
+	}
+	if f.flags&os.O_WRONLY != 0 {
+		return 0, syscall.EBADF
+	}
+	if off >= int64(len(f.n.data)) {
+		return 0, nil
+	}
+	return copy(dest, f.n.data[off:]), nil
+}
+
+func (f *memFile) Pwrite(data []byte, off int64) (int, error) {
+	f.b.mu.Lock()
+	defer f.b.mu.Unlock()
+	if f.flags&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, syscall.EBADF
+	}
+	if f.flags&os.O_APPEND != 0 {
+		off = int64(len(f.n.data))
+	}
+	if end := off + int64(len(data)); end > int64(len(f.n.data)) {
+		grown := make([]byte, end)
+		copy(grown, f.n.data)
+		f.n.data = grown
+	}
+	copy(f.n.data[off:], data)
+	f.n.touch()
+	return len(data), nil
+}
+
+func (f *memFile) Fstat(st *syscall.Stat_t) error {
+	f.b.mu.Lock()
+	defer f.b.mu.Unlock()
+	f.n.stat(st)
+	return nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
@@ -0,0 +1,485 @@
+package forkspoon
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Buffer handed to each getdents64 call
+	DIRENT_BUF_SIZE = 64 * 1024
+
+	// How backend paths are resolved with openat2: never outside the root
+	// (EXDEV), and never through /proc/<pid>/fd style links
+	RESOLVE_FLAGS = unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS
+
+	// open(2) flags passed on to the backend. openat2 rejects the others,
+	// such as the kernel-internal ones FUSE may forward.
+	OPEN_FLAGS = unix.O_ACCMODE | unix.O_CREAT | unix.O_EXCL | unix.O_NOCTTY | unix.O_TRUNC |
+		unix.O_APPEND | unix.O_NONBLOCK | unix.O_DSYNC | unix.O_SYNC | unix.O_ASYNC | unix.O_DIRECT |
+		unix.O_LARGEFILE | unix.O_DIRECTORY | unix.O_NOFOLLOW | unix.O_NOATIME | unix.O_PATH
+)
+
+// posixBackend passes everything through to a directory with system calls
+// relative to a descriptor of it. It is the backend of a mount that only
+// sets Config.BackendPath.
+//
+// Paths are resolved with openat2(2) and RESOLVE_BENEATH, so that neither
+// ".." nor a symlink, in any component, leads outside the directory: such
+// paths fail with EXDEV. Kernels without openat2 (before 5.6) get a walk
+// from the root descriptor one component at a time instead, which refuses
+// ".." and symlinks altogether. Operations on the last
+// component (lstat, unlink, rename, ...) work on it relative to its parent
+// and never follow it.
+type posixBackend struct {
+	root   string
+	rootFd int
+
+	// Whether the kernel has openat2
+	openat2 bool
+}
+
+// NewPOSIXBackend returns a Backend serving the directory root. It holds a
+// descriptor of root until closed.
+func NewPOSIXBackend(root string) (Backend, error) {
+	fd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	b := &posixBackend{root: root, rootFd: fd}
+
+	// Seccomp profiles may answer EPERM rather than ENOSYS
+	if probe, err := unix.Openat2(fd, ".", &unix.OpenHow{Flags: unix.O_PATH | unix.O_CLOEXEC, Resolve: RESOLVE_FLAGS}); err == nil {
+		unix.Close(probe)
+		b.openat2 = true
+	}
+	return b, nil
+}
+
+// Close releases the descriptor of the root
+func (b *posixBackend) Close() error {
+	return unix.Close(b.rootFd)
+}
+
+// open opens rel beneath the root, like openat(2) with flags and mode
+func (b *posixBackend) open(rel string, flags int, mode uint32) (int, error) {
+	rel = strings.Trim(rel, "/")
+	if rel == "" {
+		rel = "."
+	}
+	flags = flags&OPEN_FLAGS | unix.O_CLOEXEC
+
+	if !b.openat2 {
+		dir, name := splitPath(rel)
+		dirfd, err := b.walk(dir)
+		if err != nil {
+			return -1, err
+		}
+		defer unix.Close(dirfd)
+		fd, err := unix.Openat(dirfd, name, flags|unix.O_NOFOLLOW, mode)
+		return fd, refuseSymlink(dirfd, name, err)
+	}
+
+	how := unix.OpenHow{Flags: uint64(flags), Resolve: RESOLVE_FLAGS}
+	if flags&unix.O_CREAT != 0 {
+		// openat2 refuses file type bits, which FUSE passes along
+		how.Mode = uint64(mode & 07777)
+	}
+	for {
+		fd, err := unix.Openat2(b.rootFd, rel, &how)
+		// EAGAIN: a concurrent rename got in the way of checking ".."
+		if err != unix.EINTR && err != unix.EAGAIN {
+			return fd, err
+		}
+	}
+}
+
+// walk opens the directory rel one component at a time, for kernels without
+// openat2. ".." and symlinks fail with EXDEV.
+func (b *posixBackend) walk(rel string) (int, error) {
+	fd, err := unix.Openat(b.rootFd, ".", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	for _, name := range strings.Split(rel, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		if name == ".." {
+			unix.Close(fd)
+			return -1, unix.EXDEV
+		}
+		next, err := unix.Openat(fd, name, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		err = refuseSymlink(fd, name, err)
+		unix.Close(fd)
+		if err != nil {
+			return -1, err
+		}
+		fd = next
+	}
+	return fd, nil
+}
+
+// refuseSymlink turns the error of opening a symlink with O_NOFOLLOW into
+// EXDEV
+func refuseSymlink(dirfd int, name string, err error) error {
+	if err != unix.ENOTDIR && err != unix.ELOOP {
+		return err
+	}
+	var st unix.Stat_t
+	if unix.Fstatat(dirfd, name, &st, unix.AT_SYMLINK_NOFOLLOW) == nil && st.Mode&unix.S_IFMT == unix.S_IFLNK {
+		return unix.EXDEV
+	}
+	return err
+}
+
+// at runs fn on the directory rel is in and the last component of rel
+// ("." for the root). A last component that is not a plain name fails:
+// ".." with EXDEV, as it would lead out of the root (or of a Dir), "."
+// with EINVAL.
+func (b *posixBackend) at(rel string, fn func(dirfd int, name string) error) error {
+	rel = strings.Trim(rel, "/")
+	if rel == "" {
+		return fn(b.rootFd, ".")
+	}
+	dir, name := splitPath(rel)
+	switch name {
+	case "..":
+		return unix.EXDEV
+	case ".", "":
+		return unix.EINVAL
+	}
+	if dir == "" {
+		return fn(b.rootFd, name)
+	}
+	dirfd, err := b.open(dir, unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirfd)
+	return fn(dirfd, name)
+}
+
+// splitPath splits a relative path into its directory and last component
+func splitPath(rel string) (dir, name string) {
+	if rel == "" {
+		return "", "."
+	}
+	if i := strings.LastIndex(rel, "/"); i >= 0 {
+		return rel[:i], rel[i+1:]
+	}
+	return "", rel
+}
+
+// OpenDir returns a backend for the directory rel, holding an O_PATH
+// descriptor of it. Paths given to it resolve beneath that directory.
+func (b *posixBackend) OpenDir(rel string) (Dir, error) {
+	fd, err := b.open(rel, unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &posixBackend{root: filepath.Join(b.root, rel), rootFd: fd, openat2: b.openat2}, nil
+}
+
+// RenameTo moves name to newName in dir with renameat2(2) between the two
+// descriptors
+func (b *posixBackend) RenameTo(name string, dir Dir, newName string, flags uint32) error {
+	to, ok := dir.(*posixBackend)
+	if !ok {
+		return unix.EXDEV
+	}
+	return b.at(name, func(olddirfd int, oldName string) error {
+		return to.at(newName, func(newdirfd int, newName string) error {
+			return unix.Renameat2(olddirfd, oldName, newdirfd, newName, uint(flags))
+		})
+	})
+}
+
+func (b *posixBackend) Lstat(rel string, st *syscall.Stat_t) error {
+	_, err := b.LstatGen(rel, st)
+	return err
+}
+
+// LstatGen is Lstat returning the birth time as the generation, see statx
+func (b *posixBackend) LstatGen(rel string, st *syscall.Stat_t) (gen uint64, err error) {
+	err = b.at(rel, func(dirfd int, name string) error {
+		gen, err = statx(dirfd, name, unix.AT_SYMLINK_NOFOLLOW, st)
+		return err
+	})
+	return gen, err
+}
+
+func (b *posixBackend) ReadDir(rel string) (DirReader, error) {
+	fd, err := b.open(rel, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &direntReader{fd: fd, buf: make([]byte, DIRENT_BUF_SIZE)}, nil
+}
+
+func (b *posixBackend) Open(rel string, flags int, mode uint32) (File, error) {
+	fd, err := b.open(rel, flags, mode)
+	if err != nil {
+		return nil, err
+	}
+	return posixFile(fd), nil
+}
+
+func (b *posixBackend) Mkdir(rel string, mode uint32) error {
+	return b.at(rel, func(dirfd int, name string) error {
+		return unix.Mkdirat(dirfd, name, mode)
+	})
+}
+
+func (b *posixBackend) Unlink(rel string) error {
+	return b.at(rel, func(dirfd int, name string) error {
+		return unix.Unlinkat(dirfd, name, 0)
+	})
+}
+
+func (b *posixBackend) Rmdir(rel string) error {
+	return b.at(rel, func(dirfd int, name string) error {
+		return unix.Unlinkat(dirfd, name, unix.AT_REMOVEDIR)
+	})
+}
+
+func (b *posixBackend) Rename(oldRel, newRel string) error {
+	return b.at(oldRel, func(olddirfd int, oldName string) error {
+		return b.at(newRel, func(newdirfd int, newName string) error {
+			return unix.Renameat(olddirfd, oldName, newdirfd, newName)
+		})
+	})
+}
+
+// Chmod changes the mode through /proc/self/fd: chmod has no variant
+// relative to a directory that doesn't follow the last component
+func (b *posixBackend) Chmod(rel string, mode uint32) error {
+	fd, err := b.open(rel, unix.O_PATH|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return err
+	}
+	if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+		return unix.EOPNOTSUPP
+	}
+	return unix.Chmod("/proc/self/fd/"+strconv.Itoa(fd), mode)
+}
+
+func (b *posixBackend) Lchown(rel string, uid, gid int) error {
+	return b.at(rel, func(dirfd int, name string) error {
+		return unix.Fchownat(dirfd, name, uid, gid, unix.AT_SYMLINK_NOFOLLOW)
+	})
+}
+
+func (b *posixBackend) Truncate(rel string, size int64) error {
+	fd, err := b.open(rel, unix.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	return unix.Ftruncate(fd, size)
+}
+
+func (b *posixBackend) Utimens(rel string, atime, mtime *time.Time) error {
+	ts := []unix.Timespec{{Nsec: unix.UTIME_OMIT}, {Nsec: unix.UTIME_OMIT}}
+	for i, t := range []*time.Time{atime, mtime} {
+		if t != nil {
+			ts[i] = unix.NsecToTimespec(t.UnixNano())
+		}
+	}
+	return b.at(rel, func(dirfd int, name string) error {
+		return unix.UtimesNanoAt(dirfd, name, ts, unix.AT_SYMLINK_NOFOLLOW)
+	})
+}
+
+// posixFile is an open file descriptor
+type posixFile int
+
+func (f posixFile) Pread(dest []byte, off int64) (int, error) {
+	return syscall.Pread(int(f), dest, off)
+}
+
+func (f posixFile) Pwrite(data []byte, off int64) (int, error) {
+	return syscall.Pwrite(int(f), data, off)
+}
+
+func (f posixFile) Fstat(st *syscall.Stat_t) error {
+	_, err := f.FstatGen(st)
+	return err
+}
+
+func (f posixFile) FstatGen(st *syscall.Stat_t) (uint64, error) {
+	return statx(int(f), "", unix.AT_EMPTY_PATH, st)
+}
+
+func (f posixFile) Sync() error {
+	return syscall.Fsync(int(f))
+}
+
+func (f posixFile) Close() error {
+	return syscall.Close(int(f))
+}
+
+// direntReader enumerates a directory with raw getdents64 calls. Names,
+// inode numbers and file types come straight from the kernel dirent records,
+// so listing a directory costs no stat calls at all.
+type direntReader struct {
+	fd   int
+	buf  []byte
+	todo []byte
+	eof  bool
+}
+
+// Next returns the next directory entry. The entry's Mode only carries the
+// file type bits, and is zero when the backend reports DT_UNKNOWN. Off is the
+// backend's d_off, i.e. the position to seek to for the entry after this
+// one. ok is false once the directory is exhausted.
+func (r *direntReader) Next() (entry fuse.DirEntry, ok bool, err error) {
+	for len(r.todo) == 0 {
+		if r.eof {
+			return fuse.DirEntry{}, false, nil
+		}
+		n, err := unix.Getdents(r.fd, r.buf)
+		if err != nil {
+			return fuse.DirEntry{}, false, err
+		}
+		if n <= 0 {
+			r.eof = true
+			continue
+		}
+		r.todo = r.buf[:n]
+	}
+
+	// struct linux_dirent64 {
+	//     u64  d_ino;
+	//     s64  d_off;
+	//     u16  d_reclen;
+	//     u8   d_type;
+	//     char d_name[];
+	// };
+	rec := r.todo
+	reclen := int(binary.NativeEndian.Uint16(rec[16:18]))
+	if reclen == 0 || reclen > len(rec) {
+		r.todo = nil
+		return fuse.DirEntry{}, false, syscall.EIO
+	}
+	r.todo = rec[reclen:]
+
+	name := rec[19:reclen]
+	for i, c := range name {
+		if c == 0 {
+			name = name[:i]
+			break
+		}
+	}
+
+	entry = fuse.DirEntry{
+		Ino:  binary.NativeEndian.Uint64(rec[0:8]),
+		Off:  binary.NativeEndian.Uint64(rec[8:16]),
+		Mode: direntTypeToMode(rec[18]),
+		Name: string(name),
+	}
+	return entry, true, nil
+}
+
+// Seek repositions the reader at a d_off previously returned by Next
+func (r *direntReader) Seek(off uint64) error {
+	if _, err := unix.Seek(r.fd, int64(off), unix.SEEK_SET); err != nil {
+		return err
+	}
+	r.todo = nil
+	r.eof = false
+	return nil
+}
+
+// Lstat stats name relative to the directory
+func (r *direntReader) Lstat(name string, st *syscall.Stat_t) error {
+	_, err := r.LstatGen(name, st)
+	return err
+}
+
+func (r *direntReader) LstatGen(name string, st *syscall.Stat_t) (uint64, error) {
+	return statx(r.fd, name, unix.AT_SYMLINK_NOFOLLOW, st)
+}
+
+// statx fills st with statx(2), which unlike stat(2) reports when the inode
+// was created. That is its generation: a file deleted and recreated with the
+// same inode number, as NFS servers readily do, has a new birth time. gen is
+// 0 where the filesystem doesn't record it.
+func statx(dirfd int, name string, flags int, st *syscall.Stat_t) (gen uint64, err error) {
+	var sx unix.Statx_t
+	if err := unix.Statx(dirfd, name, flags, unix.STATX_BASIC_STATS|unix.STATX_BTIME, &sx); err != nil {
+		return 0, err
+	}
+	*st = syscall.Stat_t{
+		Dev:    unix.Mkdev(sx.Dev_major, sx.Dev_minor),
+		Ino:    sx.Ino,
+		Mode:   uint32(sx.Mode),
+		Uid:    sx.Uid,
+		Gid:    sx.Gid,
+		Rdev:   unix.Mkdev(sx.Rdev_major, sx.Rdev_minor),
+		Size:   int64(sx.Size),
+		Blocks: int64(sx.Blocks),
+		Atim:   statxTime(sx.Atime),
+		Mtim:   statxTime(sx.Mtime),
+		Ctim:   statxTime(sx.Ctime),
+	}
+	setStatField(&st.Nlink, uint64(sx.Nlink))
+	setStatField(&st.Blksize, uint64(sx.Blksize))
+	if sx.Mask&unix.STATX_BTIME != 0 {
+		gen = uint64(sx.Btime.Sec)*1e9 + uint64(sx.Btime.Nsec)
+	}
+	return gen, nil
+}
+
+func statxTime(t unix.StatxTimestamp) syscall.Timespec {
+	return syscall.NsecToTimespec(t.Sec*1e9 + int64(t.Nsec))
+}
+
+// setStatField stores v in a Stat_t field whose type depends on the
+// architecture
+func setStatField[T ~int32 | ~int64 | ~uint32 | ~uint64](field *T, v uint64) {
+	*field = T(v)
+}
+
+// Close releases the directory file descriptor
+func (r *direntReader) Close() error {
+	if r.fd < 0 {
+		return nil
+	}
+	err := syscall.Close(r.fd)
+	r.fd = -1
+	return err
+}
+
+// direntTypeToMode converts a dirent d_type to S_IFMT mode bits
+func direntTypeToMode(t uint8) uint32 {
+	switch t {
+	case syscall.DT_REG:
+		return syscall.S_IFREG
+	case syscall.DT_DIR:
+		return syscall.S_IFDIR
+	case syscall.DT_LNK:
+		return syscall.S_IFLNK
+	case syscall.DT_FIFO:
+		return syscall.S_IFIFO
+	case syscall.DT_SOCK:
+		return syscall.S_IFSOCK
+	case syscall.DT_CHR:
+		return syscall.S_IFCHR
+	case syscall.DT_BLK:
+		return syscall.S_IFBLK
+	}
+	return 0
+}
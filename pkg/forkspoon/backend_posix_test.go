@@ -0,0 +1,199 @@
+package forkspoon
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPOSIXBackendStaysBeneathRoot(t *testing.T) {
+	top := t.TempDir()
+	root := filepath.Join(top, "export")
+	for _, dir := range []string{filepath.Join(top, "outside"), filepath.Join(root, "sub")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{filepath.Join(top, "outside", "secret"), filepath.Join(root, "sub", "f")} {
+		if err := os.WriteFile(f, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"abs":    filepath.Join(top, "outside"),
+		"rel":    "../outside",
+		"inside": "sub",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backend, err := NewPOSIXBackend(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.(*posixBackend).Close()
+	b := backend.(*posixBackend)
+
+	for _, openat2 := range []bool{true, false} {
+		if openat2 && !b.openat2 {
+			t.Log("no openat2 on this kernel")
+			continue
+		}
+		b.openat2 = openat2
+
+		var st syscall.Stat_t
+		escapes := map[string]error{
+			"lstat":    b.Lstat("abs/secret", &st),
+			"lstat ..": b.Lstat("sub/../../outside/secret", &st),
+			"mkdir":    b.Mkdir("rel/new", 0755),
+			"unlink":   b.Unlink("abs/secret"),
+			"rename":   b.Rename("sub/f", "rel/f"),
+			"chmod":    b.Chmod("abs/secret", 0777),
+			"truncate": b.Truncate("rel/secret", 0),
+		}
+		_, escapes["open"] = b.Open("abs/secret", os.O_RDONLY, 0)
+		_, escapes["readdir"] = b.ReadDir("rel")
+
+		// ".." as the last component, from the root and from a Dir
+		escapes["lstat .. last"] = b.Lstat("..", &st)
+		escapes["lstat sub/../.."] = b.Lstat("sub/../..", &st)
+		escapes["utimens .."] = b.Utimens("..", nil, nil)
+		escapes["lchown .."] = b.Lchown("..", -1, -1)
+		escapes["mkdir .."] = b.Mkdir("..", 0755)
+		dir, err := b.OpenDir("sub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		escapes["dir lstat .."] = dir.Lstat("..", &st)
+		escapes["dir lchown .."] = dir.Lchown("..", -1, -1)
+		escapes["dir utimens .."] = dir.Utimens("..", nil, nil)
+		escapes["dir rename"] = dir.Rename("f", "../../f")
+		dir.Close()
+		for op, err := range escapes {
+			if !errors.Is(err, syscall.EXDEV) {
+				t.Errorf("openat2 %v: %s outside the root: %v, want EXDEV", openat2, op, err)
+			}
+		}
+
+		// The links themselves are fine, and with openat2 so is a link
+		// that stays inside
+		if err := b.Lstat("abs", &st); err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+			t.Errorf("openat2 %v: lstat of the link: mode %o, %v", openat2, st.Mode, err)
+		}
+		if openat2 {
+			if err := b.Lstat("inside/f", &st); err != nil {
+				t.Errorf("lstat through a link inside the root: %v", err)
+			}
+		}
+	}
+
+	if data, err := os.ReadFile(filepath.Join(top, "outside", "secret")); err != nil || string(data) != "data" {
+		t.Errorf("file outside the root changed: %q, %v", data, err)
+	}
+}
+
+func TestBackendDirsRejectReplacedDirectory(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	backend, err := NewPOSIXBackend(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.(*posixBackend).Close()
+	opener := backend.(DirOpener)
+
+	var st syscall.Stat_t
+	key, err := lstatKey(backend, "sub", &st)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replaced between the lookup and the open
+	if err := os.Rename(filepath.Join(root, "sub"), filepath.Join(root, "moved")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	dirs := newBackendDirs()
+	defer dirs.dropAll()
+	if _, err := dirs.get(opener, key, "sub"); !errors.Is(err, syscall.ESTALE) {
+		t.Errorf("opening the replaced directory: %v, want ESTALE", err)
+	}
+	if n := dirs.count(); n != 0 {
+		t.Errorf("%d handles held after ESTALE", n)
+	}
+	h, err := dirs.get(opener, key, "moved")
+	if err != nil {
+		t.Fatalf("opening the directory at its new name: %v", err)
+	}
+	dirs.put(h)
+}
+
+func TestPOSIXBackendGenerations(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "f"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewPOSIXBackend(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.(*posixBackend).Close()
+
+	var st syscall.Stat_t
+	key, err := lstatKey(b, "f", &st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Gen == 0 {
+		t.Skip("no birth times on this filesystem")
+	}
+	if st.Size != 4 || st.Nlink != 1 || st.Mode != syscall.S_IFREG|0644 {
+		t.Errorf("stat: size %d nlink %d mode %o", st.Size, st.Nlink, st.Mode)
+	}
+
+	// The same identity from every way of getting at the file, and after
+	// its attributes change
+	if err := b.(AttrSetter).Chmod("f", 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := b.Open("f", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Pwrite([]byte("more"), 4); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fstatKey(f, &st); err != nil || got != key {
+		t.Errorf("fstat: %+v, %v; want %+v", got, err, key)
+	}
+	f.Close()
+	dir, err := b.ReadDir("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := lstatKey(dir, "f", &st); err != nil || got != key {
+		t.Errorf("stat in a listing: %+v, %v; want %+v", got, err, key)
+	}
+	dir.Close()
+
+	// A new file with the same number is a new inode
+	if err := os.Remove(filepath.Join(root, "f")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := os.WriteFile(filepath.Join(root, "f"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := lstatKey(b, "f", &st); err != nil || got == key {
+		t.Errorf("recreated file: %+v, %v; want a new identity", got, err)
+	}
+}
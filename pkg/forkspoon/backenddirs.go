@@ -0,0 +1,189 @@
+package forkspoon
+
+import (
+	"container/list"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+const (
+	// Directory handles a mount keeps open, least recently used closed
+	// first. Handles are also closed when the kernel forgets a directory.
+	MAX_DIR_HANDLES = 1024
+)
+
+// backendDir is an open directory of the backend, shared by the requests
+// working in it
+type backendDir struct {
+	key  inodeKey
+	dir  Dir
+	elem *list.Element
+
+	// Requests using the handle, and whether it has left the table and is
+	// to be closed once they are done. Both under backendDirs.mu.
+	refs    int
+	dropped bool
+}
+
+// backendDirs holds the open directories of a mount, by inode
+type backendDirs struct {
+	mu    sync.Mutex
+	byKey map[inodeKey]*backendDir
+	lru   *list.List // of *backendDir, most recently used first
+}
+
+func newBackendDirs() *backendDirs {
+	return &backendDirs{byKey: make(map[inodeKey]*backendDir), lru: list.New()}
+}
+
+// get returns the handle of the directory key, opening it at rel if needed.
+// If what rel names by then isn't that directory (it was renamed or replaced
+// since the lookup) it fails with ESTALE.
+func (d *backendDirs) get(opener DirOpener, key inodeKey, rel string) (*backendDir, error) {
+	d.mu.Lock()
+	if h, ok := d.byKey[key]; ok {
+		h.refs++
+		d.lru.MoveToFront(h.elem)
+		d.mu.Unlock()
+		return h, nil
+	}
+	d.mu.Unlock()
+
+	// Not under the lock: opening can take a trip to the NFS server
+	dir, err := opener.OpenDir(rel)
+	if err != nil {
+		return nil, err
+	}
+	var st syscall.Stat_t
+	now, err := lstatKey(dir, "", &st)
+	if err != nil {
+		dir.Close()
+		return nil, err
+	}
+	if now != key {
+		dir.Close()
+		return nil, syscall.ESTALE
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if h, ok := d.byKey[key]; ok {
+		// Opened concurrently
+		dir.Close()
+		h.refs++
+		d.lru.MoveToFront(h.elem)
+		return h, nil
+	}
+	h := &backendDir{key: key, dir: dir, refs: 1}
+	h.elem = d.lru.PushFront(h)
+	d.byKey[key] = h
+	for d.lru.Len() > MAX_DIR_HANDLES {
+		d.dropLocked(d.lru.Back().Value.(*backendDir))
+	}
+	return h, nil
+}
+
+// put releases a handle returned by get
+func (d *backendDirs) put(h *backendDir) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h.refs--
+	if h.dropped && h.refs == 0 {
+		h.dir.Close()
+	}
+}
+
+// drop closes the handle of a directory, if open, once it is not in use
+func (d *backendDirs) drop(key inodeKey) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if h, ok := d.byKey[key]; ok {
+		d.dropLocked(h)
+	}
+}
+
+// dropAll closes every handle once it is not in use
+func (d *backendDirs) dropAll() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, h := range d.byKey {
+		d.dropLocked(h)
+	}
+}
+
+func (d *backendDirs) dropLocked(h *backendDir) {
+	delete(d.byKey, h.key)
+	d.lru.Remove(h.elem)
+	h.dropped = true
+	if h.refs == 0 {
+		h.dir.Close()
+	}
+}
+
+// count returns the number of open handles
+func (d *backendDirs) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lru.Len()
+}
+
+// at returns what to make a backend call about name in a directory with:
+// with a DirOpener backend the directory's handle and name, otherwise the
+// backend and the path from the root (dirRel joined with name). done
+// releases the handle. name may be "" for the directory itself.
+func (m *Mount) at(dirKey inodeKey, dirRel, name string) (b Backend, p string, done func(), err error) {
+	opener, ok := m.backend.(DirOpener)
+	if !ok {
+		return m.backend, filepath.Join(dirRel, name), func() {}, nil
+	}
+	h, err := m.dirs.get(opener, dirKey, dirRel)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return h.dir, name, func() { m.dirs.put(h) }, nil
+}
+
+// at is Mount.at for the node itself, through the directory it is in. A
+// node that is in no directory any more (unlinked while open) goes by its
+// path.
+func (n *loopbackNode) at() (Backend, string, func(), error) {
+	m := n.mount()
+	name, parent := n.Parent()
+	if parent != nil {
+		switch p := parent.Operations().(type) {
+		case *rootNode:
+			return m.at(p.key, "", name)
+		case *loopbackNode:
+			return m.at(p.key, p.relPath(), name)
+		}
+	}
+	return m.backend, n.relPath(), func() {}, nil
+}
+
+// rename moves name in one directory to newName in another, between their
+// handles when the backend has them. Backends without them can't honour the
+// flags of renameat2(2): a rename with any fails with EINVAL rather than
+// replacing or moving what the caller asked to keep.
+func (m *Mount) rename(oldKey inodeKey, oldDirRel, name string, newKey inodeKey, newDirRel, newName string, flags uint32) error {
+	ob, oldName, odone, err := m.at(oldKey, oldDirRel, name)
+	if err != nil {
+		return err
+	}
+	defer odone()
+	nb, newName, ndone, err := m.at(newKey, newDirRel, newName)
+	if err != nil {
+		return err
+	}
+	defer ndone()
+
+	if od, ok := ob.(Dir); ok {
+		if nd, ok := nb.(Dir); ok {
+			return od.RenameTo(oldName, nd, newName, flags)
+		}
+	}
+	if flags != 0 {
+		return syscall.EINVAL
+	}
+	return m.backend.Rename(oldName, newName)
+}
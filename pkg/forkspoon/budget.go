@@ -0,0 +1,205 @@
+package forkspoon
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Estimated memory cost of cache entries, in bytes. They cover the entry
+// structs plus map and slice overhead; names are added on top. The numbers
+// don't have to be exact, only proportional to what the caches really hold.
+const (
+	DIR_CACHE_ENTRY_COST = 128
+	DIR_ENTRY_COST       = 64
+	LOOKUP_ENTRY_COST    = 96
+	ATTR_ENTRY_COST      = 200
+)
+
+// When over the budget, evict down to this fraction of it so that eviction
+// doesn't run again on the very next insert
+const BUDGET_EVICT_TARGET = 0.9
+
+// dirEntriesCost estimates the memory held by a cached directory listing
+func dirEntriesCost(entries []fuse.DirEntry) int64 {
+	size := int64(DIR_CACHE_ENTRY_COST)
+	for i := range entries {
+		size += DIR_ENTRY_COST + int64(len(entries[i].Name))
+	}
+	return size
+}
+
+// lookupEntryCost estimates the memory held by one cached dentry
+func lookupEntryCost(name string) int64 {
+	return LOOKUP_ENTRY_COST + int64(len(name))
+}
+
+// MemoryBudget is a cache memory limit shared by several mounts. Each mount
+// accounts for its caches in a memAccount; when the sum exceeds the limit,
+// the evictor frees memory, starting with the mount that uses the most.
+type MemoryBudget struct {
+	limit atomic.Int64 // 0 means unlimited
+	used  atomic.Int64
+	wake  chan struct{}
+
+	mu        sync.Mutex
+	mounts    map[*Mount]struct{}
+	enforceMu sync.Mutex
+}
+
+// NewMemoryBudget returns a budget of limit bytes (0 for unlimited)
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	b := &MemoryBudget{
+		wake:   make(chan struct{}, 1),
+		mounts: make(map[*Mount]struct{}),
+	}
+	b.limit.Store(limit)
+	go b.evictor()
+	return b
+}
+
+// SetLimit changes the limit, evicting right away if it was lowered
+func (b *MemoryBudget) SetLimit(limit int64) {
+	b.limit.Store(limit)
+	b.kick()
+}
+
+// Limit returns the limit in bytes (0 for unlimited)
+func (b *MemoryBudget) Limit() int64 {
+	return b.limit.Load()
+}
+
+// Used returns the cache memory in use by the budget's mounts
+func (b *MemoryBudget) Used() int64 {
+	return b.used.Load()
+}
+
+func (b *MemoryBudget) kick() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// overLimit reports whether the caches use more than the limit
+func (b *MemoryBudget) overLimit() bool {
+	limit := b.limit.Load()
+	return limit > 0 && b.used.Load() > limit
+}
+
+func (b *MemoryBudget) attach(m *Mount) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mounts[m] = struct{}{}
+}
+
+func (b *MemoryBudget) detach(m *Mount) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.mounts, m)
+}
+
+func (b *MemoryBudget) list() []*Mount {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	mounts := make([]*Mount, 0, len(b.mounts))
+	for m := range b.mounts {
+		mounts = append(mounts, m)
+	}
+	return mounts
+}
+
+// memAccount tracks the cache memory of one mount. A nil account (caches
+// built outside a mount) tracks nothing.
+type memAccount struct {
+	used   atomic.Int64
+	budget *MemoryBudget
+}
+
+// add records n bytes allocated (or freed, when negative)
+func (a *memAccount) add(n int64) {
+	if a == nil {
+		return
+	}
+	a.used.Add(n)
+	if a.budget == nil {
+		return
+	}
+	a.budget.used.Add(n)
+	if n > 0 && a.budget.overLimit() {
+		a.budget.kick()
+	}
+}
+
+// evictor enforces the budget over the attached mounts whenever an insert
+// takes it over the limit
+func (b *MemoryBudget) evictor() {
+	for range b.wake {
+		b.enforceLimit(b.list())
+	}
+}
+
+// enforceLimit brings the caches of mounts back under the limit. Expired
+// entries go first; after that entries are evicted from the mount using the
+// most memory, so one busy mount can't push out the caches of all the
+// others.
+func (b *MemoryBudget) enforceLimit(mounts []*Mount) {
+	b.enforceMu.Lock()
+	defer b.enforceMu.Unlock()
+
+	if !b.overLimit() {
+		return
+	}
+	verbose := false
+	for _, m := range mounts {
+		m.dirCache.Sweep()
+		m.lookupCache.Sweep()
+		m.attrCache.Sweep()
+		verbose = verbose || m.verbose
+	}
+
+	target := int64(float64(b.limit.Load()) * BUDGET_EVICT_TARGET)
+	start := time.Now()
+	evicted := 0
+	for b.used.Load() > target {
+		var largest *Mount
+		for _, m := range mounts {
+			if largest == nil || m.mem.used.Load() > largest.mem.used.Load() {
+				largest = m
+			}
+		}
+		if largest == nil || largest.mem.used.Load() <= 0 {
+			break
+		}
+		n := largest.evict(b.used.Load() - target)
+		if n == 0 {
+			break
+		}
+		evicted += n
+	}
+
+	if verbose && evicted > 0 {
+		log.Printf("[BUDGET] Evicted %d cache entries in %v (%d of %d bytes in use)",
+			evicted, time.Since(start).Round(time.Microsecond), b.used.Load(), b.limit.Load())
+	}
+}
+
+// evict frees up to bytes of the mount's cache memory, listings first (they
+// are the largest and cheapest to rebuild per byte), then dentries, then
+// attributes. It returns the number of entries dropped.
+func (m *Mount) evict(bytes int64) int {
+	dropped := 0
+	for _, evict := range []func(int64) (int64, int){m.dirCache.evict, m.lookupCache.evict, m.attrCache.evict} {
+		if bytes <= 0 {
+			break
+		}
+		freed, n := evict(bytes)
+		bytes -= freed
+		dropped += n
+	}
+	atomic.AddUint64(&m.metrics.Evictions, uint64(dropped))
+	return dropped
+}
@@ -0,0 +1,70 @@
+package forkspoon
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestMemoryBudgetEvictsLargestMount(t *testing.T) {
+	budget := NewMemoryBudget(0)
+
+	newTestMount := func(name string) *Mount {
+		m, err := New(Config{Name: name, BackendPath: t.TempDir(), Budget: budget})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	big, small := newTestMount("big"), newTestMount("small")
+
+	fill := func(m *Mount, dirs int) {
+		entries := make([]fuse.DirEntry, 100)
+		for i := range entries {
+			entries[i] = fuse.DirEntry{Name: fmt.Sprintf("entry%03d", i), Ino: uint64(i + 1)}
+		}
+		for i := 0; i < dirs; i++ {
+			key := inodeKey{Ino: uint64(i + 1)}
+			m.dirCache.Put(key, entries, time.Minute)
+			m.lookupCache.Put(key, "name", inodeKey{Ino: uint64(i + 1000)}, 0, time.Minute)
+			m.attrCache.Put(key, fuse.AttrOut{}, time.Minute)
+		}
+	}
+	fill(big, 200)
+	fill(small, 20)
+
+	used := budget.used.Load()
+	if want := big.mem.used.Load() + small.mem.used.Load(); used != want || used == 0 {
+		t.Fatalf("budget used %d, mounts account for %d", used, want)
+	}
+	smallBefore := small.mem.used.Load()
+
+	// Room for a bit more than the small mount: only the big one has to give
+	budget.SetLimit(smallBefore * 3)
+	budget.enforceLimit([]*Mount{big, small})
+
+	if got, limit := budget.used.Load(), budget.limit.Load(); got > limit {
+		t.Errorf("budget used %d after eviction, limit %d", got, limit)
+	}
+	if small.mem.used.Load() != smallBefore || small.metrics.Evictions != 0 {
+		t.Errorf("small mount lost entries (%d -> %d bytes)", smallBefore, small.mem.used.Load())
+	}
+	if big.metrics.Evictions == 0 {
+		t.Error("no evictions counted for the big mount")
+	}
+
+	// Removing everything returns the accounting to zero
+	for _, m := range []*Mount{big, small} {
+		for i := 0; i < 200; i++ {
+			key := inodeKey{Ino: uint64(i + 1)}
+			m.dirCache.Remove(key)
+			m.lookupCache.RemoveDir(key)
+			m.attrCache.Remove(key)
+		}
+	}
+	if got := budget.used.Load(); got != 0 {
+		t.Errorf("budget used %d after removing all entries, want 0", got)
+	}
+}
@@ -0,0 +1,429 @@
+package forkspoon
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// inodeKey identifies a backend inode. Caching by identity instead of by
+// path means a rename only moves a dentry, and hard links share a single
+// attribute record. Gen tells apart an inode whose number was reused, for
+// backends that know it (see GenLstater); it is zero for the others.
+type inodeKey struct {
+	Dev uint64
+	Ino uint64
+	Gen uint64
+}
+
+// keyFromStat returns the identity of the inode described by st, of
+// generation gen
+func keyFromStat(st *syscall.Stat_t, gen uint64) inodeKey {
+	return inodeKey{Dev: uint64(st.Dev), Ino: st.Ino, Gen: gen}
+}
+
+// lstater is what Backends, Dirs and DirReaders have in common
+type lstater interface {
+	Lstat(name string, st *syscall.Stat_t) error
+}
+
+// lstatKey is Lstat that also returns the identity of the inode,
+// generation included where it is known
+func lstatKey(b lstater, name string, st *syscall.Stat_t) (inodeKey, error) {
+	if g, ok := b.(GenLstater); ok {
+		gen, err := g.LstatGen(name, st)
+		return keyFromStat(st, gen), err
+	}
+	err := b.Lstat(name, st)
+	return keyFromStat(st, 0), err
+}
+
+// fstatKey is lstatKey for an open File
+func fstatKey(f File, st *syscall.Stat_t) (inodeKey, error) {
+	if g, ok := f.(GenFstater); ok {
+		gen, err := g.FstatGen(st)
+		return keyFromStat(st, gen), err
+	}
+	err := f.Fstat(st)
+	return keyFromStat(st, 0), err
+}
+
+// DirCacheEntry holds cached directory entries
+type DirCacheEntry struct {
+	entries []fuse.DirEntry
+	expiry  time.Time
+	size    int64
+}
+
+// DirCache is our in-memory directory cache, keyed by directory inode
+type DirCache struct {
+	mu      sync.RWMutex
+	entries map[inodeKey]*DirCacheEntry
+	mem     *memAccount
+}
+
+// LookupCacheEntry is a cached dentry: a name in a parent directory
+// resolving to a child inode. The child's attributes live in attrCache.
+// No *fs.Inode is kept: go-fuse drops inodes the kernel has forgotten, and
+// a cached pointer would both pin them in memory and hand them back after
+// FORGET. Hits resolve the inode through the tree instead.
+type LookupCacheEntry struct {
+	child  inodeKey
+	mode   uint32
+	expiry time.Time
+}
+
+// LookupCache caches LOOKUP operations as a name->inode map per parent
+// directory
+type LookupCache struct {
+	mu      sync.RWMutex
+	entries map[inodeKey]map[string]*LookupCacheEntry
+	mem     *memAccount
+}
+
+// AttrCacheEntry holds cached getattr results
+type AttrCacheEntry struct {
+	attr   fuse.AttrOut
+	expiry time.Time
+}
+
+// AttrCache caches GETATTR operations, keyed by inode
+type AttrCache struct {
+	mu      sync.RWMutex
+	entries map[inodeKey]*AttrCacheEntry
+	mem     *memAccount
+}
+
+func newDirCache(mem *memAccount) *DirCache {
+	return &DirCache{entries: make(map[inodeKey]*DirCacheEntry), mem: mem}
+}
+
+func newLookupCache(mem *memAccount) *LookupCache {
+	return &LookupCache{entries: make(map[inodeKey]map[string]*LookupCacheEntry), mem: mem}
+}
+
+func newAttrCache(mem *memAccount) *AttrCache {
+	return &AttrCache{entries: make(map[inodeKey]*AttrCacheEntry), mem: mem}
+}
+
+// Get retrieves cached directory entries if not expired
+func (dc *DirCache) Get(dir inodeKey) ([]fuse.DirEntry, bool) {
+	dc.mu.RLock()
+	defer dc.mu.RUnlock()
+
+	entry, exists := dc.entries[dir]
+	if !exists {
+		return nil, false
+	}
+
+	if time.Now().After(entry.expiry) {
+		// Expired, remove it
+		go dc.removeExpired(dir)
+		return nil, false
+	}
+
+	return entry.entries, true
+}
+
+// Put stores directory entries in cache
+func (dc *DirCache) Put(dir inodeKey, entries []fuse.DirEntry, ttl time.Duration) {
+	size := dirEntriesCost(entries)
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if old, ok := dc.entries[dir]; ok {
+		dc.mem.add(-old.size)
+	}
+	dc.entries[dir] = &DirCacheEntry{
+		entries: entries,
+		expiry:  time.Now().Add(ttl),
+		size:    size,
+	}
+	dc.mem.add(size)
+}
+
+// Remove deletes a cache entry
+func (dc *DirCache) Remove(dir inodeKey) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.removeLocked(dir)
+}
+
+func (dc *DirCache) removeLocked(dir inodeKey) {
+	if entry, ok := dc.entries[dir]; ok {
+		dc.mem.add(-entry.size)
+		delete(dc.entries, dir)
+	}
+}
+
+// removeExpired deletes a cache entry unless it was refreshed meanwhile
+func (dc *DirCache) removeExpired(dir inodeKey) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if entry, ok := dc.entries[dir]; ok && time.Now().After(entry.expiry) {
+		dc.removeLocked(dir)
+	}
+}
+
+// evict drops entries until at least bytes have been freed, returning the
+// bytes freed and entries dropped. Map order is random, so this is random
+// eviction.
+func (dc *DirCache) evict(bytes int64) (int64, int) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	var freed int64
+	dropped := 0
+	for dir, entry := range dc.entries {
+		if freed >= bytes {
+			break
+		}
+		freed += entry.size
+		dropped++
+		dc.removeLocked(dir)
+	}
+	return freed, dropped
+}
+
+// Sweep removes all expired entries and returns how many were dropped
+func (dc *DirCache) Sweep() int {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	now := time.Now()
+	removed := 0
+	for dir, entry := range dc.entries {
+		if now.After(entry.expiry) {
+			dc.removeLocked(dir)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Get retrieves the cached dentry for name in parent
+func (lc *LookupCache) Get(parent inodeKey, name string) (*LookupCacheEntry, bool) {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+
+	entry, exists := lc.entries[parent][name]
+	if !exists {
+		return nil, false
+	}
+
+	if time.Now().After(entry.expiry) {
+		go lc.removeExpired(parent, name)
+		return nil, false
+	}
+
+	return entry, true
+}
+
+// Put stores a dentry in cache
+func (lc *LookupCache) Put(parent inodeKey, name string, child inodeKey, mode uint32, ttl time.Duration) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	dir := lc.entries[parent]
+	if dir == nil {
+		dir = make(map[string]*LookupCacheEntry)
+		lc.entries[parent] = dir
+	}
+	if _, exists := dir[name]; !exists {
+		lc.mem.add(lookupEntryCost(name))
+	}
+	dir[name] = &LookupCacheEntry{
+		child:  child,
+		mode:   mode,
+		expiry: time.Now().Add(ttl),
+	}
+}
+
+// Remove deletes a dentry
+func (lc *LookupCache) Remove(parent inodeKey, name string) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.removeLocked(parent, name)
+}
+
+// RemoveDir drops all dentries of a (removed) directory
+func (lc *LookupCache) RemoveDir(parent inodeKey) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	for name := range lc.entries[parent] {
+		lc.mem.add(-lookupEntryCost(name))
+	}
+	delete(lc.entries, parent)
+}
+
+// Move renames a dentry, replacing whatever newName pointed to
+func (lc *LookupCache) Move(oldParent inodeKey, oldName string, newParent inodeKey, newName string) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	lc.removeLocked(newParent, newName)
+
+	entry, exists := lc.entries[oldParent][oldName]
+	if !exists {
+		return
+	}
+	lc.removeLocked(oldParent, oldName)
+
+	dir := lc.entries[newParent]
+	if dir == nil {
+		dir = make(map[string]*LookupCacheEntry)
+		lc.entries[newParent] = dir
+	}
+	dir[newName] = entry
+	lc.mem.add(lookupEntryCost(newName))
+}
+
+func (lc *LookupCache) removeLocked(parent inodeKey, name string) {
+	dir := lc.entries[parent]
+	if _, exists := dir[name]; exists {
+		lc.mem.add(-lookupEntryCost(name))
+		delete(dir, name)
+	}
+	if len(dir) == 0 {
+		delete(lc.entries, parent)
+	}
+}
+
+// evict drops dentries until at least bytes have been freed
+func (lc *LookupCache) evict(bytes int64) (int64, int) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	var freed int64
+	dropped := 0
+	for parent, dir := range lc.entries {
+		for name := range dir {
+			if freed >= bytes {
+				return freed, dropped
+			}
+			freed += lookupEntryCost(name)
+			dropped++
+			lc.removeLocked(parent, name)
+		}
+	}
+	return freed, dropped
+}
+
+// removeExpired deletes a dentry unless it was refreshed meanwhile
+func (lc *LookupCache) removeExpired(parent inodeKey, name string) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if entry, ok := lc.entries[parent][name]; ok && time.Now().After(entry.expiry) {
+		lc.removeLocked(parent, name)
+	}
+}
+
+// Sweep removes all expired dentries and returns how many were dropped
+func (lc *LookupCache) Sweep() int {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	now := time.Now()
+	removed := 0
+	for parent, dir := range lc.entries {
+		for name, entry := range dir {
+			if now.After(entry.expiry) {
+				lc.removeLocked(parent, name)
+				removed++
+			}
+		}
+	}
+	return removed
+}
+
+// Get retrieves cached attr result
+func (ac *AttrCache) Get(key inodeKey) (*fuse.AttrOut, bool) {
+	ac.mu.RLock()
+	defer ac.mu.RUnlock()
+
+	entry, exists := ac.entries[key]
+	if !exists {
+		return nil, false
+	}
+
+	if time.Now().After(entry.expiry) {
+		go ac.removeExpired(key)
+		return nil, false
+	}
+
+	return &entry.attr, true
+}
+
+// Put stores attr result in cache
+func (ac *AttrCache) Put(key inodeKey, attr fuse.AttrOut, ttl time.Duration) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	if _, exists := ac.entries[key]; !exists {
+		ac.mem.add(ATTR_ENTRY_COST)
+	}
+	ac.entries[key] = &AttrCacheEntry{
+		attr:   attr,
+		expiry: time.Now().Add(ttl),
+	}
+}
+
+// Remove deletes an attr cache entry
+func (ac *AttrCache) Remove(key inodeKey) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.removeLocked(key)
+}
+
+func (ac *AttrCache) removeLocked(key inodeKey) {
+	if _, exists := ac.entries[key]; exists {
+		ac.mem.add(-ATTR_ENTRY_COST)
+		delete(ac.entries, key)
+	}
+}
+
+// removeExpired deletes an attr cache entry unless it was refreshed meanwhile
+func (ac *AttrCache) removeExpired(key inodeKey) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if entry, ok := ac.entries[key]; ok && time.Now().After(entry.expiry) {
+		ac.removeLocked(key)
+	}
+}
+
+// evict drops attribute records until at least bytes have been freed
+func (ac *AttrCache) evict(bytes int64) (int64, int) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	var freed int64
+	dropped := 0
+	for key := range ac.entries {
+		if freed >= bytes {
+			break
+		}
+		freed += ATTR_ENTRY_COST
+		dropped++
+		ac.removeLocked(key)
+	}
+	return freed, dropped
+}
+
+// Sweep removes all expired entries and returns how many were dropped
+func (ac *AttrCache) Sweep() int {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	now := time.Now()
+	removed := 0
+	for key, entry := range ac.entries {
+		if now.After(entry.expiry) {
+			ac.removeLocked(key)
+			removed++
+		}
+	}
+	return removed
+}
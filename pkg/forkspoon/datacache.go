@@ -0,0 +1,436 @@
+package forkspoon
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// File data is cached in blocks of this size. A miss reads the whole
+	// block from the backend, which doubles as read-ahead.
+	DATA_CACHE_BLOCK_SIZE = 1 << 20
+)
+
+// dataVersion identifies one version of a file's content: the inode plus
+// the mtime and size it had when it was opened. A file changed on the
+// backend gets a new version, so stale blocks are never served.
+type dataVersion struct {
+	key   inodeKey
+	mtime int64 // nanoseconds
+	size  int64
+}
+
+func versionFromStat(key inodeKey, st *syscall.Stat_t) dataVersion {
+	return dataVersion{
+		key:   key,
+		mtime: st.Mtim.Sec*1e9 + st.Mtim.Nsec,
+		size:  st.Size,
+	}
+}
+
+// dirName is the directory holding the version's blocks
+func (v dataVersion) dirName() string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", v.key.Dev, v.key.Ino, v.key.Gen, v.mtime, v.size)
+}
+
+func parseDataVersion(name string) (dataVersion, bool) {
+	parts := strings.Split(name, "-")
+	if len(parts) != 5 {
+		return dataVersion{}, false
+	}
+	var n [5]uint64
+	for i, p := range parts {
+		v, err := strconv.ParseUint(p, 16, 64)
+		if err != nil {
+			return dataVersion{}, false
+		}
+		n[i] = v
+	}
+	return dataVersion{key: inodeKey{Dev: n[0], Ino: n[1], Gen: n[2]}, mtime: int64(n[3]), size: int64(n[4])}, true
+}
+
+// dataBlock is one cached block
+type dataBlock struct {
+	version dataVersion
+	index   int64
+	size    int64
+}
+
+// DataCache keeps file data on a local disk (typically an SSD) in fixed
+// size blocks, evicting the least recently used ones to stay within a size
+// limit. Like a MemoryBudget it can be shared by several mounts. Blocks
+// survive restarts: the directory is indexed again when the cache is
+// opened.
+type DataCache struct {
+	dir   string
+	limit atomic.Int64
+
+	mu  sync.Mutex
+	lru *list.List // of *dataBlock, most recently used first
+
+	// Blocks by version and index, and the current version of each inode
+	// with cached blocks
+	blocks   map[dataVersion]map[int64]*list.Element
+	versions map[inodeKey]dataVersion
+	used     int64
+
+	evictions atomic.Uint64
+}
+
+// NewDataCache opens the data cache in dir, creating it if needed, with a
+// limit of limit bytes (0 for unlimited)
+func NewDataCache(dir string, limit int64) (*DataCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create data cache directory: %v", err)
+	}
+	c := &DataCache{
+		dir:      dir,
+		lru:      list.New(),
+		blocks:   make(map[dataVersion]map[int64]*list.Element),
+		versions: make(map[inodeKey]dataVersion),
+	}
+	c.limit.Store(limit)
+	if err := c.load(); err != nil {
+		return nil, fmt.Errorf("failed to index data cache: %v", err)
+	}
+	c.evict()
+	return c, nil
+}
+
+// load indexes the blocks left by an earlier run, most recently used
+// (written) first, and removes unfinished writes
+func (c *DataCache) load() error {
+	type found struct {
+		block dataBlock
+		mtime time.Time
+	}
+	var blocks []found
+
+	dirs, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		path := filepath.Join(c.dir, d.Name())
+		v, ok := parseDataVersion(d.Name())
+		if !ok || !d.IsDir() {
+			os.RemoveAll(path)
+			continue
+		}
+		files, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			index, err := strconv.ParseInt(f.Name(), 10, 64)
+			info, ierr := f.Info()
+			if err != nil || ierr != nil || !f.Type().IsRegular() || info.Size() != v.blockSize(index) {
+				os.Remove(filepath.Join(path, f.Name()))
+				continue
+			}
+			blocks = append(blocks, found{dataBlock{v, index, info.Size()}, info.ModTime()})
+		}
+	}
+
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].mtime.After(blocks[j].mtime) })
+	for _, f := range blocks {
+		b := f.block
+		if cur, ok := c.versions[b.version.key]; ok && cur != b.version {
+			// Only the newest version of a file is kept
+			c.removeBlockFile(&b)
+			continue
+		}
+		c.versions[b.version.key] = b.version
+		c.insertLocked(&b, false)
+	}
+	return nil
+}
+
+// SetLimit changes the size limit, evicting right away if it was lowered
+func (c *DataCache) SetLimit(limit int64) {
+	c.limit.Store(limit)
+	c.evict()
+}
+
+// Limit returns the size limit in bytes (0 for unlimited)
+func (c *DataCache) Limit() int64 {
+	return c.limit.Load()
+}
+
+// Used returns the bytes of cached data
+func (c *DataCache) Used() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.used
+}
+
+// Evictions returns the blocks evicted to stay within the limit
+func (c *DataCache) Evictions() uint64 {
+	return c.evictions.Load()
+}
+
+// open makes v the current version of its inode, dropping the blocks of
+// any other version
+func (c *DataCache) open(v dataVersion) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cur, ok := c.versions[v.key]; ok && cur != v {
+		c.dropLocked(cur)
+	}
+	c.versions[v.key] = v
+}
+
+// invalidate drops every cached block of an inode
+func (c *DataCache) invalidate(key inodeKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cur, ok := c.versions[key]; ok {
+		c.dropLocked(cur)
+		delete(c.versions, key)
+	}
+}
+
+func (c *DataCache) dropLocked(v dataVersion) {
+	for _, e := range c.blocks[v] {
+		c.lru.Remove(e)
+		c.used -= e.Value.(*dataBlock).size
+	}
+	delete(c.blocks, v)
+	os.RemoveAll(filepath.Join(c.dir, v.dirName()))
+}
+
+func (c *DataCache) insertLocked(b *dataBlock, front bool) {
+	byIndex := c.blocks[b.version]
+	if byIndex == nil {
+		byIndex = make(map[int64]*list.Element)
+		c.blocks[b.version] = byIndex
+	}
+	if front {
+		byIndex[b.index] = c.lru.PushFront(b)
+	} else {
+		byIndex[b.index] = c.lru.PushBack(b)
+	}
+	c.used += b.size
+}
+
+// removeLocked takes a block out of the index; the file is left alone
+func (c *DataCache) removeLocked(b *dataBlock) {
+	byIndex := c.blocks[b.version]
+	e, ok := byIndex[b.index]
+	if !ok || e.Value.(*dataBlock) != b {
+		return
+	}
+	c.lru.Remove(e)
+	c.used -= b.size
+	delete(byIndex, b.index)
+	if len(byIndex) == 0 {
+		delete(c.blocks, b.version)
+		if c.versions[b.version.key] == b.version {
+			delete(c.versions, b.version.key)
+		}
+	}
+}
+
+// blockPath is where a block is stored
+func (c *DataCache) blockPath(v dataVersion, index int64) string {
+	return filepath.Join(c.dir, v.dirName(), strconv.FormatInt(index, 10))
+}
+
+// blockBuffers holds the buffers misses read whole blocks into
+var blockBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, DATA_CACHE_BLOCK_SIZE)
+		return &buf
+	},
+}
+
+// get reads the part of a cached block starting at off into dest. ok is
+// false on a miss.
+func (c *DataCache) get(v dataVersion, index int64, dest []byte, off int64) (n int, ok bool) {
+	c.mu.Lock()
+	e, ok := c.blocks[v][index]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return 0, false
+	}
+
+	b := e.Value.(*dataBlock)
+	if off >= b.size {
+		return 0, true
+	}
+	if rest := b.size - off; int64(len(dest)) > rest {
+		dest = dest[:rest]
+	}
+	f, err := os.Open(c.blockPath(v, index))
+	if err == nil {
+		n, err = f.ReadAt(dest, off)
+		f.Close()
+	}
+	if err != nil {
+		// Removed behind our back
+		c.mu.Lock()
+		c.removeLocked(b)
+		c.mu.Unlock()
+		return 0, false
+	}
+	return n, true
+}
+
+// put stores a block read from the backend. Short blocks (the file changed
+// while being read) and blocks of versions that have been replaced are not
+// stored.
+func (c *DataCache) put(v dataVersion, index int64, data []byte) {
+	b := &dataBlock{v, index, int64(len(data))}
+	if b.size == 0 || b.size != v.blockSize(index) {
+		return
+	}
+	c.mu.Lock()
+	_, have := c.blocks[v][index]
+	cur, known := c.versions[v.key]
+	c.mu.Unlock()
+	if have || (known && cur != v) {
+		return
+	}
+
+	dir := filepath.Join(c.dir, v.dirName())
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.blockPath(v, index))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	c.mu.Lock()
+	_, have = c.blocks[v][index]
+	cur, known = c.versions[v.key]
+	switch {
+	case have:
+	case known && cur != v:
+		// Replaced while we were writing
+		c.removeBlockFile(b)
+	default:
+		c.versions[v.key] = v
+		c.insertLocked(b, true)
+	}
+	c.mu.Unlock()
+	c.evict()
+}
+
+// evict removes the least recently used blocks until the cache is within
+// its limit
+func (c *DataCache) evict() {
+	limit := c.limit.Load()
+	if limit <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.used > limit {
+		e := c.lru.Back()
+		if e == nil {
+			return
+		}
+		b := e.Value.(*dataBlock)
+		c.removeLocked(b)
+		c.removeBlockFile(b)
+		c.evictions.Add(1)
+	}
+}
+
+func (c *DataCache) removeBlockFile(b *dataBlock) {
+	os.Remove(c.blockPath(b.version, b.index))
+}
+
+// blockSize is the size of block index of the version: a full block, or
+// what is left at the end of the file
+func (v dataVersion) blockSize(index int64) int64 {
+	size := v.size - index*DATA_CACHE_BLOCK_SIZE
+	if size > DATA_CACHE_BLOCK_SIZE {
+		size = DATA_CACHE_BLOCK_SIZE
+	}
+	if size < 0 {
+		size = 0
+	}
+	return size
+}
+
+// read serves a READ of the version from the cache, filling misses from
+// file. hit is true when no block had to be read from the backend.
+func (c *DataCache) read(file File, v dataVersion, dest []byte, off int64) (n int, hit bool, err error) {
+	if off >= v.size {
+		return 0, true, nil
+	}
+	end := off + int64(len(dest))
+	if end > v.size {
+		end = v.size
+	}
+
+	hit = true
+	var block []byte
+	for pos := off; pos < end; {
+		index := pos / DATA_CACHE_BLOCK_SIZE
+		start := index * DATA_CACHE_BLOCK_SIZE
+		stop := start + DATA_CACHE_BLOCK_SIZE
+		if end < stop {
+			stop = end
+		}
+
+		// A hit reads only the range asked for
+		if got, ok := c.get(v, index, dest[pos-off:stop-off], pos-start); ok {
+			n += got
+			if pos+int64(got) < stop {
+				break
+			}
+			pos = stop
+			continue
+		}
+
+		hit = false
+		if block == nil {
+			buf := blockBuffers.Get().(*[]byte)
+			defer blockBuffers.Put(buf)
+			block = *buf
+		}
+		got, err := file.Pread(block[:v.blockSize(index)], start)
+		if err != nil {
+			return n, hit, err
+		}
+		c.put(v, index, block[:got])
+
+		// A short block means the file shrank; stop there like pread
+		avail := start + int64(got)
+		if avail <= pos {
+			break
+		}
+		if avail < stop {
+			stop = avail
+		}
+		n += copy(dest[pos-off:], block[pos-start:stop-start])
+		pos = stop
+	}
+	return n, hit, nil
+}
@@ -0,0 +1,170 @@
+package forkspoon
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// openVersion opens path on b for reading through c
+func openVersion(t *testing.T, c *DataCache, b Backend, path string) (File, dataVersion) {
+	t.Helper()
+	f, err := b.Open(path, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	var st syscall.Stat_t
+	key, err := fstatKey(f, &st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := versionFromStat(key, &st)
+	c.open(v)
+	return f, v
+}
+
+func TestDataCacheReadsThroughBlocks(t *testing.T) {
+	c, err := NewDataCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("0123456789"), DATA_CACHE_BLOCK_SIZE/4)
+	b := NewMemoryBackend()
+	if err := b.WriteFile("f", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fb := NewFaultBackend(b)
+	f, v := openVersion(t, c, fb, "f")
+
+	// Straddles the first two blocks, then the short last one
+	for _, off := range []int64{DATA_CACHE_BLOCK_SIZE - 100, int64(len(content)) - 50} {
+		dest := make([]byte, 200)
+		n, hit, err := c.read(f, v, dest, off)
+		if err != nil || hit {
+			t.Fatalf("read at %d: hit %v, err %v; want a miss", off, hit, err)
+		}
+		want := content[off:min(off+200, int64(len(content)))]
+		if !bytes.Equal(dest[:n], want) {
+			t.Fatalf("read at %d returned %d wrong bytes", off, n)
+		}
+	}
+	if c.Used() != int64(len(content)) {
+		t.Errorf("used = %d, want %d", c.Used(), len(content))
+	}
+
+	fb.ResetCalls()
+	dest := make([]byte, len(content)+10)
+	n, hit, err := c.read(f, v, dest, 0)
+	if err != nil || !hit || !bytes.Equal(dest[:n], content) {
+		t.Errorf("whole-file read: %d bytes, hit %v, err %v", n, hit, err)
+	}
+	// Hits read only the range asked for, within and across blocks
+	for _, off := range []int64{10, DATA_CACHE_BLOCK_SIZE - 100, DATA_CACHE_BLOCK_SIZE + 7, int64(len(content)) - 50} {
+		dest := make([]byte, 200)
+		n, hit, err := c.read(f, v, dest, off)
+		want := content[off:min(off+200, int64(len(content)))]
+		if err != nil || !hit || !bytes.Equal(dest[:n], want) {
+			t.Errorf("cached read at %d: %d bytes, hit %v, err %v", off, n, hit, err)
+		}
+	}
+	if calls := fb.Calls(FAULT_READ); calls != 0 {
+		t.Errorf("cached read went to the backend %d times", calls)
+	}
+}
+
+func TestDataCacheDetectsChanges(t *testing.T) {
+	c, err := NewDataCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewMemoryBackend()
+	b.WriteFile("f", []byte("old content"), 0644)
+	f, v := openVersion(t, c, b, "f")
+	dest := make([]byte, 64)
+	c.read(f, v, dest, 0)
+
+	b.WriteFile("f", []byte("new content!"), 0644)
+	f2, v2 := openVersion(t, c, b, "f")
+	if v2 == v {
+		t.Fatal("rewritten file has the same version")
+	}
+	n, hit, err := c.read(f2, v2, dest, 0)
+	if err != nil || hit || string(dest[:n]) != "new content!" {
+		t.Errorf("read after change = %q, hit %v, err %v", dest[:n], hit, err)
+	}
+	if c.Used() != int64(len("new content!")) {
+		t.Errorf("old version still cached: used = %d", c.Used())
+	}
+}
+
+func TestDataCacheEvictsLRUAndSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewDataCache(dir, 3*DATA_CACHE_BLOCK_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewMemoryBackend()
+	block := make([]byte, DATA_CACHE_BLOCK_SIZE)
+	names := []string{"a", "b", "c", "d"}
+	for _, name := range names {
+		b.WriteFile(name, block, 0644)
+	}
+	dest := make([]byte, 10)
+	read := func(name string) bool {
+		f, v := openVersion(t, c, b, name)
+		_, hit, err := c.read(f, v, dest, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hit
+	}
+	read("a")
+	read("b")
+	read("c")
+	read("a") // b is now the least recently used
+	read("d")
+
+	if c.Used() != 3*DATA_CACHE_BLOCK_SIZE || c.Evictions() != 1 {
+		t.Errorf("used %d, %d evictions; want 3 blocks and 1 eviction", c.Used(), c.Evictions())
+	}
+	if read("b") {
+		t.Error("least recently used block was not evicted")
+	}
+
+	// What is on disk is indexed again, within a lower limit
+	c2, err := NewDataCache(dir, 2*DATA_CACHE_BLOCK_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2.Used() != 2*DATA_CACHE_BLOCK_SIZE {
+		t.Errorf("reopened cache holds %d bytes", c2.Used())
+	}
+	c = c2
+	if !read("b") {
+		t.Error("block cached before the restart was not found")
+	}
+}
+
+func TestDataCachePolicy(t *testing.T) {
+	o := CacheOptions{DataCachePaths: []string{"/tools", "/data/sets/"}, DataCacheMaxFileSize: 1000}
+	for _, tc := range []struct {
+		path string
+		size int64
+		want bool
+	}{
+		{"tools/gcc", 10, true},
+		{"data/sets/x/y", 10, true},
+		{"toolsx/gcc", 10, false},
+		{"home/f", 10, false},
+		{"tools/big", 1001, false},
+	} {
+		if got := o.dataCacheable(tc.path, tc.size); got != tc.want {
+			t.Errorf("%s (%d bytes): cacheable = %v, want %v", tc.path, tc.size, got, tc.want)
+		}
+	}
+	if (&CacheOptions{DataCachePaths: []string{"/"}}).dataCacheable("any/file", 1<<40) != true {
+		t.Error(`"/" does not select everything`)
+	}
+}
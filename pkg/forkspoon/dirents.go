@@ -0,0 +1,191 @@
+package forkspoon
+
+import (
+	"context"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// entryStat is what a directory fill learned about the inode of an entry
+type entryStat struct {
+	key inodeKey
+	st  syscall.Stat_t
+}
+
+// statEntries stats every entry of dir using a pool of workers, filling in
+// the full mode, and returns the stats alongside the entries ("." and ".."
+// are passed through as listed, with no stat). Entries that vanished since
+// they were listed are removed from the result.
+func statEntries(dir DirReader, entries []fuse.DirEntry, workers int) ([]fuse.DirEntry, []*entryStat) {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(entries) {
+		workers = len(entries)
+	}
+
+	ok := make([]bool, len(entries))
+	stats := make([]*entryStat, len(entries))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				if isDotEntry(entries[i].Name) {
+					ok[i] = true
+					continue
+				}
+
+				es := &entryStat{}
+				key, err := lstatKey(dir, entries[i].Name, &es.st)
+				if err != nil {
+					continue
+				}
+				es.key = key
+				entries[i].Mode = es.st.Mode
+				entries[i].Ino = es.st.Ino
+				ok[i] = true
+				stats[i] = es
+			}
+		}()
+	}
+	for i := range entries {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	kept := entries[:0]
+	keptStats := stats[:0]
+	for i, e := range entries {
+		if ok[i] {
+			kept = append(kept, e)
+			keptStats = append(keptStats, stats[i])
+		}
+	}
+	return kept, keptStats
+}
+
+// resolveUnknownMode fills in the file type of an entry whose d_type was
+// DT_UNKNOWN (some NFS servers and older filesystems never report it)
+func resolveUnknownMode(dir DirReader, e *fuse.DirEntry) bool {
+	if e.Mode != 0 {
+		return true
+	}
+	if isDotEntry(e.Name) {
+		e.Mode = syscall.S_IFDIR
+		return true
+	}
+	var st syscall.Stat_t
+	if err := dir.Lstat(e.Name, &st); err != nil {
+		return false
+	}
+	e.Mode = st.Mode
+	return true
+}
+
+// isDotEntry reports whether name is one of the "." and ".." entries every
+// directory lists
+func isDotEntry(name string) bool {
+	return name == "." || name == ".."
+}
+
+// StreamingDirStream lists directories too large to hold in dirCache. It
+// first replays the entries read while deciding not to cache, then keeps
+// pulling entries from the backend as go-fuse consumes them. Entry offsets
+// are the backend's own cookies (d_off for the POSIX backend), so
+// telldir/seekdir map straight onto a seek of the backend directory.
+type StreamingDirStream struct {
+	mu      sync.Mutex
+	reader  DirReader
+	pending []fuse.DirEntry
+	next    *fuse.DirEntry
+	errno   syscall.Errno
+}
+
+func newStreamingDirStream(reader DirReader, pending []fuse.DirEntry) *StreamingDirStream {
+	return &StreamingDirStream{reader: reader, pending: pending}
+}
+
+// fill makes sure s.next holds the following entry, if there is one
+func (s *StreamingDirStream) fill() {
+	for s.next == nil && s.errno == 0 {
+		var e fuse.DirEntry
+		if len(s.pending) > 0 {
+			e = s.pending[0]
+			s.pending = s.pending[1:]
+		} else {
+			if s.reader == nil {
+				return
+			}
+			var ok bool
+			var err error
+			e, ok, err = s.reader.Next()
+			if err != nil {
+				s.errno = fs.ToErrno(err)
+				return
+			}
+			if !ok {
+				return
+			}
+		}
+		if s.reader != nil && !resolveUnknownMode(s.reader, &e) {
+			// Removed while we were listing
+			continue
+		}
+		s.next = &e
+	}
+}
+
+func (s *StreamingDirStream) HasNext() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fill()
+	return s.next != nil || s.errno != 0
+}
+
+func (s *StreamingDirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fill()
+	if s.next == nil {
+		if s.errno != 0 {
+			return fuse.DirEntry{}, s.errno
+		}
+		return fuse.DirEntry{}, syscall.ENOENT
+	}
+	e := *s.next
+	s.next = nil
+	return e, 0
+}
+
+// Seekdir repositions the stream at an offset previously returned in
+// DirEntry.Off (0 rewinds)
+func (s *StreamingDirStream) Seekdir(ctx context.Context, off uint64) syscall.Errno {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reader == nil {
+		return syscall.EBADF
+	}
+	if err := s.reader.Seek(off); err != nil {
+		return fs.ToErrno(err)
+	}
+	s.pending = nil
+	s.next = nil
+	s.errno = 0
+	return 0
+}
+
+func (s *StreamingDirStream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader = nil
+	}
+}
@@ -0,0 +1,124 @@
+package forkspoon
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// dirHandle is an open directory. The listing is fetched once, on the first
+// read, and the handle keeps serving that snapshot until it is rewound, so
+// entries created or removed while a program walks the directory can't make
+// it see duplicates or skip names between two getdents calls.
+type dirHandle struct {
+	mu     sync.Mutex
+	m      *Mount
+	rel    string
+	key    inodeKey
+	stream fs.DirStream
+
+	// The directory node's hand-off to Lookup, see plusEntry
+	plus *atomic.Pointer[plusEntry]
+}
+
+// plusEntry passes the attributes a listing gathered for an entry to the
+// Lookup that fills the entry in a READDIRPLUS reply. go-fuse v2.8 has no
+// way for a directory stream to return attributes itself: it takes each
+// entry from the handle, then calls the directory node's Lookup for it with
+// the same request context. The handle leaves the entry here, and Lookup
+// answers from it instead of going to the caches or the backend.
+type plusEntry struct {
+	ctx  context.Context
+	name string
+	stat *entryStat
+}
+
+var _ = (fs.FileReaddirenter)((*dirHandle)(nil))
+var _ = (fs.FileSeekdirer)((*dirHandle)(nil))
+var _ = (fs.FileReleasedirer)((*dirHandle)(nil))
+
+func newDirHandle(m *Mount, rel string, key inodeKey, plus *atomic.Pointer[plusEntry]) *dirHandle {
+	return &dirHandle{m: m, rel: rel, key: key, plus: plus}
+}
+
+// load takes a fresh snapshot of the directory (from dirCache if possible)
+func (d *dirHandle) load(ctx context.Context) syscall.Errno {
+	if d.stream != nil {
+		d.stream.Close()
+		d.stream = nil
+	}
+	stream, errno := d.m.readdirCached(ctx, d.rel, d.key)
+	if errno != 0 {
+		return errno
+	}
+	d.stream = stream
+	return 0
+}
+
+// Readdirent returns the next entry, or nil at the end of the directory
+func (d *dirHandle) Readdirent(ctx context.Context) (*fuse.DirEntry, syscall.Errno) {
+	defer d.m.trackRequest()()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stream == nil {
+		if errno := d.load(ctx); errno != 0 {
+			return nil, errno
+		}
+	}
+	if !d.stream.HasNext() {
+		return nil, 0
+	}
+	e, errno := d.stream.Next()
+	if errno != 0 {
+		return nil, errno
+	}
+	if s, ok := d.stream.(*CachedDirStream); ok {
+		if es := s.lastStat(d.m.ttlFor(filepath.Join(d.rel, e.Name))); es != nil {
+			d.plus.Store(&plusEntry{ctx: ctx, name: e.Name, stat: es})
+		}
+	}
+	return &e, 0
+}
+
+// Seekdir implements seekdir(3)/rewinddir(3). Offset 0 takes a new snapshot,
+// as POSIX requires rewinddir to pick up changes; other offsets position the
+// current snapshot.
+func (d *dirHandle) Seekdir(ctx context.Context, off uint64) syscall.Errno {
+	defer d.m.trackRequest()()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if off == 0 {
+		if _, streaming := d.stream.(*StreamingDirStream); !streaming {
+			return d.load(ctx)
+		}
+	}
+	if d.stream == nil {
+		if errno := d.load(ctx); errno != 0 {
+			return errno
+		}
+	}
+	if sd, ok := d.stream.(fs.FileSeekdirer); ok {
+		return sd.Seekdir(ctx, off)
+	}
+	return syscall.ENOTSUP
+}
+
+// Releasedir drops the snapshot
+func (d *dirHandle) Releasedir(ctx context.Context, releaseFlags uint32) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stream != nil {
+		d.stream.Close()
+		d.stream = nil
+	}
+}
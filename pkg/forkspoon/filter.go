@@ -0,0 +1,151 @@
+package forkspoon
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// PathFilter limits what a mount exposes of its backend, as glob patterns
+// (path.Match) on paths relative to the backend root. Hidden entries are
+// left out of directory listings and looking them up fails with ENOENT;
+// creating or renaming something to their names fails with EACCES.
+//
+// Include, if not empty, lists the subtrees exposed: patterns starting with
+// "/", matched component by component, so "/teams/*/shared" exposes every
+// team's shared directory and everything below, plus the directories on
+// the way to them. Exclude hides entries and everything below them, after
+// Include: "/teams/beta" the one directory, and a pattern without "/" like
+// ".snapshot" or "*.tmp" entries of that name anywhere.
+type PathFilter struct {
+	Include []string
+	Exclude []string
+}
+
+// Validate checks the patterns
+func (f *PathFilter) Validate() error {
+	for i, p := range f.Include {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("include[%d]: %q must start with /", i, p)
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("include[%d]: bad pattern %q: %v", i, p, err)
+		}
+	}
+	for i, p := range f.Exclude {
+		if strings.Contains(strings.TrimPrefix(p, "/"), "/") && !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("exclude[%d]: %q must start with / or be a single name", i, p)
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("exclude[%d]: bad pattern %q: %v", i, p, err)
+		}
+	}
+	return nil
+}
+
+// hides reports whether the entry at rel, a path relative to the backend
+// root, is hidden. The root never is.
+func (f *PathFilter) hides(rel string) bool {
+	names := splitNames(rel)
+	if len(names) == 0 {
+		return false
+	}
+	if len(f.Include) > 0 {
+		included := false
+		for _, p := range f.Include {
+			// On the way to the subtree, in it or below it
+			pattern := splitNames(p)
+			n := len(names)
+			if len(pattern) < n {
+				n = len(pattern)
+			}
+			if matchNames(pattern[:n], names[:n]) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return true
+		}
+	}
+	for _, p := range f.Exclude {
+		if !strings.HasPrefix(p, "/") {
+			for _, name := range names {
+				if ok, _ := path.Match(p, name); ok {
+					return true
+				}
+			}
+			continue
+		}
+		pattern := splitNames(p)
+		if len(pattern) <= len(names) && matchNames(pattern, names[:len(pattern)]) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitNames returns the components of a path
+func splitNames(p string) []string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// matchNames reports whether every name matches the pattern at its place
+func matchNames(patterns, names []string) bool {
+	for i, p := range patterns {
+		if ok, _ := path.Match(p, names[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// hidden reports whether the filter hides rel
+func (m *Mount) hidden(rel string) bool {
+	return m.cfg.Filter != nil && m.cfg.Filter.hides(rel)
+}
+
+// filteredDirReader leaves the entries the filter hides out of a listing
+type filteredDirReader struct {
+	DirReader
+	m      *Mount
+	dirRel string
+}
+
+// filterDir wraps the listing of dirRel when the mount has a filter
+func (m *Mount) filterDir(r DirReader, dirRel string) DirReader {
+	if m.cfg.Filter == nil {
+		return r
+	}
+	return &filteredDirReader{DirReader: r, m: m, dirRel: dirRel}
+}
+
+// LstatGen keeps the generations of the backend's reader, so a filtered
+// listing keys its entries like lookups do
+func (r *filteredDirReader) LstatGen(name string, st *syscall.Stat_t) (uint64, error) {
+	if g, ok := r.DirReader.(GenLstater); ok {
+		return g.LstatGen(name, st)
+	}
+	return 0, r.DirReader.Lstat(name, st)
+}
+
+func (r *filteredDirReader) Next() (fuse.DirEntry, bool, error) {
+	for {
+		e, ok, err := r.DirReader.Next()
+		if err != nil || !ok {
+			return e, ok, err
+		}
+		if e.Name == "." || e.Name == ".." || !r.m.cfg.Filter.hides(path.Join(r.dirRel, e.Name)) {
+			return e, ok, nil
+		}
+		atomic.AddUint64(&r.m.metrics.FilteredEntries, 1)
+	}
+}
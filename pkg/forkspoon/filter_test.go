@@ -0,0 +1,42 @@
+package forkspoon
+
+import "testing"
+
+func TestPathFilter(t *testing.T) {
+	f := &PathFilter{
+		Include: []string{"/teams/*/shared", "/README"},
+		Exclude: []string{".snapshot", "*.tmp", "/teams/beta"},
+	}
+	if err := f.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for rel, want := range map[string]bool{
+		"":                                      false,
+		"README":                                false,
+		"other":                                 true,
+		"teams":                                 false,
+		"teams/alpha":                           false,
+		"teams/alpha/private":                   true,
+		"teams/alpha/shared":                    false,
+		"teams/alpha/shared/a/b":                false,
+		"teams/alpha/shared/x.tmp":              true,
+		"teams/alpha/shared/.snapshot/hourly.0": true,
+		"teams/beta":                            true,
+		"teams/beta/shared":                     true,
+	} {
+		if got := f.hides(rel); got != want {
+			t.Errorf("hides(%q) = %v, want %v", rel, got, want)
+		}
+	}
+
+	for _, bad := range []PathFilter{
+		{Include: []string{"teams"}},
+		{Include: []string{"/[a"}},
+		{Exclude: []string{"teams/beta"}},
+		{Exclude: []string{"[a"}},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("%+v: no error", bad)
+		}
+	}
+}
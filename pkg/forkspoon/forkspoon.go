@@ -0,0 +1,265 @@
+// Package forkspoon is a caching FUSE filesystem. It serves a Backend (by
+// default a local or NFS directory) at a mountpoint and keeps the metadata
+// the kernel asks for over and over (LOOKUP, GETATTR, READDIR) in memory,
+// while data operations go through to the backend. Optionally, the data of
+// read-only files can be cached on local disk too (see DataCache), and
+// mounts of the same export on several hosts can keep their caches coherent
+// (see InvalidationBus).
+//
+// A minimal embedding:
+//
+//	m, err := forkspoon.New(forkspoon.Config{
+//		BackendPath: "/srv/nfs",
+//		Mountpoint:  "/mnt/cached",
+//		Cache:       forkspoon.CacheOptions{TTL: 30 * time.Second},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	if err := m.Start(); err != nil {
+//		return err
+//	}
+//	defer m.Unmount()
+//	m.Wait()
+package forkspoon
+
+import (
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// Default cache metadata TTL, and the one for read-only mounts, where
+	// only changes made outside the mount can make entries stale
+	DEFAULT_CACHE_TTL           = 30 * time.Second
+	DEFAULT_READ_ONLY_CACHE_TTL = 10 * time.Minute
+
+	// Defaults for the directory enumeration settings
+	DEFAULT_READDIR_STAT_WORKERS     = 8
+	DEFAULT_READDIR_STREAM_THRESHOLD = 100000
+
+	// How long Start waits for the backend and the new mount to answer
+	DEFAULT_READY_TIMEOUT = 30 * time.Second
+
+	// Defaults for the write-back buffer of a file: flushed at this size,
+	// or this long after the first buffered write
+	DEFAULT_WRITE_BACK_SIZE  = 1 << 20
+	DEFAULT_WRITE_BACK_DELAY = time.Second
+)
+
+// Config describes one mount
+type Config struct {
+	// Name labels the mount in logs and transaction records
+	Name string
+
+	// Backend serves the files. When nil, BackendPath is served through
+	// the POSIX passthrough backend.
+	Backend Backend
+
+	// BackendPath is the backend directory. It is also what paths are
+	// shown relative to in logs, and it keeps the mountpoint from being
+	// placed inside the backend, so set it for custom backends that live
+	// on disk too.
+	BackendPath string
+
+	// Mountpoint is where the filesystem is mounted. It is created if it
+	// doesn't exist.
+	Mountpoint string
+
+	Cache CacheOptions
+
+	// FUSE mount options. DirectMount calls mount(2) itself when running
+	// as root instead of going through fusermount.
+	AllowOther  bool
+	Debug       bool
+	DirectMount bool
+
+	// ReadOnly mounts with MS_RDONLY, and every operation that would
+	// change the backend fails with EROFS even if it gets past the
+	// kernel. As nothing changes through the mount, the kernel keeps file
+	// contents across opens (FOPEN_KEEP_CACHE) and caches directory
+	// listings (FOPEN_CACHE_DIR), both until the attributes change.
+	ReadOnly bool
+
+	// IDMap, if set, translates file ownership between the mount and the
+	// backend and squashes callers (see IDMap). It needs a Backend that
+	// implements AttrSetter to set the owner of new files.
+	IDMap *IDMap
+
+	// Filter, if set, hides parts of the backend (see PathFilter)
+	Filter *PathFilter
+
+	// Detach a dead FUSE mount left at the mountpoint instead of failing,
+	// and allow mounting over a non-empty directory
+	UnmountStale  bool
+	AllowNonEmpty bool
+
+	// How long Start waits for the mount to answer (DEFAULT_READY_TIMEOUT
+	// when zero)
+	ReadyTimeout time.Duration
+
+	// CheckMountpoint, when set, is called with the resolved mountpoint
+	// before mounting; an error aborts Start. Daemons serving several
+	// mounts use it to keep them from overlapping.
+	CheckMountpoint func(mountpoint string) error
+
+	// Budget is shared by mounts whose caches have a common memory limit.
+	// Nil means no limit.
+	Budget *MemoryBudget
+
+	// DataCache, if set, caches the data of the files selected by
+	// CacheOptions.DataCachePaths on local disk. It can be shared by
+	// several mounts.
+	DataCache *DataCache
+
+	// Invalidation, if set, tells the other mounts of the export about
+	// changes made through this one and applies theirs. It can be shared
+	// by several mounts. InvalidationExport names the export on the bus;
+	// mounts of the same backend must agree on it (default BackendPath).
+	Invalidation       *InvalidationBus
+	InvalidationExport string
+
+	// TransactionLog receives a record of every operation, if set
+	TransactionLog TransactionLogger
+
+	// AuditLog, if set, receives a record of every CREATE, MKDIR, UNLINK,
+	// RMDIR, RENAME and SETATTR, and of every OPEN for writing, whether it
+	// succeeds or not (rejections with EROFS included). It is called
+	// before the request is answered, so it should not drop records.
+	AuditLog TransactionLogger
+
+	// Log every operation to the standard logger
+	Verbose bool
+}
+
+// CacheOptions are the cache settings of a mount. They can be changed
+// while the mount is running with SetCacheOptions.
+type CacheOptions struct {
+	// How long metadata is cached, by us and by the kernel
+	TTL time.Duration
+
+	// Per-subtree TTLs; the longest matching path wins
+	Policies []PathPolicy
+
+	// Stat directory entries during READDIR to seed the lookup and
+	// attribute caches, with this many parallel workers
+	ReaddirAttrs       bool
+	ReaddirStatWorkers int
+
+	// Stream (and don't cache) directories with more entries than this
+	// (0 = never)
+	ReaddirStreamThreshold int
+
+	// Subtrees whose file data goes through Config.DataCache, as paths
+	// relative to the backend root ("/" for all), and the largest file
+	// cached (0 = no limit). Only files opened read-only are cached.
+	DataCachePaths       []string
+	DataCacheMaxFileSize int64
+
+	// Write-back: writes to files below WriteBackPaths are buffered per
+	// open file and adjacent ones coalesced, unless a longer entry of
+	// WriteThroughPaths covers the file. A buffer is written to the
+	// backend once it holds WriteBackSize bytes, WriteBackDelay after its
+	// first write, and on flush (close), fsync and release; write errors
+	// are reported by the next flush or fsync. Zero size and delay mean
+	// DEFAULT_WRITE_BACK_SIZE and DEFAULT_WRITE_BACK_DELAY.
+	WriteBackPaths    []string
+	WriteThroughPaths []string
+	WriteBackSize     int
+	WriteBackDelay    time.Duration
+}
+
+// PathPolicy overrides the cache TTL for a subtree. Path is relative to
+// the backend root and starts with "/".
+type PathPolicy struct {
+	Path string
+	TTL  time.Duration
+}
+
+// TTLFor returns the cache TTL for a path relative to the backend root:
+// that of the longest policy path containing it, or the default TTL
+func (o *CacheOptions) TTLFor(rel string) time.Duration {
+	rel = "/" + strings.TrimPrefix(rel, "/")
+	ttl, longest := o.TTL, -1
+	for _, pp := range o.Policies {
+		p := strings.TrimSuffix(pp.Path, "/")
+		if len(p) > longest && (rel == p || p == "" || strings.HasPrefix(rel, p+"/")) {
+			ttl, longest = pp.TTL, len(p)
+		}
+	}
+	return ttl
+}
+
+// longestMatch returns the length of the longest of paths containing rel,
+// a path relative to the backend root, or -1 if none does
+func longestMatch(paths []string, rel string) int {
+	rel = "/" + strings.TrimPrefix(rel, "/")
+	longest := -1
+	for _, pp := range paths {
+		p := strings.TrimSuffix(pp, "/")
+		if len(p) > longest && (rel == p || p == "" || strings.HasPrefix(rel, p+"/")) {
+			longest = len(p)
+		}
+	}
+	return longest
+}
+
+// dataCacheable reports whether the data of a file of the given size at a
+// path relative to the backend root is eligible for the data cache
+func (o *CacheOptions) dataCacheable(rel string, size int64) bool {
+	if o.DataCacheMaxFileSize > 0 && size > o.DataCacheMaxFileSize {
+		return false
+	}
+	return longestMatch(o.DataCachePaths, rel) >= 0
+}
+
+// writeBack reports whether writes to a path relative to the backend root
+// are buffered
+func (o *CacheOptions) writeBack(rel string) bool {
+	wb := longestMatch(o.WriteBackPaths, rel)
+	return wb >= 0 && wb > longestMatch(o.WriteThroughPaths, rel)
+}
+
+// Transaction is one operation served by a mount
+type Transaction struct {
+	// When the operation started, and how long it took
+	Time     time.Time
+	Duration time.Duration
+
+	Mount string
+	Op    string
+
+	// Backend path (both paths for RENAME)
+	Path string
+
+	// Served from the cache; only meaningful for GETATTR, LOOKUP,
+	// READDIR and, with a data cache, READ
+	Cached bool
+
+	// Result of the operation, 0 for success
+	Errno syscall.Errno
+
+	// The process that made the request, as reported by the kernel (Pid
+	// is the id of the calling thread, which only differs from the
+	// process id in multi-threaded programs). Process, its command name,
+	// is left for loggers to fill in with ProcessName once they know they
+	// keep the record: reading it costs a file read per request.
+	Pid     uint32
+	Uid     uint32
+	Gid     uint32
+	Process string
+
+	// File offset and bytes transferred, for READ and WRITE
+	Offset int64
+	Bytes  int64
+
+	// Open flags, for OPEN and CREATE
+	Flags uint32
+}
+
+// TransactionLogger records the operations a mount serves. It is called
+// from the request handlers and must be safe for concurrent use.
+type TransactionLogger interface {
+	LogTransaction(t *Transaction)
+}
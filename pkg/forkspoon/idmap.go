@@ -0,0 +1,196 @@
+package forkspoon
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+const (
+	// Squash modes of an IDMap: no squashing, requests from root only,
+	// or every request
+	SQUASH_NONE = ""
+	SQUASH_ROOT = "root"
+	SQUASH_ALL  = "all"
+
+	// Owner of the files created by squashed callers, by default: the
+	// overflow id ("nobody")
+	DEFAULT_ANON_ID = 65534
+)
+
+// IDRange maps Count consecutive ids starting at Mount, as seen on the
+// mount, to the ids starting at Backend, as stored on the backend (like a
+// line of /proc/<pid>/uid_map). Count 0 means 1.
+type IDRange struct {
+	Mount   uint32
+	Backend uint32
+	Count   uint32
+}
+
+// IDMap translates file ownership between the mount and the backend, for
+// clients whose numeric ids differ from the server's (user namespaces,
+// different directories). Owners returned by GETATTR, LOOKUP and the
+// attributes cached during READDIR are mapped to mount ids; ownership
+// given by CREATE, MKDIR (the caller) and SETATTR (chown) is mapped to
+// backend ids. Ids no range covers are passed through unchanged.
+//
+// Squash replaces the callers that create files and the ownership they
+// ask for: with SQUASH_ROOT requests from uid 0, with SQUASH_ALL every
+// request, are treated as coming from AnonUID/AnonGID (DEFAULT_ANON_ID
+// when zero, as squashing to root would be pointless). Squashed callers
+// cannot chown.
+type IDMap struct {
+	UIDs []IDRange
+	GIDs []IDRange
+
+	Squash           string
+	AnonUID, AnonGID uint32
+}
+
+// Validate checks that the squash mode is known and that no two ranges
+// overlap on either side, so the mapping can be reversed
+func (im *IDMap) Validate() error {
+	switch im.Squash {
+	case SQUASH_NONE, SQUASH_ROOT, SQUASH_ALL:
+	default:
+		return fmt.Errorf("unknown squash mode %q (use %q or %q)", im.Squash, SQUASH_ROOT, SQUASH_ALL)
+	}
+	for _, t := range []struct {
+		kind   string
+		ranges []IDRange
+	}{{"uid", im.UIDs}, {"gid", im.GIDs}} {
+		for i, a := range t.ranges {
+			if uint64(a.Mount)+uint64(a.count()) > 1<<32 || uint64(a.Backend)+uint64(a.count()) > 1<<32 {
+				return fmt.Errorf("%s range %d:%d:%d runs past the largest id", t.kind, a.Mount, a.Backend, a.count())
+			}
+			for _, b := range t.ranges[:i] {
+				if overlaps(a.Mount, b.Mount, a.count(), b.count()) || overlaps(a.Backend, b.Backend, a.count(), b.count()) {
+					return fmt.Errorf("%s ranges %d:%d:%d and %d:%d:%d overlap", t.kind, b.Mount, b.Backend, b.count(), a.Mount, a.Backend, a.count())
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (r IDRange) count() uint32 {
+	if r.Count == 0 {
+		return 1
+	}
+	return r.Count
+}
+
+func overlaps(a, b, na, nb uint32) bool {
+	return uint64(a) < uint64(b)+uint64(nb) && uint64(b) < uint64(a)+uint64(na)
+}
+
+// mapID translates id through ranges, from the mount side to the backend
+// side or the other way
+func mapID(ranges []IDRange, id uint32, toBackend bool) uint32 {
+	for _, r := range ranges {
+		from, to := r.Backend, r.Mount
+		if toBackend {
+			from, to = r.Mount, r.Backend
+		}
+		if id >= from && uint64(id) < uint64(from)+uint64(r.count()) {
+			return to + (id - from)
+		}
+	}
+	return id
+}
+
+// toMount translates a backend owner to the mount's ids
+func (im *IDMap) toMount(uid, gid uint32) (uint32, uint32) {
+	return mapID(im.UIDs, uid, false), mapID(im.GIDs, gid, false)
+}
+
+// toBackend translates a mount owner to the backend's ids
+func (im *IDMap) toBackend(uid, gid uint32) (uint32, uint32) {
+	return mapID(im.UIDs, uid, true), mapID(im.GIDs, gid, true)
+}
+
+// squashed reports whether requests from uid are squashed
+func (im *IDMap) squashed(uid uint32) bool {
+	return im.Squash == SQUASH_ALL || (im.Squash == SQUASH_ROOT && uid == 0)
+}
+
+// anon returns the mount owner squashed callers are treated as
+func (im *IDMap) anon() (uint32, uint32) {
+	uid, gid := im.AnonUID, im.AnonGID
+	if uid == 0 {
+		uid = DEFAULT_ANON_ID
+	}
+	if gid == 0 {
+		gid = DEFAULT_ANON_ID
+	}
+	return uid, gid
+}
+
+// owner returns the backend owner of a file created by the caller of ctx,
+// and false when the request carries no caller
+func (im *IDMap) owner(ctx context.Context) (uid, gid uint32, ok bool) {
+	caller, ok := fuse.FromContext(ctx)
+	if !ok {
+		return 0, 0, false
+	}
+	uid, gid = caller.Uid, caller.Gid
+	if im.squashed(uid) {
+		uid, gid = im.anon()
+	}
+	uid, gid = im.toBackend(uid, gid)
+	return uid, gid, true
+}
+
+// attrFromStat fills attr from backend attributes, with the owner mapped to
+// the mount's ids
+func (m *Mount) attrFromStat(attr *fuse.Attr, st *syscall.Stat_t) {
+	attr.FromStat(st)
+	if im := m.cfg.IDMap; im != nil {
+		attr.Uid, attr.Gid = im.toMount(attr.Uid, attr.Gid)
+	}
+}
+
+// chownNew gives a file just created through the mount (name in b, see
+// Mount.at) to its creator. Failure is only logged: the file exists, owned
+// by the daemon.
+func (m *Mount) chownNew(ctx context.Context, b Backend, name, rel string) {
+	im := m.cfg.IDMap
+	if im == nil {
+		return
+	}
+	uid, gid, ok := im.owner(ctx)
+	if !ok {
+		return
+	}
+	setter, ok := b.(AttrSetter)
+	if !ok {
+		return
+	}
+	if err := setter.Lchown(name, int(uid), int(gid)); err != nil {
+		log.Printf("Setting the owner of %s to %d:%d failed: %v", m.backendPath(rel), uid, gid, err)
+	}
+}
+
+// chownTarget returns the backend owner a SETATTR asks for, -1 for the id
+// it leaves alone. Squashed callers get EPERM.
+func (m *Mount) chownTarget(ctx context.Context, in *fuse.SetAttrIn) (uid, gid int, errno syscall.Errno) {
+	u, uok := in.GetUID()
+	g, gok := in.GetGID()
+	if im := m.cfg.IDMap; im != nil {
+		if caller, ok := fuse.FromContext(ctx); ok && im.squashed(caller.Uid) {
+			return 0, 0, syscall.EPERM
+		}
+		u, g = im.toBackend(u, g)
+	}
+	uid, gid = -1, -1
+	if uok {
+		uid = int(u)
+	}
+	if gok {
+		gid = int(g)
+	}
+	return uid, gid, 0
+}
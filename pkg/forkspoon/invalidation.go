@@ -0,0 +1,531 @@
+package forkspoon
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Transports of the invalidation bus
+	INVALIDATION_UNIX      = "unix"
+	INVALIDATION_MULTICAST = "multicast"
+
+	// Largest encoded event; paths are at most PATH_MAX twice over
+	MAX_INVALIDATION_EVENT = 16 << 10
+
+	// How long a send waits for a peer whose socket buffer is full before
+	// the event is dropped for it (the peer sees the gap)
+	INVALIDATION_SEND_TIMEOUT = 50 * time.Millisecond
+
+	// Events waiting to be applied to the bus's own mounts
+	INVALIDATION_QUEUE = 4096
+
+	// Events waiting to be sent to the peers. Once full, events are
+	// dropped: the peers see the gap and drop their caches.
+	INVALIDATION_SEND_QUEUE = 4096
+)
+
+// InvalidationEvent announces a change made through one mount, so that
+// other mounts of the same export drop what they cached about it
+type InvalidationEvent struct {
+	// The bus that sent the event, and the event's number there. A gap in
+	// the generations of an origin means events were lost.
+	Origin     string `json:"origin"`
+	Generation uint64 `json:"gen"`
+
+	// Export tells apart the backends of mounts sharing a bus
+	Export string `json:"export"`
+	Op     string `json:"op"`
+
+	// Changed path relative to the export root, and where a RENAME moved it
+	Path    string `json:"path"`
+	NewPath string `json:"new_path,omitempty"`
+}
+
+// InvalidationTransport carries encoded events between the buses of
+// different processes or hosts. Send delivers one datagram to every peer
+// (delivering it back to the sender is allowed); Receive waits for the next
+// one and fails once the transport is closed. Delivery is best effort.
+type InvalidationTransport interface {
+	Send(msg []byte) error
+	Receive(buf []byte) (int, error)
+	Close() error
+}
+
+// InvalidationBus publishes the changes made through its mounts and applies
+// those made elsewhere, so caches on all mounts of an export stay coherent
+// within milliseconds instead of a TTL. Like a DataCache it can be shared
+// by several mounts; mounts of the same bus also see each other's events.
+// When events are lost, the mounts drop their whole caches.
+type InvalidationBus struct {
+	transport InvalidationTransport
+	origin    string
+
+	// Taken, and the event queued, under pubMu so that the queues hold
+	// events in the order of their generations
+	pubMu      sync.Mutex
+	generation uint64
+
+	mu     sync.Mutex
+	mounts map[*Mount]struct{}
+	last   map[string]uint64 // highest generation seen per origin
+
+	local    chan *localEvent
+	outgoing chan *outgoingEvent
+	done     chan struct{}
+
+	published atomic.Uint64
+	dropped   atomic.Uint64
+	received  atomic.Uint64
+	lost      atomic.Uint64
+}
+
+// localEvent is an event for the other mounts of the publishing bus
+type localEvent struct {
+	ev   InvalidationEvent
+	from *Mount
+}
+
+// outgoingEvent is an encoded event waiting to be sent to the peers
+type outgoingEvent struct {
+	msg  []byte
+	ev   *InvalidationEvent
+	from *Mount
+}
+
+// NewInvalidationBus starts a bus on transport. Close it once its mounts
+// have ended.
+func NewInvalidationBus(transport InvalidationTransport) *InvalidationBus {
+	id := make([]byte, 8)
+	rand.Read(id)
+	b := &InvalidationBus{
+		transport: transport,
+		origin:    hex.EncodeToString(id),
+		mounts:    make(map[*Mount]struct{}),
+		last:      make(map[string]uint64),
+		local:     make(chan *localEvent, INVALIDATION_QUEUE),
+		outgoing:  make(chan *outgoingEvent, INVALIDATION_SEND_QUEUE),
+		done:      make(chan struct{}),
+	}
+	go b.receive()
+	go b.dispatch()
+	go b.send()
+	return b
+}
+
+// Close stops the bus and closes its transport
+func (b *InvalidationBus) Close() error {
+	close(b.done)
+	return b.transport.Close()
+}
+
+// Published returns the events sent
+func (b *InvalidationBus) Published() uint64 {
+	return b.published.Load()
+}
+
+// Dropped returns the events never sent because the peers couldn't keep up
+func (b *InvalidationBus) Dropped() uint64 {
+	return b.dropped.Load()
+}
+
+// Received returns the events received from other buses
+func (b *InvalidationBus) Received() uint64 {
+	return b.received.Load()
+}
+
+// Lost returns the events known to have been missed
+func (b *InvalidationBus) Lost() uint64 {
+	return b.lost.Load()
+}
+
+func (b *InvalidationBus) subscribe(m *Mount) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mounts[m] = struct{}{}
+}
+
+func (b *InvalidationBus) unsubscribe(m *Mount) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.mounts, m)
+}
+
+// publish announces a change made through from. Handlers call it after the
+// backend operation succeeded; it only queues the event for send, never
+// waiting on the peers.
+func (b *InvalidationBus) publish(from *Mount, op, rel, newRel string) {
+	ev := InvalidationEvent{
+		Origin:  b.origin,
+		Export:  from.export(),
+		Op:      op,
+		Path:    rel,
+		NewPath: newRel,
+	}
+
+	b.pubMu.Lock()
+	defer b.pubMu.Unlock()
+	b.generation++
+	ev.Generation = b.generation
+	msg, err := json.Marshal(&ev)
+	if err == nil && len(msg) > MAX_INVALIDATION_EVENT {
+		err = fmt.Errorf("event of %d bytes is too large", len(msg))
+	}
+	if err != nil {
+		if from.verbose {
+			log.Printf("[INVALIDATE] Failed to publish %s %s: %v", op, rel, err)
+		}
+	} else {
+		// The generation is taken either way: a dropped event is a gap
+		// the peers notice with the next one
+		select {
+		case b.outgoing <- &outgoingEvent{msg, &ev, from}:
+		default:
+			b.dropped.Add(1)
+		}
+	}
+	b.published.Add(1)
+
+	// The other mounts of this bus are applied to in order by dispatch.
+	// A full queue is a gap like any lost datagram.
+	select {
+	case b.local <- &localEvent{ev, from}:
+	default:
+	}
+}
+
+// receive applies the events of other buses until the transport is closed
+func (b *InvalidationBus) receive() {
+	buf := make([]byte, MAX_INVALIDATION_EVENT)
+	for {
+		n, err := b.transport.Receive(buf)
+		if err != nil {
+			select {
+			case <-b.done:
+				return
+			default:
+			}
+			log.Printf("Invalidation bus receive failed: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		var ev InvalidationEvent
+		if err := json.Unmarshal(buf[:n], &ev); err != nil || ev.Origin == b.origin {
+			continue
+		}
+		b.received.Add(1)
+		b.deliver(&ev, nil)
+	}
+}
+
+// send hands the queued events to the transport, in order, until the bus
+// is closed
+func (b *InvalidationBus) send() {
+	for {
+		select {
+		case <-b.done:
+			return
+		case out := <-b.outgoing:
+			if err := b.transport.Send(out.msg); err != nil && out.from.verbose {
+				log.Printf("[INVALIDATE] Failed to publish %s %s: %v", out.ev.Op, out.ev.Path, err)
+			}
+		}
+	}
+}
+
+// dispatch applies the events of the bus's own mounts to the others
+func (b *InvalidationBus) dispatch() {
+	for {
+		select {
+		case <-b.done:
+			return
+		case le := <-b.local:
+			b.deliver(&le.ev, le.from)
+		}
+	}
+}
+
+// deliver applies an event to every mount of its export except the one it
+// came from. Events that went missing before it make every mount drop its
+// caches, as nobody knows what they were about.
+func (b *InvalidationBus) deliver(ev *InvalidationEvent, from *Mount) {
+	b.mu.Lock()
+	missed := uint64(0)
+	if last, seen := b.last[ev.Origin]; seen && ev.Generation > last+1 {
+		missed = ev.Generation - last - 1
+	}
+	if ev.Generation > b.last[ev.Origin] {
+		b.last[ev.Origin] = ev.Generation
+	}
+	mounts := make([]*Mount, 0, len(b.mounts))
+	for m := range b.mounts {
+		mounts = append(mounts, m)
+	}
+	b.mu.Unlock()
+
+	if missed > 0 {
+		b.lost.Add(missed)
+		log.Printf("Invalidation bus lost %d events from %s, dropping all cached metadata", missed, ev.Origin)
+	}
+	for _, m := range mounts {
+		if missed > 0 {
+			m.invalidateAll()
+		}
+		if m != from && m.export() == ev.Export {
+			m.applyInvalidation(ev)
+		}
+	}
+}
+
+// export identifies the mount's backend on the invalidation bus
+func (m *Mount) export() string {
+	if m.cfg.InvalidationExport != "" {
+		return m.cfg.InvalidationExport
+	}
+	return m.cfg.BackendPath
+}
+
+// publish tells the other mounts of the export about a change made through
+// this one. newRel is only set for RENAME.
+func (m *Mount) publish(op, rel, newRel string) {
+	if m.cfg.Invalidation == nil {
+		return
+	}
+	atomic.AddUint64(&m.metrics.InvalidationsPublished, 1)
+	m.cfg.Invalidation.publish(m, op, rel, newRel)
+}
+
+// applyInvalidation drops what the mount, and the kernel, cached about the
+// paths of an event from another mount. A WRITE or SETATTR only changes the
+// file; the other operations change its directory entry too.
+func (m *Mount) applyInvalidation(ev *InvalidationEvent) {
+	atomic.AddUint64(&m.metrics.InvalidationsReceived, 1)
+	if m.verbose {
+		log.Printf("[INVALIDATE] %s %s from %s", ev.Op, m.backendPath(ev.Path), ev.Origin)
+	}
+	entry := ev.Op != "WRITE" && ev.Op != "SETATTR"
+	m.invalidatePath(ev.Path, entry)
+	if ev.NewPath != "" {
+		m.invalidatePath(ev.NewPath, entry)
+	}
+}
+
+// invalidatePath drops the cached state of a path relative to the backend
+// root: its attributes, listing and data, and with entry its dentry and
+// its directory's listing and attributes
+func (m *Mount) invalidatePath(rel string, entry bool) {
+	rel = strings.Trim(filepath.Clean("/"+rel), "/")
+	if rel == "" {
+		m.invalidateDir(m.root.key)
+		m.root.NotifyContent(0, 0)
+		return
+	}
+
+	dir, name := filepath.Split(rel)
+	parent, parentKey, ok := m.cachedInode(dir)
+	if !ok {
+		// Not cached, so neither is anything below it
+		return
+	}
+
+	var child *fs.Inode
+	if parent != nil {
+		child = parent.GetChild(name)
+	}
+	key, known := m.childKeyOf(parent, parentKey, name)
+	if known {
+		m.attrCache.Remove(key)
+		m.dirCache.Remove(key)
+		if m.cfg.DataCache != nil {
+			m.cfg.DataCache.invalidate(key)
+		}
+	}
+	if entry {
+		if known {
+			m.lookupCache.RemoveDir(key)
+		}
+		m.lookupCache.Remove(parentKey, name)
+		m.invalidateDir(parentKey)
+	}
+
+	// The kernel caches entries and attributes for the TTL as well
+	if child != nil {
+		child.NotifyContent(0, 0)
+	}
+	if entry && parent != nil {
+		parent.NotifyEntry(name)
+		parent.NotifyContent(0, 0)
+	}
+}
+
+// cachedInode resolves a directory path relative to the backend root
+// through the dentry cache and the kernel's inode tree, without going to
+// the backend. ino is nil when the kernel has no inode for it; ok is false
+// when the path isn't known at all.
+func (m *Mount) cachedInode(rel string) (ino *fs.Inode, key inodeKey, ok bool) {
+	ino, key = &m.root.Inode, m.root.key
+	for _, name := range strings.Split(rel, "/") {
+		if name == "" {
+			continue
+		}
+		if key, ok = m.childKeyOf(ino, key, name); !ok {
+			return nil, inodeKey{}, false
+		}
+		if ino != nil {
+			ino = ino.GetChild(name)
+		}
+	}
+	return ino, key, true
+}
+
+// invalidateAll drops every cached entry of the mount, for when it can't
+// know what changed. The kernel keeps its entries until their TTL runs out.
+func (m *Mount) invalidateAll() {
+	for _, evict := range []func(int64) (int64, int){m.dirCache.evict, m.lookupCache.evict, m.attrCache.evict} {
+		evict(math.MaxInt64)
+	}
+}
+
+// unixTransport exchanges events over Unix datagram sockets, one per bus,
+// in a shared directory: a send goes to every other socket there
+type unixTransport struct {
+	dir  string
+	path string
+	conn *net.UnixConn
+}
+
+// NewUnixTransport joins the bus of the processes using dir, for mounts of
+// the same export on one host
+func NewUnixTransport(dir string) (InvalidationTransport, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create invalidation socket directory: %v", err)
+	}
+	id := make([]byte, 4)
+	rand.Read(id)
+	path := filepath.Join(dir, fmt.Sprintf("%d-%x.sock", os.Getpid(), id))
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", path, err)
+	}
+	return &unixTransport{dir: dir, path: path, conn: conn}, nil
+}
+
+// Send writes msg to the socket of every peer. Sockets nobody listens on
+// any more are left by peers that crashed, and removed.
+func (t *unixTransport) Send(msg []byte) error {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return err
+	}
+	var first error
+	for _, e := range entries {
+		path := filepath.Join(t.dir, e.Name())
+		if path == t.path || !strings.HasSuffix(e.Name(), ".sock") {
+			continue
+		}
+		t.conn.SetWriteDeadline(time.Now().Add(INVALIDATION_SEND_TIMEOUT))
+		_, err := t.conn.WriteToUnix(msg, &net.UnixAddr{Name: path, Net: "unixgram"})
+		switch {
+		case err == nil:
+		case errors.Is(err, syscall.ECONNREFUSED):
+			os.Remove(path)
+		case errors.Is(err, syscall.ENOENT):
+		default:
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+func (t *unixTransport) Receive(buf []byte) (int, error) {
+	n, _, err := t.conn.ReadFromUnix(buf)
+	return n, err
+}
+
+func (t *unixTransport) Close() error {
+	os.Remove(t.path)
+	return t.conn.Close()
+}
+
+// multicastTransport exchanges events over UDP multicast, for mounts of
+// the same export on different hosts of a network
+type multicastTransport struct {
+	recv *net.UDPConn
+	send *net.UDPConn
+}
+
+// NewMulticastTransport joins the IPv4 multicast group at group
+// ("239.1.2.3:7946") on the named interface, or the system's default one
+// when iface is empty. Events don't leave the local network (TTL 1).
+func NewMulticastTransport(group, iface string) (InvalidationTransport, error) {
+	addr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return nil, fmt.Errorf("invalid multicast group %q: %v", group, err)
+	}
+	if !addr.IP.IsMulticast() {
+		return nil, fmt.Errorf("%s is not a multicast address", addr.IP)
+	}
+	var ifi *net.Interface
+	if iface != "" {
+		if ifi, err = net.InterfaceByName(iface); err != nil {
+			return nil, fmt.Errorf("invalid interface %q: %v", iface, err)
+		}
+	}
+
+	recv, err := net.ListenMulticastUDP("udp4", ifi, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to join %s: %v", group, err)
+	}
+	send, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		recv.Close()
+		return nil, fmt.Errorf("failed to connect to %s: %v", group, err)
+	}
+	if ifi != nil {
+		rc, err := send.SyscallConn()
+		if err == nil {
+			rc.Control(func(fd uintptr) {
+				err = unix.SetsockoptIPMreqn(int(fd), unix.IPPROTO_IP, unix.IP_MULTICAST_IF, &unix.IPMreqn{Ifindex: int32(ifi.Index)})
+			})
+		}
+		if err != nil {
+			recv.Close()
+			send.Close()
+			return nil, fmt.Errorf("failed to send on %s: %v", iface, err)
+		}
+	}
+	return &multicastTransport{recv: recv, send: send}, nil
+}
+
+func (t *multicastTransport) Send(msg []byte) error {
+	_, err := t.send.Write(msg)
+	return err
+}
+
+func (t *multicastTransport) Receive(buf []byte) (int, error) {
+	n, _, err := t.recv.ReadFromUDP(buf)
+	return n, err
+}
+
+func (t *multicastTransport) Close() error {
+	t.send.Close()
+	return t.recv.Close()
+}
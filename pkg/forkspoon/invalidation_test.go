@@ -0,0 +1,123 @@
+package forkspoon
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInvalidationBusCountsLostEvents(t *testing.T) {
+	dir := t.TempDir()
+	var buses []*InvalidationBus
+	for i := 0; i < 2; i++ {
+		transport, err := NewUnixTransport(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bus := NewInvalidationBus(transport)
+		defer bus.Close()
+		buses = append(buses, bus)
+	}
+	sender, receiver := buses[0], buses[1]
+
+	m := &Mount{}
+	for i := 0; i < 3; i++ {
+		sender.publish(m, "UNLINK", "f", "")
+	}
+	for deadline := time.Now().Add(2 * time.Second); receiver.Received() < 3; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("received %d of 3 events", receiver.Received())
+		}
+	}
+	if sender.Received() != 0 {
+		t.Errorf("sender received %d of its own events", sender.Received())
+	}
+
+	// Generations 4 and 5 never arrived
+	receiver.deliver(&InvalidationEvent{Origin: sender.origin, Generation: 6, Op: "UNLINK", Path: "f"}, nil)
+	if lost := receiver.Lost(); lost != 2 {
+		t.Errorf("lost = %d, want 2", lost)
+	}
+}
+
+// stuckTransport is a transport whose peers never take anything
+type stuckTransport struct {
+	closed chan struct{}
+}
+
+func (t *stuckTransport) Send(msg []byte) error {
+	<-t.closed
+	return errors.New("closed")
+}
+
+func (t *stuckTransport) Receive(buf []byte) (int, error) {
+	<-t.closed
+	return 0, errors.New("closed")
+}
+
+func (t *stuckTransport) Close() error {
+	close(t.closed)
+	return nil
+}
+
+func TestInvalidationBusDoesNotWaitForPeers(t *testing.T) {
+	bus := NewInvalidationBus(&stuckTransport{closed: make(chan struct{})})
+	defer bus.Close()
+
+	m := &Mount{}
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < INVALIDATION_SEND_QUEUE+10; i++ {
+			bus.publish(m, "UNLINK", "f", "")
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish waited for the transport")
+	}
+	// One event may be in the transport, the queue holds the rest
+	if dropped := bus.Dropped(); dropped < 9 || dropped > 10 {
+		t.Errorf("dropped = %d, want 9 or 10", dropped)
+	}
+	if published := bus.Published(); published != INVALIDATION_SEND_QUEUE+10 {
+		t.Errorf("published = %d, want %d", published, INVALIDATION_SEND_QUEUE+10)
+	}
+}
+
+func TestInvalidationBusConcurrentPublish(t *testing.T) {
+	bus := NewInvalidationBus(&stuckTransport{closed: make(chan struct{})})
+	defer bus.Close()
+
+	// The bus's own mounts see the events through dispatch, numbered like
+	// those the peers get
+	const publishers, events = 8, 200
+	m := &Mount{}
+	var wg sync.WaitGroup
+	for p := 0; p < publishers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < events; i++ {
+				bus.publish(m, "WRITE", "f", "")
+			}
+		}()
+	}
+	wg.Wait()
+
+	seen := func() uint64 {
+		bus.mu.Lock()
+		defer bus.mu.Unlock()
+		return bus.last[bus.origin]
+	}
+	for deadline := time.Now().Add(2 * time.Second); seen() < publishers*events; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("dispatched %d of %d events", seen(), publishers*events)
+		}
+	}
+	if lost := bus.Lost(); lost != 0 {
+		t.Errorf("lost = %d, want 0", lost)
+	}
+}
@@ -0,0 +1,198 @@
+package forkspoon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// newTestBridge builds a backend directory with nfiles files and returns a
+// go-fuse bridge over it. Requests are fed to the bridge directly, the way
+// the kernel would send them, so no FUSE mount is needed.
+func newTestBridge(t *testing.T, nfiles int) (fuse.RawFileSystem, *rootNode, []string) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	names := make([]string, nfiles)
+	for i := range names {
+		names[i] = fmt.Sprintf("file%03d", i)
+		if err := os.WriteFile(filepath.Join(dir, names[i]), []byte(names[i]), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := New(Config{
+		Name:        "test",
+		BackendPath: dir,
+		Cache:       CacheOptions{TTL: time.Minute, ReaddirAttrs: true, ReaddirStatWorkers: DEFAULT_READDIR_STAT_WORKERS},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs.NewNodeFS(m.root, &fs.Options{}), m.root, names
+}
+
+func lookup(t *testing.T, raw fuse.RawFileSystem, parent uint64, name string) *fuse.EntryOut {
+	t.Helper()
+
+	out := &fuse.EntryOut{}
+	if status := raw.Lookup(nil, &fuse.InHeader{NodeId: parent}, name, out); !status.Ok() {
+		t.Fatalf("lookup %q: %v", name, status)
+	}
+	if out.NodeId == 0 {
+		t.Fatalf("lookup %q returned no node id", name)
+	}
+	return out
+}
+
+func TestLookupForgetCycles(t *testing.T) {
+	raw, root, names := newTestBridge(t, 16)
+
+	metrics := root.m.metrics
+	hits := atomic.LoadUint64(&metrics.LookupHits)
+	forgotten := atomic.LoadUint64(&metrics.InodesForgotten)
+
+	const cycles = 2000
+	for i := 0; i < cycles; i++ {
+		name := names[i%len(names)]
+
+		var st syscall.Stat_t
+		if err := syscall.Lstat(filepath.Join(root.rootPath, name), &st); err != nil {
+			t.Fatal(err)
+		}
+
+		out := lookup(t, raw, fuse.FUSE_ROOT_ID, name)
+		if out.Ino != st.Ino {
+			t.Fatalf("cycle %d: lookup %q got ino %d, want %d", i, name, out.Ino, st.Ino)
+		}
+
+		child := root.GetChild(name)
+		if child == nil || child.Forgotten() {
+			t.Fatalf("cycle %d: lookup %q returned a forgotten inode", i, name)
+		}
+
+		raw.Forget(out.NodeId, 1)
+		if root.GetChild(name) != nil {
+			t.Fatalf("cycle %d: %q still in the tree after FORGET", i, name)
+		}
+	}
+
+	if got := atomic.LoadUint64(&metrics.LookupHits) - hits; got < cycles-uint64(len(names)) {
+		t.Errorf("got %d lookup cache hits, want at least %d", got, cycles-len(names))
+	}
+	if got := atomic.LoadUint64(&metrics.InodesForgotten) - forgotten; got != cycles {
+		t.Errorf("got %d OnForget calls, want %d", got, cycles)
+	}
+}
+
+func TestLookupForgetConcurrent(t *testing.T) {
+	raw, root, names := newTestBridge(t, 8)
+
+	const workers = 8
+	const cycles = 500
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < cycles; i++ {
+				name := names[(w+i)%len(names)]
+				out := &fuse.EntryOut{}
+				if status := raw.Lookup(nil, &fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, name, out); !status.Ok() {
+					errs <- fmt.Errorf("lookup %q: %v", name, status)
+					return
+				}
+				raw.Forget(out.NodeId, 1)
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// Every lookup was balanced by a forget: nothing may stay pinned
+	if children := root.Children(); len(children) != 0 {
+		t.Errorf("%d inodes still live after all FORGETs", len(children))
+	}
+
+	// ... while the dentries themselves are still cached
+	for _, name := range names {
+		if _, _, hit := root.m.cachedLookup(root.key, name); !hit {
+			t.Errorf("dentry %q dropped from the lookup cache", name)
+		}
+	}
+}
+
+func TestLookupForgetNested(t *testing.T) {
+	raw, root, _ := newTestBridge(t, 0)
+
+	sub := filepath.Join(root.rootPath, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sub, "leaf"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		dir := lookup(t, raw, fuse.FUSE_ROOT_ID, "sub")
+		leaf := lookup(t, raw, dir.NodeId, "leaf")
+
+		raw.Forget(leaf.NodeId, 1)
+		raw.Forget(dir.NodeId, 1)
+		if root.GetChild("sub") != nil {
+			t.Fatalf("cycle %d: directory still in the tree after FORGET", i)
+		}
+	}
+}
+
+func TestReaddirPlusReturnsListingAttributes(t *testing.T) {
+	raw, root, names := newTestBridge(t, 16)
+	metrics := root.m.metrics
+
+	var open fuse.OpenOut
+	if status := raw.OpenDir(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}}, &open); !status.Ok() {
+		t.Fatalf("opendir: %v", status)
+	}
+	defer raw.ReleaseDir(&fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, Fh: open.Fh})
+
+	misses := atomic.LoadUint64(&metrics.LookupMisses)
+	in := &fuse.ReadIn{InHeader: fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, Fh: open.Fh, Size: 64 << 10}
+	out := fuse.NewDirEntryList(make([]byte, in.Size), 0)
+	if status := raw.ReadDirPlus(nil, in, out); !status.Ok() {
+		t.Fatalf("readdirplus: %v", status)
+	}
+
+	if n := atomic.LoadUint64(&metrics.PlusEntries); n != uint64(len(names)) {
+		t.Errorf("%d entries given the listing's attributes, want %d", n, len(names))
+	}
+	if n := atomic.LoadUint64(&metrics.LookupMisses) - misses; n != 0 {
+		t.Errorf("%d lookups went to the backend", n)
+	}
+	for _, name := range names {
+		child := root.GetChild(name)
+		if child == nil {
+			t.Fatalf("%s has no inode after READDIRPLUS", name)
+		}
+		var st syscall.Stat_t
+		if err := syscall.Lstat(filepath.Join(root.rootPath, name), &st); err != nil {
+			t.Fatal(err)
+		}
+		if child.StableAttr().Ino != st.Ino {
+			t.Errorf("%s: ino %d, want %d", name, child.StableAttr().Ino, st.Ino)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package forkspoon
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheMetrics tracks cache hit/miss statistics. The counters are updated
+// atomically; read them through Snapshot.
+type CacheMetrics struct {
+	GetattrHits   uint64
+	GetattrMisses uint64
+	LookupHits    uint64
+	LookupMisses  uint64
+	ReaddirHits   uint64
+	ReaddirMisses uint64
+
+	// Entries whose attributes were pre-loaded by READDIR
+	SeededEntries uint64
+
+	// Entries of READDIRPLUS replies given the attributes of the listing
+	PlusEntries uint64
+
+	// Listings too large to cache, streamed from the backend
+	ReaddirStreamed uint64
+
+	// Inode lifecycle: kernel FORGETs, and inodes rebuilt from cache
+	InodesForgotten uint64
+	InodesRecreated uint64
+
+	// Cache entries dropped to stay within the memory limit
+	Evictions uint64
+
+	// Lookups failed and directory entries left out by the path filter
+	FilteredLookups uint64
+	FilteredEntries uint64
+
+	// READs served entirely from the data cache, and those that had to
+	// read from the backend, with the bytes each returned
+	DataCacheHits      uint64
+	DataCacheMisses    uint64
+	DataCacheHitBytes  uint64
+	DataCacheMissBytes uint64
+
+	// Writes buffered in write-back mode and merged into the previous
+	// one, and the backend writes of the merged runs
+	WritesCoalesced  uint64
+	WriteBackFlushes uint64
+
+	// Changes announced to other mounts of the export, and theirs applied
+	InvalidationsPublished uint64
+	InvalidationsReceived  uint64
+
+	// Passthrough operations (never cached)
+	OpenOps   uint64
+	CreateOps uint64
+	WriteOps  uint64
+	ReadOps   uint64
+	UnlinkOps uint64
+	RenameOps uint64
+	MkdirOps  uint64
+	RmdirOps  uint64
+
+	SetattrOps uint64
+
+	mu sync.RWMutex
+
+	// When counting started
+	StartTime time.Time
+}
+
+// updateMetrics updates the cache metrics
+func (m *Mount) updateMetrics(op string, hit bool) {
+	switch op {
+	case "GETATTR":
+		if hit {
+			atomic.AddUint64(&m.metrics.GetattrHits, 1)
+		} else {
+			atomic.AddUint64(&m.metrics.GetattrMisses, 1)
+		}
+	case "LOOKUP":
+		if hit {
+			atomic.AddUint64(&m.metrics.LookupHits, 1)
+		} else {
+			atomic.AddUint64(&m.metrics.LookupMisses, 1)
+		}
+	case "READDIR":
+		if hit {
+			atomic.AddUint64(&m.metrics.ReaddirHits, 1)
+		} else {
+			atomic.AddUint64(&m.metrics.ReaddirMisses, 1)
+		}
+	case "OPEN":
+		atomic.AddUint64(&m.metrics.OpenOps, 1)
+	case "CREATE":
+		atomic.AddUint64(&m.metrics.CreateOps, 1)
+	case "WRITE":
+		atomic.AddUint64(&m.metrics.WriteOps, 1)
+	case "READ":
+		atomic.AddUint64(&m.metrics.ReadOps, 1)
+	case "UNLINK":
+		atomic.AddUint64(&m.metrics.UnlinkOps, 1)
+	case "RENAME":
+		atomic.AddUint64(&m.metrics.RenameOps, 1)
+	case "MKDIR":
+		atomic.AddUint64(&m.metrics.MkdirOps, 1)
+	case "RMDIR":
+		atomic.AddUint64(&m.metrics.RmdirOps, 1)
+	case "SETATTR":
+		atomic.AddUint64(&m.metrics.SetattrOps, 1)
+	}
+}
+
+// countDataCacheRead records a READ served through the data cache
+func (m *Mount) countDataCacheRead(hit bool, n int) {
+	if hit {
+		atomic.AddUint64(&m.metrics.DataCacheHits, 1)
+		atomic.AddUint64(&m.metrics.DataCacheHitBytes, uint64(n))
+	} else {
+		atomic.AddUint64(&m.metrics.DataCacheMisses, 1)
+		atomic.AddUint64(&m.metrics.DataCacheMissBytes, uint64(n))
+	}
+}
+
+// Snapshot returns a consistent-enough copy of the counters
+func (cm *CacheMetrics) Snapshot() *CacheMetrics {
+	return &CacheMetrics{
+		GetattrHits:            atomic.LoadUint64(&cm.GetattrHits),
+		GetattrMisses:          atomic.LoadUint64(&cm.GetattrMisses),
+		LookupHits:             atomic.LoadUint64(&cm.LookupHits),
+		LookupMisses:           atomic.LoadUint64(&cm.LookupMisses),
+		ReaddirHits:            atomic.LoadUint64(&cm.ReaddirHits),
+		ReaddirMisses:          atomic.LoadUint64(&cm.ReaddirMisses),
+		SeededEntries:          atomic.LoadUint64(&cm.SeededEntries),
+		PlusEntries:            atomic.LoadUint64(&cm.PlusEntries),
+		ReaddirStreamed:        atomic.LoadUint64(&cm.ReaddirStreamed),
+		InodesForgotten:        atomic.LoadUint64(&cm.InodesForgotten),
+		InodesRecreated:        atomic.LoadUint64(&cm.InodesRecreated),
+		Evictions:              atomic.LoadUint64(&cm.Evictions),
+		FilteredLookups:        atomic.LoadUint64(&cm.FilteredLookups),
+		FilteredEntries:        atomic.LoadUint64(&cm.FilteredEntries),
+		DataCacheHits:          atomic.LoadUint64(&cm.DataCacheHits),
+		DataCacheMisses:        atomic.LoadUint64(&cm.DataCacheMisses),
+		DataCacheHitBytes:      atomic.LoadUint64(&cm.DataCacheHitBytes),
+		DataCacheMissBytes:     atomic.LoadUint64(&cm.DataCacheMissBytes),
+		WritesCoalesced:        atomic.LoadUint64(&cm.WritesCoalesced),
+		WriteBackFlushes:       atomic.LoadUint64(&cm.WriteBackFlushes),
+		InvalidationsPublished: atomic.LoadUint64(&cm.InvalidationsPublished),
+		InvalidationsReceived:  atomic.LoadUint64(&cm.InvalidationsReceived),
+		OpenOps:                atomic.LoadUint64(&cm.OpenOps),
+		CreateOps:              atomic.LoadUint64(&cm.CreateOps),
+		WriteOps:               atomic.LoadUint64(&cm.WriteOps),
+		ReadOps:                atomic.LoadUint64(&cm.ReadOps),
+		UnlinkOps:              atomic.LoadUint64(&cm.UnlinkOps),
+		RenameOps:              atomic.LoadUint64(&cm.RenameOps),
+		MkdirOps:               atomic.LoadUint64(&cm.MkdirOps),
+		RmdirOps:               atomic.LoadUint64(&cm.RmdirOps),
+		SetattrOps:             atomic.LoadUint64(&cm.SetattrOps),
+		StartTime:              cm.StartTime,
+	}
+}
+
+// Add sums the counters of o into a snapshot
+func (cm *CacheMetrics) Add(o *CacheMetrics) {
+	cm.GetattrHits += o.GetattrHits
+	cm.GetattrMisses += o.GetattrMisses
+	cm.LookupHits += o.LookupHits
+	cm.LookupMisses += o.LookupMisses
+	cm.ReaddirHits += o.ReaddirHits
+	cm.ReaddirMisses += o.ReaddirMisses
+	cm.SeededEntries += o.SeededEntries
+	cm.PlusEntries += o.PlusEntries
+	cm.ReaddirStreamed += o.ReaddirStreamed
+	cm.InodesForgotten += o.InodesForgotten
+	cm.InodesRecreated += o.InodesRecreated
+	cm.Evictions += o.Evictions
+	cm.FilteredLookups += o.FilteredLookups
+	cm.FilteredEntries += o.FilteredEntries
+	cm.DataCacheHits += o.DataCacheHits
+	cm.DataCacheMisses += o.DataCacheMisses
+	cm.DataCacheHitBytes += o.DataCacheHitBytes
+	cm.DataCacheMissBytes += o.DataCacheMissBytes
+	cm.WritesCoalesced += o.WritesCoalesced
+	cm.WriteBackFlushes += o.WriteBackFlushes
+	cm.InvalidationsPublished += o.InvalidationsPublished
+	cm.InvalidationsReceived += o.InvalidationsReceived
+	cm.OpenOps += o.OpenOps
+	cm.CreateOps += o.CreateOps
+	cm.WriteOps += o.WriteOps
+	cm.ReadOps += o.ReadOps
+	cm.UnlinkOps += o.UnlinkOps
+	cm.RenameOps += o.RenameOps
+	cm.MkdirOps += o.MkdirOps
+	cm.RmdirOps += o.RmdirOps
+	cm.SetattrOps += o.SetattrOps
+}
+
+// CacheTotals returns the cached operations and their hits
+func (cm *CacheMetrics) CacheTotals() (total, hits uint64) {
+	hits = cm.GetattrHits + cm.LookupHits + cm.ReaddirHits
+	total = hits + cm.GetattrMisses + cm.LookupMisses + cm.ReaddirMisses
+	return total, hits
+}
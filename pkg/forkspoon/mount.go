@@ -0,0 +1,469 @@
+package forkspoon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+const (
+	// f_type statfs(2) reports for FUSE filesystems
+	FUSE_SUPER_MAGIC = 0x65735546
+)
+
+// Mount is one Backend served at one mountpoint. Every mount has its own
+// caches, cache settings and metrics; mounts created with the same
+// MemoryBudget share a cache memory limit.
+type Mount struct {
+	name     string
+	cfg      Config
+	backend  Backend
+	verbose  bool
+	translog TransactionLogger
+
+	// Resolved mountpoint path, set once mounted
+	mountpoint string
+
+	metrics     *CacheMetrics
+	mem         *memAccount
+	dirCache    *DirCache
+	lookupCache *LookupCache
+	attrCache   *AttrCache
+	opts        atomic.Pointer[CacheOptions]
+
+	// Backend directories held open, when the backend can (see Mount.at)
+	dirs *backendDirs
+
+	// FUSE requests currently being served
+	inflight atomic.Int64
+
+	// Write-back buffers holding data, by inode (see flushWrites)
+	dirtyMu    sync.Mutex
+	dirty      map[inodeKey]map[*writeBuffer]struct{}
+	dirtyCount atomic.Int64
+
+	root   *rootNode
+	server *fuse.Server
+	done   chan struct{}
+	ended  atomic.Bool
+}
+
+// New checks the backend and builds the mount's caches and root node.
+// Nothing is mounted until Start.
+func New(cfg Config) (*Mount, error) {
+	if cfg.IDMap != nil {
+		if err := cfg.IDMap.Validate(); err != nil {
+			return nil, fmt.Errorf("id map: %v", err)
+		}
+	}
+	if cfg.Filter != nil {
+		if err := cfg.Filter.Validate(); err != nil {
+			return nil, fmt.Errorf("filter: %v", err)
+		}
+	}
+
+	backend := cfg.Backend
+	if backend == nil {
+		if cfg.BackendPath == "" {
+			return nil, errors.New("no backend: set Backend or BackendPath")
+		}
+		info, err := os.Stat(cfg.BackendPath)
+		if err != nil {
+			return nil, fmt.Errorf("backend directory error: %v", err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("backend path is not a directory: %s", cfg.BackendPath)
+		}
+		backend, err = NewPOSIXBackend(cfg.BackendPath)
+		if err != nil {
+			return nil, fmt.Errorf("backend directory error: %v", err)
+		}
+	}
+
+	var st syscall.Stat_t
+	key, err := lstatKey(backend, "", &st)
+	if err != nil {
+		closeBackend(cfg, backend)
+		return nil, fmt.Errorf("backend directory error: %v", err)
+	}
+	if cfg.Backend != nil && st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return nil, errors.New("backend root is not a directory")
+	}
+
+	rootPath := cfg.BackendPath
+	if rootPath == "" {
+		rootPath = "/"
+	}
+
+	mem := &memAccount{budget: cfg.Budget}
+	m := &Mount{
+		name:        cfg.Name,
+		cfg:         cfg,
+		backend:     backend,
+		verbose:     cfg.Verbose,
+		translog:    cfg.TransactionLog,
+		metrics:     &CacheMetrics{StartTime: time.Now()},
+		mem:         mem,
+		dirCache:    newDirCache(mem),
+		lookupCache: newLookupCache(mem),
+		attrCache:   newAttrCache(mem),
+		dirs:        newBackendDirs(),
+		done:        make(chan struct{}),
+	}
+	m.SetCacheOptions(cfg.Cache)
+	m.root = &rootNode{
+		rootPath: rootPath,
+		key:      key,
+		m:        m,
+	}
+	return m, nil
+}
+
+// Start mounts the filesystem and returns once the mount answers. The mount
+// ends when Unmount is called or when it is unmounted from outside
+// (fusermount -u); Done is closed then.
+func (m *Mount) Start() error {
+	if m.server != nil {
+		return errors.New("already started")
+	}
+
+	mountpoint, err := prepareMountpoint(m.cfg.BackendPath, m.cfg.Mountpoint, m.cfg.UnmountStale, m.cfg.AllowNonEmpty, m.verbose)
+	if err != nil {
+		closeBackend(m.cfg, m.backend)
+		return err
+	}
+	if m.cfg.CheckMountpoint != nil {
+		if err := m.cfg.CheckMountpoint(mountpoint); err != nil {
+			closeBackend(m.cfg, m.backend)
+			return err
+		}
+	}
+	m.mountpoint = mountpoint
+
+	// Mount options - CRITICAL: Set non-zero defaults to enable caching
+	ttl := m.cacheOptions().TTL
+	attrTimeout, entryTimeout, negativeTimeout := ttl, ttl, ttl
+	opts := &fs.Options{
+		// These are the DEFAULT timeouts. Individual operations can override them.
+		// Setting these to non-zero enables kernel caching! (Copies: the
+		// bridge reads them on every request, and the TTL may change.)
+		AttrTimeout:     &attrTimeout,
+		EntryTimeout:    &entryTimeout,
+		NegativeTimeout: &negativeTimeout,
+
+		MountOptions: fuse.MountOptions{
+			AllowOther:  m.cfg.AllowOther,
+			FsName:      "forkspoon-cache",
+			Debug:       m.cfg.Debug,
+			DirectMount: m.cfg.DirectMount,
+		},
+	}
+	if m.cfg.ReadOnly {
+		// The flag for mount(2), the option for fusermount
+		opts.MountOptions.DirectMountFlags = syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_RDONLY
+		opts.MountOptions.Options = append(opts.MountOptions.Options, "ro")
+	}
+
+	server, err := fs.Mount(mountpoint, m.root, opts)
+	if err != nil {
+		closeBackend(m.cfg, m.backend)
+		return fmt.Errorf("mount of %s failed: %v", mountpoint, err)
+	}
+	m.server = server
+	if m.cfg.Budget != nil {
+		m.cfg.Budget.attach(m)
+	}
+	go func() {
+		server.Wait()
+		m.ended.Store(true)
+		close(m.done)
+		m.release()
+	}()
+	m.startJanitor(ttl)
+
+	// Only count the mount as up once the backend answers and the mount is live
+	timeout := m.cfg.ReadyTimeout
+	if timeout <= 0 {
+		timeout = DEFAULT_READY_TIMEOUT
+	}
+	if err := m.waitReady(timeout); err != nil {
+		m.Unmount()
+		return err
+	}
+	if m.cfg.Invalidation != nil {
+		m.cfg.Invalidation.subscribe(m)
+	}
+	return nil
+}
+
+// release frees the caches of a mount that has ended and takes it off its
+// memory budget
+func (m *Mount) release() {
+	if m.cfg.Invalidation != nil {
+		m.cfg.Invalidation.unsubscribe(m)
+	}
+	m.invalidateAll()
+	if m.cfg.Budget != nil {
+		m.cfg.Budget.detach(m)
+	}
+	m.dirs.dropAll()
+	closeBackend(m.cfg, m.backend)
+}
+
+// closeBackend closes the backend New opened for BackendPath; backends
+// passed in Config belong to the caller
+func closeBackend(cfg Config, backend Backend) {
+	if c, ok := backend.(io.Closer); ok && cfg.Backend == nil {
+		c.Close()
+	}
+}
+
+// startJanitor periodically drops expired entries. Get only removes
+// entries that are asked for again, so without sweeping every name ever
+// looked up would stay in memory for the life of the mount.
+func (m *Mount) startJanitor(interval time.Duration) {
+	if interval < time.Second {
+		interval = time.Second
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.done:
+				return
+			case <-ticker.C:
+			}
+			removed := m.dirCache.Sweep() + m.lookupCache.Sweep() + m.attrCache.Sweep()
+			if m.verbose && removed > 0 {
+				log.Printf("[JANITOR] Dropped %d expired cache entries from %s", removed, m.name)
+			}
+		}
+	}()
+}
+
+// waitReady checks that the backend answers and that the mountpoint is
+// really served by us: statfs must report a FUSE filesystem, and a stat
+// through the mount has to make the round trip through our root Getattr.
+func (m *Mount) waitReady(timeout time.Duration) error {
+	if err := m.CheckBackend(timeout); err != nil {
+		return fmt.Errorf("backend probe failed: %v", err)
+	}
+
+	var sfs syscall.Statfs_t
+	if err := syscall.Statfs(m.mountpoint, &sfs); err != nil {
+		return fmt.Errorf("mount probe failed: %v", err)
+	}
+	if sfs.Type != FUSE_SUPER_MAGIC {
+		return fmt.Errorf("mount probe failed: %s is not a FUSE mount", m.mountpoint)
+	}
+	err := callWithTimeout(m.mountpoint, timeout, func() error {
+		var st syscall.Stat_t
+		return syscall.Stat(m.mountpoint, &st)
+	})
+	if err != nil {
+		return fmt.Errorf("mount probe failed: %v", err)
+	}
+	return nil
+}
+
+// CheckBackend stats the backend root, giving up after timeout
+func (m *Mount) CheckBackend(timeout time.Duration) error {
+	return callWithTimeout(m.root.rootPath, timeout, func() error {
+		var st syscall.Stat_t
+		return m.backend.Lstat("", &st)
+	})
+}
+
+// callWithTimeout runs fn, giving up after timeout. A hung NFS server
+// blocks stat(2) indefinitely, so the call runs in its own goroutine.
+func callWithTimeout(path string, timeout time.Duration, fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("no response from %s after %v", path, timeout)
+	}
+}
+
+// Unmount takes the mount down and waits for its server loop to end. A busy
+// mount (open files, a shell cd'ed into it) is detached lazily rather than
+// left behind as a "Transport endpoint is not connected" mountpoint.
+func (m *Mount) Unmount() error {
+	if m.server == nil {
+		return errors.New("not mounted")
+	}
+	if err := m.server.Unmount(); err != nil {
+		log.Printf("Unmount failed (%v), detaching %s lazily", err, m.mountpoint)
+		if err := m.ForceUnmount(); err != nil {
+			return err
+		}
+	}
+	<-m.done
+	return nil
+}
+
+// ForceUnmount detaches the mount without waiting for it to become idle.
+// The kernel finishes the unmount once the last user goes away, and the
+// server loop ends as soon as the mount is gone from the namespace.
+func (m *Mount) ForceUnmount() error {
+	if m.server == nil {
+		return errors.New("not mounted")
+	}
+	if err := syscall.Unmount(m.mountpoint, syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("lazy unmount of %s failed: %v", m.mountpoint, err)
+	}
+	m.server.Unmount()
+	return nil
+}
+
+// Wait blocks until the mount has ended
+func (m *Mount) Wait() {
+	<-m.done
+}
+
+// Done is closed once the mount has ended
+func (m *Mount) Done() <-chan struct{} {
+	return m.done
+}
+
+// Running reports whether the mount is up
+func (m *Mount) Running() bool {
+	return m.server != nil && !m.ended.Load()
+}
+
+// Name returns the name the mount was created with
+func (m *Mount) Name() string {
+	return m.name
+}
+
+// Mountpoint returns the resolved mountpoint, once started
+func (m *Mount) Mountpoint() string {
+	return m.mountpoint
+}
+
+// Metrics returns the mount's live counters; use Snapshot to read them
+func (m *Mount) Metrics() *CacheMetrics {
+	return m.metrics
+}
+
+// MemoryUsed returns the estimated memory held by the mount's caches
+func (m *Mount) MemoryUsed() int64 {
+	return m.mem.used.Load()
+}
+
+// InflightRequests returns the number of FUSE requests being served
+func (m *Mount) InflightRequests() int64 {
+	return m.inflight.Load()
+}
+
+// trackRequest marks a FUSE request as in flight. Handlers call it as
+// `defer m.trackRequest()()` so a shutdown can wait for them to finish.
+func (m *Mount) trackRequest() func() {
+	m.inflight.Add(1)
+	return func() {
+		m.inflight.Add(-1)
+	}
+}
+
+// CacheOptions returns the cache settings in effect
+func (m *Mount) CacheOptions() CacheOptions {
+	return *m.cacheOptions()
+}
+
+// SetCacheOptions changes the cache settings. Requests being served keep
+// the settings they started with; entries already cached keep their TTL.
+func (m *Mount) SetCacheOptions(o CacheOptions) {
+	o.Policies = append([]PathPolicy(nil), o.Policies...)
+	m.opts.Store(&o)
+}
+
+func (m *Mount) cacheOptions() *CacheOptions {
+	return m.opts.Load()
+}
+
+// ttlFor returns the cache TTL currently in effect for a path relative to
+// the backend root
+func (m *Mount) ttlFor(rel string) time.Duration {
+	return m.cacheOptions().TTLFor(rel)
+}
+
+// writeFlags reports whether open flags would change the file
+func writeFlags(flags uint32) bool {
+	return flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0
+}
+
+// startTransaction begins the record of an operation, filling in the
+// caller from the request. Handlers pass it to endTransaction, with the
+// result, when they return.
+func (m *Mount) startTransaction(ctx context.Context, op string, path string) Transaction {
+	if m.translog == nil && m.cfg.AuditLog == nil {
+		return Transaction{}
+	}
+	t := Transaction{
+		Time:  time.Now(),
+		Mount: m.name,
+		Op:    op,
+		Path:  path,
+	}
+	if caller, ok := fuse.FromContext(ctx); ok {
+		t.Pid = caller.Pid
+		t.Uid = caller.Uid
+		t.Gid = caller.Gid
+	}
+	return t
+}
+
+// endTransaction hands a finished operation to the transaction logger and,
+// if it is audited, to the audit log
+func (m *Mount) endTransaction(t *Transaction, errno syscall.Errno) {
+	audit := m.cfg.AuditLog != nil && audited(t)
+	if m.translog == nil && !audit {
+		return
+	}
+	t.Duration = time.Since(t.Time)
+	t.Errno = errno
+	if m.translog != nil {
+		m.translog.LogTransaction(t)
+	}
+	if audit {
+		m.cfg.AuditLog.LogTransaction(t)
+	}
+}
+
+// audited reports whether an operation goes to Config.AuditLog: those that
+// change the namespace or attributes, and opens for writing
+func audited(t *Transaction) bool {
+	switch t.Op {
+	case "CREATE", "MKDIR", "UNLINK", "RMDIR", "RENAME", "SETATTR":
+		return true
+	case "OPEN":
+		return writeFlags(t.Flags)
+	}
+	return false
+}
+
+// ProcessName returns the command name of a process, or "" if it is gone
+func ProcessName(pid uint32) string {
+	comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(string(comm), "\n")
+}
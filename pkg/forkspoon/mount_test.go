@@ -0,0 +1,1053 @@
+package forkspoon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountForTest mounts backend at a temporary directory for the length of
+// the test. Tests using it are skipped where FUSE can't be mounted.
+func mountForTest(t *testing.T, backend Backend, ttl time.Duration) *Mount {
+	t.Helper()
+	return mountConfigForTest(t, Config{Backend: backend, Cache: CacheOptions{TTL: ttl}})
+}
+
+// mountConfigForTest is mountForTest with more of the Config set by the test
+func mountConfigForTest(t *testing.T, cfg Config) *Mount {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("skipping FUSE mount in short mode")
+	}
+	if f, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0); err != nil {
+		t.Skipf("FUSE is not available: %v", err)
+	} else {
+		f.Close()
+	}
+	if os.Geteuid() != 0 {
+		_, err3 := exec.LookPath("fusermount3")
+		_, err := exec.LookPath("fusermount")
+		if err3 != nil && err != nil {
+			t.Skip("FUSE mounts need root or fusermount")
+		}
+	}
+
+	cfg.Name = "test"
+	cfg.Mountpoint = t.TempDir()
+	cfg.Cache.ReaddirAttrs = true
+	cfg.Cache.ReaddirStatWorkers = DEFAULT_READDIR_STAT_WORKERS
+	cfg.DirectMount = true
+	cfg.ReadyTimeout = 5 * time.Second
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := m.Unmount(); err != nil {
+			t.Errorf("unmount: %v", err)
+		}
+	})
+	return m
+}
+
+// newTestTree returns a memory backend holding the given files, each
+// containing its own name
+func newTestTree(t *testing.T, files ...string) *MemoryBackend {
+	t.Helper()
+	b := NewMemoryBackend()
+	for _, name := range files {
+		if dir := filepath.Dir(name); dir != "." {
+			if err := b.Mkdir(dir, 0755); err != nil && err != syscall.EEXIST {
+				t.Fatal(err)
+			}
+		}
+		if err := b.WriteFile(name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b
+}
+
+func listDir(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestMountChangesAreVisibleImmediately(t *testing.T) {
+	b := newTestTree(t, "a", "sub/b")
+	m := mountForTest(t, b, time.Hour)
+	mp := m.Mountpoint()
+
+	// Fill the caches, then change things through the mount: with an hour
+	// of TTL, everything below is only right if the changes invalidate
+	if got := listDir(t, mp); fmt.Sprint(got) != "[a sub]" {
+		t.Fatalf("root listing = %v", got)
+	}
+	if got := listDir(t, filepath.Join(mp, "sub")); fmt.Sprint(got) != "[b]" {
+		t.Fatalf("sub listing = %v", got)
+	}
+
+	if err := os.WriteFile(filepath.Join(mp, "sub", "c"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := listDir(t, filepath.Join(mp, "sub")); fmt.Sprint(got) != "[b c]" {
+		t.Errorf("after create: sub listing = %v", got)
+	}
+	if data, err := os.ReadFile(filepath.Join(mp, "sub", "c")); err != nil || string(data) != "hello" {
+		t.Errorf("read back %q, %v", data, err)
+	}
+
+	if err := os.Rename(filepath.Join(mp, "a"), filepath.Join(mp, "sub", "a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(mp, "a")); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("old name after rename: %v", err)
+	}
+	if got := listDir(t, mp); fmt.Sprint(got) != "[sub]" {
+		t.Errorf("after rename: root listing = %v", got)
+	}
+	if got := listDir(t, filepath.Join(mp, "sub")); fmt.Sprint(got) != "[a b c]" {
+		t.Errorf("after rename: sub listing = %v", got)
+	}
+
+	if err := os.Remove(filepath.Join(mp, "sub", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(mp, "sub", "b")); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("after unlink: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(mp, "new"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if got := listDir(t, mp); fmt.Sprint(got) != "[new sub]" {
+		t.Errorf("after mkdir: root listing = %v", got)
+	}
+
+	// The backend saw all of it
+	var st syscall.Stat_t
+	if err := b.Lstat("sub/a", &st); err != nil {
+		t.Errorf("backend sub/a: %v", err)
+	}
+	if err := b.Lstat("new", &st); err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		t.Errorf("backend new: mode %o, %v", st.Mode, err)
+	}
+}
+
+func TestMountExternalChangesWaitForTTL(t *testing.T) {
+	const ttl = time.Second
+	b := newTestTree(t, "f")
+	m := mountForTest(t, b, ttl)
+	mp := m.Mountpoint()
+
+	if got := listDir(t, mp); fmt.Sprint(got) != "[f]" {
+		t.Fatalf("listing = %v", got)
+	}
+	if info, err := os.Lstat(filepath.Join(mp, "f")); err != nil || info.Size() != 1 {
+		t.Fatalf("stat: %v, %v", info, err)
+	}
+
+	// Another client changes the backend
+	if err := b.WriteFile("f", []byte("longer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.WriteFile("g", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Lstat(filepath.Join(mp, "f")); err != nil || info.Size() != 1 {
+		t.Errorf("within the TTL: stat = %v, %v, want the cached size 1", info, err)
+	}
+	if got := listDir(t, mp); fmt.Sprint(got) != "[f]" {
+		t.Errorf("within the TTL: listing = %v, want the cached [f]", got)
+	}
+
+	time.Sleep(ttl + ttl/2)
+	if info, err := os.Lstat(filepath.Join(mp, "f")); err != nil || info.Size() != 6 {
+		t.Errorf("after the TTL: stat = %v, %v, want size 6", info, err)
+	}
+	if got := listDir(t, mp); fmt.Sprint(got) != "[f g]" {
+		t.Errorf("after the TTL: listing = %v", got)
+	}
+}
+
+func TestMountMetrics(t *testing.T) {
+	files := []string{"d/1", "d/2", "d/3", "d/4"}
+	fb := NewFaultBackend(newTestTree(t, files...))
+	m := mountForTest(t, fb, time.Hour)
+	dir := filepath.Join(m.Mountpoint(), "d")
+
+	// ls -l, twice
+	for i := 0; i < 2; i++ {
+		for _, name := range listDir(t, dir) {
+			if _, err := os.Lstat(filepath.Join(dir, name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	s := m.Metrics().Snapshot()
+	if s.ReaddirMisses != 1 {
+		t.Errorf("ReaddirMisses = %d, want 1", s.ReaddirMisses)
+	}
+	if s.SeededEntries != uint64(len(files)) {
+		t.Errorf("SeededEntries = %d, want %d", s.SeededEntries, len(files))
+	}
+	if s.LookupMisses != 1 {
+		// Only "d" itself; the entries were seeded by the listing
+		t.Errorf("LookupMisses = %d, want 1", s.LookupMisses)
+	}
+
+	// Each entry reached the backend once, from the listing
+	if n := fb.Calls(FAULT_READDIR); n != 1 {
+		t.Errorf("backend READDIR calls = %d, want 1", n)
+	}
+	for _, name := range files {
+		fb.Inject(Fault{Op: FAULT_LSTAT, Path: name, Err: syscall.EIO})
+	}
+	for _, name := range listDir(t, dir) {
+		if _, err := os.Lstat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("cached stat of %s reached the backend: %v", name, err)
+		}
+	}
+
+	if _, err := os.ReadFile(filepath.Join(dir, "1")); err != nil {
+		t.Fatal(err)
+	}
+	s = m.Metrics().Snapshot()
+	if s.OpenOps != 1 || s.ReadOps == 0 {
+		t.Errorf("OpenOps = %d, ReadOps = %d, want 1 and > 0", s.OpenOps, s.ReadOps)
+	}
+}
+
+func TestMountErrorPropagation(t *testing.T) {
+	errnos := []syscall.Errno{syscall.ESTALE, syscall.EIO, syscall.ETIMEDOUT}
+	var files []string
+	for _, errno := range errnos {
+		files = append(files, fmt.Sprintf("stat-%d", errno), fmt.Sprintf("open-%d", errno), fmt.Sprintf("read-%d", errno))
+	}
+	fb := NewFaultBackend(newTestTree(t, files...))
+	m := mountForTest(t, fb, time.Hour)
+	mp := m.Mountpoint()
+
+	for _, errno := range errnos {
+		stat, open, read := fmt.Sprintf("stat-%d", errno), fmt.Sprintf("open-%d", errno), fmt.Sprintf("read-%d", errno)
+		fb.Inject(Fault{Op: FAULT_LSTAT, Path: stat, Err: errno})
+		fb.Inject(Fault{Op: FAULT_OPEN, Path: open, Err: errno})
+		fb.Inject(Fault{Op: FAULT_READ, Path: read, Err: errno})
+
+		if _, err := os.Lstat(filepath.Join(mp, stat)); !errors.Is(err, errno) {
+			t.Errorf("stat: got %v, want %v", err, errno)
+		}
+		if _, err := os.Open(filepath.Join(mp, open)); !errors.Is(err, errno) {
+			t.Errorf("open: got %v, want %v", err, errno)
+		}
+		if _, err := os.ReadFile(filepath.Join(mp, read)); !errors.Is(err, errno) {
+			t.Errorf("read: got %v, want %v", err, errno)
+		}
+	}
+
+	// Errors are not cached: once the backend recovers, so does the mount
+	fb.Clear()
+	for _, errno := range errnos {
+		if _, err := os.Lstat(filepath.Join(mp, fmt.Sprintf("stat-%d", errno))); err != nil {
+			t.Errorf("stat after recovery: %v", err)
+		}
+	}
+
+	// A failed mutation leaves the caches alone
+	fb.Inject(Fault{Op: FAULT_UNLINK, Err: syscall.EIO})
+	if err := os.Remove(filepath.Join(mp, files[0])); !errors.Is(err, syscall.EIO) {
+		t.Errorf("unlink: got %v, want EIO", err)
+	}
+	if _, err := os.Lstat(filepath.Join(mp, files[0])); err != nil {
+		t.Errorf("stat after failed unlink: %v", err)
+	}
+}
+
+func TestMountCacheHidesLatency(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	fb := NewFaultBackend(newTestTree(t, "slow"))
+	m := mountForTest(t, fb, time.Hour)
+	path := filepath.Join(m.Mountpoint(), "slow")
+
+	fb.ResetCalls()
+	fb.Inject(Fault{Op: FAULT_LSTAT, Path: "slow", Delay: delay})
+	start := time.Now()
+	if _, err := os.Lstat(path); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("first stat took %v, less than the backend delay", elapsed)
+	}
+
+	start = time.Now()
+	for i := 0; i < 10; i++ {
+		if _, err := os.Lstat(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed >= delay {
+		t.Errorf("10 cached stats took %v", elapsed)
+	}
+	if n := fb.Calls(FAULT_LSTAT); n != 1 {
+		t.Errorf("backend LSTAT calls = %d, want 1", n)
+	}
+}
+
+func TestMountHungBackend(t *testing.T) {
+	fb := NewFaultBackend(newTestTree(t, "d/x"))
+	m := mountForTest(t, fb, time.Hour)
+	t.Cleanup(fb.Clear)
+
+	fb.Inject(Fault{Op: FAULT_READDIR, Path: "d", Hang: true, Times: 1})
+	done := make(chan error, 1)
+	go func() {
+		_, err := os.ReadDir(filepath.Join(m.Mountpoint(), "d"))
+		done <- err
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for fb.Hung() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("READDIR never reached the backend")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := m.InflightRequests(); n < 1 {
+		t.Errorf("InflightRequests = %d while the backend hangs", n)
+	}
+
+	// The rest of the mount keeps answering
+	if _, err := os.Lstat(filepath.Join(m.Mountpoint(), "d")); err != nil {
+		t.Errorf("stat while READDIR hangs: %v", err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("ReadDir returned (%v) while the backend hangs", err)
+	default:
+	}
+
+	fb.Release()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("ReadDir after release: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadDir still blocked after release")
+	}
+}
+
+func TestMountConcurrentExternalModification(t *testing.T) {
+	b := newTestTree(t, "d/x", "gone")
+	fb := NewFaultBackend(b)
+	m := mountForTest(t, fb, time.Hour)
+	mp := m.Mountpoint()
+
+	// A file appears while the directory is being listed: the listing and
+	// the attributes it seeds have to agree with each other
+	fb.Inject(Fault{Op: FAULT_READDIR, Path: "d", Times: 1, Before: func() {
+		b.WriteFile("d/late", []byte("late"), 0644)
+	}})
+	if got := listDir(t, filepath.Join(mp, "d")); fmt.Sprint(got) != "[late x]" {
+		t.Errorf("listing = %v", got)
+	}
+	if info, err := os.Lstat(filepath.Join(mp, "d", "late")); err != nil || info.Size() != 4 {
+		t.Errorf("stat of d/late = %v, %v", info, err)
+	}
+
+	// A file is removed between LOOKUP and OPEN: the error comes through
+	if _, err := os.Lstat(filepath.Join(mp, "gone")); err != nil {
+		t.Fatal(err)
+	}
+	fb.Inject(Fault{Op: FAULT_OPEN, Path: "gone", Times: 1, Before: func() {
+		b.Unlink("gone")
+	}})
+	if _, err := os.Open(filepath.Join(mp, "gone")); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("open of a file removed behind the mount: got %v, want ENOENT", err)
+	}
+}
+
+func TestCheckBackendTimeout(t *testing.T) {
+	fb := NewFaultBackend(NewMemoryBackend())
+	m, err := New(Config{Name: "test", Backend: fb, Cache: CacheOptions{TTL: time.Minute}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fb.Clear()
+
+	if err := m.CheckBackend(time.Second); err != nil {
+		t.Errorf("healthy backend: %v", err)
+	}
+	fb.Inject(Fault{Op: FAULT_LSTAT, Path: "", Hang: true})
+	if err := m.CheckBackend(100 * time.Millisecond); err == nil {
+		t.Error("hung backend answered the probe")
+	}
+	fb.Clear()
+	fb.Inject(Fault{Op: FAULT_LSTAT, Err: syscall.ESTALE})
+	if err := m.CheckBackend(time.Second); !errors.Is(err, syscall.ESTALE) {
+		t.Errorf("stale backend: got %v, want ESTALE", err)
+	}
+}
+
+// transactionRecorder keeps the transactions of a mount
+type transactionRecorder struct {
+	mu  sync.Mutex
+	txs []Transaction
+}
+
+func (r *transactionRecorder) LogTransaction(t *Transaction) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.txs = append(r.txs, *t)
+}
+
+// find returns the last transaction of op on a path ending in suffix
+func (r *transactionRecorder) find(op, suffix string) (Transaction, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := len(r.txs) - 1; i >= 0; i-- {
+		if r.txs[i].Op == op && strings.HasSuffix(r.txs[i].Path, suffix) {
+			return r.txs[i], true
+		}
+	}
+	return Transaction{}, false
+}
+
+func TestMountTransactionLog(t *testing.T) {
+	rec := &transactionRecorder{}
+	fb := NewFaultBackend(newTestTree(t, "f", "broken"))
+	m := mountConfigForTest(t, Config{Backend: fb, Cache: CacheOptions{TTL: time.Hour}, TransactionLog: rec})
+	mp := m.Mountpoint()
+
+	fb.Inject(Fault{Op: FAULT_READ, Path: "f", Delay: 50 * time.Millisecond})
+	fb.Inject(Fault{Op: FAULT_LSTAT, Path: "broken", Err: syscall.ESTALE})
+	if data, err := os.ReadFile(filepath.Join(mp, "f")); err != nil || string(data) != "f" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	os.Lstat(filepath.Join(mp, "broken"))
+
+	read, ok := rec.find("READ", "/f")
+	if !ok {
+		t.Fatal("no READ transaction")
+	}
+	// The kernel reports the calling thread, one of ours
+	if _, err := os.Stat(fmt.Sprintf("/proc/self/task/%d", read.Pid)); err != nil || read.Uid != uint32(os.Getuid()) || read.Gid != uint32(os.Getgid()) {
+		t.Errorf("READ caller = pid %d uid %d gid %d, want this process", read.Pid, read.Uid, read.Gid)
+	}
+	// Resolved by the logger, not on the request path. The kernel cuts
+	// comm to 15 characters.
+	if read.Process != "" {
+		t.Errorf("READ process = %q, want it left to the logger", read.Process)
+	}
+	if want, got := filepath.Base(os.Args[0]), ProcessName(read.Pid); got != want && (len(want) <= 15 || got != want[:15]) {
+		t.Errorf("READ process = %q, want %q", got, want)
+	}
+	if read.Offset != 0 || read.Bytes != 1 || read.Errno != 0 {
+		t.Errorf("READ offset %d bytes %d errno %v, want 0, 1 and success", read.Offset, read.Bytes, read.Errno)
+	}
+	if read.Duration < 50*time.Millisecond {
+		t.Errorf("READ took %v, less than the backend delay", read.Duration)
+	}
+
+	lookup, ok := rec.find("LOOKUP", "broken")
+	if !ok {
+		t.Fatal("no LOOKUP transaction")
+	}
+	if lookup.Errno != syscall.ESTALE || lookup.Cached {
+		t.Errorf("LOOKUP errno %v cached %v, want ESTALE from the backend", lookup.Errno, lookup.Cached)
+	}
+}
+
+func TestMountAuditLog(t *testing.T) {
+	rec := &transactionRecorder{}
+	m := mountConfigForTest(t, Config{Backend: newTestTree(t, "f", "old"), Cache: CacheOptions{TTL: time.Hour}, AuditLog: rec})
+	mp := m.Mountpoint()
+
+	// Reads and lookups aren't audited
+	if _, err := os.ReadFile(filepath.Join(mp, "f")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(filepath.Join(mp, "f"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	steps := []error{
+		os.WriteFile(filepath.Join(mp, "new"), nil, 0644),
+		os.Mkdir(filepath.Join(mp, "dir"), 0755),
+		os.Rename(filepath.Join(mp, "old"), filepath.Join(mp, "dir", "moved")),
+		os.Chmod(filepath.Join(mp, "new"), 0600),
+		os.Remove(filepath.Join(mp, "new")),
+		os.Remove(filepath.Join(mp, "dir", "moved")),
+		os.Remove(filepath.Join(mp, "dir")),
+	}
+	for i, err := range steps {
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+	}
+
+	rec.mu.Lock()
+	var ops []string
+	for _, tx := range rec.txs {
+		ops = append(ops, tx.Op)
+	}
+	rec.mu.Unlock()
+	if got, want := fmt.Sprint(ops), "[OPEN CREATE MKDIR RENAME SETATTR UNLINK UNLINK RMDIR]"; got != want {
+		t.Errorf("audited %s, want %s", got, want)
+	}
+
+	open, _ := rec.find("OPEN", "/f")
+	if open.Flags&syscall.O_ACCMODE != syscall.O_WRONLY || open.Uid != uint32(os.Getuid()) || open.Pid == 0 {
+		t.Errorf("OPEN flags %#x uid %d pid %d, want a write open by this process", open.Flags, open.Uid, open.Pid)
+	}
+	if rename, _ := rec.find("RENAME", "/dir/moved"); !strings.Contains(rename.Path, "/old -> ") {
+		t.Errorf("RENAME path %q, want both paths", rename.Path)
+	}
+}
+
+func TestMountDataCache(t *testing.T) {
+	b := newTestTree(t, "tools/cc", "home/notes")
+	fb := NewFaultBackend(b)
+	dc, err := NewDataCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mountConfigForTest(t, Config{
+		Backend:   fb,
+		DataCache: dc,
+		Cache:     CacheOptions{DataCachePaths: []string{"/tools"}},
+	})
+	mnt := m.Mountpoint()
+
+	read := func(name string) string {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(mnt, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	read("tools/cc")
+	fb.ResetCalls()
+	if got := read("tools/cc"); got != "tools/cc" {
+		t.Errorf("cached read = %q", got)
+	}
+	if calls := fb.Calls(FAULT_READ); calls != 0 {
+		t.Errorf("second read of a cached file went to the backend %d times", calls)
+	}
+	read("home/notes")
+	if calls := fb.Calls(FAULT_READ); calls == 0 {
+		t.Error("file outside the data cache paths was not read from the backend")
+	}
+
+	// Changed on the backend: the new mtime and size are seen on open
+	// (TTL 0) and the old blocks are not served
+	if err := b.WriteFile("tools/cc", []byte("tools/cc v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := read("tools/cc"); got != "tools/cc v2" {
+		t.Errorf("read after change = %q", got)
+	}
+
+	s := m.Metrics()
+	if s.DataCacheHits == 0 || s.DataCacheMisses < 2 || s.DataCacheHitBytes == 0 {
+		t.Errorf("data cache metrics: %d hits (%d bytes), %d misses", s.DataCacheHits, s.DataCacheHitBytes, s.DataCacheMisses)
+	}
+}
+
+func TestMountWriteBack(t *testing.T) {
+	fb := NewFaultBackend(newTestTree(t, "logs/x", "critical/x"))
+	m := mountConfigForTest(t, Config{
+		Backend: fb,
+		Cache: CacheOptions{
+			TTL:               time.Hour,
+			WriteBackPaths:    []string{"/"},
+			WriteThroughPaths: []string{"/critical"},
+			WriteBackDelay:    time.Hour,
+		},
+	})
+	mnt := m.Mountpoint()
+
+	appendLines := func(name string, n int) *os.File {
+		t.Helper()
+		f, err := os.OpenFile(filepath.Join(mnt, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			if _, err := fmt.Fprintf(f, "line %d\n", i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return f
+	}
+
+	// Buffered, yet visible to stat and to other readers before close
+	fb.ResetCalls()
+	f := appendLines("logs/app.log", 100)
+	if st, err := os.Stat(filepath.Join(mnt, "logs/app.log")); err != nil || st.Size() != 790 {
+		t.Errorf("stat with buffered writes: %v, %v", st, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if calls := fb.Calls(FAULT_WRITE); calls != 1 {
+		t.Errorf("100 appends took %d backend writes, want 1", calls)
+	}
+	data, err := os.ReadFile(filepath.Join(mnt, "logs/app.log"))
+	if err != nil || !strings.HasPrefix(string(data), "line 0\n") || !strings.HasSuffix(string(data), "line 99\n") {
+		t.Errorf("read back %d bytes, %v", len(data), err)
+	}
+
+	// Write-through below /critical
+	fb.ResetCalls()
+	if err := appendLines("critical/journal", 10).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if calls := fb.Calls(FAULT_WRITE); calls != 10 {
+		t.Errorf("10 write-through appends took %d backend writes", calls)
+	}
+
+	// A failed write-back is reported by close, not by write
+	fb.Inject(Fault{Op: FAULT_WRITE, Path: "logs/fail", Err: syscall.EIO})
+	f = appendLines("logs/fail", 3)
+	if err := f.Close(); !errors.Is(err, syscall.EIO) {
+		t.Errorf("close after failed write-back: %v, want EIO", err)
+	}
+
+	if s := m.Metrics().Snapshot(); s.WritesCoalesced < 99 || s.WriteBackFlushes == 0 {
+		t.Errorf("%d writes coalesced in %d flushes", s.WritesCoalesced, s.WriteBackFlushes)
+	}
+}
+
+func TestMountInvalidationBus(t *testing.T) {
+	// Two "hosts" serving the same export, each with its own bus
+	b := newTestTree(t, "a", "sub/b")
+	sockets := t.TempDir()
+	mountWithBus := func() *Mount {
+		transport, err := NewUnixTransport(sockets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bus := NewInvalidationBus(transport)
+		t.Cleanup(func() { bus.Close() })
+		return mountConfigForTest(t, Config{Backend: b, Cache: CacheOptions{TTL: time.Hour}, Invalidation: bus})
+	}
+	writer, reader := mountWithBus(), mountWithBus()
+	wmp, rmp := writer.Mountpoint(), reader.Mountpoint()
+
+	// Everything below is cached on the reader for an hour
+	listDir(t, rmp)
+	listDir(t, filepath.Join(rmp, "sub"))
+	os.ReadFile(filepath.Join(rmp, "a"))
+
+	eventually := func(what string, ok func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); !ok(); time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("reader never saw %s", what)
+			}
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(wmp, "c"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	eventually("the create", func() bool { return fmt.Sprint(listDir(t, rmp)) == "[a c sub]" })
+
+	// Without truncating: SETATTR isn't supported
+	f, err := os.OpenFile(filepath.Join(wmp, "a"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("rewritten")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	eventually("the write", func() bool {
+		data, _ := os.ReadFile(filepath.Join(rmp, "a"))
+		return string(data) == "rewritten"
+	})
+
+	if err := os.Rename(filepath.Join(wmp, "c"), filepath.Join(wmp, "sub", "c")); err != nil {
+		t.Fatal(err)
+	}
+	eventually("the rename", func() bool {
+		_, err := os.Lstat(filepath.Join(rmp, "c"))
+		return errors.Is(err, syscall.ENOENT) && fmt.Sprint(listDir(t, filepath.Join(rmp, "sub"))) == "[b c]"
+	})
+
+	if err := os.Remove(filepath.Join(wmp, "sub", "b")); err != nil {
+		t.Fatal(err)
+	}
+	eventually("the unlink", func() bool {
+		_, err := os.Lstat(filepath.Join(rmp, "sub", "b"))
+		return errors.Is(err, syscall.ENOENT)
+	})
+
+	if s := writer.Metrics().Snapshot(); s.InvalidationsPublished < 4 {
+		t.Errorf("writer published %d invalidations", s.InvalidationsPublished)
+	}
+	if s := reader.Metrics().Snapshot(); s.InvalidationsReceived < 4 {
+		t.Errorf("reader applied %d invalidations", s.InvalidationsReceived)
+	}
+}
+
+func TestMountReadOnly(t *testing.T) {
+	b := newTestTree(t, "a", "sub/b")
+	m := mountConfigForTest(t, Config{Backend: b, Cache: CacheOptions{TTL: time.Hour}, ReadOnly: true})
+	mp := m.Mountpoint()
+
+	var sfs syscall.Statfs_t
+	if err := syscall.Statfs(mp, &sfs); err != nil {
+		t.Fatal(err)
+	}
+	if sfs.Flags&0x1 == 0 { // ST_RDONLY
+		t.Errorf("mount flags %#x lack ST_RDONLY", sfs.Flags)
+	}
+
+	for what, err := range map[string]error{
+		"create": os.WriteFile(filepath.Join(mp, "new"), nil, 0644),
+		"mkdir":  os.Mkdir(filepath.Join(mp, "dir"), 0755),
+		"unlink": os.Remove(filepath.Join(mp, "a")),
+		"rmdir":  os.Remove(filepath.Join(mp, "sub")),
+		"rename": os.Rename(filepath.Join(mp, "a"), filepath.Join(mp, "c")),
+	} {
+		if !errors.Is(err, syscall.EROFS) {
+			t.Errorf("%s: %v, want EROFS", what, err)
+		}
+	}
+	if _, err := os.OpenFile(filepath.Join(mp, "a"), os.O_WRONLY, 0); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("open for writing: %v, want EROFS", err)
+	}
+
+	// Rejected by forkspoon itself too, not only by the kernel
+	ctx := context.Background()
+	if errno := m.root.Unlink(ctx, "a"); errno != syscall.EROFS {
+		t.Errorf("UNLINK reaching the filesystem: %v, want EROFS", errno)
+	}
+	if _, errno := (&loopbackFile{m: m}).Write(ctx, []byte("x"), 0); errno != syscall.EROFS {
+		t.Errorf("WRITE reaching the filesystem: %v, want EROFS", errno)
+	}
+
+	// Reading works, repeatedly
+	for i := 0; i < 2; i++ {
+		if data, err := os.ReadFile(filepath.Join(mp, "sub", "b")); err != nil || string(data) != "sub/b" {
+			t.Errorf("read %q, %v", data, err)
+		}
+		if got := listDir(t, mp); fmt.Sprint(got) != "[a sub]" {
+			t.Errorf("root listing = %v", got)
+		}
+	}
+	if err := b.Lstat("a", new(syscall.Stat_t)); err != nil {
+		t.Errorf("backend changed: %v", err)
+	}
+}
+
+func TestMountIDMap(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("squashing is tested with requests from root")
+	}
+	b := newTestTree(t, "a", "sub/b")
+	for _, name := range []string{"a", "sub/b"} {
+		if err := b.Lchown(name, 5001, 5000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := []IDRange{{Mount: 1000, Backend: 5001}}
+	gids := []IDRange{{Mount: 100, Backend: 5000}, {Mount: 200, Backend: 6000, Count: 10}}
+	squashed := mountConfigForTest(t, Config{Backend: b, Cache: CacheOptions{TTL: time.Hour},
+		IDMap: &IDMap{UIDs: ids, GIDs: gids, Squash: SQUASH_ROOT}})
+	m := mountConfigForTest(t, Config{Backend: b, Cache: CacheOptions{TTL: time.Hour},
+		IDMap: &IDMap{UIDs: ids, GIDs: gids}})
+
+	owner := func(path string) string {
+		t.Helper()
+		var st syscall.Stat_t
+		if err := syscall.Lstat(path, &st); err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("%d:%d", st.Uid, st.Gid)
+	}
+	backendOwner := func(rel string) string {
+		t.Helper()
+		var st syscall.Stat_t
+		if err := b.Lstat(rel, &st); err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("%d:%d", st.Uid, st.Gid)
+	}
+
+	// GETATTR and LOOKUP, and attributes seeded by READDIR, twice to get
+	// them from the cache too
+	mp := squashed.Mountpoint()
+	listDir(t, filepath.Join(mp, "sub"))
+	for i := 0; i < 2; i++ {
+		for _, name := range []string{"a", "sub/b"} {
+			if got := owner(filepath.Join(mp, name)); got != "1000:100" {
+				t.Errorf("%s is owned by %s, want 1000:100", name, got)
+			}
+		}
+	}
+
+	// Root is squashed: its files belong to the anonymous user, and it
+	// can't give files away
+	if err := os.WriteFile(filepath.Join(mp, "new"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(mp, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"new", "dir"} {
+		if got := backendOwner(name); got != "65534:65534" {
+			t.Errorf("%s created by squashed root is owned by %s on the backend", name, got)
+		}
+	}
+	if err := os.Lchown(filepath.Join(mp, "a"), 0, 0); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("chown by squashed root: %v, want EPERM", err)
+	}
+
+	// Without squashing, new files and chown are mapped to backend ids
+	mp = m.Mountpoint()
+	if err := os.Lchown(filepath.Join(mp, "a"), -1, 205); err != nil {
+		t.Fatal(err)
+	}
+	if got := backendOwner("a"); got != "5001:6005" {
+		t.Errorf("chown to group 205 gave %s on the backend, want 5001:6005", got)
+	}
+	if got := owner(filepath.Join(mp, "a")); got != "1000:205" {
+		t.Errorf("a is owned by %s after chown, want 1000:205", got)
+	}
+	if err := os.Mkdir(filepath.Join(mp, "rootdir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if got := backendOwner("rootdir"); got != "0:0" {
+		t.Errorf("directory created by root is owned by %s on the backend", got)
+	}
+
+	// The rest of SETATTR
+	if err := os.Chmod(filepath.Join(mp, "a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(filepath.Join(mp, "a"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(mp, "sub", "b"), []byte("xy"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var st syscall.Stat_t
+	b.Lstat("a", &st)
+	if st.Mode&07777 != 0600 || st.Size != 0 {
+		t.Errorf("backend a has mode %o and size %d, want 600 and 0", st.Mode&07777, st.Size)
+	}
+	if data, err := os.ReadFile(filepath.Join(mp, "sub", "b")); err != nil || string(data) != "xy" {
+		t.Errorf("rewritten sub/b = %q, %v", data, err)
+	}
+	if n := m.Metrics().SetattrOps; n == 0 {
+		t.Error("SETATTR was not counted")
+	}
+}
+
+func TestMountFollowsDirectoriesRenamedOnBackend(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "old"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := mountConfigForTest(t, Config{BackendPath: dir, Cache: CacheOptions{TTL: time.Hour}})
+	sub := filepath.Join(m.Mountpoint(), "sub")
+
+	// Looking inside the directory opens it on the backend
+	if _, err := os.Stat(filepath.Join(sub, "old")); err != nil {
+		t.Fatal(err)
+	}
+	if n := m.dirs.count(); n == 0 {
+		t.Fatal("no backend directories held open")
+	}
+
+	// Renamed behind the mount's back: the cached dentry still says "sub",
+	// and what is done there lands in the directory, wherever it now is
+	if err := os.Rename(filepath.Join(dir, "sub"), filepath.Join(dir, "moved")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sub, "new"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(sub, "newdir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(sub, "old")); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(listDir(t, filepath.Join(dir, "moved"))); got != "[new newdir]" {
+		t.Errorf("renamed directory holds %s, want [new newdir]", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sub")); !os.IsNotExist(err) {
+		t.Errorf("old directory name reappeared on the backend: %v", err)
+	}
+}
+
+func TestMountRenameFlags(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := mountConfigForTest(t, Config{BackendPath: dir, Cache: CacheOptions{TTL: time.Hour}})
+	a, b := filepath.Join(m.Mountpoint(), "a"), filepath.Join(m.Mountpoint(), "b")
+	contents := func() string {
+		t.Helper()
+		var got []string
+		for _, p := range []string{a, b} {
+			data, err := os.ReadFile(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, string(data))
+		}
+		return strings.Join(got, " ")
+	}
+	contents()
+
+	if err := unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_NOREPLACE); err != unix.EEXIST {
+		t.Errorf("RENAME_NOREPLACE onto an existing file: %v, want EEXIST", err)
+	}
+	if got := contents(); got != "a b" {
+		t.Errorf("after RENAME_NOREPLACE: %s, want a b", got)
+	}
+	if err := unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_EXCHANGE); err != nil {
+		t.Fatalf("RENAME_EXCHANGE: %v", err)
+	}
+	if got := contents(); got != "b a" {
+		t.Errorf("after RENAME_EXCHANGE: %s, want b a", got)
+	}
+
+	// Without directory handles the flags can't be honoured
+	mem := mountForTest(t, newTestTree(t, "a"), time.Hour)
+	err := unix.Renameat2(unix.AT_FDCWD, filepath.Join(mem.Mountpoint(), "a"), unix.AT_FDCWD, filepath.Join(mem.Mountpoint(), "c"), unix.RENAME_NOREPLACE)
+	if err != unix.EINVAL {
+		t.Errorf("RENAME_NOREPLACE on a memory backend: %v, want EINVAL", err)
+	}
+}
+
+func TestMountFilterKeepsGenerations(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b", "x.tmp"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := mountConfigForTest(t, Config{BackendPath: dir, Cache: CacheOptions{TTL: time.Hour},
+		Filter: &PathFilter{Exclude: []string{"*.tmp"}}})
+	mp := m.Mountpoint()
+
+	// Keys from lookups and a create, then from the listing
+	if _, err := os.Lstat(filepath.Join(mp, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(mp, "c"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(listDir(t, mp)); got != "[a b c]" {
+		t.Errorf("root lists %s, want [a b c]", got)
+	}
+
+	keys := make(map[uint64]map[inodeKey]bool)
+	add := func(key inodeKey) {
+		if keys[key.Ino] == nil {
+			keys[key.Ino] = make(map[inodeKey]bool)
+		}
+		keys[key.Ino][key] = true
+	}
+	m.attrCache.mu.RLock()
+	for key := range m.attrCache.entries {
+		add(key)
+	}
+	m.attrCache.mu.RUnlock()
+	m.lookupCache.mu.RLock()
+	for _, e := range m.lookupCache.entries[m.root.key] {
+		add(e.child)
+	}
+	m.lookupCache.mu.RUnlock()
+	for ino, ks := range keys {
+		if len(ks) != 1 {
+			t.Errorf("inode %d cached under %d keys: %v", ino, len(ks), ks)
+		}
+	}
+}
+
+func TestMountFilter(t *testing.T) {
+	b := newTestTree(t, "a", "lost+found/x")
+	for _, dir := range []string{"teams", "teams/alpha", "teams/beta", "teams/alpha/.snapshot"} {
+		if err := b.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.WriteFile(dir+"/f", nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := mountConfigForTest(t, Config{Backend: b, Cache: CacheOptions{TTL: time.Hour},
+		Filter: &PathFilter{Include: []string{"/teams"}, Exclude: []string{".snapshot", "/teams/beta"}}})
+	mp := m.Mountpoint()
+
+	// Twice: the second listing comes from the cache
+	for i := 0; i < 2; i++ {
+		if got := fmt.Sprint(listDir(t, mp)); got != "[teams]" {
+			t.Errorf("root lists %s, want [teams]", got)
+		}
+		if got := fmt.Sprint(listDir(t, filepath.Join(mp, "teams"))); got != "[alpha f]" {
+			t.Errorf("teams lists %s, want [alpha f]", got)
+		}
+		if got := fmt.Sprint(listDir(t, filepath.Join(mp, "teams", "alpha"))); got != "[f]" {
+			t.Errorf("teams/alpha lists %s, want [f]", got)
+		}
+	}
+	for _, name := range []string{"a", "lost+found/x", "teams/beta/f", "teams/alpha/.snapshot"} {
+		if _, err := os.Lstat(filepath.Join(mp, name)); !errors.Is(err, syscall.ENOENT) {
+			t.Errorf("%s: %v, want ENOENT", name, err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(mp, "teams", "alpha", ".snapshot2"), 0755); err != nil {
+		t.Errorf("mkdir of a visible name: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(mp, "teams", "alpha", ".snapshot"), nil, 0644); !errors.Is(err, syscall.EACCES) {
+		t.Errorf("creating a hidden name: %v, want EACCES", err)
+	}
+	if err := os.Rename(filepath.Join(mp, "teams", "alpha", "f"), filepath.Join(mp, "teams", "beta")); !errors.Is(err, syscall.EACCES) {
+		t.Errorf("renaming to a hidden name: %v, want EACCES", err)
+	}
+
+	metrics := m.Metrics().Snapshot()
+	if metrics.FilteredLookups == 0 || metrics.FilteredEntries != 4 {
+		t.Errorf("filtered %d lookups and %d entries, want some and 4", metrics.FilteredLookups, metrics.FilteredEntries)
+	}
+}
@@ -0,0 +1,245 @@
+package forkspoon
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// Where the kernel lists the mounts visible to this process
+	MOUNTINFO_PATH = "/proc/self/mountinfo"
+
+	// How long a probe of an existing mount may take before it counts as dead
+	STALE_MOUNT_PROBE_TIMEOUT = 2 * time.Second
+)
+
+// mountInfo is one line of /proc/self/mountinfo
+type mountInfo struct {
+	MountPoint string
+	FsType     string
+	Source     string
+}
+
+// readMountinfo parses the mount table in the format of proc(5):
+//
+//	36 35 98:0 /mnt1 /mnt/parent rw,noatime master:1 - ext3 /dev/root rw
+//
+// Fields after the optional tags are separated by a lone "-".
+func readMountinfo(r io.Reader) ([]mountInfo, error) {
+	var mounts []mountInfo
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep < 0 || sep+2 >= len(fields) {
+			continue
+		}
+		mounts = append(mounts, mountInfo{
+			MountPoint: unescapeMountPath(fields[4]),
+			FsType:     fields[sep+1],
+			Source:     unescapeMountPath(fields[sep+2]),
+		})
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountPath undoes the octal escapes (\040 for space etc.) the
+// kernel applies to whitespace and backslashes in mountinfo paths
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// findMount returns the topmost mount at path, if any
+func findMount(mounts []mountInfo, path string) (mountInfo, bool) {
+	var found mountInfo
+	ok := false
+	for _, m := range mounts {
+		if m.MountPoint == path {
+			found, ok = m, true
+		}
+	}
+	return found, ok
+}
+
+// isFuseMount reports whether fstype is one of the fuse types ("fuse",
+// "fuse.<subtype>", "fuseblk")
+func isFuseMount(fstype string) bool {
+	return fstype == "fuse" || fstype == "fuseblk" || strings.HasPrefix(fstype, "fuse.")
+}
+
+// resolvePath makes path absolute and resolves symlinks in its existing
+// parent directories. The last component is deliberately not followed: on a
+// dead FUSE mount even lstat of it fails with ENOTCONN.
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	dir, base := filepath.Split(abs)
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		if resolved, err := filepath.EvalSymlinks(d); err == nil {
+			rest, _ := filepath.Rel(d, filepath.Clean(dir))
+			return filepath.Join(resolved, rest, base), nil
+		}
+		if d == "/" {
+			return abs, nil
+		}
+	}
+}
+
+// IsWithin reports whether path is dir itself or lies below it
+func IsWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// prepareMountpoint makes sure mountpoint can be mounted over backend.
+// It refuses to mount on the backend, inside it, or over one of its parents
+// (each would make the filesystem recurse into itself), detects a mount left
+// behind by a crashed instance and optionally detaches it, refuses a live
+// mount, and requires the mountpoint to be an empty directory unless
+// allowNonEmpty is set. It returns the resolved mountpoint path. An empty
+// backend (one that isn't a directory on disk) skips the nesting checks.
+func prepareMountpoint(backend, mountpoint string, unmountStale, allowNonEmpty, verbose bool) (string, error) {
+	mountPath, err := resolvePath(mountpoint)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve mountpoint path: %v", err)
+	}
+	if backend != "" {
+		backendPath, err := filepath.Abs(backend)
+		if err == nil {
+			backendPath, err = filepath.EvalSymlinks(backendPath)
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve backend path: %v", err)
+		}
+		if IsWithin(mountPath, backendPath) {
+			return "", fmt.Errorf("mountpoint %s is inside the backend %s", mountPath, backendPath)
+		}
+		if IsWithin(backendPath, mountPath) {
+			return "", fmt.Errorf("backend %s is inside the mountpoint %s", backendPath, mountPath)
+		}
+	}
+
+	if err := checkExistingMount(mountPath, unmountStale, verbose); err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(mountPath, 0755); err != nil {
+		return "", fmt.Errorf("failed to create mountpoint: %v", err)
+	}
+	if !allowNonEmpty {
+		empty, err := isEmptyDir(mountPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to check mountpoint: %v", err)
+		}
+		if !empty {
+			return "", fmt.Errorf("mountpoint %s is not empty (use -allow-nonempty to mount over it)", mountPath)
+		}
+	}
+	return mountPath, nil
+}
+
+// checkExistingMount looks for a FUSE filesystem already mounted at path.
+// A mount whose server is gone answers requests with ENOTCONN; it is
+// detached with MNT_DETACH when unmountStale is set. A mount that still
+// answers belongs to a running instance and is never touched.
+func checkExistingMount(path string, unmountStale, verbose bool) error {
+	f, err := os.Open(MOUNTINFO_PATH)
+	if err != nil {
+		// No /proc: fall back to whatever mount(2) says
+		if verbose {
+			log.Printf("[MOUNT] Cannot read %s: %v", MOUNTINFO_PATH, err)
+		}
+		return nil
+	}
+	mounts, err := readMountinfo(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", MOUNTINFO_PATH, err)
+	}
+
+	m, ok := findMount(mounts, path)
+	if !ok || !isFuseMount(m.FsType) {
+		return nil
+	}
+
+	probeErr := statfsWithTimeout(path, STALE_MOUNT_PROBE_TIMEOUT)
+	if probeErr == nil {
+		return fmt.Errorf("mountpoint %s is already served by a running filesystem (%s, %s)", path, m.Source, m.FsType)
+	}
+	if !errors.Is(probeErr, syscall.ENOTCONN) && !errors.Is(probeErr, syscall.ECONNABORTED) {
+		return fmt.Errorf("mountpoint %s has a FUSE mount that is not responding: %v", path, probeErr)
+	}
+
+	if !unmountStale {
+		return fmt.Errorf("stale FUSE mount at %s (%v); run `fusermount -uz %s` or start with -unmount-stale", path, probeErr, path)
+	}
+	log.Printf("Detaching stale FUSE mount at %s (%s, %v)", path, m.Source, probeErr)
+	if err := syscall.Unmount(path, syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to unmount stale mount at %s: %v", path, err)
+	}
+	return nil
+}
+
+// statfsWithTimeout probes the filesystem at path. Unlike stat, which the
+// kernel may answer from cached root attributes, statfs always goes to the
+// FUSE server and so tells a live mount from a dead one.
+func statfsWithTimeout(path string, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		var sfs syscall.Statfs_t
+		done <- syscall.Statfs(path, &sfs)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("no response from %s after %v", path, timeout)
+	}
+}
+
+// isEmptyDir reports whether dir has no entries
+func isEmptyDir(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err == io.EOF {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return false, nil
+}
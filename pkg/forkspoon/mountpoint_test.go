@@ -0,0 +1,86 @@
+package forkspoon
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadMountinfo(t *testing.T) {
+	const table = `22 1 0:21 / /proc rw,nosuid shared:12 - proc proc rw
+36 35 98:0 /mnt1 /mnt/parent rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+90 22 0:52 / /mnt/with\040space rw,nosuid,nodev - fuse.rawBridge forkspoon-cache rw,user_id=0
+91 90 0:53 / /mnt/with\040space rw,nosuid,nodev - fuse.rawBridge second rw,user_id=0
+`
+	mounts, err := readMountinfo(strings.NewReader(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 4 {
+		t.Fatalf("got %d mounts, want 4", len(mounts))
+	}
+	if m := mounts[1]; m.MountPoint != "/mnt/parent" || m.FsType != "ext3" || m.Source != "/dev/root" {
+		t.Errorf("optional fields mis-parsed: %+v", m)
+	}
+
+	m, ok := findMount(mounts, "/mnt/with space")
+	if !ok {
+		t.Fatal("escaped mountpoint not found")
+	}
+	if m.Source != "second" {
+		t.Errorf("got mount %q, want the topmost one", m.Source)
+	}
+	if !isFuseMount(m.FsType) || isFuseMount(mounts[0].FsType) {
+		t.Errorf("isFuseMount misclassified %q / %q", m.FsType, mounts[0].FsType)
+	}
+}
+
+func TestPrepareMountpointRefusesNesting(t *testing.T) {
+	dir := t.TempDir()
+	backend := filepath.Join(dir, "backend")
+	if err := os.Mkdir(backend, 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(backend, link); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mp := range []string{
+		backend,
+		filepath.Join(backend, "sub"),
+		filepath.Join(link, "sub", "deeper"),
+		dir,
+	} {
+		if _, err := prepareMountpoint(backend, mp, false, false, false); err == nil {
+			t.Errorf("mounting %s over backend %s was allowed", mp, backend)
+		}
+	}
+
+	// A sibling whose name shares the backend's prefix is fine
+	if _, err := prepareMountpoint(backend, backend+"-cache", false, false, false); err != nil {
+		t.Errorf("sibling mountpoint refused: %v", err)
+	}
+}
+
+func TestPrepareMountpointNonEmpty(t *testing.T) {
+	dir := t.TempDir()
+	backend := filepath.Join(dir, "backend")
+	mp := filepath.Join(dir, "mnt")
+	for _, d := range []string{backend, mp} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(mp, "leftover"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := prepareMountpoint(backend, mp, false, false, false); err == nil {
+		t.Error("non-empty mountpoint was accepted")
+	}
+	if _, err := prepareMountpoint(backend, mp, false, true, false); err != nil {
+		t.Errorf("-allow-nonempty did not allow it: %v", err)
+	}
+}
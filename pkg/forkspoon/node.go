@@ -0,0 +1,1494 @@
+package forkspoon
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// loopbackNode is a filesystem node that passes through to an underlying path
+type loopbackNode struct {
+	fs.Inode
+
+	// Identity of the backend inode; the key for its cached state
+	key inodeKey
+
+	// The entry its directory handles just returned, for READDIRPLUS
+	plus atomic.Pointer[plusEntry]
+}
+
+// rootNode is the root of the loopback filesystem
+type rootNode struct {
+	fs.Inode
+
+	// Backend path of the root, as shown in logs
+	rootPath string
+	key      inodeKey
+
+	// The mount this tree belongs to: its caches, policy and metrics
+	m *Mount
+
+	// The entry its directory handles just returned, for READDIRPLUS
+	plus atomic.Pointer[plusEntry]
+}
+
+var _ = (fs.NodeOnForgetter)((*loopbackNode)(nil))
+
+// OnForget is called by go-fuse once the kernel has dropped all references
+// to the node. Cached dentries and attributes are keyed by inode identity
+// and stay valid; the next lookup hit simply instantiates a new node. The
+// backend directory held open for it, if any, is closed.
+func (n *loopbackNode) OnForget() {
+	m := n.mount()
+	atomic.AddUint64(&m.metrics.InodesForgotten, 1)
+	m.dirs.drop(n.key)
+	if m.verbose {
+		log.Printf("[FORGET] Inode: %d", n.key.Ino)
+	}
+}
+
+// Path helpers. Backend calls take the path relative to the backend root;
+// logs show the full backend path.
+func (r *rootNode) path() string {
+	return r.rootPath
+}
+
+func (n *loopbackNode) path() string {
+	return n.mount().backendPath(n.relPath())
+}
+
+func (n *loopbackNode) relPath() string {
+	return n.Path(n.Root())
+}
+
+// backendPath returns the backend path of rel for logs
+func (m *Mount) backendPath(rel string) string {
+	return filepath.Join(m.root.rootPath, rel)
+}
+
+// mount returns the mount whose tree the node is in
+func (n *loopbackNode) mount() *Mount {
+	return n.Root().Operations().(*rootNode).m
+}
+
+// ============ METADATA OPERATIONS (CACHED) ============
+
+// Getattr for loopbackNode - NOW WITH CACHING!
+func (n *loopbackNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) (errno syscall.Errno) {
+	m := n.mount()
+	defer m.trackRequest()()
+
+	rel := n.relPath()
+	p := m.backendPath(rel)
+
+	tx := m.startTransaction(ctx, "GETATTR", p)
+	defer func() { m.endTransaction(&tx, errno) }()
+
+	// Buffered writes go out first, so the size is right
+	m.flushWrites(n.key)
+
+	// Check cache first
+	if cached, hit := m.attrCache.Get(n.key); hit {
+		// Cache HIT!
+		m.updateMetrics("GETATTR", true)
+		tx.Cached = true
+
+		if m.verbose {
+			log.Printf("[GETATTR] CACHE HIT for: %s", p)
+		}
+
+		*out = *cached
+		return 0
+	}
+
+	// Cache MISS - do actual getattr
+	m.updateMetrics("GETATTR", false)
+
+	if m.verbose {
+		log.Printf("[GETATTR] CACHE MISS for: %s", p)
+	}
+
+	b, name, done, err := n.at()
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	defer done()
+
+	var st syscall.Stat_t
+	key, err := lstatKey(b, name, &st)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	m.attrFromStat(&out.Attr, &st)
+
+	// Set cache timeout - this enables kernel caching
+	ttl := m.ttlFor(rel)
+	out.SetTimeout(ttl)
+
+	// Store in our cache
+	m.attrCache.Put(key, *out, ttl)
+
+	if m.verbose {
+		log.Printf("[GETATTR] Cached attributes for: %s (TTL: %v)", p, ttl)
+	}
+
+	return 0
+}
+
+// Getattr for rootNode - NOW WITH CACHING!
+func (r *rootNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) (errno syscall.Errno) {
+	m := r.m
+	defer m.trackRequest()()
+
+	tx := m.startTransaction(ctx, "GETATTR", r.rootPath)
+	defer func() { m.endTransaction(&tx, errno) }()
+
+	// Check cache first
+	if cached, hit := m.attrCache.Get(r.key); hit {
+		// Cache HIT!
+		m.updateMetrics("GETATTR", true)
+		tx.Cached = true
+
+		if m.verbose {
+			log.Printf("[GETATTR] CACHE HIT for root: %s", r.rootPath)
+		}
+
+		*out = *cached
+		return 0
+	}
+
+	// Cache MISS - do actual getattr
+	m.updateMetrics("GETATTR", false)
+
+	if m.verbose {
+		log.Printf("[GETATTR] CACHE MISS for root: %s", r.rootPath)
+	}
+
+	var st syscall.Stat_t
+	key, err := lstatKey(m.backend, "", &st)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	m.attrFromStat(&out.Attr, &st)
+
+	ttl := m.ttlFor("")
+	out.SetTimeout(ttl)
+
+	// Store in our cache
+	m.attrCache.Put(key, *out, ttl)
+
+	if m.verbose {
+		log.Printf("[GETATTR] Cached attributes for root (TTL: %v)", ttl)
+	}
+
+	return 0
+}
+
+// Lookup for rootNode - NOW WITH CACHING!
+func (r *rootNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (inode *fs.Inode, errno syscall.Errno) {
+	m := r.m
+	defer m.trackRequest()()
+
+	rel := name
+
+	tx := m.startTransaction(ctx, "LOOKUP", m.backendPath(rel))
+	defer func() { m.endTransaction(&tx, errno) }()
+
+	if m.hidden(rel) {
+		atomic.AddUint64(&m.metrics.FilteredLookups, 1)
+		return nil, syscall.ENOENT
+	}
+
+	// An entry of a READDIRPLUS reply, with the attributes of the listing
+	if inode := m.plusLookup(ctx, &r.plus, &r.Inode, r.key, name, rel, out); inode != nil {
+		m.updateMetrics("LOOKUP", true)
+		tx.Cached = true
+		if m.verbose {
+			log.Printf("[LOOKUP] READDIRPLUS attributes for: %s", name)
+		}
+		return inode, 0
+	}
+
+	// Check cache first: the dentry, then the attributes of its inode
+	if cached, attr, hit := m.cachedLookup(r.key, name); hit && !m.flushWrites(cached.child) {
+		// Cache HIT!
+		m.updateMetrics("LOOKUP", true)
+		tx.Cached = true
+
+		if m.verbose {
+			log.Printf("[LOOKUP] CACHE HIT for: %s", name)
+		}
+
+		// Use cached attributes
+		ttl := m.ttlFor(rel)
+		out.Attr = attr.Attr
+		out.SetEntryTimeout(ttl)
+		out.SetAttrTimeout(ttl)
+		return m.cachedLookupInode(ctx, &r.Inode, name, cached), 0
+	}
+
+	// Cache MISS - do actual lookup
+	m.updateMetrics("LOOKUP", false)
+
+	if m.verbose {
+		log.Printf("[LOOKUP] CACHE MISS for: %s", name)
+	}
+
+	b, bname, done, err := m.at(r.key, "", name)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	defer done()
+
+	var st syscall.Stat_t
+	key, err := lstatKey(b, bname, &st)
+	if err == nil && m.flushWrites(key) {
+		key, err = lstatKey(b, bname, &st)
+	}
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+
+	m.attrFromStat(&out.Attr, &st)
+
+	// Set cache timeouts - enables kernel caching
+	ttl := m.ttlFor(rel)
+	out.SetEntryTimeout(ttl)
+	out.SetAttrTimeout(ttl)
+
+	if m.verbose {
+		log.Printf("[LOOKUP] Caching entry for: %s (TTL: %v)", name, ttl)
+	}
+
+	m.cacheStat(key, &st, ttl)
+	node := &loopbackNode{key: key}
+	inode = r.NewInode(ctx, node, stableAttr(key, &st))
+
+	// Store in cache
+	m.lookupCache.Put(r.key, name, key, st.Mode, ttl)
+
+	return inode, 0
+}
+
+// Lookup for loopbackNode - NOW WITH CACHING!
+func (n *loopbackNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (inode *fs.Inode, errno syscall.Errno) {
+	m := n.mount()
+	defer m.trackRequest()()
+
+	rel := filepath.Join(n.relPath(), name)
+	p := m.backendPath(rel)
+
+	tx := m.startTransaction(ctx, "LOOKUP", p)
+	defer func() { m.endTransaction(&tx, errno) }()
+
+	if m.hidden(rel) {
+		atomic.AddUint64(&m.metrics.FilteredLookups, 1)
+		return nil, syscall.ENOENT
+	}
+
+	// An entry of a READDIRPLUS reply, with the attributes of the listing
+	if inode := m.plusLookup(ctx, &n.plus, &n.Inode, n.key, name, rel, out); inode != nil {
+		m.updateMetrics("LOOKUP", true)
+		tx.Cached = true
+		if m.verbose {
+			log.Printf("[LOOKUP] READDIRPLUS attributes for: %s", p)
+		}
+		return inode, 0
+	}
+
+	// Check cache first: the dentry, then the attributes of its inode
+	if cached, attr, hit := m.cachedLookup(n.key, name); hit && !m.flushWrites(cached.child) {
+		// Cache HIT!
+		m.updateMetrics("LOOKUP", true)
+		tx.Cached = true
+
+		if m.verbose {
+			log.Printf("[LOOKUP] CACHE HIT for: %s/%s", n.path(), name)
+		}
+
+		// Use cached attributes
+		ttl := m.ttlFor(rel)
+		out.Attr = attr.Attr
+		out.SetEntryTimeout(ttl)
+		out.SetAttrTimeout(ttl)
+		return m.cachedLookupInode(ctx, &n.Inode, name, cached), 0
+	}
+
+	// Cache MISS - do actual lookup
+	m.updateMetrics("LOOKUP", false)
+
+	if m.verbose {
+		log.Printf("[LOOKUP] CACHE MISS for: %s/%s", n.path(), name)
+	}
+
+	b, bname, done, err := m.at(n.key, n.relPath(), name)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	defer done()
+
+	var st syscall.Stat_t
+	key, err := lstatKey(b, bname, &st)
+	if err == nil && m.flushWrites(key) {
+		key, err = lstatKey(b, bname, &st)
+	}
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+
+	m.attrFromStat(&out.Attr, &st)
+	ttl := m.ttlFor(rel)
+	out.SetEntryTimeout(ttl)
+	out.SetAttrTimeout(ttl)
+
+	if m.verbose {
+		log.Printf("[LOOKUP] Caching entry for: %s (TTL: %v)", name, ttl)
+	}
+
+	m.cacheStat(key, &st, ttl)
+	node := &loopbackNode{key: key}
+	inode = n.NewInode(ctx, node, stableAttr(key, &st))
+
+	// Store in cache
+	m.lookupCache.Put(n.key, name, key, st.Mode, ttl)
+
+	return inode, 0
+}
+
+// CachedDirStream wraps directory entries for caching. Entries carry their
+// 1-based position in the listing as DirEntry.Off, so an offset handed out
+// to telldir(3) stays valid for the lifetime of the snapshot.
+type CachedDirStream struct {
+	entries []fuse.DirEntry
+	index   int
+
+	// Attributes of the entries when the listing was just filled with
+	// -readdir-attrs (nil otherwise), and when they were fetched
+	stats    []*entryStat
+	statTime time.Time
+}
+
+func (s *CachedDirStream) HasNext() bool {
+	return s.index < len(s.entries)
+}
+
+func (s *CachedDirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	if !s.HasNext() {
+		return fuse.DirEntry{}, syscall.ENOENT
+	}
+	entry := s.entries[s.index]
+	s.index++
+	return entry, 0
+}
+
+// Seekdir positions the stream after the entry whose Off is off
+func (s *CachedDirStream) Seekdir(ctx context.Context, off uint64) syscall.Errno {
+	if off > uint64(len(s.entries)) {
+		return syscall.EINVAL
+	}
+	s.index = int(off)
+	return 0
+}
+
+func (s *CachedDirStream) Close() {}
+
+// lastStat returns the attributes of the entry Next returned last, if the
+// listing has them and they are no older than maxAge
+func (s *CachedDirStream) lastStat(maxAge time.Duration) *entryStat {
+	if s.stats == nil || s.index == 0 || time.Since(s.statTime) > maxAge {
+		return nil
+	}
+	return s.stats[s.index-1]
+}
+
+// Readdir for rootNode - CACHED
+func (r *rootNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	return r.m.readdirCached(ctx, "", r.key)
+}
+
+// Readdir - NOW WITH ACTUAL CACHING!
+func (n *loopbackNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	return n.mount().readdirCached(ctx, n.relPath(), n.key)
+}
+
+// readdirCached serves a directory listing from dirCache, filling it from
+// the backend on a miss. With -readdir-attrs the children are stat'ed in
+// parallel and the attributes seed attrCache and lookupCache, so the
+// LOOKUP/GETATTR storm that follows an `ls -l` is served from memory. A
+// freshly filled listing also carries them for READDIRPLUS (see plusEntry).
+func (m *Mount) readdirCached(ctx context.Context, dirRel string, dirKey inodeKey) (stream fs.DirStream, errno syscall.Errno) {
+	dirPath := m.backendPath(dirRel)
+
+	tx := m.startTransaction(ctx, "READDIR", dirPath)
+	defer func() { m.endTransaction(&tx, errno) }()
+
+	// Check cache first
+	if cachedEntries, hit := m.dirCache.Get(dirKey); hit {
+		// Cache HIT!
+		m.updateMetrics("READDIR", true)
+		tx.Cached = true
+
+		if m.verbose {
+			log.Printf("[READDIR] CACHE HIT for: %s", dirPath)
+		}
+
+		// Return cached entries
+		return &CachedDirStream{entries: cachedEntries}, 0
+	}
+
+	// Cache MISS - read from filesystem
+	m.updateMetrics("READDIR", false)
+
+	if m.verbose {
+		log.Printf("[READDIR] CACHE MISS for: %s", dirPath)
+	}
+
+	// Settings for this listing, even if a reload happens meanwhile
+	policy := m.cacheOptions()
+
+	// Enumerate: the POSIX backend gets names, inode numbers and types
+	// from getdents64 without a stat per entry
+	b, name, done, err := m.at(dirKey, dirRel, "")
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	reader, err := b.ReadDir(name)
+	done()
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	reader = m.filterDir(reader, dirRel)
+
+	fuseEntries := make([]fuse.DirEntry, 0, 64)
+	for {
+		e, ok, err := reader.Next()
+		if err != nil {
+			reader.Close()
+			return nil, fs.ToErrno(err)
+		}
+		if !ok {
+			break
+		}
+		fuseEntries = append(fuseEntries, e)
+
+		// Too large to keep in memory: stream the rest straight from the
+		// backend and skip caching altogether
+		if policy.ReaddirStreamThreshold > 0 && len(fuseEntries) >= policy.ReaddirStreamThreshold {
+			atomic.AddUint64(&m.metrics.ReaddirStreamed, 1)
+			if m.verbose {
+				log.Printf("[READDIR] Streaming uncached listing for: %s (more than %d entries)", dirPath, policy.ReaddirStreamThreshold)
+			}
+			return newStreamingDirStream(reader, fuseEntries), 0
+		}
+	}
+
+	var stats []*entryStat
+	if policy.ReaddirAttrs {
+		// Attributes are wanted for seeding and READDIRPLUS: stat all
+		// children in parallel
+		fuseEntries, stats = statEntries(reader, fuseEntries, policy.ReaddirStatWorkers)
+		for i, e := range fuseEntries {
+			if stats[i] != nil {
+				m.seedEntryCaches(dirKey, e.Name, stats[i].key, &stats[i].st, policy.TTLFor(filepath.Join(dirRel, e.Name)))
+			}
+		}
+	} else {
+		// Only entries without a d_type need a stat
+		kept := fuseEntries[:0]
+		for _, e := range fuseEntries {
+			if resolveUnknownMode(reader, &e) {
+				kept = append(kept, e)
+			}
+		}
+		fuseEntries = kept
+	}
+	reader.Close()
+
+	// Number the snapshot so offsets survive later changes to the directory
+	for i := range fuseEntries {
+		fuseEntries[i].Off = uint64(i + 1)
+	}
+
+	// Store in cache
+	ttl := policy.TTLFor(dirRel)
+	m.dirCache.Put(dirKey, fuseEntries, ttl)
+
+	if m.verbose {
+		log.Printf("[READDIR] Cached %d entries (and their attributes) for: %s (TTL: %v)", len(fuseEntries), dirPath, ttl)
+	}
+
+	return &CachedDirStream{entries: fuseEntries, stats: stats, statTime: time.Now()}, 0
+}
+
+// seedEntryCaches stores attributes gathered during a directory fill in
+// attrCache and m.lookupCache. The inode is created on the first Lookup hit
+// without touching the backend.
+func (m *Mount) seedEntryCaches(dirKey inodeKey, name string, key inodeKey, st *syscall.Stat_t, ttl time.Duration) {
+	m.cacheStat(key, st, ttl)
+	m.lookupCache.Put(dirKey, name, key, st.Mode, ttl)
+
+	atomic.AddUint64(&m.metrics.SeededEntries, 1)
+}
+
+// cacheStat stores freshly fetched backend attributes of the inode key in
+// attrCache for ttl
+func (m *Mount) cacheStat(key inodeKey, st *syscall.Stat_t, ttl time.Duration) {
+	var attr fuse.AttrOut
+	m.attrFromStat(&attr.Attr, st)
+	attr.SetTimeout(ttl)
+	m.attrCache.Put(key, attr, ttl)
+}
+
+// stableAttr is the go-fuse identity of the inode key: a new inode with a
+// reused number gets a new node
+func stableAttr(key inodeKey, st *syscall.Stat_t) fs.StableAttr {
+	return fs.StableAttr{Mode: st.Mode, Ino: key.Ino, Gen: key.Gen}
+}
+
+// cachedLookup resolves name in parent from the dentry cache. It only hits
+// when the child's attributes are cached as well, since LOOKUP has to
+// return them.
+func (m *Mount) cachedLookup(parent inodeKey, name string) (*LookupCacheEntry, *fuse.AttrOut, bool) {
+	cached, hit := m.lookupCache.Get(parent, name)
+	if !hit {
+		return nil, nil, false
+	}
+	attr, hit := m.attrCache.Get(cached.child)
+	if !hit {
+		return nil, nil, false
+	}
+	return cached, attr, true
+}
+
+// plusLookup answers the Lookup go-fuse makes for an entry of a READDIRPLUS
+// reply with the attributes the listing gathered, if a directory handle of
+// parent left them for this request (see plusEntry). It returns nil when
+// the lookup has to be done the usual way.
+func (m *Mount) plusLookup(ctx context.Context, slot *atomic.Pointer[plusEntry], parent *fs.Inode, parentKey inodeKey, name, rel string, out *fuse.EntryOut) *fs.Inode {
+	e := slot.Load()
+	if e == nil || e.ctx != ctx || e.name != name || !slot.CompareAndSwap(e, nil) {
+		return nil
+	}
+	if m.flushWrites(e.stat.key) {
+		// Buffered writes changed the size since
+		return nil
+	}
+	st := &e.stat.st
+	m.attrFromStat(&out.Attr, st)
+	ttl := m.ttlFor(rel)
+	out.SetEntryTimeout(ttl)
+	out.SetAttrTimeout(ttl)
+	m.cacheStat(e.stat.key, st, ttl)
+	m.lookupCache.Put(parentKey, name, e.stat.key, st.Mode, ttl)
+
+	atomic.AddUint64(&m.metrics.PlusEntries, 1)
+	return parent.NewInode(ctx, &loopbackNode{key: e.stat.key}, stableAttr(e.stat.key, st))
+}
+
+// cachedLookupInode returns the inode for a lookup cache hit. A child that
+// is still live in go-fuse's tree is reused; otherwise (never instantiated,
+// or already forgotten by the kernel) a fresh inode is created, which
+// needs no backend access since the dentry and attributes are cached.
+func (m *Mount) cachedLookupInode(ctx context.Context, parent *fs.Inode, name string, cached *LookupCacheEntry) *fs.Inode {
+	if ch := parent.GetChild(name); ch != nil && !ch.Forgotten() {
+		if node, ok := ch.Operations().(*loopbackNode); ok && node.key == cached.child {
+			return ch
+		}
+	}
+
+	atomic.AddUint64(&m.metrics.InodesRecreated, 1)
+	node := &loopbackNode{key: cached.child}
+	return parent.NewInode(ctx, node, fs.StableAttr{Mode: cached.mode, Ino: cached.child.Ino, Gen: cached.child.Gen})
+}
+
+// childKeyOf returns the identity of the inode name refers to in parent,
+// from the dentry cache or else from go-fuse's inode tree (parent may be nil
+// when the kernel has no inode for it)
+func (m *Mount) childKeyOf(parent *fs.Inode, parentKey inodeKey, name string) (inodeKey, bool) {
+	if cached, hit := m.lookupCache.Get(parentKey, name); hit {
+		return cached.child, true
+	}
+	if parent == nil {
+		return inodeKey{}, false
+	}
+	if ch := parent.GetChild(name); ch != nil {
+		if node, ok := ch.Operations().(*loopbackNode); ok {
+			return node.key, true
+		}
+	}
+	return inodeKey{}, false
+}
+
+// invalidateRename updates the caches after a successful rename: the dentry
+// moves to its new parent, whatever it replaced loses a link, and both
+// directories change. With RENAME_EXCHANGE the two entries swap instead.
+func (m *Mount) invalidateRename(oldParent *fs.Inode, oldParentKey inodeKey, name string, newParent *fs.Inode, newParentKey inodeKey, newName string, flags uint32) {
+	moved, movedOK := m.childKeyOf(oldParent, oldParentKey, name)
+	replaced, replacedOK := m.childKeyOf(newParent, newParentKey, newName)
+
+	if flags&unix.RENAME_EXCHANGE != 0 {
+		m.lookupCache.Remove(oldParentKey, name)
+		m.lookupCache.Remove(newParentKey, newName)
+	} else {
+		m.lookupCache.Move(oldParentKey, name, newParentKey, newName)
+	}
+	if replacedOK && replaced != moved {
+		m.attrCache.Remove(replaced)
+	}
+	if movedOK {
+		// ctime changes, and a directory's ".." now points elsewhere
+		m.attrCache.Remove(moved)
+		m.dirCache.Remove(moved)
+	}
+	m.invalidateDir(oldParentKey)
+	m.invalidateDir(newParentKey)
+}
+
+// invalidateDir drops everything cached about the contents and attributes
+// of a directory whose entries just changed
+func (m *Mount) invalidateDir(dir inodeKey) {
+	m.dirCache.Remove(dir)
+	m.attrCache.Remove(dir)
+}
+
+// invalidateChild drops the cached dentry for name in parent, plus the
+// attributes of the inode it pointed to (its link count and ctime change).
+// Returns the child's identity when it was known.
+func (m *Mount) invalidateChild(parent *fs.Inode, parentKey inodeKey, name string) (inodeKey, bool) {
+	child, ok := m.childKeyOf(parent, parentKey, name)
+	m.lookupCache.Remove(parentKey, name)
+	if ok {
+		m.attrCache.Remove(child)
+	}
+	return child, ok
+}
+
+// ============ DATA OPERATIONS (PASSTHROUGH - NEVER CACHED) ============
+
+// Open - PASSTHROUGH
+func (n *loopbackNode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	m := n.mount()
+	defer m.trackRequest()()
+
+	rel := n.relPath()
+	p := m.backendPath(rel)
+
+	m.updateMetrics("OPEN", false)
+	tx := m.startTransaction(ctx, "OPEN", p)
+	tx.Flags = flags
+	defer func() { m.endTransaction(&tx, errno) }()
+
+	if m.verbose {
+		log.Printf("[OPEN] File: %s with flags: %d", p, flags)
+	}
+	if m.cfg.ReadOnly && writeFlags(flags) {
+		return nil, 0, syscall.EROFS
+	}
+
+	// Writes buffered by other handles are seen by this one
+	m.flushWrites(n.key)
+
+	b, name, done, err := n.at()
+	if err != nil {
+		return nil, 0, fs.ToErrno(err)
+	}
+	defer done()
+
+	f, err := b.Open(name, int(flags), 0)
+	if err != nil {
+		return nil, 0, fs.ToErrno(err)
+	}
+
+	lf := &loopbackFile{file: f, rel: rel, path: p, key: n.key, m: m}
+	if flags&syscall.O_TRUNC != 0 {
+		m.attrCache.Remove(n.key)
+		lf.changed.Store(true)
+	}
+	m.openDataCache(lf, rel, flags)
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		lf.wb = newWriteBuffer(lf, rel)
+	}
+	if m.cfg.ReadOnly {
+		return lf, fuse.FOPEN_KEEP_CACHE, 0
+	}
+	return lf, 0, 0
+}
+
+// openDataCache sets up data caching for a newly opened file. Files opened
+// read-only that the policy selects are read through the data cache; opening
+// a file for writing drops its cached data.
+func (m *Mount) openDataCache(f *loopbackFile, rel string, flags uint32) {
+	dc := m.cfg.DataCache
+	if dc == nil {
+		return
+	}
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		dc.invalidate(f.key)
+		return
+	}
+
+	var st syscall.Stat_t
+	key, err := fstatKey(f.file, &st)
+	if err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return
+	}
+	if !m.cacheOptions().dataCacheable(rel, st.Size) {
+		return
+	}
+	v := versionFromStat(key, &st)
+	dc.open(v)
+	f.version = &v
+}
+
+// Create for rootNode - PASSTHROUGH
+func (r *rootNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	m := r.m
+	defer m.trackRequest()()
+
+	rel := name
+	p := m.backendPath(rel)
+
+	m.updateMetrics("CREATE", false)
+	tx := m.startTransaction(ctx, "CREATE", p)
+	tx.Flags = flags
+	defer func() { m.endTransaction(&tx, errno) }()
+
+	if m.verbose {
+		log.Printf("[CREATE] File: %s", p)
+	}
+	if m.cfg.ReadOnly {
+		return nil, nil, 0, syscall.EROFS
+	}
+	if m.hidden(rel) {
+		return nil, nil, 0, syscall.EACCES
+	}
+
+	b, bname, done, err := m.at(r.key, "", name)
+	if err != nil {
+		return nil, nil, 0, fs.ToErrno(err)
+	}
+	defer done()
+
+	f, err := b.Open(bname, int(flags)|os.O_CREATE, mode)
+	if err != nil {
+		return nil, nil, 0, fs.ToErrno(err)
+	}
+	m.chownNew(ctx, b, bname, rel)
+
+	var st syscall.Stat_t
+	key, err := fstatKey(f, &st)
+	if err != nil {
+		f.Close()
+		return nil, nil, 0, fs.ToErrno(err)
+	}
+
+	m.attrFromStat(&out.Attr, &st)
+	ttl := m.ttlFor(rel)
+	out.SetEntryTimeout(ttl)
+	out.SetAttrTimeout(ttl)
+
+	m.cacheStat(key, &st, ttl)
+	node := &loopbackNode{key: key}
+	child := r.NewInode(ctx, node, stableAttr(key, &st))
+	m.lookupCache.Put(r.key, name, key, st.Mode, ttl)
+	m.invalidateDir(r.key)
+	if m.cfg.DataCache != nil {
+		m.cfg.DataCache.invalidate(key)
+	}
+
+	m.publish("CREATE", rel, "")
+
+	lf := &loopbackFile{file: f, rel: rel, path: p, key: key, m: m}
+	lf.wb = newWriteBuffer(lf, rel)
+	return child, lf, 0, 0
+}
+
+// Create for loopbackNode - PASSTHROUGH
+func (n *loopbackNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	m := n.mount()
+	defer m.trackRequest()()
+
+	rel := filepath.Join(n.relPath(), name)
+	p := m.backendPath(rel)
+
+	m.updateMetrics("CREATE", false)
+	tx := m.startTransaction(ctx, "CREATE", p)
+	tx.Flags = flags
+	defer func() { m.endTransaction(&tx, errno) }()
+
+	if m.verbose {
+		log.Printf("[CREATE] File: %s/%s", n.path(), name)
+	}
+	if m.cfg.ReadOnly {
+		return nil, nil, 0, syscall.EROFS
+	}
+	if m.hidden(rel) {
+		return nil, nil, 0, syscall.EACCES
+	}
+
+	b, bname, done, err := m.at(n.key, n.relPath(), name)
+	if err != nil {
+		return nil, nil, 0, fs.ToErrno(err)
+	}
+	defer done()
+
+	f, err := b.Open(bname, int(flags)|os.O_CREATE, mode)
+	if err != nil {
+		return nil, nil, 0, fs.ToErrno(err)
+	}
+	m.chownNew(ctx, b, bname, rel)
+
+	var st syscall.Stat_t
+	key, err := fstatKey(f, &st)
+	if err != nil {
+		f.Close()
+		return nil, nil, 0, fs.ToErrno(err)
+	}
+
+	m.attrFromStat(&out.Attr, &st)
+	ttl := m.ttlFor(rel)
+	out.SetEntryTimeout(ttl)
+	out.SetAttrTimeout(ttl)
+
+	m.cacheStat(key, &st, ttl)
+	node := &loopbackNode{key: key}
+	child := n.NewInode(ctx, node, stableAttr(key, &st))
+	m.lookupCache.Put(n.key, name, key, st.Mode, ttl)
+	m.invalidateDir(n.key)
+	if m.cfg.DataCache != nil {
+		m.cfg.DataCache.invalidate(key)
+	}
+
+	m.publish("CREATE", rel, "")
+
+	lf := &loopbackFile{file: f, rel: rel, path: p, key: key, m: m}
+	lf.wb = newWriteBuffer(lf, rel)
+	return child, lf, 0, 0
+}
+
+// Mkdir for rootNode - PASSTHROUGH
+func (r *rootNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (inode *fs.Inode, errno syscall.Errno) {
+	m := r.m
+	defer m.trackRequest()()
+
+	rel := name
+	p := m.backendPath(rel)
+
+	m.updateMetrics("MKDIR", false)
+	tx := m.startTransaction(ctx, "MKDIR", p)
+	defer func() { m.endTransaction(&tx, errno) }()
+
+	if m.verbose {
+		log.Printf("[MKDIR] Directory: %s", p)
+	}
+	if m.cfg.ReadOnly {
+		return nil, syscall.EROFS
+	}
+	if m.hidden(rel) {
+		return nil, syscall.EACCES
+	}
+
+	b, bname, done, err := m.at(r.key, "", name)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	defer done()
+
+	err = b.Mkdir(bname, mode)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	m.chownNew(ctx, b, bname, rel)
+
+	var st syscall.Stat_t
+	key, err := lstatKey(b, bname, &st)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+
+	m.attrFromStat(&out.Attr, &st)
+	ttl := m.ttlFor(rel)
+	out.SetEntryTimeout(ttl)
+	out.SetAttrTimeout(ttl)
+
+	m.cacheStat(key, &st, ttl)
+	node := &loopbackNode{key: key}
+	child := r.NewInode(ctx, node, stableAttr(key, &st))
+	m.lookupCache.Put(r.key, name, key, st.Mode, ttl)
+	m.invalidateDir(r.key)
+	m.publish("MKDIR", rel, "")
+
+	return child, 0
+}
+
+// Mkdir for loopbackNode - PASSTHROUGH
+func (n *loopbackNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (inode *fs.Inode, errno syscall.Errno) {
+	m := n.mount()
+	defer m.trackRequest()()
+
+	rel := filepath.Join(n.relPath(), name)
+	p := m.backendPath(rel)
+
+	m.updateMetrics("MKDIR", false)
+	tx := m.startTransaction(ctx, "MKDIR", p)
+	defer func() { m.endTransaction(&tx, errno) }()
+
+	if m.verbose {
+		log.Printf("[MKDIR] Directory: %s/%s", n.path(), name)
+	}
+	if m.cfg.ReadOnly {
+		return nil, syscall.EROFS
+	}
+	if m.hidden(rel) {
+		return nil, syscall.EACCES
+	}
+
+	b, bname, done, err := m.at(n.key, n.relPath(), name)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	defer done()
+
+	err = b.Mkdir(bname, mode)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	m.chownNew(ctx, b, bname, rel)
+
+	var st syscall.Stat_t
+	key, err := lstatKey(b, bname, &st)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+
+	m.attrFromStat(&out.Attr, &st)
+	ttl := m.ttlFor(rel)
+	out.SetEntryTimeout(ttl)
+	out.SetAttrTimeout(ttl)
+
+	m.cacheStat(key, &st, ttl)
+	node := &loopbackNode{key: key}
+	child := n.NewInode(ctx, node, stableAttr(key, &st))
+	m.lookupCache.Put(n.key, name, key, st.Mode, ttl)
+	m.invalidateDir(n.key)
+	m.publish("MKDIR", rel, "")
+
+	return child, 0
+}
+
+// Unlink for rootNode - PASSTHROUGH
+func (r *rootNode) Unlink(ctx context.Context, name string) (errno syscall.Errno) {
+	m := r.m
+	defer m.trackRequest()()
+
+	rel := name
+	p := m.backendPath(rel)
+
+	m.updateMetrics("UNLINK", false)
+	tx := m.startTransaction(ctx, "UNLINK", p)
+	defer func() { m.endTransaction(&tx, errno) }()
+
+	if m.verbose {
+		log.Printf("[UNLINK] File: %s", p)
+	}
+	if m.cfg.ReadOnly {
+		return syscall.EROFS
+	}
+
+	b, bname, done, err := m.at(r.key, "", name)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	defer done()
+
+	err = b.Unlink(bname)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+
+	m.invalidateChild(&r.Inode, r.key, name)
+	m.invalidateDir(r.key)
+	m.publish("UNLINK", rel, "")
+	return 0
+}
+
+// Unlink for loopbackNode - PASSTHROUGH
+func (n *loopbackNode) Unlink(ctx context.Context, name string) (errno syscall.Errno) {
+	m := n.mount()
+	defer m.trackRequest()()
+
+	rel := filepath.Join(n.relPath(), name)
+	p := m.backendPath(rel)
+
+	m.updateMetrics("UNLINK", false)
+	tx := m.startTransaction(ctx, "UNLINK", p)
+	defer func() { m.endTransaction(&tx, errno) }()
+
+	if m.verbose {
+		log.Printf("[UNLINK] File: %s/%s", n.path(), name)
+	}
+	if m.cfg.ReadOnly {
+		return syscall.EROFS
+	}
+
+	b, bname, done, err := m.at(n.key, n.relPath(), name)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	defer done()
+
+	err = b.Unlink(bname)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+
+	m.invalidateChild(&n.Inode, n.key, name)
+	m.invalidateDir(n.key)
+	m.publish("UNLINK", rel, "")
+	return 0
+}
+
+// Rmdir for rootNode - PASSTHROUGH
+func (r *rootNode) Rmdir(ctx context.Context, name string) (errno syscall.Errno) {
+	m := r.m
+	defer m.trackRequest()()
+
+	rel := name
+	p := m.backendPath(rel)
+
+	m.updateMetrics("RMDIR", false)
+	tx := m.startTransaction(ctx, "RMDIR", p)
+	defer func() { m.endTransaction(&tx, errno) }()
+
+	if m.verbose {
+		log.Printf("[RMDIR] Directory: %s", p)
+	}
+	if m.cfg.ReadOnly {
+		return syscall.EROFS
+	}
+
+	b, bname, done, err := m.at(r.key, "", name)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	defer done()
+
+	err = b.Rmdir(bname)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+
+	if child, ok := m.invalidateChild(&r.Inode, r.key, name); ok {
+		m.dirCache.Remove(child)
+		m.lookupCache.RemoveDir(child)
+		m.dirs.drop(child)
+	}
+	m.invalidateDir(r.key)
+	m.publish("RMDIR", rel, "")
+	return 0
+}
+
+// Rmdir for loopbackNode - PASSTHROUGH
+func (n *loopbackNode) Rmdir(ctx context.Context, name string) (errno syscall.Errno) {
+	m := n.mount()
+	defer m.trackRequest()()
+
+	rel := filepath.Join(n.relPath(), name)
+	p := m.backendPath(rel)
+
+	m.updateMetrics("RMDIR", false)
+	tx := m.startTransaction(ctx, "RMDIR", p)
+	defer func() { m.endTransaction(&tx, errno) }()
+
+	if m.verbose {
+		log.Printf("[RMDIR] Directory: %s/%s", n.path(), name)
+	}
+	if m.cfg.ReadOnly {
+		return syscall.EROFS
+	}
+
+	b, bname, done, err := m.at(n.key, n.relPath(), name)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	defer done()
+
+	err = b.Rmdir(bname)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+
+	if child, ok := m.invalidateChild(&n.Inode, n.key, name); ok {
+		m.dirCache.Remove(child)
+		m.lookupCache.RemoveDir(child)
+		m.dirs.drop(child)
+	}
+	m.invalidateDir(n.key)
+	m.publish("RMDIR", rel, "")
+	return 0
+}
+
+// Rename for rootNode - PASSTHROUGH
+func (r *rootNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) (errno syscall.Errno) {
+	m := r.m
+	defer m.trackRequest()()
+
+	oldRel := name
+	newRel := ""
+	newDirRel := ""
+	var newParentKey inodeKey
+
+	switch parent := newParent.(type) {
+	case *rootNode:
+		newRel = newName
+		newParentKey = parent.key
+	case *loopbackNode:
+		newDirRel = parent.relPath()
+		newRel = filepath.Join(newDirRel, newName)
+		newParentKey = parent.key
+	}
+	oldPath, newPath := m.backendPath(oldRel), m.backendPath(newRel)
+
+	m.updateMetrics("RENAME", false)
+	tx := m.startTransaction(ctx, "RENAME", fmt.Sprintf("%s -> %s", oldPath, newPath))
+	tx.Flags = flags
+	defer func() { m.endTransaction(&tx, errno) }()
+
+	if m.verbose {
+		log.Printf("[RENAME] From: %s To: %s with flags: %d", oldPath, newPath, flags)
+	}
+	if m.cfg.ReadOnly {
+		return syscall.EROFS
+	}
+	if m.hidden(newRel) {
+		return syscall.EACCES
+	}
+
+	err := m.rename(r.key, "", name, newParentKey, newDirRel, newName, flags)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+
+	m.invalidateRename(&r.Inode, r.key, name, newParent.EmbeddedInode(), newParentKey, newName, flags)
+	m.publish("RENAME", oldRel, newRel)
+	return 0
+}
+
+// Rename for loopbackNode - PASSTHROUGH
+func (n *loopbackNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) (errno syscall.Errno) {
+	m := n.mount()
+	defer m.trackRequest()()
+
+	oldRel := filepath.Join(n.relPath(), name)
+	newRel := ""
+	newDirRel := ""
+	var newParentKey inodeKey
+
+	switch parent := newParent.(type) {
+	case *rootNode:
+		newRel = newName
+		newParentKey = parent.key
+	case *loopbackNode:
+		newDirRel = parent.relPath()
+		newRel = filepath.Join(newDirRel, newName)
+		newParentKey = parent.key
+	}
+	oldPath, newPath := m.backendPath(oldRel), m.backendPath(newRel)
+
+	m.updateMetrics("RENAME", false)
+	tx := m.startTransaction(ctx, "RENAME", fmt.Sprintf("%s -> %s", oldPath, newPath))
+	tx.Flags = flags
+	defer func() { m.endTransaction(&tx, errno) }()
+
+	if m.verbose {
+		log.Printf("[RENAME] From: %s To: %s with flags: %d", oldPath, newPath, flags)
+	}
+	if m.cfg.ReadOnly {
+		return syscall.EROFS
+	}
+	if m.hidden(newRel) {
+		return syscall.EACCES
+	}
+
+	err := m.rename(n.key, n.relPath(), name, newParentKey, newDirRel, newName, flags)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+
+	m.invalidateRename(&n.Inode, n.key, name, newParent.EmbeddedInode(), newParentKey, newName, flags)
+	m.publish("RENAME", oldRel, newRel)
+	return 0
+}
+
+var _ = (fs.NodeSetattrer)((*rootNode)(nil))
+var _ = (fs.NodeSetattrer)((*loopbackNode)(nil))
+
+// Setattr for rootNode - PASSTHROUGH
+func (r *rootNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	return r.m.setattr(ctx, "", r.key, func() (Backend, string, func(), error) {
+		return r.m.at(r.key, "", "")
+	}, in, out)
+}
+
+// Setattr for loopbackNode - PASSTHROUGH
+func (n *loopbackNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	return n.mount().setattr(ctx, n.relPath(), n.key, n.at, in, out)
+}
+
+// setattr applies a SETATTR (chmod, chown, truncate, utimes) to the backend
+// and caches the attributes that result. at resolves the node as Mount.at.
+func (m *Mount) setattr(ctx context.Context, rel string, key inodeKey, at func() (Backend, string, func(), error), in *fuse.SetAttrIn, out *fuse.AttrOut) (errno syscall.Errno) {
+	defer m.trackRequest()()
+
+	p := m.backendPath(rel)
+
+	m.updateMetrics("SETATTR", false)
+	tx := m.startTransaction(ctx, "SETATTR", p)
+	defer func() { m.endTransaction(&tx, errno) }()
+
+	if m.verbose {
+		log.Printf("[SETATTR] File: %s (valid: %#x)", p, in.Valid)
+	}
+	if m.cfg.ReadOnly {
+		return syscall.EROFS
+	}
+	b, name, done, err := at()
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	defer done()
+	setter, ok := b.(AttrSetter)
+	if !ok {
+		return syscall.ENOTSUP
+	}
+
+	// Buffered writes go out first, or they would land after a truncate
+	m.flushWrites(key)
+
+	if mode, ok := in.GetMode(); ok {
+		if err := setter.Chmod(name, mode); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+	if in.Valid&(fuse.FATTR_UID|fuse.FATTR_GID) != 0 {
+		uid, gid, errno := m.chownTarget(ctx, in)
+		if errno != 0 {
+			return errno
+		}
+		if err := setter.Lchown(name, uid, gid); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+	if size, ok := in.GetSize(); ok {
+		if err := setter.Truncate(name, int64(size)); err != nil {
+			return fs.ToErrno(err)
+		}
+		if m.cfg.DataCache != nil {
+			m.cfg.DataCache.invalidate(key)
+		}
+	}
+	atime, aok := in.GetATime()
+	mtime, mok := in.GetMTime()
+	if aok || mok {
+		var ap, mp *time.Time
+		if aok {
+			ap = &atime
+		}
+		if mok {
+			mp = &mtime
+		}
+		if err := setter.Utimens(name, ap, mp); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+
+	var st syscall.Stat_t
+	now, err := lstatKey(b, name, &st)
+	if err != nil {
+		m.attrCache.Remove(key)
+		return fs.ToErrno(err)
+	}
+	m.attrFromStat(&out.Attr, &st)
+	ttl := m.ttlFor(rel)
+	out.SetTimeout(ttl)
+	m.attrCache.Put(now, *out, ttl)
+
+	m.publish("SETATTR", rel, "")
+	return 0
+}
+
+// loopbackFile represents an open file
+type loopbackFile struct {
+	file File
+	rel  string
+	path string
+	key  inodeKey
+	m    *Mount
+
+	// Written to (or truncated) since other mounts were last told
+	changed atomic.Bool
+
+	// Content version read through the data cache, nil if not cached
+	version *dataVersion
+
+	// Write-back buffer, nil for write-through
+	wb *writeBuffer
+}
+
+// Read - PASSTHROUGH, or through the data cache
+func (f *loopbackFile) Read(ctx context.Context, dest []byte, off int64) (res fuse.ReadResult, errno syscall.Errno) {
+	m := f.m
+	defer m.trackRequest()()
+
+	m.updateMetrics("READ", false)
+	tx := m.startTransaction(ctx, "READ", f.path)
+	defer func() { m.endTransaction(&tx, errno) }()
+
+	// Our own buffered writes have to be read back
+	if f.wb != nil {
+		f.wb.writeOut()
+	}
+
+	if f.version != nil {
+		n, hit, err := m.cfg.DataCache.read(f.file, *f.version, dest, off)
+		tx.Offset, tx.Bytes, tx.Cached = off, int64(n), hit
+		if err != nil {
+			return nil, fs.ToErrno(err)
+		}
+		m.countDataCacheRead(hit, n)
+		return fuse.ReadResultData(dest[:n]), 0
+	}
+
+	n, err := f.file.Pread(dest, off)
+	tx.Offset, tx.Bytes = off, int64(n)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+// Write - PASSTHROUGH
+func (f *loopbackFile) Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno) {
+	m := f.m
+	defer m.trackRequest()()
+
+	m.updateMetrics("WRITE", false)
+	tx := m.startTransaction(ctx, "WRITE", f.path)
+	defer func() { m.endTransaction(&tx, errno) }()
+
+	if m.cfg.ReadOnly {
+		return 0, syscall.EROFS
+	}
+
+	var n int
+	var err error
+	if f.wb != nil {
+		n, err = f.wb.write(data, off)
+	} else {
+		n, err = f.file.Pwrite(data, off)
+	}
+	tx.Offset, tx.Bytes = off, int64(n)
+	if n > 0 {
+		// Size and mtime changed
+		f.changed.Store(true)
+		m.attrCache.Remove(f.key)
+		if m.cfg.DataCache != nil {
+			m.cfg.DataCache.invalidate(f.key)
+		}
+	}
+	return uint32(n), fs.ToErrno(err)
+}
+
+// Flush is called on every close(2) of the file. Buffered writes go out
+// here, so their errors reach the application, and other mounts are told
+// about the changes (close-to-open consistency, as with NFS).
+func (f *loopbackFile) Flush(ctx context.Context) syscall.Errno {
+	defer f.m.trackRequest()()
+
+	var err error
+	if f.wb != nil {
+		err = f.wb.flush()
+	}
+	f.publishChanges()
+	return fs.ToErrno(err)
+}
+
+// publishChanges announces the writes made through the file since the
+// last time
+func (f *loopbackFile) publishChanges() {
+	if f.changed.Swap(false) {
+		f.m.publish("WRITE", f.rel, "")
+	}
+}
+
+// Fsync writes out buffered writes and syncs the file if the backend can
+func (f *loopbackFile) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	defer f.m.trackRequest()()
+
+	if f.wb != nil {
+		if err := f.wb.flush(); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+	var err error
+	if s, ok := f.file.(Syncer); ok {
+		err = s.Sync()
+	}
+	f.publishChanges()
+	return fs.ToErrno(err)
+}
+
+// Release closes the file
+func (f *loopbackFile) Release(ctx context.Context) syscall.Errno {
+	defer f.m.trackRequest()()
+
+	if f.wb != nil {
+		// Nobody is left to report a failure to
+		if err := f.wb.flush(); err != nil {
+			log.Printf("Write-back of %s failed on release: %v", f.path, err)
+		}
+	}
+	f.publishChanges()
+	err := f.file.Close()
+	return fs.ToErrno(err)
+}
+
+// OpendirHandle for rootNode - see newDirHandle
+func (r *rootNode) OpendirHandle(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	m := r.m
+	defer m.trackRequest()()
+
+	if m.verbose {
+		log.Printf("[OPENDIR] Directory: %s", r.rootPath)
+	}
+	return newDirHandle(m, "", r.key, &r.plus), m.dirOpenFlags(), 0
+}
+
+// OpendirHandle - Required for directory operations
+func (n *loopbackNode) OpendirHandle(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	m := n.mount()
+	defer m.trackRequest()()
+
+	rel := n.relPath()
+	if m.verbose {
+		log.Printf("[OPENDIR] Directory: %s", m.backendPath(rel))
+	}
+	return newDirHandle(m, rel, n.key, &n.plus), m.dirOpenFlags(), 0
+}
+
+// dirOpenFlags lets the kernel cache the listings of a read-only mount
+func (m *Mount) dirOpenFlags() uint32 {
+	if m.cfg.ReadOnly {
+		return fuse.FOPEN_CACHE_DIR
+	}
+	return 0
+}
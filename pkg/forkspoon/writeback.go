@@ -0,0 +1,178 @@
+package forkspoon
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// writeBuffer collects the writes to one open file in write-back mode. It
+// holds a single run of adjacent bytes: a write that doesn't continue the
+// run flushes it first.
+type writeBuffer struct {
+	f *loopbackFile
+
+	mu    sync.Mutex
+	off   int64
+	data  []byte
+	timer *time.Timer
+
+	// First error of a flush no caller was waiting for, reported by the
+	// next Flush, Fsync or Release
+	err error
+}
+
+// newWriteBuffer returns the write-back buffer for f, or nil if writes to
+// rel go straight through
+func newWriteBuffer(f *loopbackFile, rel string) *writeBuffer {
+	if !f.m.cacheOptions().writeBack(rel) {
+		return nil
+	}
+	return &writeBuffer{f: f}
+}
+
+// write buffers data for offset off. Once an earlier flush has failed,
+// writes fail too, with its error.
+func (wb *writeBuffer) write(data []byte, off int64) (int, error) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	if wb.err != nil {
+		return 0, wb.err
+	}
+
+	m := wb.f.m
+	opts := m.cacheOptions()
+	size, delay := opts.WriteBackSize, opts.WriteBackDelay
+	if size <= 0 {
+		size = DEFAULT_WRITE_BACK_SIZE
+	}
+	if delay <= 0 {
+		delay = DEFAULT_WRITE_BACK_DELAY
+	}
+
+	if len(wb.data) > 0 && off != wb.off+int64(len(wb.data)) {
+		if err := wb.flushLocked(); err != nil {
+			return 0, err
+		}
+	}
+	if len(wb.data) == 0 {
+		wb.off = off
+		m.markDirty(wb)
+		wb.timer = time.AfterFunc(delay, wb.writeOut)
+	} else {
+		atomic.AddUint64(&m.metrics.WritesCoalesced, 1)
+	}
+	wb.data = append(wb.data, data...)
+
+	// Failures surface at the next write, flush or fsync
+	if len(wb.data) >= size {
+		wb.flushLocked()
+	}
+	return len(data), nil
+}
+
+// flushLocked writes the buffered run to the backend. A failure is kept
+// for the next Flush, Fsync or Release and returned.
+func (wb *writeBuffer) flushLocked() error {
+	if wb.timer != nil {
+		wb.timer.Stop()
+		wb.timer = nil
+	}
+	if len(wb.data) == 0 {
+		return wb.err
+	}
+
+	m := wb.f.m
+	data, off := wb.data, wb.off
+	var err error
+	for len(data) > 0 {
+		var n int
+		n, err = wb.f.file.Pwrite(data, off)
+		if err == nil && n == 0 {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			break
+		}
+		data, off = data[n:], off+int64(n)
+	}
+	wb.data = wb.data[:0]
+	m.markClean(wb)
+	atomic.AddUint64(&m.metrics.WriteBackFlushes, 1)
+
+	// Size and mtime changed
+	m.attrCache.Remove(wb.f.key)
+	if err != nil && wb.err == nil {
+		wb.err = err
+	}
+	return wb.err
+}
+
+// writeOut writes the buffered run, leaving any error to be reported by
+// flush
+func (wb *writeBuffer) writeOut() {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	wb.flushLocked()
+}
+
+// flush writes the buffered run and returns, and clears, the pending error
+func (wb *writeBuffer) flush() error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	err := wb.flushLocked()
+	wb.err = nil
+	return err
+}
+
+// markDirty records that an inode has buffered writes, so that operations
+// that have to see them can flush them first
+func (m *Mount) markDirty(wb *writeBuffer) {
+	m.dirtyMu.Lock()
+	defer m.dirtyMu.Unlock()
+	if m.dirty == nil {
+		m.dirty = make(map[inodeKey]map[*writeBuffer]struct{})
+	}
+	bufs := m.dirty[wb.f.key]
+	if bufs == nil {
+		bufs = make(map[*writeBuffer]struct{})
+		m.dirty[wb.f.key] = bufs
+	}
+	bufs[wb] = struct{}{}
+	m.dirtyCount.Add(1)
+}
+
+func (m *Mount) markClean(wb *writeBuffer) {
+	m.dirtyMu.Lock()
+	defer m.dirtyMu.Unlock()
+	bufs := m.dirty[wb.f.key]
+	if _, ok := bufs[wb]; !ok {
+		return
+	}
+	delete(bufs, wb)
+	if len(bufs) == 0 {
+		delete(m.dirty, wb.f.key)
+	}
+	m.dirtyCount.Add(-1)
+}
+
+// flushWrites flushes the buffered writes to an inode, so that its size and
+// contents on the backend are current. It reports whether there were any;
+// errors are left for the file handles to report.
+func (m *Mount) flushWrites(key inodeKey) bool {
+	if m.dirtyCount.Load() == 0 {
+		return false
+	}
+	m.dirtyMu.Lock()
+	var bufs []*writeBuffer
+	for wb := range m.dirty[key] {
+		bufs = append(bufs, wb)
+	}
+	m.dirtyMu.Unlock()
+
+	for _, wb := range bufs {
+		wb.writeOut()
+	}
+	return len(bufs) > 0
+}